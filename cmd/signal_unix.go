@@ -0,0 +1,11 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// rotateSignals force a rotation, like POST /api/rotate.
+var rotateSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,6 @@
+package cmd
+
+import "os"
+
+// rotateSignals is empty on Windows, which has no SIGUSR2.
+var rotateSignals []os.Signal
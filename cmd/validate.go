@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Exit codes of the proxyrotator binary.
+const (
+	// exitRuntime: the proxy failed to start, or stopped with an error.
+	exitRuntime = 1
+
+	// exitConfig: the command line is invalid and nothing was started.
+	exitConfig = 2
+)
+
+// configError lists every problem found in the command line.
+type configError struct {
+	errs []error
+}
+
+func (e *configError) Error() string {
+	if len(e.errs) == 1 {
+		return e.errs[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d configuration errors:", len(e.errs))
+	for _, err := range e.errs {
+		b.WriteString("\n  ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+func (e *configError) Unwrap() []error { return e.errs }
+
+// exitCode maps an error returned by the root command to the exit code.
+func exitCode(err error) int {
+	var cfgErr *configError
+	if errors.As(err, &cfgErr) {
+		return exitConfig
+	}
+	return exitRuntime
+}
+
+// flagCheck collects flag errors instead of stopping at the first one, so a
+// bad command line is fixed in one go rather than one retry per flag.
+type flagCheck struct {
+	errs []error
+}
+
+// failf records a problem.
+func (c *flagCheck) failf(format string, args ...any) {
+	c.errs = append(c.errs, fmt.Errorf(format, args...))
+}
+
+// require records the problem unless ok holds.
+func (c *flagCheck) require(ok bool, format string, args ...any) {
+	if !ok {
+		c.failf(format, args...)
+	}
+}
+
+// duration parses the value of a duration flag that must be set.
+func (c *flagCheck) duration(flag, value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		c.failf("%s: %w", flag, err)
+	}
+	return d
+}
+
+// optionalDuration parses the value of a duration flag that is off when
+// empty or "0".
+func (c *flagCheck) optionalDuration(flag, value string) time.Duration {
+	if value == "" || value == "0" {
+		return 0
+	}
+	return c.duration(flag, value)
+}
+
+// nonNegativeDuration is optionalDuration for flags that reject negative
+// values.
+func (c *flagCheck) nonNegativeDuration(flag, value string) time.Duration {
+	d := c.optionalDuration(flag, value)
+	if d < 0 {
+		c.failf("%s must not be negative", flag)
+		return 0
+	}
+	return d
+}
+
+// oneOf records a problem unless value is one of allowed.
+func (c *flagCheck) oneOf(flag, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	c.failf("%s: want %s, got %q", flag, strings.Join(allowed, ", "), value)
+}
+
+// err returns a *configError with everything recorded, or nil.
+func (c *flagCheck) err() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return &configError{errs: c.errs}
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlagCheck(t *testing.T) {
+	cases := []struct {
+		name    string
+		run     func(c *flagCheck)
+		wantErr []string // substrings, one per recorded problem
+	}{
+		{"clean", func(c *flagCheck) {
+			c.duration("--a", "5s")
+			c.optionalDuration("--b", "0")
+			c.nonNegativeDuration("--c", "")
+			c.require(true, "never")
+			c.oneOf("--d", "x", "x", "y")
+		}, nil},
+		{"bad duration", func(c *flagCheck) { c.duration("--a", "soon") }, []string{"--a:"}},
+		{"negative duration", func(c *flagCheck) { c.nonNegativeDuration("--c", "-1s") }, []string{"--c must not be negative"}},
+		{"not one of", func(c *flagCheck) { c.oneOf("--d", "z", "x", "y") }, []string{`--d: want x, y, got "z"`}},
+		{"all collected", func(c *flagCheck) {
+			c.duration("--a", "soon")
+			c.require(false, "--e must be positive")
+			c.oneOf("--d", "z", "x", "y")
+		}, []string{"--a:", "--e must be positive", "--d: want"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var c flagCheck
+			tc.run(&c)
+			err := c.err()
+			if len(tc.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("err = %v, want nil", err)
+				}
+				return
+			}
+			var cfgErr *configError
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("err = %v, want a *configError", err)
+			}
+			if len(cfgErr.errs) != len(tc.wantErr) {
+				t.Fatalf("recorded %d problems, want %d: %v", len(cfgErr.errs), len(tc.wantErr), err)
+			}
+			for i, want := range tc.wantErr {
+				if !strings.Contains(cfgErr.errs[i].Error(), want) {
+					t.Errorf("problem %d = %q, want it to contain %q", i, cfgErr.errs[i], want)
+				}
+			}
+			if len(tc.wantErr) > 1 && !strings.HasPrefix(err.Error(), fmt.Sprintf("%d configuration errors:", len(tc.wantErr))) {
+				t.Errorf("message = %q, want a count of the errors first", err)
+			}
+		})
+	}
+}
+
+func TestFlagCheck_OptionalDuration(t *testing.T) {
+	var c flagCheck
+	if d := c.optionalDuration("--a", ""); d != 0 {
+		t.Errorf("empty = %s, want 0", d)
+	}
+	if d := c.optionalDuration("--a", "90s"); d != 90*time.Second {
+		t.Errorf("90s = %s", d)
+	}
+	if err := c.err(); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	var c flagCheck
+	c.failf("--x is wrong")
+	cases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"config", c.err(), exitConfig},
+		{"wrapped config", fmt.Errorf("startup: %w", c.err()), exitConfig},
+		{"runtime", errors.New("listen :8080: address in use"), exitRuntime},
+	}
+	for _, tc := range cases {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("%s: exitCode = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRun_BadParentProxyIsConfigError(t *testing.T) {
+	defer func(v string) { flagParentProxy = v }(flagParentProxy)
+	for _, bad := range []string{"socks5://1.2.3.4:1080", "http://", "::bad"} {
+		flagParentProxy = bad
+		err := run(nil, nil)
+		if got := exitCode(err); got != exitConfig {
+			t.Errorf("--parent-proxy %q: exit code %d (err %v), want %d", bad, got, err, exitConfig)
+		}
+		if err == nil || !strings.Contains(err.Error(), "--parent-proxy") {
+			t.Errorf("--parent-proxy %q: err = %v, want it named", bad, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package accesslog writes one line per proxied request, separate from the
+// operational logs.
+//
+// The line layout is controlled by an Apache-style format string. Supported
+// tokens:
+//
+//	%t  request start time, e.g. [02/Jan/2006:15:04:05 -0700]
+//	%a  client IP address
+//	%m  request method (CONNECT, GET, …)
+//	%d  destination host:port
+//	%P  ID of the upstream proxy used ("-" if none)
+//	%I  bytes received from the client
+//	%O  bytes sent to the client
+//	%D  duration in microseconds
+//	%T  duration in seconds
+//	%s  result (ok, no_proxy, dial_error, …)
+//	%S  TLS server name sent through a CONNECT tunnel ("-" if not logged)
+//	%%  a literal percent sign
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFormat is used when no format string is configured.
+const DefaultFormat = `%a - - %t "%m %d" %s %P %I %O %D`
+
+// Entry describes a single proxied request.
+type Entry struct {
+	Time        time.Time     // when the request was received
+	ClientAddr  string        // remote address of the client connection
+	Method      string        // request method
+	Destination string        // host:port the client asked for
+	ProxyID     int64         // upstream proxy used; 0 if none was selected
+	BytesUp     int64         // bytes received from the client
+	BytesDown   int64         // bytes sent to the client
+	Duration    time.Duration // time from request to tunnel close
+	Result      string        // outcome, e.g. "ok" or "dial_error"
+	SNI         string        // TLS server name seen in the tunnel, if peeked at
+}
+
+// Logger formats entries and writes them to an io.Writer.
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	format string
+}
+
+// New creates a Logger writing to w. An empty format selects DefaultFormat.
+func New(w io.Writer, format string) *Logger {
+	if format == "" {
+		format = DefaultFormat
+	}
+	return &Logger{w: w, format: format}
+}
+
+// Open creates a Logger appending to the file at path. A path of "-" writes
+// to stdout.
+func Open(path, format string) (*Logger, error) {
+	if path == "-" {
+		return New(os.Stdout, format), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+	l := New(f, format)
+	l.closer = f
+	return l, nil
+}
+
+// Log writes one formatted line for e. Safe for concurrent use.
+func (l *Logger) Log(e Entry) {
+	line := l.Format(e)
+	l.mu.Lock()
+	_, _ = io.WriteString(l.w, line+"\n")
+	l.mu.Unlock()
+}
+
+// Close closes the underlying file, if the Logger opened one.
+func (l *Logger) Close() error {
+	if l.closer != nil {
+		return l.closer.Close()
+	}
+	return nil
+}
+
+// Format renders e according to the logger's format string.
+func (l *Logger) Format(e Entry) string {
+	var b strings.Builder
+	f := l.format
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' || i+1 == len(f) {
+			b.WriteByte(f[i])
+			continue
+		}
+		i++
+		switch f[i] {
+		case 't':
+			b.WriteString(e.Time.Format("[02/Jan/2006:15:04:05 -0700]"))
+		case 'a':
+			b.WriteString(clientIP(e.ClientAddr))
+		case 'm':
+			b.WriteString(dash(e.Method))
+		case 'd':
+			b.WriteString(dash(e.Destination))
+		case 'P':
+			if e.ProxyID == 0 {
+				b.WriteByte('-')
+			} else {
+				b.WriteString(strconv.FormatInt(e.ProxyID, 10))
+			}
+		case 'I':
+			b.WriteString(strconv.FormatInt(e.BytesUp, 10))
+		case 'O':
+			b.WriteString(strconv.FormatInt(e.BytesDown, 10))
+		case 'D':
+			b.WriteString(strconv.FormatInt(e.Duration.Microseconds(), 10))
+		case 'T':
+			b.WriteString(strconv.FormatFloat(e.Duration.Seconds(), 'f', 3, 64))
+		case 's':
+			b.WriteString(dash(e.Result))
+		case 'S':
+			b.WriteString(dash(e.SNI))
+		case '%':
+			b.WriteByte('%')
+		default:
+			// Unknown token — emit it verbatim so typos are visible.
+			b.WriteByte('%')
+			b.WriteByte(f[i])
+		}
+	}
+	return b.String()
+}
+
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return dash(addr)
+	}
+	return host
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
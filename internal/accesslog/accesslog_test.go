@@ -0,0 +1,46 @@
+package accesslog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFormat_DefaultFormat(t *testing.T) {
+	l := New(nil, "")
+	got := l.Format(Entry{
+		Time:        time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ClientAddr:  "10.0.0.5:51234",
+		Method:      "CONNECT",
+		Destination: "example.com:443",
+		ProxyID:     3,
+		BytesUp:     512,
+		BytesDown:   2048,
+		Duration:    1500 * time.Millisecond,
+		Result:      "ok",
+	})
+	want := `10.0.0.5 - - [01/Mar/2024:12:30:00 +0000] "CONNECT example.com:443" ok 3 512 2048 1500000`
+	if got != want {
+		t.Errorf("Format() =\n  %s\nwant\n  %s", got, want)
+	}
+}
+
+func TestFormat_MissingFieldsAndLiterals(t *testing.T) {
+	l := New(nil, "%m %P %s %T 100%% %x")
+	got := l.Format(Entry{Duration: 250 * time.Millisecond})
+	want := "- - - 0.250 100% %x"
+	if got != want {
+		t.Errorf("Format() = %q, want %q", got, want)
+	}
+}
+
+func TestLog_WritesLine(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, "%a %d")
+	l.Log(Entry{ClientAddr: "127.0.0.1:1000", Destination: "a.com:80"})
+	l.Log(Entry{ClientAddr: "127.0.0.1:1001", Destination: "b.com:80"})
+	want := "127.0.0.1 a.com:80\n127.0.0.1 b.com:80\n"
+	if buf.String() != want {
+		t.Errorf("log output = %q, want %q", buf.String(), want)
+	}
+}
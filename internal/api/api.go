@@ -2,39 +2,97 @@
 //
 // Endpoints
 //
-//	POST /api/rotate          Force an immediate proxy rotation.
-//	POST /api/status          Report an HTTP status code from the crawler.
-//	GET  /api/pool            List all proxies and their current state.
-//	GET  /api/current         Return the currently active proxy.
+//	POST   /api/rotate                    Force an immediate proxy rotation.
+//	POST   /api/status                    Report an HTTP status code from the crawler.
+//	GET    /api/pool                      List all proxies and their current state.
+//	GET    /api/current                   Return the currently active proxy.
+//	POST   /api/drain-current             Stop new traffic to the current proxy; pause rotation.
+//	POST   /api/resume                    End the pause with a fresh selection.
+//	GET    /api/drain                     Report the progress of every drain under way.
+//	POST   /api/monitor/check             Run a health check now (whole pool or one proxy).
+//	GET    /api/connections               List in-flight proxied connections.
+//	POST   /api/reserve                   Reserve a proxy for one client label, or release it.
+//	POST   /api/reload                    Re-read the proxy list and auth file.
+//	GET    /api/stats                     Goroutine, handler and tunnel counts.
+//	POST   /api/selftest                  Dial a destination through the current proxy.
+//	POST   /api/proxy/{id}/test           Dial a destination through one proxy by ID.
+//	POST   /api/proxy/{id}/reset-budget   Give a proxy its max-requests back.
+//	POST   /api/proxies                   Add a proxy to the pool until the next reload.
+//	DELETE /api/proxies/{id}              Remove a proxy from the pool until the next reload.
+//	GET    /api/pins                      List pins (by domain or client IP), or look up one.
+//	GET    /metrics                       The /api/stats counts in Prometheus text format.
+//
+// Every endpoint answers 503 while no proxy is active, except /api/proxies
+// and /metrics.
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/drsoft-oss/proxyrotator/internal/monitor"
 	"github.com/drsoft-oss/proxyrotator/internal/pool"
 	"github.com/drsoft-oss/proxyrotator/internal/rotator"
+	"github.com/drsoft-oss/proxyrotator/internal/server"
 )
 
 // Server is the API HTTP server.
 type Server struct {
 	pool    *pool.Pool
 	rotator *rotator.Rotator
+	monitor *monitor.Monitor
+	proxy   *server.Server
+	conns   *server.Registry
 	server  *http.Server
+
+	// checking is set while a whole-pool /api/monitor/check pass runs.
+	checking atomic.Bool
+
+	// reload is what POST /api/reload runs; see SetReload.
+	reload func() (pool.ReloadResult, error)
 }
 
 // New creates and configures the API server.
-func New(addr string, p *pool.Pool, r *rotator.Rotator) *Server {
-	s := &Server{pool: p, rotator: r}
+func New(addr string, p *pool.Pool, r *rotator.Rotator, m *monitor.Monitor, proxy *server.Server) *Server {
+	s := &Server{pool: p, rotator: r, monitor: m, proxy: proxy}
+	if proxy != nil {
+		s.conns = proxy.Connections()
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/rotate", s.handleRotate)
-	mux.HandleFunc("/api/status", s.handleStatus)
-	mux.HandleFunc("/api/pool", s.handlePool)
-	mux.HandleFunc("/api/current", s.handleCurrent)
+	mux.HandleFunc("/api/rotate", s.requireActive(s.handleRotate))
+	mux.HandleFunc("/api/status", s.requireActive(s.handleStatus))
+	mux.HandleFunc("/api/pool", s.requireActive(s.handlePool))
+	mux.HandleFunc("/api/current", s.requireActive(s.handleCurrent))
+	mux.HandleFunc("/api/drain-current", s.requireActive(s.handleDrainCurrent))
+	mux.HandleFunc("/api/resume", s.requireActive(s.handleResume))
+	mux.HandleFunc("/api/drain", s.requireActive(s.handleDrain))
+	mux.HandleFunc("/api/monitor/check", s.requireActive(s.handleMonitorCheck))
+	mux.HandleFunc("/api/connections", s.requireActive(s.handleConnections))
+	mux.HandleFunc("/api/reserve", s.requireActive(s.handleReserve))
+	mux.HandleFunc("/api/reload", s.requireActive(s.handleReload))
+	mux.HandleFunc("/api/stats", s.requireActive(s.handleStats))
+	mux.HandleFunc("/api/selftest", s.requireActive(s.handleSelfTest))
+	mux.HandleFunc("/api/proxy/", s.requireActive(s.handleProxy))
+	// Adding and removing proxies must work with no active proxy: that is
+	// when a fresh one is needed most.
+	mux.HandleFunc("/api/proxies", s.handleProxies)
+	mux.HandleFunc("/api/proxies/", s.handleProxies)
+	mux.HandleFunc("/api/pins", s.requireActive(s.handlePins))
+	mux.HandleFunc("/metrics", s.handleMetrics)
 
 	s.server = &http.Server{
 		Addr:         addr,
@@ -45,6 +103,19 @@ func New(addr string, p *pool.Pool, r *rotator.Rotator) *Server {
 	return s
 }
 
+// SetReload makes POST /api/reload call fn, so a reload through the API goes
+// through the same steps as one from the embedding service (e.g. on SIGHUP).
+// Without it the handler reloads the pool and reconciles the rotator only.
+func (s *Server) SetReload(fn func() (pool.ReloadResult, error)) {
+	s.reload = fn
+}
+
+// Handler returns the API's request handler, for serving it on another
+// listener (see server.Server.ServeAPI).
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
+}
+
 // Start begins listening. Blocks until the server stops.
 func (s *Server) Start() error {
 	return s.server.ListenAndServe()
@@ -65,6 +136,76 @@ type StatusRequest struct {
 	Status int `json:"status"`
 	// Destination is the target domain (host or host:port).
 	Destination string `json:"destination"`
+	// DurationMs, if set, is how long the request took as the crawler
+	// measured it. It is averaged into the carrying proxy's
+	// reported_latency_ms.
+	DurationMs *int64 `json:"duration_ms,omitempty"`
+	// ProxyID, if it names a canary (the X-Proxy-Id the CONNECT answer
+	// carried), charges the report to that canary instead of the current
+	// proxy. Any other ID is ignored.
+	ProxyID int64 `json:"proxy_id,omitempty"`
+}
+
+// MonitorCheckRequest is the optional payload for POST /api/monitor/check.
+type MonitorCheckRequest struct {
+	// ID limits the check to a single proxy. Zero checks the whole pool.
+	ID int64 `json:"id"`
+}
+
+// ReserveRequest is the payload for POST /api/reserve.
+type ReserveRequest struct {
+	// ID of the proxy to reserve.
+	ID int64 `json:"id"`
+
+	// Client is the label of the client the proxy is reserved for. Empty
+	// releases the proxy back to general traffic.
+	Client string `json:"client"`
+}
+
+// AddProxyRequest is the payload for POST /api/proxies.
+type AddProxyRequest struct {
+	// URI is a proxy line as it would appear in the proxy file, metadata
+	// included (e.g. "http://1.2.3.4:8080 group=dc").
+	URI string `json:"uri"`
+}
+
+// SelfTestRequest is the payload for POST /api/selftest and
+// POST /api/proxy/{id}/test.
+type SelfTestRequest struct {
+	// Destination is the host:port to dial through the proxy under test.
+	Destination string `json:"destination"`
+}
+
+// ConnectionInfo is a serialisable view of one in-flight connection.
+type ConnectionInfo struct {
+	ID          uint64 `json:"id"`
+	Client      string `json:"client"`
+	Destination string `json:"destination"`
+	ProxyID     int64  `json:"proxy_id"`
+	Proxy       string `json:"proxy"`
+	Started     string `json:"started"`
+	AgeMs       int64  `json:"age_ms"`
+	BytesUp     int64  `json:"bytes_up,omitempty"`
+	BytesDown   int64  `json:"bytes_down,omitempty"`
+}
+
+// DrainInfo is a serialisable view of one retiring proxy's drain.
+type DrainInfo struct {
+	ProxyID   int64  `json:"proxy_id"`
+	Proxy     string `json:"proxy"`
+	Conns     int    `json:"remaining_conns"`
+	BytesUp   int64  `json:"bytes_up"`
+	BytesDown int64  `json:"bytes_down"`
+	Closed    int64  `json:"closed_conns"`
+}
+
+// PinInfo is a serialisable view of one domain pin.
+type PinInfo struct {
+	Domain  string `json:"domain,omitempty"`
+	Client  string `json:"client,omitempty"`
+	ProxyID int64  `json:"proxy_id"`
+	Proxy   string `json:"proxy"`
+	AgeMs   int64  `json:"age_ms"`
 }
 
 // ProxyInfo is a serialisable snapshot of a single proxy's state.
@@ -72,12 +213,39 @@ type ProxyInfo struct {
 	ID          int64         `json:"id"`
 	Address     string        `json:"address"`
 	Scheme      string        `json:"scheme"`
+	Group       string        `json:"group,omitempty"`
+	Canary      float64       `json:"canary_percent,omitempty"`
+	Country     string        `json:"country,omitempty"`
+	Priority    int64         `json:"priority,omitempty"`
+	ReservedFor string        `json:"reserved_for,omitempty"`
+	Egress      string        `json:"egress_country,omitempty"`
+	GeoMismatch bool          `json:"geo_mismatch,omitempty"`
+	Subnet      string        `json:"subnet,omitempty"`
+	ASN         string        `json:"asn,omitempty"`
 	Alive       bool          `json:"alive"`
+	Draining    bool          `json:"draining,omitempty"`
+	Quarantined string        `json:"quarantined_until,omitempty"`
+	DeadReason  string        `json:"dead_reason,omitempty"`
 	Latency     string        `json:"latency_ms"`
+	RespLatency int64         `json:"response_latency_ms"`
+	Reported    int64         `json:"reported_latency_ms"`
 	ActiveConns int64         `json:"active_conns"`
+	MaxConns    int64         `json:"max_conns,omitempty"`
+	MaxRequests int64         `json:"max_requests,omitempty"`
+	BudgetUsed  int64         `json:"budget_used,omitempty"`
 	ReqCount    int64         `json:"req_count"`
 	ConnErrors  int64         `json:"conn_errors"`
 	HTTPErrors  int64         `json:"http_errors"`
+	Streak      int64         `json:"success_streak"`
+
+	// Lifetime totals, not reset on rotation. For canaries these are the
+	// numbers to judge them by. ConnErrorRate is pool.Proxy.ErrorRate,
+	// which leaves HTTP errors out; ErrorRate counts both, one for one.
+	TotalReqs       int64   `json:"total_requests"`
+	TotalConnErrors int64   `json:"total_conn_errors"`
+	TotalHTTPErrors int64   `json:"total_http_errors"`
+	ConnErrorRate   float64 `json:"conn_error_rate"`
+	ErrorRate       float64 `json:"error_rate"`
 }
 
 // -----------------------------------------------------------------------
@@ -108,8 +276,16 @@ func (s *Server) handleRotate(w http.ResponseWriter, r *http.Request) {
 // handleStatus receives an HTTP status code report from the crawler.
 //
 //	POST /api/status
-//	Body: {"status": 403, "destination": "example.com"}
-//	Response: {"ok": true, "rotated": false}
+//	Body: {"status": 403, "destination": "example.com", "duration_ms": 850}
+//	Response: {"ok": true, "rotated": false, "destination_blocked": false, "error_spike": false}
+//
+// A report whose proxy_id names a canary only counts against that canary:
+// canaries never rotate, so it never rotates the current proxy either.
+//
+// destination_blocked is true when enough distinct proxies have failed the
+// destination that its errors no longer cause rotations. error_spike is true
+// while the share of failed reports is over --error-spike-rate. Every
+// response carries both, whether or not the status counted as an error.
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -125,24 +301,51 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "destination is required", http.StatusBadRequest)
 		return
 	}
+	canary := s.rotator.Canary(req.ProxyID)
+	if req.DurationMs != nil {
+		if *req.DurationMs < 0 {
+			http.Error(w, "duration_ms must not be negative", http.StatusBadRequest)
+			return
+		}
+		d := time.Duration(*req.DurationMs) * time.Millisecond
+		if canary != nil {
+			canary.RecordReportedLatency(d)
+		} else {
+			s.rotator.RecordReportedLatency(req.Destination, d)
+		}
+	}
 
-	// 2xx and 3xx are healthy — ignore
-	if req.Status >= 200 && req.Status < 400 {
-		jsonOK(w, map[string]any{"ok": true, "rotated": false})
+	failed := rotationWorthy(req.Status)
+	s.rotator.RecordStatus(failed)
+	if !failed || canary != nil {
+		if failed {
+			canary.RecordHTTPError()
+			log.Printf("[api] status report: %d for %s (canary=%s)", req.Status, req.Destination, canary)
+		}
+		jsonOK(w, map[string]any{
+			"ok":                  true,
+			"rotated":             false,
+			"destination_blocked": s.rotator.DestinationBlocked(req.Destination),
+			"error_spike":         s.rotator.ErrorSpike(),
+		})
 		return
 	}
 
 	genBefore := s.rotator.Generation()
-	s.rotator.RecordHTTPError(req.Destination)
+	blocked := s.rotator.RecordHTTPError(req.Destination)
 	rotated := s.rotator.Generation() != genBefore
 
-	log.Printf("[api] status report: %d for %s (rotated=%v)", req.Status, req.Destination, rotated)
-	jsonOK(w, map[string]any{"ok": true, "rotated": rotated})
+	spike := s.rotator.ErrorSpike()
+
+	log.Printf("[api] status report: %d for %s (rotated=%v blocked=%v spike=%v)", req.Status, req.Destination, rotated, blocked, spike)
+	jsonOK(w, map[string]any{"ok": true, "rotated": rotated, "destination_blocked": blocked, "error_spike": spike})
 }
 
-// handlePool returns the full proxy pool state.
+// handlePool returns the full proxy pool state, as JSON or, with
+// ?format=csv, as CSV with one column per ProxyInfo field.
 //
 //	GET /api/pool
+//	GET /api/pool?format=csv
 func (s *Server) handlePool(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -155,10 +358,18 @@ func (s *Server) handlePool(w http.ResponseWriter, r *http.Request) {
 		info := proxyToInfo(px)
 		if cur != nil && px.ID == cur.ID {
 			info.Address = "[ACTIVE] " + info.Address
+			info.Draining = s.rotator.Paused()
 		}
 		infos = append(infos, info)
 	}
-	jsonOK(w, infos)
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		jsonOK(w, infos)
+	case "csv":
+		writeCSV(w, infos)
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q (want json or csv)", format), http.StatusBadRequest)
+	}
 }
 
 // handleCurrent returns the currently active proxy.
@@ -169,20 +380,607 @@ func (s *Server) handleCurrent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	info := proxyToInfo(s.rotator.Current())
+	info.Draining = s.rotator.Paused()
+	jsonOK(w, info)
+}
+
+// handleDrainCurrent stops routing new connections to the current proxy
+// and pauses rotation without selecting a replacement. Connections already
+// open on the proxy finish there; new ones are answered with 503 until
+// POST /api/resume.
+//
+//	POST /api/drain-current
+//	Response: {"ok": true, "proxy": {…, "draining": true}}
+func (s *Server) handleDrainCurrent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info := proxyToInfo(s.rotator.DrainCurrent())
+	info.Draining = true
+	log.Printf("[api] draining current proxy %s", info.Address)
+	jsonOK(w, map[string]any{"ok": true, "proxy": info})
+}
+
+// handleDrain reports the progress of every drain under way: the current
+// proxy while rotation is paused, and removed proxies that still have
+// connections open. With --drain-max-bytes or --drain-idle-timeout it
+// includes the bytes relayed so far and the connections those limits
+// closed.
+//
+//	GET /api/drain
+//	Response: {"count": 1, "draining": [{"proxy_id": 3, "remaining_conns": 2, ...}]}
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.proxy == nil {
+		jsonError(w, http.StatusServiceUnavailable, "proxy server not running")
+		return
+	}
+	progress := s.proxy.DrainProgress()
+	out := make([]DrainInfo, 0, len(progress))
+	for _, d := range progress {
+		out = append(out, DrainInfo{
+			ProxyID:   d.Proxy.ID,
+			Proxy:     d.Proxy.String(),
+			Conns:     d.Conns,
+			BytesUp:   d.BytesUp,
+			BytesDown: d.BytesDown,
+			Closed:    d.Closed,
+		})
+	}
+	jsonOK(w, map[string]any{"count": len(out), "draining": out})
+}
+
+// handleResume ends a pause started by POST /api/drain-current and selects
+// the next proxy. Without a pause it answers 409.
+//
+//	POST /api/resume
+//	Response: {"ok": true, "proxy": {…}}
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.rotator.Resume(); err != nil {
+		if errors.Is(err, rotator.ErrNotPaused) {
+			jsonError(w, http.StatusConflict, err.Error())
+			return
+		}
+		// Rotation is back on; only the fresh selection failed.
+		log.Printf("[api] resume: %v", err)
+	}
 	cur := s.rotator.Current()
-	if cur == nil {
-		http.Error(w, "no active proxy", http.StatusServiceUnavailable)
+	log.Printf("[api] rotation resumed; current proxy: %s", cur.String())
+	jsonOK(w, map[string]any{"ok": true, "proxy": proxyToInfo(cur)})
+}
+
+// monitorCheckWait is how long /api/monitor/check waits for its check
+// before answering 202 and letting it finish in the background, so the
+// answer always beats the API's 5s write timeout.
+var monitorCheckWait = 4 * time.Second
+
+// waitCheck runs check in the background and reports whether it finished
+// within monitorCheckWait.
+func waitCheck(check func()) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		check()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(monitorCheckWait):
+		return false
+	}
+}
+
+// handleMonitorCheck runs a health check immediately instead of waiting for
+// the next monitor tick. Without a body the whole pool is checked; with
+// {"id": N} only that proxy is. A check still running after a few seconds
+// (a large pool, or a proxy that times out) carries on in the background
+// and the answer is 202 with "pending"; so is a whole-pool request while
+// an earlier one is still running, which is not started twice.
+//
+//	POST /api/monitor/check
+//	Body (optional): {"id": 3}
+//	Response: {"ok": true, "alive": 9, "quarantined": 0, "dead": 1, "total": 10}
+//	      or: {"ok": true, "proxy": {…}}
+//	      or: 202 {"ok": true, "pending": true}
+func (s *Server) handleMonitorCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MonitorCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.ID != 0 {
+		px := s.pool.Get(req.ID)
+		if px == nil {
+			http.Error(w, fmt.Sprintf("no proxy with id %d", req.ID), http.StatusNotFound)
+			return
+		}
+		if !waitCheck(func() { s.monitor.CheckOne(req.ID) }) {
+			log.Printf("[api] on-demand check of %s still running; answering 202", px.String())
+			jsonStatus(w, http.StatusAccepted, map[string]any{"ok": true, "pending": true, "proxy": proxyToInfo(px)})
+			return
+		}
+		log.Printf("[api] on-demand check of %s: alive=%v", px.String(), px.IsAlive())
+		jsonOK(w, map[string]any{"ok": true, "proxy": proxyToInfo(px)})
 		return
 	}
-	jsonOK(w, proxyToInfo(cur))
+
+	if !s.checking.CompareAndSwap(false, true) {
+		jsonStatus(w, http.StatusAccepted, map[string]any{"ok": true, "pending": true})
+		return
+	}
+	finished := waitCheck(func() {
+		defer s.checking.Store(false)
+		s.monitor.RunOnce()
+	})
+	if !finished {
+		log.Printf("[api] on-demand health check still running; answering 202")
+		jsonStatus(w, http.StatusAccepted, map[string]any{"ok": true, "pending": true})
+		return
+	}
+	alive, quarantined, total := s.pool.AliveLen(), len(s.pool.Quarantined()), s.pool.Len()
+	log.Printf("[api] on-demand health check: %d/%d alive", alive, total)
+	jsonOK(w, map[string]any{"ok": true, "alive": alive, "quarantined": quarantined,
+		"dead": total - alive - quarantined, "total": total})
+}
+
+// handleReserve reserves a proxy for the client with the given label, so
+// only that client's connections use it, or releases it with an empty
+// client. Reserving a proxy already reserved for another client, the last
+// one general traffic could use, or the current proxy while rotation is
+// paused answers 409.
+//
+//	POST /api/reserve
+//	Body: {"id": 5, "client": "vip"}
+//	Response: {"ok": true, "proxy": {…}}
+func (s *Server) handleReserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ReserveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	px := s.pool.Get(req.ID)
+	if px == nil {
+		http.Error(w, fmt.Sprintf("no proxy with id %d", req.ID), http.StatusNotFound)
+		return
+	}
+	if err := s.rotator.Reserve(px, req.Client); err != nil {
+		if errors.Is(err, rotator.ErrReservedElsewhere) || errors.Is(err, rotator.ErrLastProxy) || errors.Is(err, rotator.ErrPaused) {
+			jsonError(w, http.StatusConflict, err.Error())
+			return
+		}
+		// The reservation stands; only moving off the proxy failed.
+		log.Printf("[api] reserve %s: %v", px.String(), err)
+	}
+	jsonOK(w, map[string]any{"ok": true, "proxy": proxyToInfo(px)})
+}
+
+// handleConnections lists the connections currently being proxied, oldest
+// first. Long-lived entries point at hung destinations holding a proxy's
+// active_conns up.
+//
+//	GET /api/connections
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.proxy == nil {
+		jsonError(w, http.StatusServiceUnavailable, "proxy server not running")
+		return
+	}
+	now := time.Now()
+	snapshot := s.conns.Snapshot()
+	out := make([]ConnectionInfo, 0, len(snapshot))
+	for _, c := range snapshot {
+		out = append(out, ConnectionInfo{
+			ID:          c.ID,
+			Client:      c.ClientAddr,
+			Destination: c.Destination,
+			ProxyID:     c.Proxy.ID,
+			Proxy:       c.Proxy.String(),
+			Started:     c.Started.UTC().Format(time.RFC3339),
+			AgeMs:       now.Sub(c.Started).Milliseconds(),
+			BytesUp:     c.BytesUp,
+			BytesDown:   c.BytesDown,
+		})
+	}
+	jsonOK(w, map[string]any{"count": len(out), "connections": out, "clients": s.proxy.ClientConns()})
+}
+
+// handlePins lists the current pins, sorted by domain (or client IP with
+// --pin-mode client-ip), or looks up the pin of one domain or client.
+//
+//	GET /api/pins
+//	Response: {"count": 2, "pins": [{"domain": "example.com", "proxy_id": 3, ...}]}
+//	GET /api/pins?domain=example.com
+//	GET /api/pins?client=10.0.0.7
+//	Response: {"domain": "example.com", "proxy_id": 3, "proxy": "...", "age_ms": 5120}
+//	          404 if there is no such pin
+func (s *Server) handlePins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	domain, client := r.URL.Query().Get("domain"), r.URL.Query().Get("client")
+	if domain != "" || client != "" {
+		pin, ok := s.rotator.PinFor(client, domain)
+		if !ok {
+			body := map[string]any{"error": "not_pinned"}
+			if domain != "" {
+				body["domain"] = domain
+			}
+			if client != "" {
+				body["client"] = client
+			}
+			jsonStatus(w, http.StatusNotFound, body)
+			return
+		}
+		jsonOK(w, pinToInfo(pin, now))
+		return
+	}
+	pins := s.rotator.Pins()
+	out := make([]PinInfo, 0, len(pins))
+	for _, pin := range pins {
+		out = append(out, pinToInfo(pin, now))
+	}
+	jsonOK(w, map[string]any{"count": len(out), "pins": out})
+}
+
+func pinToInfo(pin rotator.Pin, now time.Time) PinInfo {
+	info := PinInfo{Domain: pin.Domain, Client: pin.Client, ProxyID: pin.Proxy.ID, Proxy: pin.Proxy.String()}
+	if !pin.Since.IsZero() {
+		info.AgeMs = now.Sub(pin.Since).Milliseconds()
+	}
+	return info
+}
+
+// handleReload re-reads the proxy file and auth file and applies the
+// changes without dropping open tunnels; see SetReload and pool.Reload.
+//
+//	POST /api/reload
+//	Response: {"ok": true, "added": 1, "removed": 0, "updated": 2, "unchanged": 7}
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reload := s.reload
+	if reload == nil {
+		reload = s.reloadPool
+	}
+	res, err := reload()
+	if err != nil {
+		log.Printf("[api] reload failed: %v", err)
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonOK(w, map[string]any{
+		"ok":        true,
+		"added":     res.Added,
+		"removed":   res.Removed,
+		"updated":   res.Updated,
+		"unchanged": res.Unchanged,
+	})
+}
+
+// reloadPool is the reload used without SetReload.
+func (s *Server) reloadPool() (pool.ReloadResult, error) {
+	res, err := s.pool.Reload()
+	if err != nil {
+		return res, err
+	}
+	log.Printf("[api] proxy list reloaded: added=%d removed=%d updated=%d unchanged=%d",
+		res.Added, res.Removed, res.Updated, res.Unchanged)
+	return res, s.rotator.Reconcile()
+}
+
+// handleStats returns runtime counts for capacity diagnostics. A goroutine
+// count that keeps growing while handlers and tunnels stay flat points at a
+// leak. rotations_by_trigger tells which rotation triggers do the rotating;
+// dropped_triggers counts trigger firings lost to a full rotation queue.
+// pinned_domains (the pins held, by domain or by client IP with
+// --pin-mode client-ip; the name predates the mode) and pin_evictions size
+// --max-pins.
+//
+//	GET /api/stats
+//	Response: {"goroutines": 57, "handlers": 12, "tunnels": 11,
+//	           "rotations_by_trigger": {"interval": 40, "conn-errors": 3},
+//	           "dropped_triggers": 0, "pinned_domains": 310, "pin_evictions": 0}
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := s.proxyStats()
+	pinned, evictions := s.rotator.PinStats()
+	jsonOK(w, map[string]any{
+		"goroutines":           runtime.NumGoroutine(),
+		"handlers":             st.Handlers,
+		"tunnels":              st.Tunnels,
+		"rotations_by_trigger": s.rotator.TriggerCounts(),
+		"dropped_triggers":     s.rotator.DroppedTriggers(),
+		"pinned_domains":       pinned,
+		"pin_evictions":        evictions,
+	})
+}
+
+// proxyStats returns the proxy server's counts, or zeros when the API runs
+// without one.
+func (s *Server) proxyStats() server.Stats {
+	if s.proxy == nil {
+		return server.Stats{}
+	}
+	return s.proxy.Stats()
+}
+
+// handleMetrics serves the /api/stats counts in the Prometheus text
+// exposition format. Unlike the /api endpoints it answers even without an
+// active proxy, so scrapes keep working through an outage.
+//
+//	GET /metrics
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := s.proxyStats()
+	pinned, evictions := s.rotator.PinStats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"proxyrotator_goroutines", "Number of goroutines.", int64(runtime.NumGoroutine())},
+		{"proxyrotator_inflight_handlers", "Accepted client connections still being handled.", st.Handlers},
+		{"proxyrotator_active_tunnels", "Connections currently relaying bytes.", st.Tunnels},
+		{"proxyrotator_pinned_domains", "Pins currently held, by domain or by client IP.", int64(pinned)},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+
+	counts := s.rotator.TriggerCounts()
+	triggers := make([]string, 0, len(counts))
+	for t := range counts {
+		triggers = append(triggers, string(t))
+	}
+	sort.Strings(triggers)
+	fmt.Fprint(w, "# HELP proxyrotator_rotations_total Rotations performed, by trigger.\n# TYPE proxyrotator_rotations_total counter\n")
+	for _, t := range triggers {
+		fmt.Fprintf(w, "proxyrotator_rotations_total{trigger=%q} %d\n", t, counts[rotator.Trigger(t)])
+	}
+	fmt.Fprintf(w, "# HELP proxyrotator_dropped_triggers_total Rotation requests dropped on a full queue.\n# TYPE proxyrotator_dropped_triggers_total counter\nproxyrotator_dropped_triggers_total %d\n",
+		s.rotator.DroppedTriggers())
+	fmt.Fprintf(w, "# HELP proxyrotator_pin_evictions_total Pins evicted to stay within --max-pins.\n# TYPE proxyrotator_pin_evictions_total counter\nproxyrotator_pin_evictions_total %d\n",
+		evictions)
+}
+
+// selfTestTimeout bounds a self-test dial so the answer always beats the
+// API's 5s write timeout.
+const selfTestTimeout = 4 * time.Second
+
+// handleSelfTest dials a destination through the current proxy, exactly as
+// a client connection would, and reports whether it worked. It answers
+// "can I scrape right now?" more directly than the monitor's probe, and
+// counts towards no rotation trigger.
+//
+//	POST /api/selftest
+//	Body: {"destination": "example.com:443"}
+//	Response: {"ok": true, "destination": "example.com:443", "elapsed_ms": 182, "proxy": {…}}
+//	      or: 502 {"ok": false, "error": "…", "destination": …, "elapsed_ms": …, "proxy": {…}}
+func (s *Server) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.dialTest(w, r, s.rotator.Current(), "self-test")
+}
+
+// handleProxy serves the actions on one proxy in the pool, picked by ID.
+//
+//	POST /api/proxy/{id}/test
+//	Body: {"destination": "example.com:443"}
+//	Response: as POST /api/selftest
+//
+// is handleSelfTest for that proxy, so a suspicious proxy can be checked
+// without rotating to it.
+//
+//	POST /api/proxy/{id}/reset-budget
+//	Response: {"ok": true, "proxy": {...}}
+//
+// gives a proxy with max-requests metadata its full budget back, making it
+// selectable again, e.g. once the provider has given it a fresh IP.
+//
+// Both answer 404 if there is no proxy with that ID.
+func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
+	idStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/proxy/"), "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || (action != "test" && action != "reset-budget") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	px := s.pool.Get(id)
+	if px == nil {
+		http.Error(w, fmt.Sprintf("no proxy with id %d", id), http.StatusNotFound)
+		return
+	}
+	if action == "test" {
+		s.dialTest(w, r, px, "proxy test")
+		return
+	}
+	used := px.BudgetUsed()
+	px.ResetBudget()
+	log.Printf("[api] request budget of %s reset (%d of %d used)", px.String(), used, px.MaxRequests)
+	jsonOK(w, map[string]any{"ok": true, "proxy": proxyToInfo(px)})
+}
+
+// handleProxies adds a proxy to the pool, or removes one, without editing
+// the proxy file. Changes last until the next reload, which makes the pool
+// match the file again.
+//
+//	POST /api/proxies
+//	Body: {"uri": "http://1.2.3.4:8080"}
+//	Response: {"ok": true, "proxy": {...}}
+//
+// adds the proxy, alive until the monitor finds otherwise.
+//
+//	DELETE /api/proxies/{id}
+//	Response: {"ok": true, "proxy": {...}}
+//
+// removes the proxy. Connections open on it finish; new ones go elsewhere,
+// and if it was current the rotator moves on. Unknown IDs answer 404.
+func (s *Server) handleProxies(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/proxies"), "/")
+	if idStr == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req AddProxyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		px, err := s.pool.Add(req.URI)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("[api] proxy added: %s", px.String())
+		if err := s.rotator.Reconcile(); err != nil {
+			log.Printf("[api] add %s: %v", px.String(), err)
+		}
+		jsonOK(w, map[string]any{"ok": true, "proxy": proxyToInfo(px)})
+		return
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	px := s.pool.Get(id)
+	if px == nil {
+		http.Error(w, fmt.Sprintf("no proxy with id %d", id), http.StatusNotFound)
+		return
+	}
+	if err := s.pool.Remove(id); err != nil {
+		// Removed by someone else since Get.
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.rotator.Reconcile(); err != nil {
+		log.Printf("[api] remove %s: %v", px.String(), err)
+	}
+	log.Printf("[api] proxy removed: %s", px.String())
+	jsonOK(w, map[string]any{"ok": true, "proxy": proxyToInfo(px)})
+}
+
+// dialTest decodes a SelfTestRequest, dials its destination through px and
+// writes the result; what names the test in log lines.
+func (s *Server) dialTest(w http.ResponseWriter, r *http.Request, px *pool.Proxy, what string) {
+	if s.proxy == nil {
+		jsonError(w, http.StatusServiceUnavailable, "proxy server not running")
+		return
+	}
+	var req SelfTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, _, err := net.SplitHostPort(req.Destination); err != nil {
+		http.Error(w, fmt.Sprintf("destination must be host:port, got %q", req.Destination), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), selfTestTimeout)
+	defer cancel()
+	elapsed, err := s.proxy.DialTest(ctx, px, req.Destination)
+
+	resp := map[string]any{
+		"ok":          err == nil,
+		"destination": req.Destination,
+		"elapsed_ms":  elapsed.Milliseconds(),
+		"proxy":       proxyToInfo(px),
+	}
+	if err != nil {
+		log.Printf("[api] %s %s via %s failed: %v", what, req.Destination, px.String(), err)
+		resp["error"] = err.Error()
+		jsonStatus(w, http.StatusBadGateway, resp)
+		return
+	}
+	log.Printf("[api] %s %s via %s ok in %s", what, req.Destination, px.String(), elapsed.Round(time.Millisecond))
+	jsonOK(w, resp)
 }
 
 // -----------------------------------------------------------------------
 // Helpers
 // -----------------------------------------------------------------------
 
+// requireActive wraps h so that every endpoint answers the same way while
+// the rotator has no current proxy (e.g. the whole pool is dead):
+//
+//	503 {"ok": false, "error": "no_active_proxy"}
+func (s *Server) requireActive(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.rotator.Current() == nil {
+			jsonError(w, http.StatusServiceUnavailable, "no_active_proxy")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// rotationWorthy reports whether a status reported via /api/status counts as
+// an HTTP error. 2xx and 3xx never do, whatever the configuration: a redirect
+// — including the common http:// → https:// upgrade of a plain-HTTP request
+// — means the destination answered normally, not that the proxy is burned.
+func rotationWorthy(status int) bool {
+	return status < 200 || status >= 400
+}
+
+func jsonError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": msg}); err != nil {
+		log.Printf("[api] encode response: %v", err)
+	}
+}
+
 func jsonOK(w http.ResponseWriter, v any) {
+	jsonStatus(w, http.StatusOK, v)
+}
+
+func jsonStatus(w http.ResponseWriter, code int, v any) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(v); err != nil {
 		log.Printf("[api] encode response: %v", err)
 	}
@@ -190,19 +988,50 @@ func jsonOK(w http.ResponseWriter, v any) {
 
 func proxyToInfo(px *pool.Proxy) ProxyInfo {
 	lat := px.Latency()
+	respLat, _ := px.ResponseLatency()
+	reportedLat, _ := px.ReportedLatency()
+	reqs, errs := px.TotalReqs.Load(), px.TotalConnErrors.Load()
+	rate := math.Round(px.ErrorRate()*1e4) / 1e4
 	latStr := "0"
 	if lat > 0 {
 		latStr = fmt.Sprintf("%d", lat.Milliseconds())
 	}
+	var quarantined string
+	if until := px.QuarantinedUntil(); !until.IsZero() {
+		quarantined = until.UTC().Format(time.RFC3339)
+	}
 	return ProxyInfo{
 		ID:          px.ID,
 		Address:     px.String(),
 		Scheme:      px.Scheme,
+		Group:       px.Group,
+		Canary:      px.Canary,
+		Country:     px.Country,
+		Priority:    px.Priority,
+		ReservedFor: px.ReservedFor(),
+		Egress:      px.EgressCountry(),
+		GeoMismatch: px.CountryMismatch(),
+		Subnet:      px.Subnet(),
+		ASN:         px.NetworkASN(),
 		Alive:       px.IsAlive(),
+		DeadReason:  px.DeadReason(),
+		Quarantined: quarantined,
 		Latency:     latStr,
+		RespLatency: respLat.Milliseconds(),
+		Reported:    reportedLat.Milliseconds(),
 		ActiveConns: px.ActiveConns.Load(),
+		MaxConns:    px.MaxConns,
+		MaxRequests: px.MaxRequests,
+		BudgetUsed:  px.BudgetUsed(),
 		ReqCount:    px.ReqCount.Load(),
 		ConnErrors:  px.ConnErrors.Load(),
 		HTTPErrors:  px.HTTPErrors.Load(),
+		Streak:      px.SuccessStreak(),
+
+		TotalReqs:       reqs,
+		TotalConnErrors: errs,
+		TotalHTTPErrors: px.TotalHTTPErrors.Load(),
+		ConnErrorRate:   rate,
+		ErrorRate:       math.Round(px.WeightedErrorRate(1, 1)*1e4) / 1e4,
 	}
 }
@@ -0,0 +1,811 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/monitor"
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+	"github.com/drsoft-oss/proxyrotator/internal/rotator"
+	"github.com/drsoft-oss/proxyrotator/internal/server"
+)
+
+// newTestServer builds an API server over a fresh pool and rotator.
+func newTestServer(t *testing.T, uris ...string) *Server {
+	t.Helper()
+	p := pool.New(false)
+	if err := p.LoadProxies(uris); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := monitor.New(p, monitor.Config{Timeout: time.Second, UpdateLiveness: true})
+	return New("127.0.0.1:0", p, r, m, server.New(server.Config{}, r))
+}
+
+func TestNoActiveProxy_AllEndpoints(t *testing.T) {
+	// A zero Rotator has no current proxy, as during a failed startup.
+	s := New("127.0.0.1:0", pool.New(false), &rotator.Rotator{}, nil, nil)
+
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/api/current"},
+		{http.MethodGet, "/api/pool"},
+		{http.MethodPost, "/api/rotate"},
+		{http.MethodPost, "/api/drain-current"},
+		{http.MethodPost, "/api/resume"},
+		{http.MethodGet, "/api/drain"},
+		{http.MethodPost, "/api/status"},
+		{http.MethodPost, "/api/monitor/check"},
+		{http.MethodGet, "/api/connections"},
+		{http.MethodPost, "/api/reserve"},
+		{http.MethodPost, "/api/reload"},
+		{http.MethodGet, "/api/stats"},
+		{http.MethodPost, "/api/selftest"},
+		{http.MethodPost, "/api/proxy/1/test"},
+		{http.MethodPost, "/api/proxy/1/reset-budget"},
+		{http.MethodGet, "/api/pins"},
+	} {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: status = %d, want 503", tc.method, tc.path, rec.Code)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s %s: decode body: %v", tc.method, tc.path, err)
+		}
+		if body["error"] != "no_active_proxy" {
+			t.Errorf("%s %s: error = %v, want no_active_proxy", tc.method, tc.path, body["error"])
+		}
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080")
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/current", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "1.2.3.4:8080") {
+		t.Errorf("unexpected body: %s", rec.Body.String())
+	}
+}
+
+func TestMonitorCheck(t *testing.T) {
+	// Nothing listens on port 1, so every check fails fast.
+	s := newTestServer(t, "http://127.0.0.1:1", "http://127.0.0.2:1")
+
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/monitor/check", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Alive, Dead, Total int
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Total != 2 || body.Dead != 2 || body.Alive != 0 {
+		t.Errorf("summary = %+v, want 2 dead of 2", body)
+	}
+}
+
+func TestMonitorCheck_SingleProxy(t *testing.T) {
+	s := newTestServer(t, "http://127.0.0.1:1", "http://127.0.0.2:1")
+	id := s.pool.All()[1].ID
+
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(fmt.Sprintf(`{"id": %d}`, id))
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/monitor/check", body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if s.pool.All()[0].IsAlive() != true {
+		t.Error("unchecked proxy should keep its state")
+	}
+	if s.pool.All()[1].IsAlive() {
+		t.Error("checked proxy should be marked dead")
+	}
+
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/monitor/check", strings.NewReader(`{"id": 999}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestMonitorCheck_SlowUpstream(t *testing.T) {
+	// The upstream opens the tunnel and then never answers the check
+	// request, so each check runs into the monitor's 1s timeout.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(io.Discard, br)
+			}()
+		}
+	}()
+	s := newTestServer(t, "http://"+ln.Addr().String())
+	px := s.pool.All()[0]
+
+	defer func(wait time.Duration) { monitorCheckWait = wait }(monitorCheckWait)
+	monitorCheckWait = 100 * time.Millisecond
+
+	check := func(body string) int {
+		t.Helper()
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/monitor/check", strings.NewReader(body)))
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%q answered after %s, want about monitorCheckWait", body, elapsed)
+		}
+		return rec.Code
+	}
+
+	if code := check(fmt.Sprintf(`{"id": %d}`, px.ID)); code != http.StatusAccepted {
+		t.Errorf("single proxy: status = %d, want 202", code)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for px.IsAlive() {
+		if time.Now().After(deadline) {
+			t.Fatal("background check never marked the silent proxy dead")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if code := check(""); code != http.StatusAccepted {
+		t.Errorf("whole pool: status = %d, want 202", code)
+	}
+	if code := check(""); code != http.StatusAccepted {
+		t.Errorf("whole pool while a pass runs: status = %d, want 202", code)
+	}
+	for s.checking.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("background pass never finished")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080", "http://5.6.7.8:8080")
+	px := s.pool.All()[1]
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 51234}
+	tc := s.conns.Track(client, "example.com:443", px)
+
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/connections", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Count       int              `json:"count"`
+		Connections []ConnectionInfo `json:"connections"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Count != 1 || len(body.Connections) != 1 {
+		t.Fatalf("got %d connections, want 1", body.Count)
+	}
+	c := body.Connections[0]
+	if c.Client != "10.0.0.7:51234" || c.Destination != "example.com:443" || c.ProxyID != px.ID {
+		t.Errorf("unexpected connection %+v", c)
+	}
+
+	tc.Done()
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/connections", nil))
+	if !strings.Contains(rec.Body.String(), `"count":0`) {
+		t.Errorf("expected no connections after deregistering, got %s", rec.Body.String())
+	}
+}
+
+// The API may run without a proxy server; endpoints that need one must not
+// panic.
+func TestNoProxyServer(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("127.0.0.1:0", p, r, nil, nil)
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodGet, "/api/stats", "", http.StatusOK},
+		{http.MethodGet, "/metrics", "", http.StatusOK},
+		{http.MethodGet, "/api/connections", "", http.StatusServiceUnavailable},
+		{http.MethodGet, "/api/drain", "", http.StatusServiceUnavailable},
+		{http.MethodPost, "/api/selftest", `{"destination": "example.com:443"}`, http.StatusServiceUnavailable},
+		{http.MethodPost, fmt.Sprintf("/api/proxy/%d/test", p.All()[0].ID), `{"destination": "example.com:443"}`, http.StatusServiceUnavailable},
+	} {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: status = %d, want %d: %s", tc.method, tc.path, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+}
+
+func TestReload_InMemoryPool(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080")
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/reload", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "not loaded from a file") {
+		t.Errorf("unexpected body: %s", rec.Body.String())
+	}
+}
+
+func TestReload_Callback(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080")
+	calls := 0
+	s.SetReload(func() (pool.ReloadResult, error) {
+		calls++
+		return pool.ReloadResult{Added: 2, Unchanged: 1}, nil
+	})
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/reload", nil))
+	if rec.Code != http.StatusOK || calls != 1 {
+		t.Fatalf("status = %d after %d calls, want 200 after 1: %s", rec.Code, calls, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"added":2`) {
+		t.Errorf("body %s does not report the callback's result", rec.Body.String())
+	}
+}
+
+func TestStatsAndMetrics(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080")
+
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("stats: status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var stats struct {
+		Goroutines int64            `json:"goroutines"`
+		Handlers   int64            `json:"handlers"`
+		Tunnels    int64            `json:"tunnels"`
+		ByTrigger  map[string]int64 `json:"rotations_by_trigger"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Goroutines < 1 || stats.Handlers != 0 || stats.Tunnels != 0 || stats.ByTrigger == nil {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		"# TYPE proxyrotator_goroutines gauge\n",
+		"proxyrotator_inflight_handlers 0\n",
+		"proxyrotator_active_tunnels 0\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+// stubConnectProxy is an HTTP proxy that accepts every CONNECT and then
+// hangs up.
+func stubConnectProxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestSelfTest(t *testing.T) {
+	s := newTestServer(t, stubConnectProxy(t))
+	px := s.rotator.Current()
+	gen := s.rotator.Generation()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/selftest", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post(`{"destination": "example.com:443"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		OK          bool   `json:"ok"`
+		Destination string `json:"destination"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !body.OK || body.Destination != "example.com:443" {
+		t.Errorf("response = %+v, want ok for example.com:443", body)
+	}
+	if px.TotalReqs.Load() != 0 || px.ReqCount.Load() != 0 || s.rotator.Generation() != gen {
+		t.Error("a self-test must not count as traffic or rotate")
+	}
+
+	if rec := post(`{"destination": "example.com"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("destination without port: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestSelfTest_DialFails(t *testing.T) {
+	// Nothing listens on port 1.
+	s := newTestServer(t, "http://127.0.0.1:1")
+	px := s.rotator.Current()
+
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"destination": "example.com:443"}`)
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/selftest", body))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502: %s", rec.Code, rec.Body.String())
+	}
+	if px.ConnErrors.Load() != 0 || px.TotalConnErrors.Load() != 0 {
+		t.Error("a failed self-test must not count as a connection error")
+	}
+}
+
+func TestProxyTest(t *testing.T) {
+	// The current proxy is dead; the one under test is not.
+	s := newTestServer(t, "http://127.0.0.1:1", stubConnectProxy(t))
+	cur := s.rotator.Current()
+	gen := s.rotator.Generation()
+	target := s.pool.All()[1]
+
+	post := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := strings.NewReader(`{"destination": "example.com:443"}`)
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, body))
+		return rec
+	}
+
+	if rec := post(fmt.Sprintf("/api/proxy/%d/test", target.ID)); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if s.rotator.Current() != cur || s.rotator.Generation() != gen {
+		t.Error("testing a proxy must not rotate to it")
+	}
+	if target.TotalReqs.Load() != 0 {
+		t.Error("a proxy test must not count as traffic")
+	}
+
+	for _, path := range []string{"/api/proxy/999/test", "/api/proxy/x/test", "/api/proxy/1", "/api/proxy/1/nope"} {
+		if rec := post(path); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestDrainCurrentAndResume(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080", "http://5.6.7.8:8080")
+	drained := s.rotator.Current()
+	call := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	if rec := call(http.MethodPost, "/api/resume"); rec.Code != http.StatusConflict {
+		t.Errorf("resume without a drain: status = %d, want 409", rec.Code)
+	}
+	if rec := call(http.MethodPost, "/api/drain-current"); rec.Code != http.StatusOK {
+		t.Fatalf("drain: status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var info ProxyInfo
+	if err := json.NewDecoder(call(http.MethodGet, "/api/current").Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != drained.ID || !info.Draining {
+		t.Errorf("/api/current = id %d draining=%v, want id %d draining", info.ID, info.Draining, drained.ID)
+	}
+
+	if rec := call(http.MethodPost, "/api/resume"); rec.Code != http.StatusOK {
+		t.Fatalf("resume: status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if s.rotator.Paused() || s.rotator.Current() == drained {
+		t.Error("resume should select a fresh proxy")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080", "http://5.6.7.8:8080")
+	px := s.pool.All()[1]
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/reserve", strings.NewReader(body)))
+		return rec
+	}
+	rec := post(fmt.Sprintf(`{"id": %d, "client": "vip"}`, px.ID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct{ Proxy ProxyInfo }
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Proxy.ReservedFor != "vip" {
+		t.Errorf("reserved_for = %q, want vip", resp.Proxy.ReservedFor)
+	}
+
+	if rec := post(fmt.Sprintf(`{"id": %d, "client": "other"}`, px.ID)); rec.Code != http.StatusConflict {
+		t.Errorf("second client: status = %d, want 409", rec.Code)
+	}
+	if rec := post(`{"id": 999, "client": "vip"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status = %d, want 404", rec.Code)
+	}
+	if rec := post(fmt.Sprintf(`{"id": %d, "client": ""}`, px.ID)); rec.Code != http.StatusOK || px.ReservedFor() != "" {
+		t.Errorf("release: status = %d, reserved_for = %q", rec.Code, px.ReservedFor())
+	}
+
+	cur := s.rotator.DrainCurrent()
+	if rec := post(fmt.Sprintf(`{"id": %d, "client": "vip"}`, cur.ID)); rec.Code != http.StatusConflict || cur.ReservedFor() != "" {
+		t.Errorf("current while paused: status = %d, reserved_for = %q; want 409 and no reservation", rec.Code, cur.ReservedFor())
+	}
+}
+
+func TestProxyResetBudget(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080 max-requests=1", "http://5.6.7.8:8080")
+	px := s.pool.All()[0]
+	if !px.AcquireConn() || !px.Exhausted() {
+		t.Fatal("the single request of budget should be used up")
+	}
+	px.ReleaseConn()
+
+	rec := httptest.NewRecorder()
+	path := fmt.Sprintf("/api/proxy/%d/reset-budget", px.ID)
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if px.Exhausted() {
+		t.Error("budget not reset")
+	}
+}
+
+func TestProxies_AddRemove(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080", "http://5.6.7.8:8080")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/api/proxies", `{"uri": "socks5://9.9.9.9:1080 group=dc"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("add: status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct{ Proxy ProxyInfo }
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Proxy.Scheme != "socks5" || resp.Proxy.Group != "dc" || s.pool.Get(resp.Proxy.ID) == nil {
+		t.Errorf("added proxy = %+v, want socks5 in group dc and in the pool", resp.Proxy)
+	}
+	if rec := do(http.MethodPost, "/api/proxies", `{"uri": "ftp://1.2.3.4:21"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad uri: status = %d, want 400", rec.Code)
+	}
+
+	// Removing the current proxy moves the rotator off it; the proxy
+	// itself stays usable by whoever still holds it, only dead.
+	cur := s.rotator.Current()
+	if rec := do(http.MethodDelete, fmt.Sprintf("/api/proxies/%d", cur.ID), ""); rec.Code != http.StatusOK {
+		t.Fatalf("remove: status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if s.pool.Get(cur.ID) != nil || cur.IsAlive() || cur.DeadReason() != pool.DeadRemoved {
+		t.Errorf("removed proxy: in pool=%v alive=%v reason=%q", s.pool.Get(cur.ID) != nil, cur.IsAlive(), cur.DeadReason())
+	}
+	if s.rotator.Current() == cur {
+		t.Error("rotator still on the removed proxy")
+	}
+	if rec := do(http.MethodDelete, fmt.Sprintf("/api/proxies/%d", cur.ID), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("remove again: status = %d, want 404", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/proxies/2", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET by id: status = %d, want 405", rec.Code)
+	}
+}
+
+func TestProxies_AddToDeadPool(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080", "http://5.6.7.8:8080")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	// Every proxy dead, then the current one removed as well.
+	for _, px := range s.pool.All() {
+		px.SetAlive(false)
+	}
+	cur := s.rotator.Current()
+	if rec := do(http.MethodDelete, fmt.Sprintf("/api/proxies/%d", cur.ID), ""); rec.Code != http.StatusOK {
+		t.Fatalf("remove: status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := do(http.MethodPost, "/api/proxies", `{"uri": "http://9.9.9.9:8080"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("add: status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct{ Proxy ProxyInfo }
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.rotator.Current(); got == nil || got.ID != resp.Proxy.ID {
+		t.Errorf("current = %v after adding to a dead pool, want the added proxy %d", got, resp.Proxy.ID)
+	}
+}
+
+func TestRotationWorthy(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		want   bool
+	}{
+		{200, false},
+		{204, false},
+		{301, false}, // e.g. http → https upgrade
+		{302, false},
+		{304, false},
+		{307, false},
+		{308, false},
+		{403, true},
+		{429, true},
+		{500, true},
+		{503, true},
+	} {
+		if got := rotationWorthy(tc.status); got != tc.want {
+			t.Errorf("rotationWorthy(%d) = %v, want %v", tc.status, got, tc.want)
+		}
+	}
+}
+
+func TestStatus_RedirectNeverCounts(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{RotateHTTPErrors: 1, HTTPErrorDedupWindow: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("127.0.0.1:0", p, r, nil, nil)
+
+	for i, status := range []int{301, 302, 307, 308} {
+		rec := httptest.NewRecorder()
+		body := strings.NewReader(fmt.Sprintf(`{"status": %d, "destination": "site%d.example"}`, status, i))
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/status", body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: code = %d", status, rec.Code)
+		}
+		var resp map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"ok", "rotated", "destination_blocked", "error_spike"} {
+			if _, ok := resp[key]; !ok {
+				t.Errorf("status %d: response %s lacks %q", status, rec.Body, key)
+			}
+		}
+	}
+	if n := r.Current().HTTPErrors.Load(); n != 0 {
+		t.Errorf("redirects were counted as HTTP errors: %d", n)
+	}
+}
+
+func TestStatus_SuccessReportsBlockedDestination(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{RotateHTTPErrors: 1, HTTPErrorDedupWindow: time.Nanosecond, DestBlockProxies: 1, DestBlockWindow: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("127.0.0.1:0", p, r, nil, nil)
+
+	var resp struct {
+		Blocked bool `json:"destination_blocked"`
+	}
+	for _, status := range []int{403, 200} {
+		rec := httptest.NewRecorder()
+		body := strings.NewReader(fmt.Sprintf(`{"status": %d, "destination": "shop.example"}`, status))
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/status", body))
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Blocked {
+			t.Errorf("status %d: destination_blocked = false, want true: %s", status, rec.Body)
+		}
+	}
+}
+
+func TestStatus_Duration(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080", "http://5.6.7.8:8080")
+
+	for body, want := range map[string]int{
+		`{"status": 200, "destination": "shop.example", "duration_ms": 800}`: http.StatusOK,
+		`{"status": 200, "destination": "shop.example", "duration_ms": -1}`:  http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/status", strings.NewReader(body)))
+		if rec.Code != want {
+			t.Errorf("%s: code = %d, want %d", body, rec.Code, want)
+		}
+	}
+	if got := proxyToInfo(s.rotator.Current()).Reported; got != 800 {
+		t.Errorf("reported_latency_ms = %d, want 800", got)
+	}
+}
+
+func TestStatus_CanaryReport(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080 canary=5"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{RotateHTTPErrors: 1, HTTPErrorDedupWindow: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("127.0.0.1:0", p, r, nil, nil)
+	stable, canary := p.All()[0], p.All()[1]
+	canary.TotalReqs.Store(4)
+
+	body := fmt.Sprintf(`{"status": 403, "destination": "shop.example", "duration_ms": 900, "proxy_id": %d}`, canary.ID)
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/status", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d", rec.Code)
+	}
+	if r.Current() != stable || stable.HTTPErrors.Load() != 0 {
+		t.Errorf("canary report was charged to the current proxy")
+	}
+	info := proxyToInfo(canary)
+	if info.TotalHTTPErrors != 1 || info.ErrorRate != 0.25 || info.Reported != 900 {
+		t.Errorf("canary total_http_errors = %d, error_rate = %v, reported_latency_ms = %d; want 1, 0.25, 900",
+			info.TotalHTTPErrors, info.ErrorRate, info.Reported)
+	}
+
+	// An ID that is not a canary's is ignored: the report goes to the current proxy.
+	body = fmt.Sprintf(`{"status": 403, "destination": "shop.example", "proxy_id": %d}`, stable.ID)
+	s.server.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/status", strings.NewReader(body)))
+	if stable.TotalHTTPErrors.Load() != 1 || canary.TotalHTTPErrors.Load() != 1 {
+		t.Errorf("report with the stable proxy's ID: stable has %d HTTP errors, canary %d; want 1, 1",
+			stable.TotalHTTPErrors.Load(), canary.TotalHTTPErrors.Load())
+	}
+}
+
+func TestPins(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080", "http://5.6.7.8:8080")
+	px := s.rotator.ProxyFor("shop.example:443")
+	s.rotator.ProxyFor("blog.example:443")
+
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/pins", nil))
+	var list struct {
+		Count int       `json:"count"`
+		Pins  []PinInfo `json:"pins"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Count != 2 || list.Pins[0].Domain != "blog.example" || list.Pins[1].Domain != "shop.example" {
+		t.Errorf("pins = %+v, want blog.example and shop.example", list)
+	}
+
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/pins?domain=Shop.Example", nil))
+	var pin PinInfo
+	if err := json.NewDecoder(rec.Body).Decode(&pin); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || pin.ProxyID != px.ID {
+		t.Errorf("lookup = %d %+v, want 200 and proxy %d", rec.Code, pin, px.ID)
+	}
+
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/pins?domain=other.example", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unpinned lookup: code = %d, want 404", rec.Code)
+	}
+}
+
+func TestPool_CSV(t *testing.T) {
+	s := newTestServer(t, "http://1.2.3.4:8080 group=dc", "socks5://5.6.7.8:1080")
+
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/pool?format=csv", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Content-Type = %q, want text/csv", ct)
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d rows, want header + 2", len(records))
+	}
+	header := records[0]
+	if header[0] != "id" || header[1] != "address" || !contains(header, "group") || !contains(header, "conn_error_rate") {
+		t.Errorf("unexpected header %v", header)
+	}
+	row := map[string]string{}
+	for i, col := range header {
+		row[col] = records[1][i]
+	}
+	if row["address"] != "[ACTIVE] http://1.2.3.4:8080" || row["group"] != "dc" || row["alive"] != "true" {
+		t.Errorf("unexpected first row %v", row)
+	}
+
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/pool?format=xml", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status = %d, want 400", rec.Code)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
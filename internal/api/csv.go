@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// writeCSV writes rows (a slice of structs) as CSV with a header row. Columns
+// are taken from the struct's json tags in field order, so the CSV tracks
+// the JSON representation as fields are added.
+func writeCSV[T any](w http.ResponseWriter, rows []T) {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	var cols []int
+	var header []string
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		cols = append(cols, i)
+		header = append(header, name)
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	_ = cw.Write(header)
+	record := make([]string, len(cols))
+	for _, row := range rows {
+		v := reflect.ValueOf(row)
+		for j, i := range cols {
+			record[j] = csvValue(v.Field(i))
+		}
+		_ = cw.Write(record)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("[api] encode CSV: %v", err)
+	}
+}
+
+// csvValue formats one field the way it appears in JSON.
+func csvValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
@@ -11,13 +11,20 @@
 package monitor
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/drsoft-oss/proxyrotator/internal/pool"
@@ -28,8 +35,37 @@ const (
 	defaultCheckURL     = "http://connectivitycheck.gstatic.com/generate_204"
 	defaultTimeout      = 10 * time.Second
 	defaultConcurrency  = 10
+
+	// maxStatusLine caps how much of the check response is read looking for
+	// the end of its status line.
+	maxStatusLine = 512
+)
+
+// defaultHealthyStatuses are the check URL responses that count as alive
+// when Config.HealthyStatuses is empty.
+var defaultHealthyStatuses = []int{http.StatusOK, http.StatusNoContent}
+
+// probeRetryDelay separates the attempts of a check (see
+// Config.ProbeAttempts). Tests shorten it.
+var probeRetryDelay = time.Second
+
+// Dead reasons recorded on proxies that fail a health check.
+const (
+	// DeadAuthFailed means the upstream rejected our credentials (407):
+	// renew them rather than chase a network problem.
+	DeadAuthFailed = "auth_failed"
+
+	// DeadCheckFailed covers every other failure (refused, timeout, bad
+	// status from the check URL, …).
+	DeadCheckFailed = "check_failed"
+
+	// DeadGeoMismatch means the proxy passed its check but exits in a
+	// country other than its declared country= (see Config.GeoMismatchDead).
+	DeadGeoMismatch = "geo_mismatch"
 )
 
+var errGeoMismatch = errors.New("egress country does not match declared country")
+
 // Config controls health-check behaviour.
 type Config struct {
 	// Interval between full-pool health checks.
@@ -39,20 +75,71 @@ type Config struct {
 	// from the liveness check interval). Zero means "same as Interval".
 	LatencyInterval time.Duration
 
-	// CheckURL is the URL used to probe liveness. A 204 / 200 response
-	// from the target is considered healthy.
+	// CheckURL is the URL used to probe liveness. A response with one of
+	// HealthyStatuses from the target is considered healthy.
 	CheckURL string
 
+	// HealthyStatuses are the status codes of CheckURL that count as alive.
+	// Defaults to 200 and 204.
+	HealthyStatuses []int
+
 	// Timeout per individual proxy check.
 	Timeout time.Duration
 
 	// Concurrency limits how many proxies are checked in parallel.
 	Concurrency int
 
+	// InitialConcurrency replaces Concurrency for the first pass, so a large
+	// pool can be assessed quickly at startup without keeping that load up
+	// afterwards. Zero means "same as Concurrency".
+	InitialConcurrency int
+
+	// ProbeAttempts is how many times a check probes a proxy, probeRetryDelay
+	// apart, before counting it as failed; the first success ends the
+	// check. Each attempt gets its own Timeout. An authentication failure
+	// is not retried. Defaults to 1.
+	ProbeAttempts int
+
+	// MaxRPS caps how many checks a pass starts per second, spacing them
+	// at least 1/MaxRPS apart, to bound probe traffic on metered links.
+	// Zero means no cap. CheckOne is not throttled.
+	MaxRPS float64
+
+	// PassTimeout caps a whole-pool pass. A pass still running at the
+	// deadline is abandoned (and logged) so a stuck check cannot hold up the
+	// next tick. Zero means "same as Interval"; if both are zero there is no
+	// cap.
+	PassTimeout time.Duration
+
 	// UpdateLiveness controls whether dead proxies are removed from the pool.
 	// When false, the monitor still measures latency but does not mark
 	// proxies dead/alive (useful for latency-only updates).
 	UpdateLiveness bool
+
+	// Dialer carries upstream dial options. Nil uses upstream's defaults.
+	Dialer *upstream.Dialer
+
+	// GeoURL, if set, is fetched through every proxy that declares a
+	// country= once it passes its health check. The response body must be
+	// the egress country's two-letter code, as https://ipinfo.io/country
+	// returns it. A failed lookup leaves the proxy's health alone.
+	GeoURL string
+
+	// GeoMismatchDead marks a proxy that exits in another country dead
+	// with DeadGeoMismatch. Otherwise the mismatch is only logged and
+	// reported by the API.
+	GeoMismatchDead bool
+
+	// ResolveHosts looks up the address of every proxy given by host name
+	// on each check and records it (Proxy.SetIP), so rotations can tell
+	// proxies' subnets apart.
+	ResolveHosts bool
+
+	// ASNURL, if set, is fetched through every proxy that passes its health
+	// check and the ASN at the start of the body is recorded
+	// (Proxy.SetEgressASN). https://ipinfo.io/org answers in that form.
+	// A failed lookup leaves the proxy's health alone.
+	ASNURL string
 }
 
 // Monitor orchestrates background health checks.
@@ -60,6 +147,15 @@ type Monitor struct {
 	pool *pool.Pool
 	cfg  Config
 
+	// ranOnce is set by the first RunOnce, the one InitialConcurrency
+	// applies to.
+	ranOnce atomic.Bool
+
+	// now and pause time the MaxRPS spacing of a pass. They are time.Now
+	// and sleep except in tests.
+	now   func() time.Time
+	pause func(ctx context.Context, d time.Duration) bool
+
 	stop chan struct{}
 	wg   sync.WaitGroup
 }
@@ -69,16 +165,31 @@ func New(p *pool.Pool, cfg Config) *Monitor {
 	if cfg.CheckURL == "" {
 		cfg.CheckURL = defaultCheckURL
 	}
+	if len(cfg.HealthyStatuses) == 0 {
+		cfg.HealthyStatuses = defaultHealthyStatuses
+	}
 	if cfg.Timeout == 0 {
 		cfg.Timeout = defaultTimeout
 	}
 	if cfg.Concurrency == 0 {
 		cfg.Concurrency = defaultConcurrency
 	}
+	if cfg.InitialConcurrency == 0 {
+		cfg.InitialConcurrency = cfg.Concurrency
+	}
+	if cfg.ProbeAttempts < 1 {
+		cfg.ProbeAttempts = 1
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = &upstream.Dialer{}
+	}
 	if cfg.LatencyInterval == 0 {
 		cfg.LatencyInterval = cfg.Interval
 	}
-	return &Monitor{pool: p, cfg: cfg, stop: make(chan struct{})}
+	if cfg.PassTimeout == 0 {
+		cfg.PassTimeout = cfg.Interval
+	}
+	return &Monitor{pool: p, cfg: cfg, now: time.Now, pause: sleep, stop: make(chan struct{})}
 }
 
 // Start launches the background monitoring goroutine.
@@ -95,26 +206,85 @@ func (m *Monitor) Stop() {
 
 // RunOnce performs a single health-check pass over the whole pool.
 // Safe to call manually (e.g. on startup before serving traffic).
+// The pass is bounded by PassTimeout; checks still running at the deadline
+// are abandoned and leave their proxy's state untouched.
 func (m *Monitor) RunOnce() {
-	log.Println("[monitor] health check pass started")
+	ctx := context.Background()
+	if m.cfg.PassTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.PassTimeout)
+		defer cancel()
+	}
+
+	concurrency := m.cfg.Concurrency
+	if !m.ranOnce.Swap(true) && m.cfg.InitialConcurrency != concurrency {
+		concurrency = m.cfg.InitialConcurrency
+		log.Printf("[monitor] health check pass started (initial, %d in parallel)", concurrency)
+	} else {
+		log.Println("[monitor] health check pass started")
+	}
 	proxies := m.pool.All()
+	changes := newTransitions()
 
-	sem := make(chan struct{}, m.cfg.Concurrency)
+	sem := make(chan struct{}, concurrency)
 	var wg sync.WaitGroup
+	var gap time.Duration
+	if m.cfg.MaxRPS > 0 {
+		gap = time.Duration(float64(time.Second) / m.cfg.MaxRPS)
+	}
+	var last time.Time
 
+dispatch:
 	for _, px := range proxies {
+		if gap > 0 && !last.IsZero() {
+			if !m.pause(ctx, last.Add(gap).Sub(m.now())) {
+				break dispatch
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		last = m.now()
 		wg.Add(1)
-		sem <- struct{}{}
 		go func(px *pool.Proxy) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			m.check(px)
+			m.check(ctx, px, changes)
 		}(px)
 	}
-	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	changes.summarize()
+	if ctx.Err() != nil {
+		log.Printf("[monitor] health check pass abandoned after %s: %d/%d alive",
+			m.cfg.PassTimeout, m.pool.AliveLen(), m.pool.Len())
+		return
+	}
 	log.Printf("[monitor] health check done: %d/%d alive", m.pool.AliveLen(), m.pool.Len())
 }
 
+// CheckOne runs a health check on the single proxy with the given ID and
+// returns it, or nil if the pool has no such proxy.
+func (m *Monitor) CheckOne(id int64) *pool.Proxy {
+	px := m.pool.Get(id)
+	if px == nil {
+		return nil
+	}
+	m.check(context.Background(), px, nil)
+	return px
+}
+
 // -----------------------------------------------------------------------
 // Internal
 // -----------------------------------------------------------------------
@@ -134,25 +304,56 @@ func (m *Monitor) loop() {
 }
 
 // check probes a single proxy and updates its alive/latency fields.
-func (m *Monitor) check(px *pool.Proxy) {
-	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
-	defer cancel()
+// passCtx is the enclosing pass; if it ends first the result is discarded.
+// Liveness changes are logged through changes, nil outside a pass.
+func (m *Monitor) check(passCtx context.Context, px *pool.Proxy, changes *transitions) {
+	if m.cfg.ResolveHosts && px.NeedsResolve() {
+		ctx, cancel := context.WithTimeout(passCtx, m.cfg.Timeout)
+		m.resolve(ctx, px)
+		cancel()
+	}
+	latency, err := m.probeAttempts(passCtx, px)
+	if err == nil && m.cfg.ASNURL != "" {
+		ctx, cancel := context.WithTimeout(passCtx, m.cfg.Timeout)
+		m.checkASN(ctx, px)
+		cancel()
+	}
+	if err == nil && m.cfg.GeoURL != "" && px.Country != "" {
+		ctx, cancel := context.WithTimeout(passCtx, m.cfg.Timeout)
+		m.checkCountry(ctx, px)
+		cancel()
+		if m.cfg.GeoMismatchDead && px.CountryMismatch() {
+			err = errGeoMismatch
+		}
+	}
 
-	start := time.Now()
-	err := m.probe(ctx, px)
-	latency := time.Since(start)
+	if passCtx.Err() != nil {
+		// The pass was abandoned — the failure says nothing about the proxy.
+		return
+	}
 
 	if err != nil {
 		if m.cfg.UpdateLiveness {
-			if px.IsAlive() {
-				log.Printf("[monitor] proxy DEAD %s: %v", px.String(), err)
+			reason := DeadCheckFailed
+			switch {
+			case errors.Is(err, upstream.ErrProxyAuth):
+				reason = DeadAuthFailed
+			case errors.Is(err, errGeoMismatch):
+				reason = DeadGeoMismatch
+			}
+			if px.IsAlive() || px.DeadReason() != reason {
+				if reason == DeadAuthFailed {
+					changes.record("failed authentication", px, fmt.Sprintf("[monitor] proxy AUTH FAILED %s: %v", px.String(), err))
+				} else {
+					changes.record("went dead", px, fmt.Sprintf("[monitor] proxy DEAD %s: %v", px.String(), err))
+				}
 			}
-			px.SetAlive(false)
+			px.MarkDead(reason)
 		}
 		px.SetLatency(0)
 	} else {
 		if m.cfg.UpdateLiveness && !px.IsAlive() {
-			log.Printf("[monitor] proxy RECOVERED %s (latency=%s)", px.String(), latency.Round(time.Millisecond))
+			changes.record("recovered", px, fmt.Sprintf("[monitor] proxy RECOVERED %s (latency=%s)", px.String(), latency.Round(time.Millisecond)))
 		}
 		if m.cfg.UpdateLiveness {
 			px.SetAlive(true)
@@ -161,6 +362,24 @@ func (m *Monitor) check(px *pool.Proxy) {
 	}
 }
 
+// probeAttempts probes px up to ProbeAttempts times and returns the latency
+// and error of the last attempt.
+func (m *Monitor) probeAttempts(passCtx context.Context, px *pool.Proxy) (time.Duration, error) {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(passCtx, m.cfg.Timeout)
+		start := time.Now()
+		err := m.probe(ctx, px)
+		latency := time.Since(start)
+		cancel()
+		if err == nil || attempt >= m.cfg.ProbeAttempts || errors.Is(err, upstream.ErrProxyAuth) {
+			return latency, err
+		}
+		if !sleep(passCtx, probeRetryDelay) {
+			return latency, err
+		}
+	}
+}
+
 // probe dials through the proxy and issues a lightweight HTTP request.
 func (m *Monitor) probe(ctx context.Context, px *pool.Proxy) error {
 	// Determine destination from the check URL
@@ -178,11 +397,14 @@ func (m *Monitor) probe(ctx context.Context, px *pool.Proxy) error {
 	}
 
 	// Dial through the proxy
-	conn, err := upstream.Dial(ctx, px.URL, host)
+	conn, err := m.cfg.Dialer.Dial(ctx, px.URL, host)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
 
 	// Send a minimal HTTP/1.1 request and read the status line
 	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n",
@@ -191,16 +413,135 @@ func (m *Monitor) probe(ctx context.Context, px *pool.Proxy) error {
 		return fmt.Errorf("write request: %w", err)
 	}
 
-	// Read just enough to get the status code
-	buf := make([]byte, 32)
-	n, _ := conn.Read(buf)
-	if n < 9 {
-		return fmt.Errorf("short response (%d bytes)", n)
+	code, err := readStatus(conn)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(m.cfg.HealthyStatuses, code) {
+		return fmt.Errorf("check URL returned %d", code)
 	}
-	_ = http.StatusOK // keep import
 	return nil
 }
 
+// readStatus reads an HTTP response's status line from r, up to the first
+// CRLF, and returns its status code.
+func readStatus(r io.Reader) (int, error) {
+	line, err := bufio.NewReader(io.LimitReader(r, maxStatusLine)).ReadString('\n')
+	if err != nil {
+		if len(line) == maxStatusLine {
+			return 0, fmt.Errorf("status line longer than %d bytes", maxStatusLine)
+		}
+		return 0, fmt.Errorf("short response (%d bytes): %w", len(line), err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	proto, rest, _ := strings.Cut(line, " ")
+	codeStr, _, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeStr)
+	if !strings.HasPrefix(proto, "HTTP/") || len(codeStr) != 3 || err != nil || code < 100 {
+		return 0, fmt.Errorf("malformed status line %q", line)
+	}
+	return code, nil
+}
+
+// checkCountry looks up px's egress country and records it, logging when
+// the proxy starts exiting somewhere other than its declared country.
+func (m *Monitor) checkCountry(ctx context.Context, px *pool.Proxy) {
+	code, err := m.egressCountry(ctx, px)
+	if err != nil {
+		log.Printf("[monitor] geo check %s: %v", px.String(), err)
+		return
+	}
+	prev := px.EgressCountry()
+	px.SetEgressCountry(code)
+	if px.CountryMismatch() && code != prev {
+		log.Printf("[monitor] proxy %s exits in %s, declared %s", px.String(), code, px.Country)
+	}
+}
+
+// egressCountry fetches GeoURL through px and returns the country code in
+// the response body.
+func (m *Monitor) egressCountry(ctx context.Context, px *pool.Proxy) (string, error) {
+	code, err := m.fetchThrough(ctx, px, "geo", m.cfg.GeoURL)
+	if err != nil {
+		return "", err
+	}
+	if len(code) != 2 {
+		return "", fmt.Errorf("geo URL returned %q, want a two-letter country code", code)
+	}
+	return strings.ToUpper(code), nil
+}
+
+// resolve looks up px's host name and records the first address.
+func (m *Monitor) resolve(ctx context.Context, px *pool.Proxy) {
+	host, _, err := net.SplitHostPort(px.Host)
+	if err != nil {
+		host = px.Host
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		log.Printf("[monitor] resolve %s: %v", px.String(), err)
+		return
+	}
+	px.SetIP(addrs[0].IP)
+}
+
+// checkASN looks up the ASN px exits from and records it.
+func (m *Monitor) checkASN(ctx context.Context, px *pool.Proxy) {
+	body, err := m.fetchThrough(ctx, px, "ASN", m.cfg.ASNURL)
+	if err == nil {
+		var asn string
+		if asn, err = pool.ParseASN(body); err == nil {
+			px.SetEgressASN(asn)
+			return
+		}
+	}
+	log.Printf("[monitor] ASN check %s: %v", px.String(), err)
+}
+
+// fetchThrough GETs rawURL through px and returns the start of the body,
+// trimmed. name labels the URL in errors.
+func (m *Monitor) fetchThrough(ctx context.Context, px *pool.Proxy, name, rawURL string) (string, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return m.cfg.Dialer.Dial(ctx, px.URL, addr)
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("bad %s URL: %w", name, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s URL returned %s", name, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", fmt.Errorf("read %s response: %w", name, err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// sleep waits for d or until ctx is done, reporting whether the full wait
+// elapsed.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func hasPort(host string) bool {
 	_, _, err := net.SplitHostPort(host)
 	return err == nil
@@ -0,0 +1,319 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// fakeUpstream starts an HTTP proxy that accepts any CONNECT and answers
+// the request sent through the tunnel with response. It returns the proxy
+// as the only member of a pool.
+func fakeUpstream(t *testing.T, response string) *pool.Proxy {
+	t.Helper()
+	return fakeUpstreamFunc(t, func(int) string { return response })
+}
+
+// fakeUpstreamFunc is fakeUpstream answering the nth request through it
+// (from 1) with respond(n).
+func fakeUpstreamFunc(t *testing.T, respond func(n int) string) *pool.Proxy {
+	t.Helper()
+	return fakeUpstreamMeta(t, "", func(n int, _ *http.Request) string { return respond(n) })
+}
+
+// fakeUpstreamMeta is fakeUpstreamFunc with metadata (e.g. "country=DE")
+// on the proxy's line, answering each request with respond(n, req).
+func fakeUpstreamMeta(t *testing.T, meta string, respond func(n int, req *http.Request) string) *pool.Proxy {
+	t.Helper()
+	var served atomic.Int32
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				io.WriteString(conn, respond(int(served.Add(1)), req))
+			}()
+		}
+	}()
+
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{strings.TrimSpace("http://" + ln.Addr().String() + " " + meta)}); err != nil {
+		t.Fatal(err)
+	}
+	return p.All()[0]
+}
+
+func TestProbe_HealthyStatuses(t *testing.T) {
+	cases := []struct {
+		name     string
+		response string
+		healthy  []int
+		wantErr  string
+	}{
+		{"204", "HTTP/1.1 204 No Content\r\n\r\n", nil, ""},
+		{"200", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", nil, ""},
+		{"403", "HTTP/1.1 403 Forbidden\r\n\r\n", nil, "returned 403"},
+		{"403 allowed", "HTTP/1.1 403 Forbidden\r\n\r\n", []int{403}, ""},
+		{"200 not allowed", "HTTP/1.1 200 OK\r\n\r\n", []int{204}, "returned 200"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			px := fakeUpstream(t, tc.response)
+			m := New(nil, Config{CheckURL: "http://check.example/generate_204", HealthyStatuses: tc.healthy})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := m.probe(ctx, px)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("probe: %v, want healthy", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("probe: %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheck_ProbeAttempts(t *testing.T) {
+	defer func(d time.Duration) { probeRetryDelay = d }(probeRetryDelay)
+	probeRetryDelay = 10 * time.Millisecond
+
+	const attempts = 3
+	cases := []struct {
+		name      string
+		failures  int
+		wantAlive bool
+	}{
+		{"recovers on the last attempt", attempts - 1, true},
+		{"fails every attempt", attempts, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var probes atomic.Int32
+			px := fakeUpstreamFunc(t, func(n int) string {
+				probes.Add(1)
+				if n <= tc.failures {
+					return "HTTP/1.1 503 Service Unavailable\r\n\r\n"
+				}
+				return "HTTP/1.1 204 No Content\r\n\r\n"
+			})
+			m := New(nil, Config{
+				CheckURL:       "http://check.example/generate_204",
+				Timeout:        2 * time.Second,
+				ProbeAttempts:  attempts,
+				UpdateLiveness: true,
+			})
+			m.check(context.Background(), px, nil)
+			if px.IsAlive() != tc.wantAlive {
+				t.Errorf("alive = %v after %d failed probes of %d, want %v", px.IsAlive(), tc.failures, attempts, tc.wantAlive)
+			}
+			if want := min(tc.failures+1, attempts); int(probes.Load()) != want {
+				t.Errorf("probed %d times, want %d", probes.Load(), want)
+			}
+		})
+	}
+}
+
+func TestCheck_GeoCountry(t *testing.T) {
+	cases := []struct {
+		name         string
+		geoBody      string
+		mismatchDead bool
+		wantEgress   string
+		wantAlive    bool
+		wantLog      string
+	}{
+		{"matches", "de\n", false, "DE", true, ""},
+		{"mismatch logged", "FR", false, "FR", true, "exits in FR, declared DE"},
+		{"mismatch dead", "FR", true, "FR", false, "exits in FR, declared DE"},
+		{"bad answer", "Germany", false, "", true, "want a two-letter country code"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			px := fakeUpstreamMeta(t, "country=DE", func(_ int, req *http.Request) string {
+				if req.URL.Path == "/country" {
+					return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(tc.geoBody), tc.geoBody)
+				}
+				return "HTTP/1.1 204 No Content\r\n\r\n"
+			})
+			m := New(nil, Config{
+				CheckURL:        "http://check.example/generate_204",
+				GeoURL:          "http://geo.example/country",
+				GeoMismatchDead: tc.mismatchDead,
+				Timeout:         2 * time.Second,
+				UpdateLiveness:  true,
+			})
+			var logs strings.Builder
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			m.check(context.Background(), px, nil)
+			if got := px.EgressCountry(); got != tc.wantEgress {
+				t.Errorf("egress country = %q, want %q", got, tc.wantEgress)
+			}
+			if px.IsAlive() != tc.wantAlive {
+				t.Errorf("alive = %v, want %v", px.IsAlive(), tc.wantAlive)
+			}
+			if !tc.wantAlive && px.DeadReason() != DeadGeoMismatch {
+				t.Errorf("dead reason = %q, want %q", px.DeadReason(), DeadGeoMismatch)
+			}
+			if out := logs.String(); tc.wantLog != "" && !strings.Contains(out, tc.wantLog) {
+				t.Errorf("log lacks %q:\n%s", tc.wantLog, out)
+			} else if tc.wantLog == "" && strings.Contains(out, "exits in") {
+				t.Errorf("unexpected mismatch log:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestRunOnce_MaxRPS(t *testing.T) {
+	const (
+		proxies = 5
+		rps     = 20
+		gap     = time.Second / rps
+	)
+	var reached atomic.Int64
+	uris := make([]string, 0, proxies)
+	for i := 0; i < proxies; i++ {
+		px := fakeUpstreamFunc(t, func(int) string {
+			reached.Add(1)
+			return "HTTP/1.1 204 No Content\r\n\r\n"
+		})
+		uris = append(uris, px.URL.String())
+	}
+	p := pool.New(false)
+	if err := p.LoadProxies(uris); err != nil {
+		t.Fatal(err)
+	}
+	m := New(p, Config{
+		CheckURL:    "http://check.example/generate_204",
+		Timeout:     2 * time.Second,
+		Concurrency: proxies,
+		MaxRPS:      rps,
+	})
+	// A fake clock that only moves when the pass pauses, so the spacing is
+	// exact however slowly the checks themselves run.
+	clock := time.Unix(0, 0)
+	var pauses []time.Duration
+	m.now = func() time.Time { return clock }
+	m.pause = func(_ context.Context, d time.Duration) bool {
+		pauses = append(pauses, d)
+		clock = clock.Add(d)
+		return true
+	}
+
+	m.RunOnce()
+
+	if n := reached.Load(); n != proxies {
+		t.Fatalf("%d checks reached the upstreams, want %d", n, proxies)
+	}
+	if len(pauses) != proxies-1 {
+		t.Fatalf("pass paused %d times, want %d: %v", len(pauses), proxies-1, pauses)
+	}
+	for i, d := range pauses {
+		if d != gap {
+			t.Errorf("pause before check %d = %s, want %s", i+2, d, gap)
+		}
+	}
+}
+
+func TestRunOnce_InitialConcurrency(t *testing.T) {
+	const (
+		proxies = 8
+		initial = 4
+		steady  = 2
+	)
+	var inflight, peak atomic.Int32
+	uris := make([]string, 0, proxies)
+	for i := 0; i < proxies; i++ {
+		px := fakeUpstreamFunc(t, func(int) string {
+			n := inflight.Add(1)
+			for {
+				if top := peak.Load(); n <= top || peak.CompareAndSwap(top, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			inflight.Add(-1)
+			return "HTTP/1.1 204 No Content\r\n\r\n"
+		})
+		uris = append(uris, px.URL.String())
+	}
+	p := pool.New(false)
+	if err := p.LoadProxies(uris); err != nil {
+		t.Fatal(err)
+	}
+	m := New(p, Config{
+		CheckURL:           "http://check.example/generate_204",
+		Timeout:            2 * time.Second,
+		Concurrency:        steady,
+		InitialConcurrency: initial,
+	})
+
+	m.RunOnce()
+	if got := peak.Load(); got <= steady || got > initial {
+		t.Errorf("first pass ran %d checks at once, want more than %d and at most %d", got, steady, initial)
+	}
+	peak.Store(0)
+	m.RunOnce()
+	if got := peak.Load(); got > steady {
+		t.Errorf("second pass ran %d checks at once, want at most %d", got, steady)
+	}
+}
+
+func TestReadStatus(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    int
+		wantErr string
+	}{
+		{"HTTP/1.1 204 No Content\r\n", 204, ""},
+		{"HTTP/1.0 200\r\n", 200, ""},
+		{"HTTP/1.1 404 Not Found\n", 404, ""},
+		{"", 0, "short response (0 bytes)"},
+		{"HTTP/1.1 20", 0, "short response (11 bytes)"},
+		{"SSH-2.0-OpenSSH_9.6\r\n", 0, "malformed"},
+		{"HTTP/1.1 2x4 OK\r\n", 0, "malformed"},
+		{"HTTP/1.1 2040 OK\r\n", 0, "malformed"},
+		{"HTTP/1.1 " + strings.Repeat("9", maxStatusLine), 0, "longer than"},
+	}
+	for _, tc := range cases {
+		got, err := readStatus(strings.NewReader(tc.in))
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("readStatus(%q) = %d, %v; want error containing %q", tc.in, got, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("readStatus(%q) = %d, %v; want %d", tc.in, got, err, tc.want)
+		}
+	}
+}
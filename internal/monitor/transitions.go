@@ -0,0 +1,107 @@
+package monitor
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// When a whole provider goes down, hundreds of proxies die in the same
+// pass. A pass therefore logs only the first few state changes of each kind
+// one line per proxy, and sums the rest up per provider when it ends.
+
+// transitionLogBurst is how many proxies a pass logs individually for each
+// kind of state change before it only counts them.
+const transitionLogBurst = 5
+
+// summaryProviders is how many providers a summary line names.
+const summaryProviders = 5
+
+// transitions collects the liveness changes of one pass. A nil
+// *transitions logs every change, as CheckOne does.
+type transitions struct {
+	mu     sync.Mutex
+	kinds  []string                  // in order of first occurrence
+	logged map[string]int            // kind → lines logged individually
+	counts map[string]map[string]int // kind → provider → proxies
+}
+
+func newTransitions() *transitions {
+	return &transitions{logged: make(map[string]int), counts: make(map[string]map[string]int)}
+}
+
+// record notes that px went through a change of the given kind ("went
+// dead", "recovered", …) and logs line unless the pass has already logged
+// transitionLogBurst of them.
+func (t *transitions) record(kind string, px *pool.Proxy, line string) {
+	if t == nil {
+		log.Print(line)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byProvider, ok := t.counts[kind]
+	if !ok {
+		byProvider = make(map[string]int)
+		t.counts[kind] = byProvider
+		t.kinds = append(t.kinds, kind)
+	}
+	byProvider[provider(px)]++
+	if t.logged[kind] < transitionLogBurst {
+		t.logged[kind]++
+		log.Print(line)
+	}
+}
+
+// summarize logs one line per kind of change that was not logged in full,
+// e.g. "[monitor] 45 proxies went dead this pass: residential 40, gw.example.com 5 (5 logged above)".
+func (t *transitions) summarize() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, kind := range t.kinds {
+		byProvider := t.counts[kind]
+		total := 0
+		providers := make([]string, 0, len(byProvider))
+		for p, n := range byProvider {
+			total += n
+			providers = append(providers, p)
+		}
+		if total <= t.logged[kind] {
+			continue
+		}
+		sort.Slice(providers, func(i, j int) bool {
+			a, b := providers[i], providers[j]
+			if byProvider[a] != byProvider[b] {
+				return byProvider[a] > byProvider[b]
+			}
+			return a < b
+		})
+		parts := make([]string, 0, summaryProviders+1)
+		for i, p := range providers {
+			if i == summaryProviders {
+				parts = append(parts, fmt.Sprintf("%d others", len(providers)-i))
+				break
+			}
+			parts = append(parts, fmt.Sprintf("%s %d", p, byProvider[p]))
+		}
+		log.Printf("[monitor] %d proxies %s this pass: %s (%d logged above)",
+			total, kind, strings.Join(parts, ", "), t.logged[kind])
+	}
+}
+
+// provider names where px comes from for a summary: its group, or else the
+// host it connects to, which gateway-style providers share across proxies.
+func provider(px *pool.Proxy) string {
+	if px.Group != "" {
+		return px.Group
+	}
+	if host, _, err := net.SplitHostPort(px.Host); err == nil {
+		return host
+	}
+	return px.Host
+}
@@ -0,0 +1,43 @@
+package pool
+
+// Request budgets model providers that burn an IP after a fixed number of
+// requests: a proxy with max-requests=N metadata takes N connections and
+// then reports no capacity, so selection passes it over, until ResetBudget.
+// The budget is claimed in AcquireConn, which keeps concurrent connections
+// from overshooting it; a connection whose dial then fails still counts.
+
+// claimBudget takes one request from the budget, returning false if it is
+// used up. Proxies without MaxRequests always succeed.
+func (p *Proxy) claimBudget() bool {
+	if p.MaxRequests == 0 {
+		return true
+	}
+	for {
+		n := p.budgetUsed.Load()
+		if n >= p.MaxRequests {
+			return false
+		}
+		if p.budgetUsed.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// BudgetUsed returns how many requests have been taken from the proxy's
+// max-requests budget since it was loaded or last reset.
+func (p *Proxy) BudgetUsed() int64 {
+	return p.budgetUsed.Load()
+}
+
+// Exhausted reports whether the proxy has a max-requests budget and has
+// used all of it.
+func (p *Proxy) Exhausted() bool {
+	return p.MaxRequests > 0 && p.budgetUsed.Load() >= p.MaxRequests
+}
+
+// ResetBudget gives the proxy its full max-requests budget back, e.g. once
+// the provider has assigned it a fresh IP.
+func (p *Proxy) ResetBudget() {
+	p.budgetUsed.Store(0)
+	p.notifyChanged()
+}
@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAcquireConn_RequestBudget(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080 max-requests=10"}); err != nil {
+		t.Fatal(err)
+	}
+	px := p.All()[0]
+	if px.MaxRequests != 10 {
+		t.Fatalf("MaxRequests = %d, want 10", px.MaxRequests)
+	}
+
+	// Releasing a connection does not give its request back.
+	var wg sync.WaitGroup
+	var acquired atomic.Int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if px.AcquireConn() {
+				acquired.Add(1)
+				px.ReleaseConn()
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired.Load() != 10 || px.BudgetUsed() != 10 {
+		t.Fatalf("acquired %d connections (budget used %d), want exactly 10", acquired.Load(), px.BudgetUsed())
+	}
+	if !px.Exhausted() || px.HasCapacity() {
+		t.Error("a proxy with its budget used up should be exhausted and have no capacity")
+	}
+	if px.ActiveConns.Load() != 0 {
+		t.Errorf("ActiveConns = %d after a refused claim, want 0", px.ActiveConns.Load())
+	}
+
+	px.ResetBudget()
+	if px.Exhausted() || !px.AcquireConn() {
+		t.Error("AcquireConn should succeed after ResetBudget")
+	}
+}
+
+func TestLoadProxies_BadMaxRequests(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080 max-requests=0"}); err != nil {
+		t.Fatal(err)
+	}
+	if p.Len() != 1 {
+		t.Fatalf("max-requests=0 should be rejected, pool has %d entries", p.Len())
+	}
+}
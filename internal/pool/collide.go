@@ -0,0 +1,71 @@
+package pool
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The same box listed under two schemes (http://1.2.3.4:8080 and
+// socks5://1.2.3.4:8080) has one egress IP, so rotating between the two
+// entries changes nothing a destination can see.
+
+// SetPreferredScheme makes LoadProxies, LoadFile and Reload keep only the
+// entries with this scheme for any host:port that is listed under several
+// schemes including it. Empty keeps every entry.
+func (p *Pool) SetPreferredScheme(scheme string) {
+	p.mu.Lock()
+	p.preferScheme = strings.ToLower(scheme)
+	p.mu.Unlock()
+}
+
+// SchemeCollisions returns the groups of proxies that share a host:port
+// under different schemes, in list order.
+func (p *Pool) SchemeCollisions() [][]*Proxy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	byHost := make(map[string][]*Proxy)
+	var order []string
+	for _, px := range p.proxies {
+		h := strings.ToLower(px.Host)
+		if _, ok := byHost[h]; !ok {
+			order = append(order, h)
+		}
+		byHost[h] = append(byHost[h], px)
+	}
+
+	var out [][]*Proxy
+	for _, h := range order {
+		group := byHost[h]
+		for _, px := range group[1:] {
+			if px.Scheme != group[0].Scheme {
+				out = append(out, group)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// preferScheme drops entries whose host:port is also listed with scheme.
+func preferScheme(proxies []*Proxy, scheme string) []*Proxy {
+	if scheme == "" {
+		return proxies
+	}
+	preferred := make(map[string]bool)
+	for _, px := range proxies {
+		if px.Scheme == scheme {
+			preferred[strings.ToLower(px.Host)] = true
+		}
+	}
+	out := proxies[:0:0]
+	for _, px := range proxies {
+		if px.Scheme != scheme && preferred[strings.ToLower(px.Host)] {
+			fmt.Fprintf(os.Stderr, "warn: skip %s: %s is also listed as %s\n", px, px.Host, scheme)
+			continue
+		}
+		out = append(out, px)
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+package pool
+
+import "testing"
+
+func TestSchemeCollisions(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{
+		"http://1.2.3.4:8080",
+		"http://5.6.7.8:8080",
+		"socks5://1.2.3.4:8080",
+		"http://5.6.7.8:8080", // plain duplicate, same scheme: not a collision
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got := p.SchemeCollisions()
+	if len(got) != 1 || len(got[0]) != 2 {
+		t.Fatalf("expected one collision of two entries, got %v", got)
+	}
+	if got[0][0].Scheme != "http" || got[0][1].Scheme != "socks5" {
+		t.Errorf("unexpected collision %v", got[0])
+	}
+}
+
+func TestSetPreferredScheme(t *testing.T) {
+	p := New(false)
+	p.SetPreferredScheme("socks5")
+	if err := p.LoadProxies([]string{
+		"http://1.2.3.4:8080",
+		"socks5://1.2.3.4:8080",
+		"http://5.6.7.8:8080",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	all := p.All()
+	if len(all) != 2 {
+		t.Fatalf("expected 2 proxies, got %d", len(all))
+	}
+	if all[0].Scheme != "socks5" || all[1].Host != "5.6.7.8:8080" {
+		t.Errorf("unexpected pool %v", all)
+	}
+	if c := p.SchemeCollisions(); len(c) != 0 {
+		t.Errorf("expected no collisions left, got %v", c)
+	}
+}
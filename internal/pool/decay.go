@@ -0,0 +1,117 @@
+package pool
+
+import (
+	"math"
+	"time"
+)
+
+// Health decay (see Pool.SetHealthDecay) replaces the per-sample moving
+// averages and the lifetime error rate with averages in which each event's
+// weight halves every half-life. Bursts of events count equally among
+// themselves, and history fades smoothly instead of falling off the end of
+// a fixed window.
+
+// decayedMean is an exponentially time-decayed average.
+type decayedMean struct {
+	value  float64
+	weight float64 // decayed number of samples behind value
+	at     time.Time
+}
+
+// add folds x, observed at now, into the average after decaying the weight
+// of everything before it by the time elapsed since the previous sample.
+func (m *decayedMean) add(x float64, now time.Time, halfLife time.Duration) {
+	m.addCapped(x, now, halfLife, math.Inf(1))
+}
+
+// addCapped is add with the decayed weight of the earlier samples capped at
+// maxWeight, so a new sample always moves the average at least
+// 1/(maxWeight+1) of the way. Without a cap, a proxy busy enough to pile up
+// thousands of samples per half-life has an average that barely reacts.
+func (m *decayedMean) addCapped(x float64, now time.Time, halfLife time.Duration, maxWeight float64) {
+	if m.weight > 0 {
+		if dt := now.Sub(m.at); dt > 0 {
+			m.weight *= math.Exp2(-float64(dt) / float64(halfLife))
+		}
+	}
+	m.weight = math.Min(m.weight, maxWeight) + 1
+	m.value += (x - m.value) / m.weight
+	m.at = now
+}
+
+// flip turns the latest of the samples behind the average from 0 into 1,
+// for a success found out afterwards to have failed. Without a sample to
+// turn, it adds a 1.
+func (m *decayedMean) flip(now time.Time, halfLife time.Duration) {
+	if m.weight < 1 {
+		m.add(1, now, halfLife)
+		return
+	}
+	m.value = math.Min(m.value+1/m.weight, 1)
+}
+
+// SetHealthDecay sets the half-life of the proxies' rolling health signals:
+// the connection error rate (ErrorRate), the response latency and the
+// client-reported latency. An event a half-life old weighs half as much as
+// one happening now; the latencies still give each new sample at least the
+// weight it has without decay. Zero keeps the defaults: a lifetime error
+// rate and moving averages weighted per sample. Proxies loaded afterwards,
+// including by Reload, use the same half-life.
+func (p *Pool) SetHealthDecay(halfLife time.Duration) {
+	p.mu.Lock()
+	p.healthDecay = halfLife
+	proxies := p.proxies
+	p.mu.Unlock()
+	for _, px := range proxies {
+		px.setHealthDecay(halfLife)
+	}
+}
+
+func (p *Proxy) setHealthDecay(halfLife time.Duration) {
+	p.mu.Lock()
+	p.healthDecay = halfLife
+	p.mu.Unlock()
+}
+
+// RecordOutcome feeds one completed request (failed false) or connection
+// error (failed true) into the decayed error rate. It is a no-op without a
+// health decay; the lifetime counters are kept by the caller either way.
+func (p *Proxy) RecordOutcome(failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.healthDecay <= 0 {
+		return
+	}
+	x := 0.0
+	if failed {
+		x = 1
+	}
+	now := time.Now()
+	p.errDecay.add(x, now, p.healthDecay)
+	if !failed {
+		p.httpDecay.add(0, now, p.healthDecay)
+	}
+}
+
+// decayedErrorRate returns the decayed error rate, or false if health decay
+// is off.
+func (p *Proxy) decayedErrorRate() (float64, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.healthDecay <= 0 {
+		return 0, false
+	}
+	return p.errDecay.value, true
+}
+
+// decayedRates returns the decayed connection error rate and the decayed
+// share of completed requests with an HTTP error, or false if health decay
+// is off.
+func (p *Proxy) decayedRates() (conn, http float64, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.healthDecay <= 0 {
+		return 0, 0, false
+	}
+	return p.errDecay.value, p.httpDecay.value, true
+}
@@ -0,0 +1,89 @@
+package pool
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDecayedMean(t *testing.T) {
+	var m decayedMean
+	t0 := time.Now()
+	m.add(1, t0, time.Minute)
+	m.add(0, t0.Add(time.Minute), time.Minute)
+	// The first sample has halved to weight 0.5 against the second's 1.
+	if want := 1.0 / 3; math.Abs(m.value-want) > 1e-9 {
+		t.Errorf("value = %v, want %v", m.value, want)
+	}
+
+	// Samples at the same instant weigh equally.
+	var burst decayedMean
+	for _, x := range []float64{1, 0, 0, 1} {
+		burst.add(x, t0, time.Minute)
+	}
+	if burst.value != 0.5 {
+		t.Errorf("burst value = %v, want 0.5", burst.value)
+	}
+}
+
+func TestSetHealthDecay_ErrorRate(t *testing.T) {
+	p := New(false)
+	p.SetHealthDecay(time.Hour)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	px := p.All()[0]
+	px.TotalReqs.Add(99) // lifetime counters no longer drive the rate
+	px.RecordOutcome(true)
+	px.RecordOutcome(false)
+	if got := px.ErrorRate(); math.Abs(got-0.5) > 1e-3 {
+		t.Errorf("decayed ErrorRate = %v, want 0.5", got)
+	}
+
+	p.SetHealthDecay(0)
+	if got := px.ErrorRate(); got != 0 {
+		t.Errorf("lifetime ErrorRate = %v, want 0", got)
+	}
+}
+
+func TestSetHealthDecay_WeightedErrorRate(t *testing.T) {
+	p := New(false)
+	p.SetHealthDecay(time.Hour)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	px := p.All()[0]
+	for i := 0; i < 4; i++ {
+		px.RecordOutcome(false)
+	}
+	px.RecordHTTPError() // one of the four turns out to have failed
+	if got := px.WeightedErrorRate(1, 1); math.Abs(got-0.25) > 1e-3 {
+		t.Errorf("decayed WeightedErrorRate = %v, want 0.25", got)
+	}
+	if got := px.ErrorRate(); got != 0 {
+		t.Errorf("decayed ErrorRate = %v, want 0 without connection errors", got)
+	}
+}
+
+func TestSetHealthDecay_LatencyKeepsMoving(t *testing.T) {
+	p := New(false)
+	p.SetHealthDecay(time.Hour)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	px := p.All()[0]
+	for i := 0; i < 1000; i++ {
+		px.RecordResponseLatency(100 * time.Millisecond)
+		px.RecordReportedLatency(100 * time.Millisecond)
+	}
+	// However many samples came before, a slowdown moves the average by at
+	// least responseLatencyWeight of the way.
+	px.RecordResponseLatency(1100 * time.Millisecond)
+	px.RecordReportedLatency(1100 * time.Millisecond)
+	if got, _ := px.ResponseLatency(); got < 299*time.Millisecond {
+		t.Errorf("response latency = %v after a slow sample, want ≥ 300ms", got)
+	}
+	if got, _ := px.ReportedLatency(); got < 299*time.Millisecond {
+		t.Errorf("reported latency = %v after a slow sample, want ≥ 300ms", got)
+	}
+}
@@ -0,0 +1,94 @@
+package pool
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Where a proxy sits on the network, for rotations that want the next
+// proxy to look unrelated to the last one: its IP (a literal in the proxy
+// line, or resolved by the monitor) and its ASN (asn= metadata, or looked up
+// by the monitor through the proxy).
+
+// parseASN normalises an autonomous system number given as "AS15169",
+// "as15169" or "15169" to "AS15169".
+func parseASN(s string) (string, error) {
+	digits := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "AS")
+	if n, err := strconv.ParseUint(digits, 10, 32); err != nil || n == 0 {
+		return "", fmt.Errorf("bad asn %q (want e.g. AS15169)", s)
+	}
+	return "AS" + digits, nil
+}
+
+// ParseASN extracts the ASN from the start of s, as returned by ipinfo.io's
+// /org endpoint ("AS15169 Google LLC").
+func ParseASN(s string) (string, error) {
+	first, _, _ := strings.Cut(strings.TrimSpace(s), " ")
+	return parseASN(first)
+}
+
+// SetIP records the address the proxy's host name resolved to.
+func (p *Proxy) SetIP(ip net.IP) {
+	p.mu.Lock()
+	p.resolvedIP = ip
+	p.mu.Unlock()
+}
+
+// IP returns the proxy's address: the host itself if it is an IP literal,
+// otherwise what SetIP last recorded, or nil if it has not been resolved.
+func (p *Proxy) IP() net.IP {
+	host, _, err := net.SplitHostPort(p.Host)
+	if err != nil {
+		host = p.Host
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.resolvedIP
+}
+
+// NeedsResolve reports whether the proxy's host is a name rather than an IP.
+func (p *Proxy) NeedsResolve() bool {
+	host, _, err := net.SplitHostPort(p.Host)
+	if err != nil {
+		host = p.Host
+	}
+	return net.ParseIP(host) == nil
+}
+
+// Subnet returns the /24 (IPv4) or /48 (IPv6) network of the proxy's IP,
+// or "" if the IP is not known.
+func (p *Proxy) Subnet() string {
+	ip := p.IP()
+	if ip == nil {
+		return ""
+	}
+	bits := 48
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 24
+	}
+	n := net.IPNet{IP: ip.Mask(net.CIDRMask(bits, len(ip)*8)), Mask: net.CIDRMask(bits, len(ip)*8)}
+	return n.String()
+}
+
+// SetEgressASN records the ASN the proxy was last seen exiting from.
+func (p *Proxy) SetEgressASN(asn string) {
+	p.mu.Lock()
+	p.egressASN = asn
+	p.mu.Unlock()
+}
+
+// NetworkASN returns the ASN the monitor last saw the proxy exit from,
+// falling back to the declared asn=, or "" if neither is known.
+func (p *Proxy) NetworkASN() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.egressASN != "" {
+		return p.egressASN
+	}
+	return p.ASN
+}
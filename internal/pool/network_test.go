@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSubnet(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{
+		"http://10.1.2.3:8080",
+		"http://[2001:db8:1:2::5]:8080",
+		"http://proxy.example:8080",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	all := p.All()
+	if got := all[0].Subnet(); got != "10.1.2.0/24" {
+		t.Errorf("IPv4 subnet = %q", got)
+	}
+	if got := all[1].Subnet(); got != "2001:db8:1::/48" {
+		t.Errorf("IPv6 subnet = %q", got)
+	}
+	if got := all[2].Subnet(); got != "" {
+		t.Errorf("unresolved host subnet = %q, want none", got)
+	}
+	all[2].SetIP(net.ParseIP("192.0.2.77"))
+	if got := all[2].Subnet(); got != "192.0.2.0/24" {
+		t.Errorf("resolved host subnet = %q", got)
+	}
+}
+
+func TestASN(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080 asn=as64500"}); err != nil {
+		t.Fatal(err)
+	}
+	px := p.All()[0]
+	if px.ASN != "AS64500" || px.NetworkASN() != "AS64500" {
+		t.Errorf("asn=as64500 loaded as %q", px.ASN)
+	}
+	px.SetEgressASN("AS64501")
+	if got := px.NetworkASN(); got != "AS64501" {
+		t.Errorf("NetworkASN = %q, want the egress ASN over the declared one", got)
+	}
+
+	for _, s := range []string{"AS15169 Google LLC", "15169"} {
+		if asn, err := ParseASN(s); err != nil || asn != "AS15169" {
+			t.Errorf("ParseASN(%q) = %q, %v", s, asn, err)
+		}
+	}
+	for _, s := range []string{"", "Google LLC", "AS0", "ASx"} {
+		if _, err := ParseASN(s); err == nil {
+			t.Errorf("ParseASN(%q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package pool
+
+import (
+	"sort"
+	"time"
+)
+
+// A proxy rotated away from for failing is quarantined for a while, so
+// rotation does not bring it straight back: Alive leaves it out until the
+// quarantine ends by itself. Quarantined lists it meanwhile, for a rotator
+// that has nothing else left to choose.
+
+// Quarantine keeps the proxy out of Alive for d from now, replacing any
+// quarantine in progress.
+func (p *Proxy) Quarantine(d time.Duration) {
+	now := time.Now()
+	p.mu.Lock()
+	p.quarantinedAt, p.quarantinedUntil = now, now.Add(d)
+	p.mu.Unlock()
+}
+
+// Quarantined reports whether the proxy is quarantined at now.
+func (p *Proxy) Quarantined(now time.Time) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return now.Before(p.quarantinedUntil)
+}
+
+// QuarantinedUntil returns when the proxy's quarantine ends, or the zero
+// time if it is not quarantined.
+func (p *Proxy) QuarantinedUntil() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !time.Now().Before(p.quarantinedUntil) {
+		return time.Time{}
+	}
+	return p.quarantinedUntil
+}
+
+// Quarantined returns the alive proxies Alive leaves out for being
+// quarantined, the one quarantined longest ago first.
+func (p *Pool) Quarantined() []*Proxy {
+	p.mu.RLock()
+	var out []*Proxy
+	now := time.Now()
+	for _, px := range p.proxies {
+		if px.IsAlive() && px.Quarantined(now) {
+			out = append(out, px)
+		}
+	}
+	p.mu.RUnlock()
+
+	start := make(map[*Proxy]time.Time, len(out))
+	for _, px := range out {
+		start[px] = px.quarantineStart()
+	}
+	sort.SliceStable(out, func(i, j int) bool { return start[out[i]].Before(start[out[j]]) })
+	return out
+}
+
+func (p *Proxy) quarantineStart() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.quarantinedAt
+}
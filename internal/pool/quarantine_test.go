@@ -0,0 +1,51 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuarantine_Expires(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	px := p.All()[0]
+	px.Quarantine(50 * time.Millisecond)
+	if alive := p.Alive(); len(alive) != 1 || alive[0] == px {
+		t.Fatalf("Alive() = %v, want only the proxy not quarantined", alive)
+	}
+	if n := p.AliveLen(); n != 1 {
+		t.Errorf("AliveLen() = %d during the quarantine, want 1 like Alive()", n)
+	}
+	if px.QuarantinedUntil().IsZero() {
+		t.Error("QuarantinedUntil is zero during the quarantine")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if n := len(p.Alive()); n != 2 {
+		t.Errorf("Alive() has %d proxies after the quarantine ended, want 2", n)
+	}
+	if !px.QuarantinedUntil().IsZero() {
+		t.Error("QuarantinedUntil should be zero once the quarantine has ended")
+	}
+}
+
+func TestQuarantine_AllQuarantined(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	all := p.All()
+	all[1].Quarantine(time.Hour)
+	time.Sleep(time.Millisecond)
+	all[0].Quarantine(time.Hour)
+	all[2].Quarantine(time.Hour)
+
+	if alive := p.Alive(); len(alive) != 0 {
+		t.Errorf("Alive() = %v, want none", alive)
+	}
+	if q := p.Quarantined(); len(q) != 3 || q[0] != all[1] {
+		t.Errorf("Quarantined() = %v, want all three, the proxy quarantined first leading", q)
+	}
+}
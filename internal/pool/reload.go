@@ -0,0 +1,148 @@
+package pool
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReloadResult summarises the changes applied by Reload.
+type ReloadResult struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+// Reload re-reads the proxy file (and the auth file, if one was loaded) and
+// applies the difference to the pool in one step:
+//
+//   - Entries whose scheme, host, credentials and metadata are unchanged keep
+//     their *Proxy, with all of its state.
+//   - Entries with the same scheme and host but new credentials or metadata
+//     are replaced by a fresh *Proxy that keeps the old ID, liveness,
+//     latencies and counters. Connections already open on the old one finish
+//     on it; its active connections are not carried over.
+//   - New entries are added with new IDs; missing ones are removed.
+//
+// On any error the pool is left untouched. Reload fails for pools that were
+// not loaded with LoadFile.
+func (p *Pool) Reload() (ReloadResult, error) {
+	p.mu.RLock()
+	file, authFile := p.file, p.authFile
+	p.mu.RUnlock()
+	opts := p.parseOptions()
+	if file == "" {
+		return ReloadResult{}, fmt.Errorf("pool was not loaded from a file")
+	}
+
+	if authFile != "" {
+		var err error
+		if opts.creds, err = readAuthFile(authFile); err != nil {
+			return ReloadResult{}, err
+		}
+	}
+	lines, err := readLines(file)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	fresh, err := parseList(lines, opts)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Replaced proxies are new *Proxy values; whoever waits on the old ones
+	// must look again.
+	defer p.changed.notify()
+
+	// Index the current proxies by endpoint. Duplicated endpoints are
+	// matched in list order.
+	existing := make(map[string][]*Proxy)
+	for _, px := range p.proxies {
+		k := px.endpoint()
+		existing[k] = append(existing[k], px)
+	}
+
+	var res ReloadResult
+	next := make([]*Proxy, 0, len(fresh))
+	for _, px := range fresh {
+		k := px.endpoint()
+		olds := existing[k]
+		if len(olds) == 0 {
+			px.ID = p.nextID.Add(1)
+			next = append(next, px)
+			res.Added++
+			continue
+		}
+		old := olds[0]
+		existing[k] = olds[1:]
+		if old.sameConfig(px) {
+			next = append(next, old)
+			res.Unchanged++
+			continue
+		}
+		px.inherit(old)
+		next = append(next, px)
+		res.Updated++
+	}
+	for _, olds := range existing {
+		res.Removed += len(olds)
+	}
+
+	p.proxies = next
+	p.adopt(next...)
+	p.creds = opts.creds
+	return res, nil
+}
+
+// endpoint identifies a proxy across reloads: its scheme and host.
+func (p *Proxy) endpoint() string {
+	return p.Scheme + "://" + strings.ToLower(p.Host)
+}
+
+// sameConfig reports whether p and o were parsed from equivalent lines,
+// credentials included.
+func (p *Proxy) sameConfig(o *Proxy) bool {
+	return p.URL.String() == o.URL.String() &&
+		p.Group == o.Group &&
+		p.MaxConns == o.MaxConns &&
+		p.MaxRequests == o.MaxRequests &&
+		p.DialTimeout == o.DialTimeout &&
+		p.Canary == o.Canary &&
+		p.Country == o.Country &&
+		p.Priority == o.Priority
+}
+
+// inherit copies old's identity, health and counters onto p, which replaces
+// it in the pool. ActiveConns stays with old, where those connections will
+// release it.
+func (p *Proxy) inherit(old *Proxy) {
+	p.ID = old.ID
+
+	old.mu.RLock()
+	p.alive, p.deadReason = old.alive, old.deadReason
+	p.latency, p.latencySamples = old.latency, old.latencySamples
+	p.respLatency, p.respSamples = old.respLatency, old.respSamples
+	p.reportedLatency, p.reportedSamples = old.reportedLatency, old.reportedSamples
+	p.errDecay, p.httpDecay = old.errDecay, old.httpDecay
+	p.respDecay, p.reportedDecay = old.respDecay, old.reportedDecay
+	p.egressCountry = old.egressCountry
+	p.reservedFor = old.reservedFor
+	p.quarantinedAt, p.quarantinedUntil = old.quarantinedAt, old.quarantinedUntil
+	old.mu.RUnlock()
+
+	p.ReqCount.Store(old.ReqCount.Load())
+	p.ConnErrors.Store(old.ConnErrors.Load())
+	p.HTTPErrors.Store(old.HTTPErrors.Load())
+	p.Completed.Store(old.Completed.Load())
+	p.baseReqs.Store(old.baseReqs.Load())
+	p.baseConnErrors.Store(old.baseConnErrors.Load())
+	p.baseHTTPErrors.Store(old.baseHTTPErrors.Load())
+	p.baseCompleted.Store(old.baseCompleted.Load())
+	p.TotalReqs.Store(old.TotalReqs.Load())
+	p.TotalConnErrors.Store(old.TotalConnErrors.Load())
+	p.TotalHTTPErrors.Store(old.TotalHTTPErrors.Load())
+	p.successStreak.Store(old.successStreak.Load())
+	p.budgetUsed.Store(old.budgetUsed.Load())
+}
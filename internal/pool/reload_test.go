@@ -0,0 +1,98 @@
+package pool
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReload_Diff(t *testing.T) {
+	auth := writeProxyFile(t, "5.6.7.8:8080 alice:old\n")
+	list := writeProxyFile(t, "http://1.2.3.4:8080\nhttp://5.6.7.8:8080\nhttp://9.10.11.12:8080\n")
+	p := New(false)
+	if err := p.LoadAuthFile(auth); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.LoadFile(list); err != nil {
+		t.Fatal(err)
+	}
+	before := p.All()
+	kept, renewed := before[0], before[1]
+	kept.SetLatency(42 * time.Millisecond)
+	renewed.MarkDead("auth_failed")
+	renewed.TotalReqs.Add(7)
+	renewed.ActiveConns.Add(2)
+
+	// Rotate alice's password, drop the third proxy and add a new one.
+	if err := os.WriteFile(auth, []byte("5.6.7.8:8080 alice:new\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(list, []byte("http://1.2.3.4:8080\nhttp://5.6.7.8:8080\nsocks5://13.14.15.16:1080\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := p.Reload()
+	if err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	want := ReloadResult{Added: 1, Removed: 1, Updated: 1, Unchanged: 1}
+	if res != want {
+		t.Errorf("result = %+v, want %+v", res, want)
+	}
+
+	after := p.All()
+	if len(after) != 3 {
+		t.Fatalf("expected 3 proxies, got %d", len(after))
+	}
+	if after[0] != kept || kept.Latency() != 42*time.Millisecond {
+		t.Error("unchanged proxy should be kept as-is")
+	}
+
+	upd := after[1]
+	if upd == renewed {
+		t.Fatal("updated proxy should be a new *Proxy")
+	}
+	if pw, _ := upd.URL.User.Password(); pw != "new" {
+		t.Errorf("updated password = %q, want new", pw)
+	}
+	if upd.ID != renewed.ID || upd.IsAlive() || upd.TotalReqs.Load() != 7 {
+		t.Errorf("updated proxy should inherit id, liveness and counters: id=%d alive=%v total=%d",
+			upd.ID, upd.IsAlive(), upd.TotalReqs.Load())
+	}
+	if upd.ActiveConns.Load() != 0 || renewed.ActiveConns.Load() != 2 {
+		t.Error("active connections should stay with the replaced proxy")
+	}
+
+	if added := after[2]; added.Scheme != "socks5" || added.ID <= before[2].ID {
+		t.Errorf("added proxy = %s (id %d), want a fresh socks5 entry", added, added.ID)
+	}
+}
+
+func TestReload_ErrorLeavesPoolUntouched(t *testing.T) {
+	list := writeProxyFile(t, "http://1.2.3.4:8080\n")
+	p := New(false)
+	if err := p.LoadFile(list); err != nil {
+		t.Fatal(err)
+	}
+	before := p.All()[0]
+
+	if err := os.WriteFile(list, []byte("# nothing left\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Reload(); err == nil {
+		t.Fatal("expected error reloading an empty list")
+	}
+	if all := p.All(); len(all) != 1 || all[0] != before {
+		t.Error("pool should be unchanged after a failed reload")
+	}
+}
+
+func TestReload_NotFromFile(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Reload(); err == nil {
+		t.Fatal("expected error reloading an in-memory pool")
+	}
+}
@@ -0,0 +1,21 @@
+package pool
+
+// SetReservedFor reserves the proxy for the client with the given label, or
+// releases it if client is empty. The rotator keeps a reserved proxy out of
+// general selection; see rotator.Reserve.
+func (p *Proxy) SetReservedFor(client string) {
+	p.mu.Lock()
+	p.reservedFor = client
+	p.mu.Unlock()
+	if client == "" {
+		p.notifyChanged()
+	}
+}
+
+// ReservedFor returns the label of the client the proxy is reserved for, or
+// "" if it is not reserved.
+func (p *Proxy) ReservedFor() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.reservedFor
+}
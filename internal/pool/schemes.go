@@ -0,0 +1,40 @@
+package pool
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SetAllowedSchemes restricts the upstream schemes LoadProxies, LoadFile,
+// Reload and Add accept. A list containing an entry with any other scheme
+// is rejected as a whole rather than loaded without it, so a policy
+// violation cannot go unnoticed behind a skip warning. An empty list
+// allows every supported scheme.
+func (p *Pool) SetAllowedSchemes(schemes []string) {
+	var allowed map[string]bool
+	if len(schemes) > 0 {
+		allowed = make(map[string]bool, len(schemes))
+		for _, s := range schemes {
+			allowed[strings.ToLower(s)] = true
+		}
+	}
+	p.mu.Lock()
+	p.allowedSchemes = allowed
+	p.mu.Unlock()
+}
+
+// checkScheme returns an error if allowed is set and does not include
+// px's scheme.
+func checkScheme(px *Proxy, allowed map[string]bool) error {
+	if allowed == nil || allowed[px.Scheme] {
+		return nil
+	}
+	names := make([]string, 0, len(allowed))
+	for s := range allowed {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("proxy %s: scheme %q is not allowed (allowed: %s)",
+		px, px.Scheme, strings.Join(names, ", "))
+}
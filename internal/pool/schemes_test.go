@@ -0,0 +1,37 @@
+package pool
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetAllowedSchemes(t *testing.T) {
+	p := New(false)
+	p.SetAllowedSchemes([]string{"socks5", "HTTPS"})
+	if err := p.LoadProxies([]string{
+		"socks5://1.2.3.4:1080",
+		"https://5.6.7.8:443",
+	}); err != nil {
+		t.Fatalf("allowed schemes rejected: %v", err)
+	}
+
+	err := p.LoadProxies([]string{"socks5://1.2.3.4:1080", "9.9.9.9:8080"})
+	if err == nil {
+		t.Fatal("expected a bare host:port (http) entry to be rejected")
+	}
+	if !strings.Contains(err.Error(), `scheme "http" is not allowed`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := len(p.All()); n != 2 {
+		t.Errorf("pool should keep its previous %d entries, has %d", 2, n)
+	}
+
+	if _, err := p.Add("http://9.9.9.9:8080"); err == nil {
+		t.Error("Add should reject a disallowed scheme")
+	}
+
+	p.SetAllowedSchemes(nil)
+	if _, err := p.Add("http://9.9.9.9:8080"); err != nil {
+		t.Errorf("empty policy should allow every scheme: %v", err)
+	}
+}
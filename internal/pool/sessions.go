@@ -0,0 +1,52 @@
+package pool
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Gateway-style providers expose one host:port and pick the exit IP from
+// the username, e.g. user-session-42. A line with sessions=N and a
+// {session} placeholder in its URL stands for N such credentials, each
+// loaded as a proxy of its own, so rotation moves between exit IPs while
+// the host stays the same.
+
+// sessionPlaceholder is replaced by 1..N in a line with sessions=N.
+const sessionPlaceholder = "{session}"
+
+// maxSessions bounds sessions=N so a typo cannot exhaust memory.
+const maxSessions = 100000
+
+// expandSessions returns the lines a proxy line stands for: the line itself,
+// or one line per session if it has sessions= metadata.
+func expandSessions(line string) ([]string, error) {
+	fields := strings.Fields(line)
+	n, rest := 0, fields[:0:0]
+	for _, f := range fields {
+		val, ok := strings.CutPrefix(f, "sessions=")
+		if !ok {
+			rest = append(rest, f)
+			continue
+		}
+		var err error
+		if n, err = strconv.Atoi(val); err != nil || n < 1 || n > maxSessions {
+			return nil, fmt.Errorf("bad sessions %q (want an integer from 1 to %d)", val, maxSessions)
+		}
+	}
+	if n == 0 {
+		if strings.Contains(line, sessionPlaceholder) {
+			return nil, fmt.Errorf("%s needs sessions=<n>", sessionPlaceholder)
+		}
+		return []string{line}, nil
+	}
+	if len(rest) == 0 || !strings.Contains(rest[0], sessionPlaceholder) {
+		return nil, fmt.Errorf("sessions= needs %s in the proxy URL", sessionPlaceholder)
+	}
+	template := strings.Join(rest, " ")
+	out := make([]string, n)
+	for i := range out {
+		out[i] = strings.ReplaceAll(template, sessionPlaceholder, strconv.Itoa(i+1))
+	}
+	return out, nil
+}
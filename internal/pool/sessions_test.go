@@ -0,0 +1,33 @@
+package pool
+
+import "testing"
+
+func TestLoadProxies_Sessions(t *testing.T) {
+	p := New(false)
+	err := p.LoadProxies([]string{
+		"http://user-session-{session}:pw@gw.example.com:7777 sessions=3 group=resi",
+		"http://5.6.7.8:8080",
+		"http://user-{session}:pw@gw.example.com:7777",
+		"http://user:pw@gw.example.com:7777 sessions=2",
+		"http://user-{session}:pw@gw.example.com:7777 sessions=0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := p.All()
+	if len(all) != 4 {
+		t.Fatalf("expected 3 sessions and 1 plain proxy, got %d proxies", len(all))
+	}
+	for i, want := range []string{"user-session-1", "user-session-2", "user-session-3"} {
+		px := all[i]
+		if got := px.URL.User.Username(); got != want {
+			t.Errorf("proxy %d username = %q, want %q", i, got, want)
+		}
+		if px.Host != "gw.example.com:7777" || px.Group != "resi" {
+			t.Errorf("proxy %d = %s group %q, want the gateway in group resi", i, px.Host, px.Group)
+		}
+	}
+	if all[0].ID == all[1].ID {
+		t.Error("sessions should get distinct IDs")
+	}
+}
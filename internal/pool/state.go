@@ -0,0 +1,165 @@
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// proxyState is the persisted part of a proxy: lifetime counters, latencies,
+// the used request budget and, with a health decay, the decayed averages,
+// which would otherwise start from zero on every restart.
+// Liveness is not saved; the monitor re-establishes it.
+type proxyState struct {
+	Key             string        `json:"key"`
+	TotalReqs       int64         `json:"total_requests"`
+	TotalConnErrors int64         `json:"total_conn_errors"`
+	TotalHTTPErrors int64         `json:"total_http_errors,omitempty"`
+	Latency         time.Duration `json:"latency_ns"`
+	LatencySamples  int64         `json:"latency_samples"`
+	RespLatency     time.Duration `json:"response_latency_ns"`
+	RespSamples     int64         `json:"response_latency_samples"`
+	ReportedLatency time.Duration `json:"reported_latency_ns,omitempty"`
+	ReportedSamples int64         `json:"reported_latency_samples,omitempty"`
+	BudgetUsed      int64         `json:"budget_used,omitempty"`
+	Decay           *decayState   `json:"health_decay,omitempty"`
+}
+
+// decayState holds a proxy's health-decay averages (see decay.go). Each
+// keeps the time of its last sample, so the time the process was down
+// counts toward the decay like any other.
+type decayState struct {
+	ErrorRate       decayedMeanState `json:"error_rate"`
+	HTTPErrorRate   decayedMeanState `json:"http_error_rate"`
+	ResponseLatency decayedMeanState `json:"response_latency"`
+	ReportedLatency decayedMeanState `json:"reported_latency"`
+}
+
+type decayedMeanState struct {
+	Value  float64   `json:"value"`
+	Weight float64   `json:"weight"`
+	At     time.Time `json:"at"`
+}
+
+func (m decayedMean) state() decayedMeanState {
+	return decayedMeanState{Value: m.value, Weight: m.weight, At: m.at}
+}
+
+func (s decayedMeanState) mean() decayedMean {
+	return decayedMean{value: s.Value, weight: s.Weight, at: s.At}
+}
+
+type stateFile struct {
+	SavedAt time.Time    `json:"saved_at"`
+	Proxies []proxyState `json:"proxies"`
+}
+
+// stateKey identifies a proxy across restarts: scheme, user and host, but
+// never the password.
+func (p *Proxy) stateKey() string {
+	user := ""
+	if p.URL.User != nil {
+		user = p.URL.User.Username() + "@"
+	}
+	return p.Scheme + "://" + user + strings.ToLower(p.Host)
+}
+
+// SaveState writes every proxy's counters, latencies and decayed averages
+// to path. The file is replaced atomically, so a crash mid-write leaves the
+// previous state.
+func (p *Pool) SaveState(path string) error {
+	st := stateFile{SavedAt: time.Now().UTC()}
+	for _, px := range p.All() {
+		px.mu.RLock()
+		ps := proxyState{
+			Key:            px.stateKey(),
+			Latency:        px.latency,
+			LatencySamples: px.latencySamples,
+			RespLatency:    px.respLatency,
+			RespSamples:    px.respSamples,
+		}
+		ps.ReportedLatency, ps.ReportedSamples = px.reportedLatency, px.reportedSamples
+		if px.healthDecay > 0 {
+			ps.Decay = &decayState{
+				ErrorRate:       px.errDecay.state(),
+				HTTPErrorRate:   px.httpDecay.state(),
+				ResponseLatency: px.respDecay.state(),
+				ReportedLatency: px.reportedDecay.state(),
+			}
+		}
+		px.mu.RUnlock()
+		ps.TotalReqs = px.TotalReqs.Load()
+		ps.TotalConnErrors = px.TotalConnErrors.Load()
+		ps.TotalHTTPErrors = px.TotalHTTPErrors.Load()
+		ps.BudgetUsed = px.budgetUsed.Load()
+		st.Proxies = append(st.Proxies, ps)
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	return nil
+}
+
+// LoadState restores counters, latencies and decayed averages saved by
+// SaveState onto the proxies that are still in the pool, and returns how
+// many matched. A missing file is not an error.
+func (p *Pool) LoadState(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read state file: %w", err)
+	}
+	var st stateFile
+	if err := json.Unmarshal(data, &st); err != nil {
+		return 0, fmt.Errorf("parse state file: %w", err)
+	}
+
+	saved := make(map[string]proxyState, len(st.Proxies))
+	for _, ps := range st.Proxies {
+		saved[ps.Key] = ps
+	}
+	matched := 0
+	for _, px := range p.All() {
+		ps, ok := saved[px.stateKey()]
+		if !ok {
+			continue
+		}
+		matched++
+		px.mu.Lock()
+		px.latency, px.latencySamples = ps.Latency, ps.LatencySamples
+		px.respLatency, px.respSamples = ps.RespLatency, ps.RespSamples
+		px.reportedLatency, px.reportedSamples = ps.ReportedLatency, ps.ReportedSamples
+		if d := ps.Decay; d != nil {
+			px.errDecay, px.httpDecay = d.ErrorRate.mean(), d.HTTPErrorRate.mean()
+			px.respDecay, px.reportedDecay = d.ResponseLatency.mean(), d.ReportedLatency.mean()
+		}
+		px.mu.Unlock()
+		px.TotalReqs.Store(ps.TotalReqs)
+		px.TotalConnErrors.Store(ps.TotalConnErrors)
+		px.TotalHTTPErrors.Store(ps.TotalHTTPErrors)
+		px.budgetUsed.Store(ps.BudgetUsed)
+	}
+	return matched, nil
+}
@@ -0,0 +1,60 @@
+package pool
+
+import "sync/atomic"
+
+// A connection waiting for a proxy that matches its static route (queue
+// mode) sleeps on Pool.Changed instead of polling. The signal is pool-wide:
+// a route to a group or country is satisfied by any of its proxies, and a
+// reload that replaces a *Proxy must wake waiters as well. The channel is
+// created on demand, so while nobody waits a change costs one atomic load.
+
+// signal is a channel closed on the next notify, recreated on demand.
+type signal struct {
+	ch atomic.Pointer[chan struct{}]
+}
+
+func (s *signal) wait() <-chan struct{} {
+	for {
+		if ch := s.ch.Load(); ch != nil {
+			return *ch
+		}
+		ch := make(chan struct{})
+		if s.ch.CompareAndSwap(nil, &ch) {
+			return ch
+		}
+	}
+}
+
+func (s *signal) notify() {
+	if s.ch.Load() == nil {
+		return
+	}
+	if ch := s.ch.Swap(nil); ch != nil {
+		close(*ch)
+	}
+}
+
+// Changed returns a channel that is closed the next time a proxy in the
+// pool may have become usable — one is marked alive, released from a
+// reservation, or gets a connection slot or its request budget back — or
+// the pool's contents change (LoadProxies, Add, Reload). Callers re-check
+// once it fires and call Changed again to keep waiting; fetching the
+// channel before the check means no change is missed.
+func (p *Pool) Changed() <-chan struct{} {
+	return p.changed.wait()
+}
+
+// adopt ties proxies to the pool's change signal. The caller holds p.mu.
+func (p *Pool) adopt(proxies ...*Proxy) {
+	for _, px := range proxies {
+		px.changed = &p.changed
+	}
+}
+
+// notifyChanged wakes everything waiting on the Changed channel of the
+// proxy's pool. Proxies not in a pool have nobody to wake.
+func (p *Proxy) notifyChanged() {
+	if p.changed != nil {
+		p.changed.notify()
+	}
+}
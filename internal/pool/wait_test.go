@@ -0,0 +1,81 @@
+package pool
+
+import (
+	"os"
+	"testing"
+)
+
+func fired(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestChanged(t *testing.T) {
+	p := New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	px := p.All()[0]
+
+	for _, tc := range []struct {
+		name string
+		do   func()
+		want bool
+	}{
+		{"mark dead", func() { px.MarkDead("test") }, false},
+		{"reserve", func() { px.SetReservedFor("ci") }, false},
+		{"mark alive", func() { px.SetAlive(true) }, true},
+		{"unreserve", func() { px.SetReservedFor("") }, true},
+		{"release conn", func() { px.AcquireConn(); px.ReleaseConn() }, true},
+		{"reset budget", px.ResetBudget, true},
+		{"add", func() { p.Add("http://5.6.7.8:8080") }, true},
+		{"added proxy alive", func() { p.All()[1].SetAlive(true) }, true},
+		{"remove", func() { p.Remove(p.All()[1].ID) }, true},
+		{"remove unknown", func() { p.Remove(999) }, false},
+	} {
+		ch := p.Changed()
+		if p.Changed() != ch {
+			t.Fatalf("%s: waiters got different channels", tc.name)
+		}
+		tc.do()
+		if got := fired(ch); got != tc.want {
+			t.Errorf("%s: Changed fired = %v, want %v", tc.name, got, tc.want)
+		}
+		if tc.want && fired(p.Changed()) {
+			t.Errorf("%s: the next Changed channel is already closed", tc.name)
+		}
+	}
+}
+
+func TestChanged_Reload(t *testing.T) {
+	list := writeProxyFile(t, "http://1.2.3.4:8080\n")
+	p := New(false)
+	if err := p.LoadFile(list); err != nil {
+		t.Fatal(err)
+	}
+	old := p.All()[0]
+
+	ch := p.Changed()
+	if err := os.WriteFile(list, []byte("http://1.2.3.4:8080 group=eu\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !fired(ch) {
+		t.Error("Reload did not fire Changed")
+	}
+	renewed := p.All()[0]
+	if renewed == old {
+		t.Fatal("Reload kept the *Proxy whose metadata changed")
+	}
+	ch = p.Changed()
+	renewed.SetAlive(true)
+	if !fired(ch) {
+		t.Error("a proxy replaced by Reload does not fire Changed")
+	}
+}
@@ -0,0 +1,117 @@
+// Package rotationlog appends one JSON line per proxy rotation to a file,
+// giving a durable audit trail that outlives the process.
+//
+// Records are queued and written by a background goroutine, so logging never
+// blocks the rotation path. If the queue is full (the disk cannot keep up)
+// records are dropped and counted rather than stalling rotations.
+package rotationlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queueSize is the number of records that can be pending before new ones
+// are dropped.
+const queueSize = 1024
+
+// Record describes a single rotation.
+type Record struct {
+	Time           time.Time `json:"time"`
+	Generation     int64     `json:"generation"`
+	Reason         string    `json:"reason"`
+	FromID         int64     `json:"from_id,omitempty"` // 0 for the startup selection
+	ToID           int64     `json:"to_id"`
+	OldActiveConns int64     `json:"old_active_conns"` // connections still draining on the old proxy
+}
+
+// Logger writes Records as JSON lines.
+type Logger struct {
+	w      *bufio.Writer
+	closer io.Closer
+
+	queue   chan Record
+	done    chan struct{}
+	dropped atomic.Int64
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New creates a Logger writing to w and starts its writer goroutine.
+func New(w io.Writer) *Logger {
+	l := &Logger{
+		w:     bufio.NewWriter(w),
+		queue: make(chan Record, queueSize),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Open creates a Logger appending to the file at path.
+func Open(path string) (*Logger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open rotation log: %w", err)
+	}
+	l := New(f)
+	l.closer = f
+	return l, nil
+}
+
+// Log queues rec for writing. It never blocks; if the queue is full the
+// record is dropped.
+func (l *Logger) Log(rec Record) {
+	select {
+	case l.queue <- rec:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of records discarded because the queue was full.
+func (l *Logger) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// Close writes any queued records, flushes, and closes the underlying file
+// if the Logger opened one. Log must not be called after Close.
+func (l *Logger) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.queue)
+		<-l.done
+		if n := l.dropped.Load(); n > 0 {
+			log.Printf("[rotationlog] %d records dropped (writer could not keep up)", n)
+		}
+		if l.closer != nil {
+			l.closeErr = l.closer.Close()
+		}
+	})
+	return l.closeErr
+}
+
+// run drains the queue, flushing whenever it catches up so records reach
+// disk promptly without a write syscall per line under bursts.
+func (l *Logger) run() {
+	defer close(l.done)
+	enc := json.NewEncoder(l.w)
+	for rec := range l.queue {
+		if err := enc.Encode(rec); err != nil {
+			log.Printf("[rotationlog] write failed: %v", err)
+		}
+		if len(l.queue) == 0 {
+			if err := l.w.Flush(); err != nil {
+				log.Printf("[rotationlog] flush failed: %v", err)
+			}
+		}
+	}
+	_ = l.w.Flush()
+}
@@ -0,0 +1,77 @@
+package rotationlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpen_AppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rotations.jsonl")
+	if err := os.WriteFile(path, []byte(`{"generation":1}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.Log(Record{Time: at, Generation: 2, Reason: "requests", FromID: 1, ToID: 2, OldActiveConns: 5})
+	l.Log(Record{Time: at, Generation: 3, Reason: "manual", FromID: 2, ToID: 3})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []Record
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("line %q is not JSON: %v", sc.Text(), err)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("got %d lines, want 3 (existing content preserved)", len(recs))
+	}
+	got := recs[1]
+	if got.Generation != 2 || got.Reason != "requests" || got.FromID != 1 || got.ToID != 2 || got.OldActiveConns != 5 || !got.Time.Equal(at) {
+		t.Errorf("unexpected record %+v", got)
+	}
+}
+
+// blockingWriter never completes a write until released.
+type blockingWriter struct{ release chan struct{} }
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestLog_NeverBlocks(t *testing.T) {
+	w := blockingWriter{release: make(chan struct{})}
+	l := New(w)
+
+	start := time.Now()
+	for i := 0; i < queueSize*3; i++ {
+		l.Log(Record{Generation: int64(i)})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Log blocked for %s with a stalled writer", elapsed)
+	}
+	if l.Dropped() == 0 {
+		t.Error("expected records to be dropped once the queue filled")
+	}
+
+	close(w.release)
+	l.Close()
+}
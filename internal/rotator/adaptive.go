@@ -0,0 +1,25 @@
+package rotator
+
+import (
+	"math"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// adaptiveBadErrorRate is the connection error rate at which a proxy's
+// adaptive request threshold bottoms out at half of AdaptiveRequests.
+const adaptiveBadErrorRate = 0.05
+
+// adaptiveLimit returns px's request threshold under AdaptiveRequests: twice
+// the base for a proxy without connection errors, halving exponentially
+// down to half the base as its error rate (pool.Proxy.ErrorRate) rises to
+// adaptiveBadErrorRate. A proxy at half that rate gets the base itself.
+func (r *Rotator) adaptiveLimit(px *pool.Proxy) int64 {
+	base := r.cfg.AdaptiveRequests
+	bad := math.Min(px.ErrorRate()/adaptiveBadErrorRate, 1)
+	limit := int64(math.Round(float64(base) * math.Exp2(1-2*bad)))
+	if limit < 1 {
+		return 1
+	}
+	return limit
+}
@@ -0,0 +1,45 @@
+package rotator
+
+import "testing"
+
+func TestAdaptiveLimit(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080"})
+	r, err := New(p, Config{AdaptiveRequests: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	px := r.Current()
+	for _, tc := range []struct {
+		reqs, errs int64
+		want       int64
+	}{
+		{0, 0, 200},    // no traffic yet counts as no errors
+		{975, 25, 100}, // 2.5%: the base
+		{900, 100, 50}, // 10%: floored at half
+	} {
+		px.TotalReqs.Store(tc.reqs)
+		px.TotalConnErrors.Store(tc.errs)
+		if got := r.adaptiveLimit(px); got != tc.want {
+			t.Errorf("%d reqs, %d errs: limit = %d, want %d", tc.reqs, tc.errs, got, tc.want)
+		}
+	}
+}
+
+func TestRecordRequest_Adaptive(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{AdaptiveRequests: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An error-free proxy gets twice the base.
+	for i := 0; i < 3; i++ {
+		r.RecordRequest(r.Current(), "example.com:443")
+	}
+	if n := len(r.rotateCh); n != 0 {
+		t.Fatalf("rotation queued after 3 requests with a limit of 4 (%d queued)", n)
+	}
+	r.RecordRequest(r.Current(), "example.com:443")
+	if req := <-r.rotateCh; req.trigger != TriggerRequests {
+		t.Errorf("trigger = %s, want %s", req.trigger, TriggerRequests)
+	}
+}
@@ -0,0 +1,58 @@
+package rotator
+
+import (
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// Canary proxies (canary=<pct> metadata) are kept out of normal rotation.
+// Instead each new connection is routed to a canary with probability equal
+// to its percentage, so a new provider can be vetted on a small slice of
+// real traffic before it is trusted with the rest.
+
+// canaryFor rolls the dice for one new connection and returns the canary it
+// should use, or nil for the stable pool. Percentages of several canaries
+// add up; a full canary is skipped.
+func (r *Rotator) canaryFor() *pool.Proxy {
+	canaries := r.pool.Canaries()
+	if len(canaries) == 0 {
+		return nil
+	}
+	roll := r.rand.Float64() * 100
+	for _, px := range canaries {
+		roll -= px.Canary
+		if roll < 0 {
+			if px.HasCapacity() && px.ReservedFor() == "" {
+				return px
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// stable filters canaries out of alive. If every alive proxy is a canary
+// they are all returned, so traffic still flows.
+func stable(alive []*pool.Proxy) []*pool.Proxy {
+	out := make([]*pool.Proxy, 0, len(alive))
+	for _, px := range alive {
+		if px.Canary == 0 {
+			out = append(out, px)
+		}
+	}
+	if len(out) == 0 {
+		return alive
+	}
+	return out
+}
+
+// Canary returns the canary with the given pool ID, or nil if id names no
+// proxy or one that is not a canary. The API uses it to charge a status
+// report to the canary that carried the request rather than to the current
+// proxy.
+func (r *Rotator) Canary(id int64) *pool.Proxy {
+	px := r.pool.Get(id)
+	if px == nil || px.Canary == 0 {
+		return nil
+	}
+	return px
+}
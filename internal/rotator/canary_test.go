@@ -0,0 +1,80 @@
+package rotator
+
+import "testing"
+
+func TestCanary_ExcludedFromRotation(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080 canary=5", "http://9.10.11.12:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	canary := p.All()[1]
+	for i := 0; i < 6; i++ {
+		if r.Current() == canary {
+			t.Fatalf("canary became the current proxy after %d rotations", i)
+		}
+		if err := r.RotateNow("test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCanary_ReceivesItsShare(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080 canary=20%"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedRand(r, 1)
+	canary := p.All()[1]
+
+	const n = 5000
+	hits := 0
+	for i := 0; i < n; i++ {
+		if r.ProxyFor("example.com:443") == canary {
+			hits++
+		}
+	}
+	if share := float64(hits) / n; share < 0.16 || share > 0.24 {
+		t.Errorf("canary got %.1f%% of connections, want ≈20%%", share*100)
+	}
+
+	// Canary picks bypass pinning: the pin stays on the stable proxy.
+	if got := r.pins["example.com"]; got != p.All()[0] {
+		t.Errorf("pin = %v, want the stable proxy", got)
+	}
+}
+
+func TestCanary_SeededRollsRepeat(t *testing.T) {
+	picks := func() []bool {
+		p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080 canary=50"})
+		r, err := New(p, Config{NoPinning: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seedRand(r, 42)
+		out := make([]bool, 64)
+		for i := range out {
+			out[i] = r.ProxyFor("example.com:443") == p.All()[1]
+		}
+		return out
+	}
+	a, b := picks(), picks()
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("connection %d went to a different proxy with the same seed", i)
+		}
+	}
+}
+
+func TestCanary_OnlyCanariesLeft(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080 canary=5"})
+	p.All()[0].SetAlive(false)
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != p.All()[1] {
+		t.Errorf("expected the canary to carry traffic when no stable proxy is alive")
+	}
+}
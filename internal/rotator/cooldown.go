@@ -0,0 +1,28 @@
+package rotator
+
+import "time"
+
+// cooldownLeft returns how much of MinRotateInterval remains since the last
+// rotation, or zero if a rotation asked for by triggers may go ahead.
+// Manual and signal rotations are an operator's decision and never wait, nor
+// does max-requests, whose proxy cannot take another request.
+func (r *Rotator) cooldownLeft(triggers map[Trigger]bool, now time.Time) time.Duration {
+	if r.cfg.MinRotateInterval <= 0 {
+		return 0
+	}
+	for _, t := range []Trigger{TriggerManual, TriggerSignal, TriggerMaxRequests} {
+		if triggers[t] {
+			return 0
+		}
+	}
+	r.mu.RLock()
+	rotatedAt := r.rotatedAt
+	r.mu.RUnlock()
+	if rotatedAt.IsZero() {
+		return 0
+	}
+	if left := r.cfg.MinRotateInterval - now.Sub(rotatedAt); left > 0 {
+		return left
+	}
+	return 0
+}
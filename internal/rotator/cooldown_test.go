@@ -0,0 +1,63 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCooldown_BurstRotatesOnce(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	r, err := New(p, Config{RotateConnErrors: 1, MinRotateInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	defer r.Stop()
+
+	gen0 := r.Generation()
+	for i := 0; i < 20; i++ {
+		r.RecordConnError(r.Current())
+		time.Sleep(5 * time.Millisecond) // let the loop keep up
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := r.Generation() - gen0; n != 1 {
+		t.Fatalf("%d rotations after 20 conn errors within the cooldown, want 1", n)
+	}
+
+	// A manual rotation is not held back.
+	r.ForceRotate()
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for r.Generation()-gen0 != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("ForceRotate was held back by the cooldown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCooldownLeft(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{MinRotateInterval: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := map[Trigger]bool{TriggerConnErrors: true}
+	if left := r.cooldownLeft(errs, time.Now()); left != 0 {
+		t.Errorf("cooldown of %s before any rotation, want none", left)
+	}
+
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if left := r.cooldownLeft(errs, now); left <= 0 || left > 10*time.Second {
+		t.Errorf("cooldown left = %s right after a rotation", left)
+	}
+	if left := r.cooldownLeft(errs, now.Add(11*time.Second)); left != 0 {
+		t.Errorf("cooldown left = %s after it expired", left)
+	}
+	mixed := map[Trigger]bool{TriggerConnErrors: true, TriggerSignal: true}
+	if left := r.cooldownLeft(mixed, now); left != 0 {
+		t.Errorf("a signal rotation waited %s", left)
+	}
+}
@@ -0,0 +1,58 @@
+package rotator
+
+import (
+	"log"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// A destination that answers 403 to one proxy after another is refusing the
+// content, not the proxies. Rotating on its errors would only burn through
+// the pool, so once DestBlockProxies distinct proxies have failed it within
+// DestBlockWindow its errors stop counting until those failures age out.
+
+// DestinationBlocked reports whether destination is currently considered
+// blocked (see DestBlockProxies), without recording a failure.
+func (r *Rotator) DestinationBlocked(destination string) bool {
+	return r.destBlocked(extractDomain(destination), nil)
+}
+
+// destBlocked records that px failed domain (px may be nil to only look) and
+// reports whether enough distinct proxies have failed it to consider the
+// destination blocked.
+func (r *Rotator) destBlocked(domain string, px *pool.Proxy) bool {
+	if r.cfg.DestBlockProxies <= 0 {
+		return false
+	}
+	now := time.Now()
+
+	r.destFailuresMu.Lock()
+	defer r.destFailuresMu.Unlock()
+
+	failed := r.destFailures[domain]
+	for p, at := range failed {
+		if now.Sub(at) > r.cfg.DestBlockWindow {
+			delete(failed, p)
+		}
+	}
+	wasBlocked := len(failed) >= r.cfg.DestBlockProxies
+	if px != nil && !wasBlocked {
+		if failed == nil {
+			failed = make(map[*pool.Proxy]time.Time)
+			r.destFailures[domain] = failed
+		}
+		failed[px] = now
+	}
+	if len(failed) == 0 {
+		delete(r.destFailures, domain)
+		return false
+	}
+
+	blocked := len(failed) >= r.cfg.DestBlockProxies
+	if blocked && !wasBlocked {
+		log.Printf("[rotator] %s failed on %d distinct proxies — treating it as blocked, not rotating for it",
+			domain, len(failed))
+	}
+	return blocked
+}
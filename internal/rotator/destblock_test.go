@@ -0,0 +1,67 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDestBlock_StopsRotatingForBlockedDestination(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	r, err := New(p, Config{
+		RotateHTTPErrors:     1,
+		HTTPErrorDedupWindow: time.Millisecond,
+		DestBlockProxies:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// First proxy fails: an ordinary rotation trigger.
+	if r.RecordHTTPError("blocked.example:443") {
+		t.Fatal("one failing proxy should not mark the destination blocked")
+	}
+	if got := (<-r.rotateCh).reason; got != "http-errors=1 destination=blocked.example" {
+		t.Errorf("trigger = %q", got)
+	}
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond) // past the post-rotation grace period
+
+	// A second, distinct proxy fails the same destination: it is blocked.
+	if !r.RecordHTTPError("blocked.example:443") {
+		t.Fatal("expected destination to be blocked after two distinct proxies failed it")
+	}
+	select {
+	case got := <-r.rotateCh:
+		t.Errorf("blocked destination should not trigger rotation, got %q", got.reason)
+	default:
+	}
+	if n := r.Current().HTTPErrors.Load(); n != 0 {
+		t.Errorf("blocked error counted against the proxy: HTTPErrors=%d", n)
+	}
+
+	// Other destinations still rotate.
+	time.Sleep(5 * time.Millisecond)
+	if r.RecordHTTPError("other.example:443") {
+		t.Error("unrelated destination reported as blocked")
+	}
+	if got := (<-r.rotateCh).reason; got != "http-errors=1 destination=other.example" {
+		t.Errorf("trigger = %q", got)
+	}
+}
+
+func TestDestBlock_FailuresExpire(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080"})
+	r, err := New(p, Config{DestBlockProxies: 1, DestBlockWindow: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.destBlocked("example.com", r.Current()) {
+		t.Fatal("expected blocked after one failure with DestBlockProxies=1")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if r.destBlocked("example.com", nil) {
+		t.Error("failure should have expired")
+	}
+}
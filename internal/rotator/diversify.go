@@ -0,0 +1,75 @@
+package rotator
+
+import (
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// Rotating to another IP in the same /24, or the same provider's ASN,
+// barely changes what a target sees. With Config.Diversify set, a rotation
+// only considers proxies on a different network from the one it leaves,
+// when there are any.
+
+// Modes for Config.Diversify.
+const (
+	// DiversifySubnet avoids the outgoing proxy's /24 (IPv4) or /48 (IPv6).
+	DiversifySubnet = "subnet"
+
+	// DiversifyASN avoids the outgoing proxy's autonomous system.
+	DiversifyASN = "asn"
+)
+
+// networkKey returns what Diversify compares px by, or "" if it is not
+// known.
+func (r *Rotator) networkKey(px *pool.Proxy) string {
+	switch r.cfg.Diversify {
+	case DiversifySubnet:
+		return px.Subnet()
+	case DiversifyASN:
+		return px.NetworkASN()
+	}
+	return ""
+}
+
+// diversify returns the network key nextIndex should skip candidates on,
+// or "" to skip none: when Diversify is off, when the current proxy's
+// network is unknown, or when no candidate in alive is on another network.
+// sameOnly reports that last case, where the rotation falls back to a proxy
+// on the same network. Candidates whose network is unknown count as
+// different. Callers hold r.mu.
+func (r *Rotator) diversify(alive []*pool.Proxy) (avoid string, sameOnly bool) {
+	if r.cfg.Diversify == "" || r.current == nil {
+		return "", false
+	}
+	key := r.networkKey(r.current)
+	if key == "" {
+		return "", false
+	}
+	others := false
+	for _, px := range alive {
+		if px == r.current {
+			continue
+		}
+		if r.networkKey(px) != key {
+			return key, false
+		}
+		others = true
+	}
+	return "", others
+}
+
+// notePicked records that r.current became current at r.generation. Entries
+// for proxies no longer in alive (removed, dead or reloaded) are dropped once
+// they outnumber the live ones. Callers hold r.mu.
+func (r *Rotator) notePicked(alive []*pool.Proxy) {
+	r.pickedAt[r.current] = r.generation
+	if len(r.pickedAt) <= 2*len(alive) {
+		return
+	}
+	keep := make(map[*pool.Proxy]int64, len(alive))
+	for _, px := range alive {
+		if g, ok := r.pickedAt[px]; ok {
+			keep[px] = g
+		}
+	}
+	r.pickedAt = keep
+}
@@ -0,0 +1,88 @@
+package rotator
+
+import (
+	"testing"
+)
+
+func TestDiversify_Subnet(t *testing.T) {
+	p := makePool(t, []string{
+		"http://10.0.0.1:8080",
+		"http://10.0.0.2:8080",
+		"http://10.0.1.1:8080",
+		"http://10.0.0.3:8080",
+	})
+	all := p.All()
+	r, err := New(p, Config{Diversify: DiversifySubnet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != all[0] {
+		t.Fatalf("startup picked %s, want the first proxy", r.Current())
+	}
+
+	// Every rotation leaves the outgoing subnet, yet over a few rounds each
+	// proxy on 10.0.0.0/24 gets its turn, not just the one after 10.0.1.1.
+	used := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		prev := r.Current()
+		if err := r.RotateNow("test"); err != nil {
+			t.Fatal(err)
+		}
+		cur := r.Current()
+		if cur.Subnet() == prev.Subnet() {
+			t.Fatalf("rotation %d stayed on %s: %s → %s", i, cur.Subnet(), prev, cur)
+		}
+		used[cur.String()]++
+	}
+	for _, px := range all {
+		if used[px.String()] == 0 {
+			t.Errorf("%s never used; uses: %v", px, used)
+		}
+	}
+	if used[all[2].String()] != 20 {
+		t.Errorf("10.0.1.1 used %d times, want every other rotation (20)", used[all[2].String()])
+	}
+	if r.Current() == all[2] {
+		t.Fatalf("after an even number of rotations the current proxy is %s", r.Current())
+	}
+	if next := r.PeekNext(); next != all[2] {
+		t.Errorf("PeekNext = %v, want the only proxy outside 10.0.0.0/24", next)
+	}
+
+	// With every alternative on the same subnet, any proxy will do.
+	all[2].MarkDead("test")
+	prev := r.Current()
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() == prev || r.Current() == all[2] {
+		t.Errorf("rotated to %s, want another proxy on 10.0.0.0/24", r.Current())
+	}
+}
+
+func TestDiversify_ASN(t *testing.T) {
+	p := makePool(t, []string{
+		"http://1.2.3.4:8080 asn=AS100",
+		"http://5.6.7.8:8080 asn=100",
+		"http://9.10.11.12:8080",
+		"http://13.14.15.16:8080 asn=AS200",
+	})
+	all := p.All()
+	all[2].SetEgressASN("AS100")
+	r, err := New(p, Config{Diversify: DiversifyASN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != all[3] {
+		t.Errorf("rotated to %s, want the only proxy outside AS100", r.Current())
+	}
+}
+
+func TestNew_BadDiversify(t *testing.T) {
+	if _, err := New(makePool(t, []string{"http://1.2.3.4:8080"}), Config{Diversify: "country"}); err == nil {
+		t.Error("expected an error for an unknown diversify mode")
+	}
+}
@@ -0,0 +1,59 @@
+package rotator
+
+import (
+	"errors"
+	"log"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// DrainCurrent and Resume split a rotation in two for maintenance: the
+// current proxy stops taking new connections and drains, and no successor
+// is picked until Resume.
+
+// ErrPaused is returned by rotations attempted between DrainCurrent and
+// Resume.
+var ErrPaused = errors.New("rotation is paused while the current proxy drains")
+
+// ErrNotPaused is returned by Resume when DrainCurrent was not called.
+var ErrNotPaused = errors.New("rotation is not paused")
+
+// DrainCurrent pauses rotation and returns the current proxy, which keeps
+// its open connections but gets no new ones: while paused, Paused is true
+// and callers must turn new connections away. Triggers that fire in the
+// meantime are dropped, with one log line per pause; direct rotations
+// such as RotateNow are refused with ErrPaused. Calling it again is
+// harmless.
+func (r *Rotator) DrainCurrent() *pool.Proxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.paused {
+		r.paused = true
+		r.pauses++
+		if r.current != nil {
+			log.Printf("[rotator] draining %s (active_conns=%d); rotation paused until resumed",
+				r.current.String(), r.current.ActiveConns.Load())
+		}
+	}
+	return r.current
+}
+
+// Paused reports whether DrainCurrent has paused rotation.
+func (r *Rotator) Paused() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.paused
+}
+
+// Resume ends a pause started by DrainCurrent with a fresh selection, so
+// new connections go to the next proxy rather than the drained one.
+func (r *Rotator) Resume() error {
+	r.mu.Lock()
+	if !r.paused {
+		r.mu.Unlock()
+		return ErrNotPaused
+	}
+	r.paused = false
+	r.mu.Unlock()
+	return r.pickNext("resume")
+}
@@ -0,0 +1,116 @@
+package rotator
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedLog collects log output written from the rotation loop.
+type lockedLog struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (l *lockedLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+func (l *lockedLog) count(s string) int {
+	return strings.Count(l.String(), s)
+}
+
+func TestDrainCurrentAndResume(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Resume(); !errors.Is(err, ErrNotPaused) {
+		t.Errorf("Resume without a pause: err = %v, want ErrNotPaused", err)
+	}
+
+	drained := r.DrainCurrent()
+	if drained != r.Current() || !r.Paused() {
+		t.Fatal("DrainCurrent should pause on the current proxy")
+	}
+	gen := r.Generation()
+	if err := r.pickNext("test"); !errors.Is(err, ErrPaused) {
+		t.Errorf("rotation while paused: err = %v, want ErrPaused", err)
+	}
+	if r.Generation() != gen {
+		t.Error("a rotation went through while paused")
+	}
+
+	if err := r.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Paused() || r.Current() == drained {
+		t.Error("Resume should unpause and select a proxy other than the drained one")
+	}
+}
+
+func TestDrainCurrent_TriggersDroppedQuietly(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs lockedLog
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	r.Start()
+	defer r.Stop()
+
+	// waitDropped waits for the loop to log the n-th dropped pause.
+	waitDropped := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for logs.count("dropped: paused") < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("no log for pause %d:\n%s", n, logs.String())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	r.DrainCurrent()
+	gen := r.Generation()
+	for i := 0; i < 5; i++ {
+		r.ForceRotate()
+		time.Sleep(5 * time.Millisecond) // one trigger per loop pass
+	}
+	waitDropped(1)
+	time.Sleep(50 * time.Millisecond)
+	if r.Generation() != gen {
+		t.Error("a triggered rotation went through while paused")
+	}
+
+	// A new pause is logged again.
+	if err := r.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	r.DrainCurrent()
+	r.ForceRotate()
+	waitDropped(2)
+	time.Sleep(50 * time.Millisecond)
+
+	if n := logs.count("dropped: paused"); n != 2 {
+		t.Errorf("pause logged %d times over two pauses, want 2", n)
+	}
+	if logs.count("rotation failed") != 0 {
+		t.Errorf("triggers while paused logged as failures:\n%s", logs.String())
+	}
+}
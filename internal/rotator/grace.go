@@ -0,0 +1,58 @@
+package rotator
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// After a rotation, error reports keep arriving for requests that went out
+// through the previous proxy, and RecordHTTPError discards them for a grace
+// period. Destinations that cache or rate-limit per client keep failing for
+// longer after the switch; DestGrace lets each domain have its own period.
+
+// ParseDestGrace parses a --dest-grace value of the form
+//
+//	slow.example.com=30s
+//
+// The duration is the grace period after a rotation during which error
+// reports for that domain, or any of its subdomains, are discarded.
+func ParseDestGrace(s string) (domain string, grace time.Duration, err error) {
+	domain, val, ok := strings.Cut(s, "=")
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if !ok || domain == "" {
+		return "", 0, fmt.Errorf("destination grace %q: want <domain>=<duration>", s)
+	}
+	grace, err = time.ParseDuration(strings.TrimSpace(val))
+	if err != nil || grace < 0 {
+		return "", 0, fmt.Errorf("destination grace %q: want a non-negative duration such as 30s", s)
+	}
+	return domain, grace, nil
+}
+
+// graceFor returns the post-rotation grace period for domain: that of the
+// most specific DestGrace entry matching it or a parent domain, else
+// HTTPErrorDedupWindow.
+func (r *Rotator) graceFor(domain string) time.Duration {
+	if grace, ok := lookupDomain(r.cfg.DestGrace, domain); ok {
+		return grace
+	}
+	return r.cfg.HTTPErrorDedupWindow
+}
+
+// lookupDomain returns the value m holds for domain or, failing that, for
+// its closest parent domain.
+func lookupDomain[V any](m map[string]V, domain string) (V, bool) {
+	for len(m) > 0 {
+		if v, ok := m[domain]; ok {
+			return v, true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			break
+		}
+		domain = parent
+	}
+	var zero V
+	return zero, false
+}
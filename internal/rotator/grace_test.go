@@ -0,0 +1,49 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDestGrace(t *testing.T) {
+	domain, grace, err := ParseDestGrace("Slow.Example.com=30s")
+	if err != nil || domain != "slow.example.com" || grace != 30*time.Second {
+		t.Errorf("got %q, %s, %v", domain, grace, err)
+	}
+	for _, bad := range []string{"slow.example.com", "=30s", "slow.example.com=soon", "slow.example.com=-1s"} {
+		if _, _, err := ParseDestGrace(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestRecordHTTPError_DestGrace(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{
+		RotateHTTPErrors: 1,
+		DestGrace:        map[string]time.Duration{"slow.com": time.Hour, "fast.com": 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	cur := r.Current()
+
+	// Within the default 2s grace, and within slow.com's hour.
+	r.RecordHTTPError("other.com:443")
+	r.RecordHTTPError("api.slow.com:443")
+	if n := cur.HTTPErrors.Load(); n != 0 {
+		t.Fatalf("HTTPErrors = %d, want 0 during the grace period", n)
+	}
+
+	// fast.com has no grace at all.
+	r.RecordHTTPError("fast.com:443")
+	if n := cur.HTTPErrors.Load(); n != 1 {
+		t.Errorf("HTTPErrors = %d, want 1 for a destination without grace", n)
+	}
+	if n := len(r.rotateCh); n != 1 {
+		t.Errorf("%d rotations queued, want 1", n)
+	}
+}
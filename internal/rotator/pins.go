@@ -0,0 +1,145 @@
+package rotator
+
+import (
+	"sort"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// With Config.MaxPins set, pins are also kept in least-recently-used order
+// so the oldest can be evicted once the cap is reached. Every helper here
+// that changes pins expects pinsMu to be held for writing.
+//
+// Config.PinMode decides what the pin map is keyed by. The mode is fixed for
+// the rotator's lifetime, so keys of one kind never mix with the other.
+
+// Modes for Config.PinMode.
+const (
+	// PinDomain pins each destination domain to the proxy its first
+	// connection used. It is the default.
+	PinDomain = "domain"
+
+	// PinClientIP pins each downstream client IP to the proxy its first
+	// connection used, whatever the destination, so a session spanning
+	// several domains keeps one exit IP.
+	PinClientIP = "client-ip"
+
+	// PinNone pins nothing: every connection uses the current proxy.
+	PinNone = "none"
+)
+
+// Pin is a read-only view of one pin. Domain is set for a PinDomain pin,
+// Client for a PinClientIP one.
+type Pin struct {
+	Domain string
+	Client string
+	Proxy  *pool.Proxy
+	Since  time.Time // when the pin was made; zero if unknown
+}
+
+// key returns what the pin is keyed by.
+func (p Pin) key() string { return p.Domain + p.Client }
+
+// makePin returns the view of the pin stored under key. Callers hold
+// pinsMu.
+func (r *Rotator) makePin(key string, px *pool.Proxy) Pin {
+	pin := Pin{Proxy: px, Since: r.pinnedAt[key]}
+	if r.cfg.PinMode == PinClientIP {
+		pin.Client = key
+	} else {
+		pin.Domain = key
+	}
+	return pin
+}
+
+// pinKey returns the key a connection from clientIP to destination is pinned
+// under, or "" if it is not pinned at all: always in PinNone mode, and in
+// PinClientIP mode when the client IP is not known.
+func (r *Rotator) pinKey(clientIP, destination string) string {
+	switch r.cfg.PinMode {
+	case PinNone:
+		return ""
+	case PinClientIP:
+		return clientIP
+	}
+	return extractDomain(destination)
+}
+
+// Pins returns the current pins, sorted by domain or client IP.
+func (r *Rotator) Pins() []Pin {
+	r.pinsMu.RLock()
+	out := make([]Pin, 0, len(r.pins))
+	for key, px := range r.pins {
+		out = append(out, r.makePin(key, px))
+	}
+	r.pinsMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].key() < out[j].key() })
+	return out
+}
+
+// PinFor returns the pin a connection from clientIP to destination (a domain
+// or host:port) would use under Config.PinMode, or false if there is none.
+// Either argument may be empty when the mode does not need it.
+func (r *Rotator) PinFor(clientIP, destination string) (Pin, bool) {
+	key := r.pinKey(clientIP, destination)
+	if key == "" {
+		return Pin{}, false
+	}
+	r.pinsMu.RLock()
+	defer r.pinsMu.RUnlock()
+	px, ok := r.pins[key]
+	if !ok {
+		return Pin{}, false
+	}
+	return r.makePin(key, px), true
+}
+
+// setPin pins key to px, evicting the least recently used pin if that
+// takes the map over MaxPins.
+func (r *Rotator) setPin(key string, px *pool.Proxy) {
+	r.pins[key] = px
+	r.pinnedAt[key] = time.Now()
+	if r.cfg.MaxPins <= 0 {
+		return
+	}
+	r.touchPin(key)
+	for len(r.pins) > r.cfg.MaxPins {
+		oldest := r.pinLRU.Back()
+		if oldest == nil {
+			break
+		}
+		r.deletePin(oldest.Value.(string))
+		r.pinEvictions++
+	}
+}
+
+// touchPin marks key's pin as just used.
+func (r *Rotator) touchPin(key string) {
+	if r.cfg.MaxPins <= 0 {
+		return
+	}
+	if e, ok := r.pinElems[key]; ok {
+		r.pinLRU.MoveToFront(e)
+		return
+	}
+	r.pinElems[key] = r.pinLRU.PushFront(key)
+}
+
+// deletePin removes key's pin.
+func (r *Rotator) deletePin(key string) {
+	delete(r.pins, key)
+	delete(r.pinnedAt, key)
+	if e, ok := r.pinElems[key]; ok {
+		r.pinLRU.Remove(e)
+		delete(r.pinElems, key)
+	}
+}
+
+// PinStats returns the number of pins (domains or client IPs) and how many
+// pins have been evicted to stay within MaxPins.
+func (r *Rotator) PinStats() (pinned int, evictions int64) {
+	r.pinsMu.RLock()
+	defer r.pinsMu.RUnlock()
+	return len(r.pins), r.pinEvictions
+}
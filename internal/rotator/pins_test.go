@@ -0,0 +1,130 @@
+package rotator
+
+import (
+	"testing"
+)
+
+func TestPinMode(t *testing.T) {
+	type call struct {
+		client, destination string
+		wantPinned          bool // the seeded pin's proxy rather than the current one
+	}
+	cases := []struct {
+		mode     string
+		seed     []string // keys pinned to the non-current proxy beforehand
+		calls    []call
+		wantKeys []string // pins present afterwards
+	}{
+		{
+			mode: PinDomain,
+			seed: []string{"a.com"},
+			calls: []call{
+				{"10.0.0.1", "a.com:443", true},
+				{"10.0.0.2", "a.com:80", true},
+				{"10.0.0.1", "b.com:443", false},
+			},
+			wantKeys: []string{"a.com", "b.com"},
+		},
+		{
+			mode: PinClientIP,
+			seed: []string{"10.0.0.1"},
+			calls: []call{
+				{"10.0.0.1", "a.com:443", true},
+				{"10.0.0.1", "b.com:443", true},
+				{"10.0.0.2", "a.com:443", false},
+				{"", "a.com:443", false},
+			},
+			wantKeys: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			mode: PinNone,
+			calls: []call{
+				{"10.0.0.1", "a.com:443", false},
+				{"10.0.0.2", "b.com:443", false},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.mode, func(t *testing.T) {
+			p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+			r, err := New(p, Config{PinMode: tc.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cur := r.Current()
+			other := p.All()[0]
+			if other == cur {
+				other = p.All()[1]
+			}
+			for _, key := range tc.seed {
+				r.pins[key] = other
+			}
+
+			for _, c := range tc.calls {
+				want := cur
+				if c.wantPinned {
+					want = other
+				}
+				if got := r.ProxyForClient(c.client, c.destination); got != want {
+					t.Errorf("ProxyForClient(%q, %q) = %v, want %v", c.client, c.destination, got, want)
+				}
+			}
+			if len(r.pins) != len(tc.wantKeys) {
+				t.Errorf("pins = %v, want keys %v", r.pins, tc.wantKeys)
+			}
+			for _, key := range tc.wantKeys {
+				if _, ok := r.pins[key]; !ok {
+					t.Errorf("no pin for %q in %v", key, r.pins)
+				}
+			}
+		})
+	}
+}
+
+func TestPinMode_ClientIPClearedAfterRotation(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{PinMode: PinClientIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := r.ProxyForClient("10.0.0.1", "a.com:443")
+	pin, ok := r.PinFor("10.0.0.1", "")
+	if !ok || pin.Client != "10.0.0.1" || pin.Domain != "" || pin.Proxy != first {
+		t.Fatalf("PinFor = %+v, %v; want client 10.0.0.1 pinned to %v", pin, ok, first)
+	}
+	if pins := r.Pins(); len(pins) != 1 || pins[0].Client != "10.0.0.1" {
+		t.Errorf("Pins() = %+v, want the one client pin", pins)
+	}
+
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.PinFor("10.0.0.1", ""); ok {
+		t.Error("client pin survived its proxy rotating out")
+	}
+	if got := r.ProxyForClient("10.0.0.1", "b.com:443"); got == first || got != r.Current() {
+		t.Errorf("after rotation got %v, want the new current proxy (first was %v)", got, first)
+	}
+}
+
+func TestNew_PinMode(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080"})
+	if _, err := New(p, Config{PinMode: "session"}); err == nil {
+		t.Error("New accepted pin mode \"session\"")
+	}
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.cfg.PinMode != PinDomain {
+		t.Errorf("default pin mode = %q, want %q", r.cfg.PinMode, PinDomain)
+	}
+	r, err = New(p, Config{NoPinning: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.cfg.PinMode != PinNone {
+		t.Errorf("NoPinning pin mode = %q, want %q", r.cfg.PinMode, PinNone)
+	}
+}
@@ -0,0 +1,76 @@
+package rotator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// Policy overrides the rotation thresholds for one proxy group (the
+// group=<name> metadata on a proxy line). Zero fields fall back to the
+// global Config thresholds.
+type Policy struct {
+	RotateRequests   int64
+	RotateConnErrors int64
+	RotateHTTPErrors int64
+}
+
+// ParsePolicy parses a --group-policy value of the form
+//
+//	<group>:requests=N,conn-errors=N,http-errors=N
+//
+// Any subset of the keys may be given; each must be positive, since a zero
+// would silently fall back to the global threshold.
+func ParsePolicy(s string) (group string, p Policy, err error) {
+	group, spec, ok := strings.Cut(s, ":")
+	if !ok || group == "" || spec == "" {
+		return "", Policy{}, fmt.Errorf("group policy %q: want <group>:key=N[,key=N…]", s)
+	}
+	for _, kv := range strings.Split(spec, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return "", Policy{}, fmt.Errorf("group policy %q: bad entry %q", s, kv)
+		}
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n <= 0 {
+			return "", Policy{}, fmt.Errorf("group policy %q: %s must be a positive integer", s, key)
+		}
+		switch key {
+		case "requests":
+			p.RotateRequests = n
+		case "conn-errors":
+			p.RotateConnErrors = n
+		case "http-errors":
+			p.RotateHTTPErrors = n
+		default:
+			return "", Policy{}, fmt.Errorf("group policy %q: unknown key %q (use requests, conn-errors, http-errors)", s, key)
+		}
+	}
+	return group, p, nil
+}
+
+// policyFor returns the effective thresholds for px: its group's policy
+// with any unset field filled from the global config.
+func (r *Rotator) policyFor(px *pool.Proxy) Policy {
+	eff := Policy{
+		RotateRequests:   r.cfg.RotateRequests,
+		RotateConnErrors: r.cfg.RotateConnErrors,
+		RotateHTTPErrors: r.cfg.RotateHTTPErrors,
+	}
+	gp, ok := r.cfg.GroupPolicies[px.Group]
+	if !ok || px.Group == "" {
+		return eff
+	}
+	if gp.RotateRequests > 0 {
+		eff.RotateRequests = gp.RotateRequests
+	}
+	if gp.RotateConnErrors > 0 {
+		eff.RotateConnErrors = gp.RotateConnErrors
+	}
+	if gp.RotateHTTPErrors > 0 {
+		eff.RotateHTTPErrors = gp.RotateHTTPErrors
+	}
+	return eff
+}
@@ -0,0 +1,35 @@
+package rotator
+
+import (
+	"log"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// usable returns the alive proxies general traffic may be given: stable,
+// neither reserved nor out of budget, and not quarantined. If quarantine
+// has taken out every one of them, it falls back to the usable proxy
+// quarantined longest ago rather than leaving nothing to choose.
+func (r *Rotator) usable() []*pool.Proxy {
+	if alive := selectable(stable(r.pool.Alive())); len(alive) > 0 {
+		return alive
+	}
+	if q := selectable(stable(r.pool.Quarantined())); len(q) > 0 {
+		return q[:1]
+	}
+	return nil
+}
+
+// quarantine quarantines prev, the proxy a rotation just left, if the
+// rotation was triggered by its errors, so round-robin does not bring it
+// straight back.
+func (r *Rotator) quarantine(prev *pool.Proxy, triggers map[Trigger]bool) {
+	if r.cfg.QuarantineDuration <= 0 || prev == nil || prev == r.Current() {
+		return
+	}
+	if !triggers[TriggerConnErrors] && !triggers[TriggerHTTPErrors] && !triggers[TriggerTotalErrors] {
+		return
+	}
+	prev.Quarantine(r.cfg.QuarantineDuration)
+	log.Printf("[rotator] %s quarantined for %s", prev.String(), r.cfg.QuarantineDuration)
+}
@@ -0,0 +1,70 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuarantine_OnlyOtherProxyReserved(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := p.All()
+	all[1].Quarantine(time.Hour)
+	time.Sleep(time.Millisecond)
+	all[0].Quarantine(time.Hour)
+	if err := r.Reserve(all[2], "vip"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The only proxy out of quarantine is reserved, so selection falls
+	// back to the one quarantined longest ago.
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatalf("rotation with every usable proxy quarantined: %v", err)
+	}
+	if r.Current() != all[1] {
+		t.Errorf("current = %v, want %v, quarantined first", r.Current(), all[1])
+	}
+	if got := r.AlternativeTo(all[1]); got != nil {
+		t.Errorf("AlternativeTo = %v, want nil: the fallback is a single proxy", got)
+	}
+}
+
+func TestQuarantine_AfterErrorRotation(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	r, err := New(p, Config{RotateConnErrors: 1, QuarantineDuration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	defer r.Stop()
+
+	failing := r.Current()
+	gen := r.Generation()
+	r.RecordConnError(r.Current())
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for r.Generation() == gen {
+		if time.Now().After(deadline) {
+			t.Fatal("conn error did not rotate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if failing.QuarantinedUntil().IsZero() {
+		t.Fatal("proxy rotated away from for conn errors was not quarantined")
+	}
+
+	for i := 0; i < 4; i++ {
+		prev := r.Current()
+		if err := r.RotateNow("test"); err != nil {
+			t.Fatal(err)
+		}
+		if r.Current() == failing {
+			t.Fatalf("rotation %d went back to the quarantined proxy", i)
+		}
+		if !prev.QuarantinedUntil().IsZero() {
+			t.Fatal("a manual rotation quarantined the proxy it left")
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package rotator
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedRand is the rotator's source for its random choices (canary rolls,
+// the random strategy).
+// Each rotator has its own so tests can seed it and get the same choices on
+// every run; *rand.Rand is not safe for concurrent use, hence the lock.
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func newTimeSeededRand() *lockedRand {
+	return newLockedRand(time.Now().UnixNano())
+}
+
+// Intn returns a number in [0, n).
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Intn(n)
+}
+
+// Float64 returns a number in [0.0, 1.0).
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Float64()
+}
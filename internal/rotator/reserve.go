@@ -0,0 +1,102 @@
+package rotator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// A proxy reserved for a client label carries that client's connections
+// and nothing else: rotation, overflow, canary rolls and static routes all
+// pass it over, so general traffic never lands on it.
+
+// ErrReservedElsewhere is returned by Reserve when the proxy is already
+// reserved for another client.
+var ErrReservedElsewhere = errors.New("proxy is reserved for another client")
+
+// ErrLastProxy is returned by Reserve when reserving the proxy would leave
+// general traffic without an alive proxy.
+var ErrLastProxy = errors.New("no other alive proxy would be left for general traffic")
+
+// Reserve reserves px for client, or releases it if client is empty. Pins
+// to px are dropped and, if px is current, the rotator moves off it; while
+// rotation is paused that is impossible, so reserving the current proxy is
+// refused with ErrPaused and leaves it unreserved.
+func (r *Rotator) Reserve(px *pool.Proxy, client string) error {
+	if client == "" {
+		if prev := px.ReservedFor(); prev != "" {
+			px.SetReservedFor("")
+			log.Printf("[rotator] %s released from client %q", px.String(), prev)
+		}
+		return nil
+	}
+	if prev := px.ReservedFor(); prev == client {
+		return nil
+	} else if prev != "" {
+		return fmt.Errorf("%w (%q)", ErrReservedElsewhere, prev)
+	}
+	others := 0
+	for _, o := range selectable(stable(append(r.pool.Alive(), r.pool.Quarantined()...))) {
+		if o != px {
+			others++
+		}
+	}
+	if others == 0 {
+		return ErrLastProxy
+	}
+	if r.Current() == px && r.Paused() {
+		return ErrPaused
+	}
+
+	px.SetReservedFor(client)
+	log.Printf("[rotator] %s reserved for client %q", px.String(), client)
+
+	r.pinsMu.Lock()
+	for key, pinned := range r.pins {
+		if pinned == px {
+			r.deletePin(key)
+		}
+	}
+	r.pinsMu.Unlock()
+	if r.Current() == px {
+		err := r.pickNext(fmt.Sprintf("reserved for %q", client))
+		if errors.Is(err, ErrPaused) {
+			// Paused since the check above: general traffic stays on px.
+			px.SetReservedFor("")
+			log.Printf("[rotator] %s released from client %q: rotation is paused", px.String(), client)
+		}
+		return err
+	}
+	return nil
+}
+
+// ReservedProxy returns an alive proxy reserved for client with a free
+// connection slot, or nil if client has none. A quarantined proxy still
+// counts: it is the client's, and general traffic is no place to send the
+// client meanwhile.
+func (r *Rotator) ReservedProxy(client string) *pool.Proxy {
+	if client == "" {
+		return nil
+	}
+	for _, px := range r.pool.All() {
+		if px.ReservedFor() == client && px.IsAlive() && px.HasCapacity() {
+			return px
+		}
+	}
+	return nil
+}
+
+// selectable filters out the proxies general traffic must not be given:
+// those reserved for a client and those that have used up their
+// max-requests budget, which stay out until it is reset.
+func selectable(alive []*pool.Proxy) []*pool.Proxy {
+	out := make([]*pool.Proxy, 0, len(alive))
+	for _, px := range alive {
+		if !px.Exhausted() && px.ReservedFor() == "" {
+			out = append(out, px)
+		}
+	}
+	return out
+}
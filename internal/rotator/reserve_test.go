@@ -0,0 +1,93 @@
+package rotator
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vip := r.Current()
+	r.ProxyFor("example.com:443") // pins example.com to vip
+
+	if err := r.Reserve(vip, "vip"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() == vip {
+		t.Fatal("reserving the current proxy should rotate away from it")
+	}
+	if _, ok := r.PinFor("", "example.com"); ok {
+		t.Error("pins to a reserved proxy should be dropped")
+	}
+	for i := 0; i < 4; i++ {
+		if err := r.pickNext("test"); err != nil {
+			t.Fatal(err)
+		}
+		if r.Current() == vip || r.ProxyFor("example.com:443") == vip || r.AlternativeTo(nil) == vip {
+			t.Fatal("a reserved proxy was handed to general traffic")
+		}
+	}
+	if got := r.ReservedProxy("vip"); got != vip {
+		t.Errorf("ReservedProxy(vip) = %v, want %v", got, vip)
+	}
+	if got := r.ReservedProxy("other"); got != nil {
+		t.Errorf("ReservedProxy(other) = %v, want nil", got)
+	}
+	// Quarantine keeps a proxy out of rotation, not away from its client.
+	vip.Quarantine(time.Hour)
+	if got := r.ReservedProxy("vip"); got != vip {
+		t.Errorf("ReservedProxy(vip) = %v while quarantined, want %v", got, vip)
+	}
+	vip.Quarantine(0)
+
+	if err := r.Reserve(vip, "other"); !errors.Is(err, ErrReservedElsewhere) {
+		t.Errorf("reserving for a second client: err = %v, want ErrReservedElsewhere", err)
+	}
+	// A client may hold several proxies, but general traffic keeps one.
+	for _, px := range p.All() {
+		if px != vip && px != r.Current() {
+			if err := r.Reserve(px, "vip"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := r.Reserve(r.Current(), "vip"); !errors.Is(err, ErrLastProxy) {
+		t.Errorf("reserving the last shared proxy: err = %v, want ErrLastProxy", err)
+	}
+
+	if err := r.Reserve(vip, ""); err != nil {
+		t.Fatal(err)
+	}
+	if vip.ReservedFor() != "" {
+		t.Error("an empty client should release the proxy")
+	}
+}
+
+func TestReserve_CurrentWhilePaused(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := r.DrainCurrent()
+
+	if err := r.Reserve(cur, "vip"); !errors.Is(err, ErrPaused) {
+		t.Fatalf("reserving the current proxy while paused: err = %v, want ErrPaused", err)
+	}
+	if cur.ReservedFor() != "" || r.Current() != cur {
+		t.Errorf("reserved_for = %q, current = %v; want the current proxy still unreserved", cur.ReservedFor(), r.Current())
+	}
+	// Any other proxy can still be reserved.
+	other := p.All()[0]
+	if other == cur {
+		other = p.All()[1]
+	}
+	if err := r.Reserve(other, "vip"); err != nil {
+		t.Errorf("reserving another proxy while paused: %v", err)
+	}
+}
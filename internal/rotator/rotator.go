@@ -1,10 +1,11 @@
 // Package rotator manages the active proxy selection and all rotation triggers.
 //
 // Rotation sources:
-//   - Time interval  (--rotate-interval)
+//   - Time interval  (--rotate-interval, --rotate-schedule)
 //   - Request count  (--rotate-requests)
 //   - Conn errors    (--rotate-conn-errors) — ECONNRESET / handshake failures
 //   - HTTP errors    (--rotate-http-errors) — non-2xx/3xx codes reported via API
+//   - Total errors   (--rotate-total-errors) — weighted sum of the two above
 //   - Manual         (POST /api/rotate)
 //
 // On rotation the old proxy is drained (new connections go to the new proxy;
@@ -12,10 +13,13 @@
 package rotator
 
 import (
+	"container/list"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/drsoft-oss/proxyrotator/internal/pool"
@@ -27,10 +31,31 @@ type Config struct {
 	// Zero disables interval-based rotation.
 	RotateInterval time.Duration
 
+	// RotateSchedule varies the interval by time of day. Outside its windows
+	// RotateInterval applies (or nothing, if that is zero).
+	RotateSchedule Schedule
+
 	// RotateRequests rotates after this many requests have been served.
 	// Zero disables request-count rotation.
 	RotateRequests int64
 
+	// AdaptiveRequests is the base of a request-count threshold that
+	// follows each proxy's connection error rate: from twice the base for a
+	// proxy without errors down to half of it for a flaky one (see
+	// adaptiveLimit). It applies alongside RotateRequests. Zero disables.
+	AdaptiveRequests int64
+
+	// DestWeights makes a request to a domain (or any of its subdomains)
+	// count as this many requests towards RotateRequests, so expensive
+	// targets rotate sooner. Keys are lower-case domains; unlisted
+	// destinations weigh 1.
+	DestWeights map[string]int64
+
+	// RotateSuccesses rotates after this many requests have completed
+	// without a connection error and without an HTTP error reported for
+	// them. Zero disables.
+	RotateSuccesses int64
+
 	// RotateConnErrors rotates after this many connection-level errors
 	// (e.g. ECONNRESET, TLS handshake failure) on the current proxy.
 	// Zero disables.
@@ -41,11 +66,147 @@ type Config struct {
 	// Zero disables.
 	RotateHTTPErrors int64
 
+	// GroupPolicies overrides RotateRequests, RotateConnErrors and
+	// RotateHTTPErrors for proxies in the named group, so e.g. residential
+	// proxies can rotate on the first HTTP error while datacenter ones
+	// tolerate more.
+	GroupPolicies map[string]Policy
+
+	// RotateTotalErrors rotates once the weighted sum of connection and HTTP
+	// errors on the current proxy reaches this value, even if neither
+	// per-type threshold above has been hit. Zero disables.
+	RotateTotalErrors int64
+
+	// ConnErrorWeight and HTTPErrorWeight scale each error type in the
+	// combined RotateTotalErrors budget. Both default to 1 when zero.
+	ConnErrorWeight int64
+	HTTPErrorWeight int64
+
 	// HTTPErrorDedupWindow is the duration within which identical
 	// destination errors are counted only once (prevents request-queue
 	// flooding from triggering multiple rotations for the same event).
-	// Defaults to 2 seconds when zero.
+	// Defaults to 2 seconds when zero. It is also the grace period after a
+	// rotation during which error reports are discarded as belonging to the
+	// previous proxy, unless DestGrace overrides it.
 	HTTPErrorDedupWindow time.Duration
+
+	// DestGrace overrides the post-rotation grace period for a domain (or
+	// any of its subdomains), for destinations that keep failing for a
+	// while after the proxy changes, or that should count errors sooner.
+	// Keys are lower-case domains.
+	DestGrace map[string]time.Duration
+
+	// NoPinning disables pinning: every connection uses the current proxy
+	// and the pin map is never written. It is the same as PinMode PinNone.
+	NoPinning bool
+
+	// PinMode is what connections are pinned by: PinDomain (the default
+	// when empty), PinClientIP or PinNone.
+	PinMode string
+
+	// MaxPins caps the number of pins, by domain or by client IP. Beyond it
+	// the least recently used pin is evicted. Zero means no cap.
+	MaxPins int
+
+	// MaxResponseLatency rotates once the current proxy's moving-average
+	// response latency (request sent → first response byte) exceeds this
+	// value. Zero disables.
+	MaxResponseLatency time.Duration
+
+	// DestBlockProxies stops HTTP errors for a destination from counting
+	// towards rotation once this many distinct proxies have failed it within
+	// DestBlockWindow: the destination is blocking the content, not our
+	// proxies. Zero disables.
+	DestBlockProxies int
+
+	// DestBlockWindow is how long a proxy's failure of a destination is
+	// remembered for DestBlockProxies. Defaults to 10 minutes when zero.
+	DestBlockWindow time.Duration
+
+	// MinRotateInterval is the least time between two rotations. Triggers
+	// firing sooner after the last rotation are dropped; manual and signal
+	// rotations, and max-requests, are not held back. Zero disables.
+	MinRotateInterval time.Duration
+
+	// QuarantineDuration keeps a proxy rotated away from for connection,
+	// HTTP or total errors out of selection for this long (see
+	// pool.Proxy.Quarantine). Zero disables.
+	QuarantineDuration time.Duration
+
+	// ErrorSpikeRate is the share of failed status reports, across all
+	// destinations over the last minute, at which errors are taken to be
+	// the target's or the network's rather than the proxies' (e.g. 0.5).
+	// ErrorSpikeMode then decides what HTTP errors do. Zero disables.
+	ErrorSpikeRate float64
+
+	// ErrorSpikeMode is SpikeFailOpen (the default) or SpikeFailClosed.
+	ErrorSpikeMode string
+
+	// Strategy is how a rotation picks the next proxy: StrategyRoundRobin
+	// (the default), StrategyRandom or StrategyLeastConns.
+	Strategy string
+
+	// Diversify, DiversifySubnet or DiversifyASN, makes a rotation prefer
+	// proxies on another network than the outgoing one; see diversify.go.
+	// Empty disables it.
+	Diversify string
+
+	// NoAlternativeAction decides what a rotation does when the current
+	// proxy is the only alive one: NoAltReselect (the default), NoAltKeep or
+	// NoAltFail.
+	NoAlternativeAction string
+
+	// Routes statically maps domains to proxies (by ID, host:port, group or
+	// country), bypassing rotation for them; see LoadRoutes. Every route
+	// must name a proxy in the pool, or a group or country one of its
+	// proxies belongs to, when New is called.
+	Routes map[string]string
+
+	// RouteUnavailable is what a connection to a routed domain does while
+	// no routed proxy is usable: RouteFallback (the default), RouteFail or
+	// RouteQueue, which waits up to RouteQueueTimeout (default 10s). See
+	// CheckRoute.
+	RouteUnavailable  string
+	RouteQueueTimeout time.Duration
+
+	// PreserveCounters keeps a proxy's request and error counters
+	// accumulating across activations instead of zeroing them when it
+	// becomes current. Rotation thresholds still count per activation.
+	PreserveCounters bool
+
+	// OnRotate, if set, is called after every rotation (including the
+	// initial selection). It runs with the rotator's lock held, so it must
+	// return quickly and must not call back into the Rotator.
+	OnRotate func(Rotation)
+}
+
+// Actions for Config.NoAlternativeAction.
+const (
+	// NoAltReselect re-selects the current proxy as a new generation and
+	// resets its counters, as any other rotation would.
+	NoAltReselect = "reselect"
+
+	// NoAltKeep leaves the current proxy and its counters untouched and
+	// logs that the rotation had no effect.
+	NoAltKeep = "keep"
+
+	// NoAltFail marks the current proxy dead so the monitor has to find an
+	// alternative before it is used for rotation again.
+	NoAltFail = "fail"
+)
+
+// DeadNoAlternative is the dead reason recorded by NoAltFail.
+const DeadNoAlternative = "no_alternative"
+
+// Rotation describes one change of the active proxy, as passed to
+// Config.OnRotate.
+type Rotation struct {
+	Time           time.Time
+	Generation     int64
+	Reason         string
+	From           *pool.Proxy // nil for the initial selection
+	To             *pool.Proxy
+	OldActiveConns int64 // connections still open on From
 }
 
 // Rotator selects and rotates the active upstream proxy.
@@ -58,18 +219,54 @@ type Rotator struct {
 	poolIndex   int         // index into pool.Alive() slice
 	generation  int64       // increments on every rotation
 	rotatedAt   time.Time   // wall-clock time of last rotation
-
-	// Domain pinning: domain → pinned proxy (session-scoped).
-	// Cleared automatically when the pinned proxy is rotated out.
-	pins   map[string]*pool.Proxy
-	pinsMu sync.RWMutex
+	paused      bool        // between DrainCurrent and Resume
+	pauses      int64       // increments on every DrainCurrent that pauses
+
+	// Generation at which each proxy last became current, kept only with
+	// Diversify so round-robin can spread over the other network (guarded
+	// by mu); see nextIndex.
+	pickedAt map[*pool.Proxy]int64
+
+	// Pinning: domain or client IP (per Config.PinMode) → pinned proxy
+	// (session-scoped). Cleared automatically when the pinned proxy is
+	// rotated out.
+	pins     map[string]*pool.Proxy
+	pinnedAt map[string]time.Time // when each pin was set
+	pinsMu   sync.RWMutex
+
+	// Pins in least-recently-used order, front first, kept only with
+	// MaxPins (guarded by pinsMu); see pins.go.
+	pinLRU       *list.List
+	pinElems     map[string]*list.Element
+	pinEvictions int64
+
+	// Routed domains currently falling back because their proxy is dead
+	// (guarded by pinsMu).
+	routesDown map[string]bool
 
 	// HTTP error deduplication: tracks recently-seen (destination) entries.
 	recentHTTPErrors   map[string]time.Time
 	recentHTTPErrorsMu sync.Mutex
 
+	// Per-destination failing proxies (see DestBlockProxies).
+	destFailures   map[string]map[*pool.Proxy]time.Time
+	destFailuresMu sync.Mutex
+
 	// Channel used internally to trigger a rotation from any goroutine.
-	rotateCh chan string // value = reason string (for logging)
+	rotateCh chan rotateRequest
+
+	// Rotations performed per trigger (see TriggerCounts).
+	triggerCounts   map[Trigger]int64
+	triggerCountsMu sync.Mutex
+
+	// Rotation requests dropped on a full rotateCh (see DroppedTriggers).
+	droppedTriggers atomic.Int64
+
+	// Status reports over the last minute (see ErrorSpikeRate).
+	statuses statusWindow
+
+	// rand drives random choices; tests replace it with a seeded one.
+	rand *lockedRand
 
 	stop chan struct{}
 	wg   sync.WaitGroup
@@ -80,16 +277,88 @@ func New(p *pool.Pool, cfg Config) (*Rotator, error) {
 	if cfg.HTTPErrorDedupWindow == 0 {
 		cfg.HTTPErrorDedupWindow = 2 * time.Second
 	}
+	switch cfg.RouteUnavailable {
+	case "":
+		cfg.RouteUnavailable = RouteFallback
+	case RouteFallback, RouteFail, RouteQueue:
+	default:
+		return nil, fmt.Errorf("unknown route-unavailable policy %q (want %s, %s or %s)",
+			cfg.RouteUnavailable, RouteFallback, RouteFail, RouteQueue)
+	}
+	if cfg.RouteQueueTimeout == 0 {
+		cfg.RouteQueueTimeout = 10 * time.Second
+	}
+	switch cfg.Strategy {
+	case "":
+		cfg.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyRandom, StrategyLeastConns:
+	default:
+		return nil, fmt.Errorf("unknown rotation strategy %q (want %s, %s or %s)",
+			cfg.Strategy, StrategyRoundRobin, StrategyRandom, StrategyLeastConns)
+	}
+	switch cfg.ErrorSpikeMode {
+	case "":
+		cfg.ErrorSpikeMode = SpikeFailOpen
+	case SpikeFailOpen, SpikeFailClosed:
+	default:
+		return nil, fmt.Errorf("unknown error spike mode %q (want %s or %s)",
+			cfg.ErrorSpikeMode, SpikeFailOpen, SpikeFailClosed)
+	}
+	switch cfg.PinMode {
+	case "":
+		cfg.PinMode = PinDomain
+	case PinDomain, PinClientIP, PinNone:
+	default:
+		return nil, fmt.Errorf("unknown pin mode %q (want %s, %s or %s)",
+			cfg.PinMode, PinDomain, PinClientIP, PinNone)
+	}
+	if cfg.NoPinning {
+		cfg.PinMode = PinNone
+	}
+	switch cfg.Diversify {
+	case "", DiversifySubnet, DiversifyASN:
+	default:
+		return nil, fmt.Errorf("unknown diversify mode %q (want %s or %s)",
+			cfg.Diversify, DiversifySubnet, DiversifyASN)
+	}
+	switch cfg.NoAlternativeAction {
+	case "":
+		cfg.NoAlternativeAction = NoAltReselect
+	case NoAltReselect, NoAltKeep, NoAltFail:
+	default:
+		return nil, fmt.Errorf("unknown no-alternative action %q (want %s, %s or %s)",
+			cfg.NoAlternativeAction, NoAltReselect, NoAltKeep, NoAltFail)
+	}
+	if cfg.DestBlockWindow == 0 {
+		cfg.DestBlockWindow = 10 * time.Minute
+	}
+	if cfg.ConnErrorWeight == 0 {
+		cfg.ConnErrorWeight = 1
+	}
+	if cfg.HTTPErrorWeight == 0 {
+		cfg.HTTPErrorWeight = 1
+	}
 
 	r := &Rotator{
 		pool:             p,
 		cfg:              cfg,
 		pins:             make(map[string]*pool.Proxy),
+		pinnedAt:         make(map[string]time.Time),
+		pickedAt:         make(map[*pool.Proxy]int64),
+		pinLRU:           list.New(),
+		pinElems:         make(map[string]*list.Element),
+		routesDown:       make(map[string]bool),
 		recentHTTPErrors: make(map[string]time.Time),
-		rotateCh:         make(chan string, 16),
+		destFailures:     make(map[string]map[*pool.Proxy]time.Time),
+		rotateCh:         make(chan rotateRequest, 16),
+		triggerCounts:    make(map[Trigger]int64),
+		rand:             newTimeSeededRand(),
 		stop:             make(chan struct{}),
 	}
 
+	if err := r.checkRoutes(); err != nil {
+		return nil, err
+	}
 	if err := r.pickNext("startup"); err != nil {
 		return nil, fmt.Errorf("no alive proxies in pool: %w", err)
 	}
@@ -113,69 +382,288 @@ func (r *Rotator) Generation() int64 {
 }
 
 // ProxyFor returns the proxy that should be used for a given destination
-// hostname. If the domain is pinned to a still-alive proxy, that proxy is
-// returned. Otherwise the current global proxy is returned (and the domain
-// is pinned to it for the rest of the session).
+// hostname, for a connection whose client is not known; see ProxyForClient.
 func (r *Rotator) ProxyFor(destination string) *pool.Proxy {
-	domain := extractDomain(destination)
+	return r.ProxyForClient("", destination)
+}
+
+// ProxyForClient returns the proxy that should be used for a connection
+// from clientIP to destination. If the connection's pin (its destination
+// domain, or clientIP, depending on Config.PinMode) points to a still-alive
+// proxy, that proxy is returned. Otherwise the current global proxy is
+// returned (and pinned for the rest of the session).
+//
+// Proxies at their max-conns cap are passed over: if neither the pin nor the
+// current proxy has a free slot, another alive proxy with capacity is
+// returned for this connection only, without changing the pin. Its
+// requests and errors count against that proxy, never the current one (see
+// RecordRequest). nil means no proxy has capacity.
+//
+// A connection picked for a canary proxy bypasses pinning entirely. A
+// domain with a static route (Config.Routes) goes to its routed proxy before
+// any of this, unless that proxy is dead.
+func (r *Rotator) ProxyForClient(clientIP, destination string) *pool.Proxy {
+	if len(r.cfg.Routes) > 0 {
+		if px := r.routedProxy(extractDomain(destination)); px != nil {
+			if px.HasCapacity() {
+				return px
+			}
+			return r.overflowProxy()
+		}
+	}
+	if px := r.canaryFor(); px != nil {
+		return px
+	}
+
+	key := r.pinKey(clientIP, destination)
+	if key == "" {
+		cur := r.Current()
+		if cur != nil && !cur.HasCapacity() {
+			return r.overflowProxy()
+		}
+		return cur
+	}
 
 	r.pinsMu.Lock()
 	defer r.pinsMu.Unlock()
 
-	if px, ok := r.pins[domain]; ok && px.IsAlive() {
-		return px
+	if px, ok := r.pins[key]; ok && px.IsAlive() {
+		r.touchPin(key)
+		if px.HasCapacity() {
+			return px
+		}
+		return r.overflowProxy()
 	}
 
 	// No valid pin — use (and pin) the current proxy.
 	cur := r.Current()
-	if cur != nil {
-		r.pins[domain] = cur
+	if cur == nil {
+		return nil
+	}
+	r.setPin(key, cur)
+	if !cur.HasCapacity() {
+		return r.overflowProxy()
 	}
 	return cur
 }
 
+// AlternativeTo returns an alive proxy with a free connection slot other
+// than those in failed, for retrying a request that failed on them. It does
+// not touch pins. nil means there is no such proxy.
+func (r *Rotator) AlternativeTo(failed ...*pool.Proxy) *pool.Proxy {
+	return r.overflowProxy(failed...)
+}
+
+// overflowProxy returns the first alive stable proxy not in exclude with a
+// free connection slot, or nil if every proxy is full. Reserved proxies are
+// never used.
+func (r *Rotator) overflowProxy(exclude ...*pool.Proxy) *pool.Proxy {
+	for _, px := range r.usable() {
+		if !slices.Contains(exclude, px) && px.HasCapacity() {
+			return px
+		}
+	}
+	return nil
+}
+
+// topTier returns the proxies of the highest priority in alive (which Alive
+// orders by priority) that has one with a free connection slot. If every
+// proxy is full, it is the highest priority overall. Rotation stays inside
+// that tier, so a lower priority is only used while every proxy above it is
+// dead or at its max-conns.
+func topTier(alive []*pool.Proxy) []*pool.Proxy {
+	start := 0
+	for i, px := range alive {
+		if px.HasCapacity() {
+			start = i
+			break
+		}
+	}
+	for start > 0 && alive[start-1].Priority == alive[start].Priority {
+		start--
+	}
+	end := start
+	for end < len(alive) && alive[end].Priority == alive[start].Priority {
+		end++
+	}
+	return alive[start:end]
+}
+
+// RotateNow rotates synchronously, bypassing the trigger queue. It is meant
+// for use before Start, e.g. to move off a proxy found dead at startup.
+func (r *Rotator) RotateNow(reason string) error {
+	return r.pickNext(reason)
+}
+
+// Reconcile brings the rotator in line with the pool after pool.Reload,
+// pool.Add or pool.Remove: pins to proxies no longer in the pool are dropped
+// and, if the current proxy was removed or replaced, or is missing or dead
+// while an alive proxy has turned up, a new one is picked. Connections already
+// open on the old proxies are unaffected.
+func (r *Rotator) Reconcile() error {
+	inPool := make(map[*pool.Proxy]bool)
+	for _, px := range r.pool.All() {
+		inPool[px] = true
+	}
+
+	r.pinsMu.Lock()
+	for key, px := range r.pins {
+		if !inPool[px] {
+			r.deletePin(key)
+		}
+	}
+	r.pinsMu.Unlock()
+
+	cur := r.Current()
+	switch {
+	case cur != nil && !inPool[cur]:
+		return r.pickNext("reload")
+	case (cur == nil || !cur.IsAlive()) && r.pool.AliveLen() > 0:
+		// Nothing usable was current and an alive proxy has turned up.
+		return r.pickNext("reload")
+	}
+	return nil
+}
+
 // ForceRotate queues a manual rotation.
 func (r *Rotator) ForceRotate() {
-	r.rotateCh <- "manual"
+	r.requestRotation(TriggerManual, string(TriggerManual))
 }
 
-// RecordRequest increments the request counter for the current proxy
-// and triggers a rotation if the request threshold is reached.
-func (r *Rotator) RecordRequest() {
-	r.mu.RLock()
-	cur := r.current
-	r.mu.RUnlock()
-	if cur == nil {
+// SignalRotate queues a rotation asked for by an OS signal. It is
+// ForceRotate logged and counted as TriggerSignal.
+func (r *Rotator) SignalRotate() {
+	r.requestRotation(TriggerSignal, string(TriggerSignal))
+}
+
+// RecordRequest increments the request counter of px by the weight of
+// destination (see DestWeights) and triggers a rotation if the request
+// threshold is reached. Requests on any proxy but the current one, such as
+// a static route's or an overflow's, are left out.
+func (r *Rotator) RecordRequest(px *pool.Proxy, destination string) {
+	cur := r.Current()
+	if cur == nil || px != cur {
 		return
 	}
-	n := cur.ReqCount.Add(1)
-	if r.cfg.RotateRequests > 0 && n >= r.cfg.RotateRequests {
-		r.rotateCh <- fmt.Sprintf("request-count=%d", n)
+	cur.ReqCount.Add(r.destWeight(destination))
+	n, _, _ := cur.Session()
+	if limit := r.policyFor(cur).RotateRequests; limit > 0 && n >= limit {
+		r.requestRotation(TriggerRequests, fmt.Sprintf("request-count=%d", n))
+	} else if r.cfg.AdaptiveRequests > 0 {
+		if limit := r.adaptiveLimit(cur); n >= limit {
+			r.requestRotation(TriggerRequests, fmt.Sprintf("request-count=%d (adaptive limit %d)", n, limit))
+		}
 	}
+	r.checkBudget(cur)
 }
 
-// RecordConnError increments the connection error counter for the current
-// proxy and triggers rotation when the threshold is exceeded.
-func (r *Rotator) RecordConnError() {
-	r.mu.RLock()
-	cur := r.current
-	r.mu.RUnlock()
-	if cur == nil {
+// CheckBudget triggers a rotation when px is the current proxy and has used
+// up its max-requests budget. RecordRequest does this itself; CheckBudget is
+// for requests that are left out of the request-count triggers but still
+// draw on the budget.
+func (r *Rotator) CheckBudget(px *pool.Proxy) {
+	if cur := r.Current(); cur != nil && px == cur {
+		r.checkBudget(cur)
+	}
+}
+
+// checkBudget triggers a rotation when cur has used up its max-requests
+// budget, whatever the global triggers say.
+func (r *Rotator) checkBudget(cur *pool.Proxy) {
+	if cur.Exhausted() {
+		r.requestRotation(TriggerMaxRequests, fmt.Sprintf("max-requests=%d", cur.MaxRequests))
+	}
+}
+
+// RecordCompletion counts one request that px carried to the end without a
+// connection error, and triggers a rotation when px is current and its
+// successful requests reach RotateSuccesses. Completions after px
+// has been rotated away are left out: they belong to a finished session.
+func (r *Rotator) RecordCompletion(px *pool.Proxy) {
+	if px != r.Current() {
+		return
+	}
+	px.Completed.Add(1)
+	if limit := r.cfg.RotateSuccesses; limit > 0 {
+		if n := px.SessionSuccesses(); n >= limit {
+			r.requestRotation(TriggerSuccesses, fmt.Sprintf("successful-requests=%d", n))
+		}
+	}
+}
+
+// minResponseLatencySamples is how many response latency samples a proxy
+// needs before MaxResponseLatency can rotate it away, so a single slow
+// response does not trigger a rotation.
+const minResponseLatencySamples = 5
+
+// RecordResponseLatency records the time from sending a request through px
+// to its first response byte, and triggers a rotation when px is current
+// and its moving average exceeds MaxResponseLatency.
+func (r *Rotator) RecordResponseLatency(px *pool.Proxy, d time.Duration) {
+	px.RecordResponseLatency(d)
+	if r.cfg.MaxResponseLatency <= 0 || px != r.Current() {
 		return
 	}
-	n := cur.ConnErrors.Add(1)
-	if r.cfg.RotateConnErrors > 0 && n >= r.cfg.RotateConnErrors {
-		r.rotateCh <- fmt.Sprintf("conn-errors=%d", n)
+	avg, n := px.ResponseLatency()
+	if n >= minResponseLatencySamples && avg > r.cfg.MaxResponseLatency {
+		r.requestRotation(TriggerResponseLatency, fmt.Sprintf("response-latency=%s", avg.Round(time.Millisecond)))
 	}
 }
 
+// RecordReportedLatency credits a request duration measured by the client to
+// the proxy that carried traffic for destination — its static route or
+// domain pin, else the current proxy — and returns that proxy (nil if there
+// is none). It feeds no rotation trigger.
+func (r *Rotator) RecordReportedLatency(destination string, d time.Duration) *pool.Proxy {
+	domain := extractDomain(destination)
+	px := r.routedProxy(domain)
+	if px == nil && r.cfg.PinMode == PinDomain {
+		r.pinsMu.RLock()
+		if pinned, ok := r.pins[domain]; ok {
+			px = pinned
+		}
+		r.pinsMu.RUnlock()
+	}
+	if px == nil {
+		px = r.Current()
+	}
+	if px != nil {
+		px.RecordReportedLatency(d)
+	}
+	return px
+}
+
+// RecordConnError increments the connection error counter of px and
+// triggers rotation when the threshold is exceeded. Only errors on the
+// current proxy count: a retry failing on some other proxy says nothing
+// about the current one and must not rotate it away.
+func (r *Rotator) RecordConnError(px *pool.Proxy) {
+	cur := r.Current()
+	if cur == nil || px != cur {
+		return
+	}
+	cur.ConnErrors.Add(1)
+	_, n, _ := cur.Session()
+	if limit := r.policyFor(cur).RotateConnErrors; limit > 0 && n >= limit {
+		r.requestRotation(TriggerConnErrors, fmt.Sprintf("conn-errors=%d", n))
+	} else if total, ok := r.totalErrorsReached(cur); ok {
+		r.requestRotation(TriggerTotalErrors, fmt.Sprintf("total-errors=%d", total))
+	}
+	r.checkBudget(cur)
+}
+
 // RecordHTTPError is called by the API when the crawler reports a non-2xx/3xx
 // response for a given destination. It deduplicates within the configured
 // window to handle queued requests all using the same (soon-to-be-rotated)
 // proxy.
-func (r *Rotator) RecordHTTPError(destination string) {
-	if r.cfg.RotateHTTPErrors <= 0 {
-		return
+//
+// It returns true when the destination is considered blocked (see
+// DestBlockProxies); such errors never count towards rotation. During an
+// error spike (see ErrorSpikeRate) errors are dropped, or each one rotates,
+// depending on ErrorSpikeMode.
+func (r *Rotator) RecordHTTPError(destination string) (blocked bool) {
+	if !r.tracksHTTPErrors() {
+		return false
 	}
 
 	domain := extractDomain(destination)
@@ -186,37 +674,78 @@ func (r *Rotator) RecordHTTPError(destination string) {
 	if seen && time.Since(last) < window {
 		// Already counted this destination within the dedup window — skip.
 		r.recentHTTPErrorsMu.Unlock()
-		return
+		return r.destBlocked(domain, nil)
 	}
 	r.recentHTTPErrors[domain] = time.Now()
 	r.recentHTTPErrorsMu.Unlock()
 
-	// Check if we rotated recently (grace period = dedup window).
-	// If so, the error almost certainly belongs to the old proxy.
-	// We skip the grace period on the very first proxy selection (rotatedAt
-	// is zero, meaning no rotation has actually happened yet).
+	// Check if we rotated recently (grace period = dedup window, or the
+	// domain's DestGrace). If so, the error almost certainly belongs to the
+	// old proxy. We skip the grace period on the very first proxy selection
+	// (rotatedAt is zero, meaning no rotation has actually happened yet).
 	r.mu.RLock()
 	rotatedAt := r.rotatedAt
 	cur := r.current
 	r.mu.RUnlock()
 
-	if !rotatedAt.IsZero() && time.Since(rotatedAt) < window {
-		return
+	if !rotatedAt.IsZero() && time.Since(rotatedAt) < r.graceFor(domain) {
+		return r.destBlocked(domain, nil)
 	}
 	if cur == nil {
-		return
+		return false
+	}
+	if r.destBlocked(domain, cur) {
+		return true
 	}
+	spike := r.ErrorSpike()
+	if spike && r.cfg.ErrorSpikeMode == SpikeFailOpen {
+		return false
+	}
+
+	cur.RecordHTTPError()
+	_, _, n := cur.Session()
+	if spike {
+		r.requestRotation(TriggerHTTPErrors, fmt.Sprintf("http-errors=%d destination=%s (error spike)", n, domain))
+	} else if limit := r.policyFor(cur).RotateHTTPErrors; limit > 0 && n >= limit {
+		r.requestRotation(TriggerHTTPErrors, fmt.Sprintf("http-errors=%d destination=%s", n, domain))
+	} else if total, ok := r.totalErrorsReached(cur); ok {
+		r.requestRotation(TriggerTotalErrors, fmt.Sprintf("total-errors=%d destination=%s", total, domain))
+	}
+	return false
+}
+
+// tracksHTTPErrors reports whether any threshold consumes HTTP errors.
+// RotateSuccesses does, by subtracting them.
+func (r *Rotator) tracksHTTPErrors() bool {
+	if r.cfg.RotateHTTPErrors > 0 || r.cfg.RotateTotalErrors > 0 || r.cfg.RotateSuccesses > 0 {
+		return true
+	}
+	if r.cfg.ErrorSpikeRate > 0 && r.cfg.ErrorSpikeMode == SpikeFailClosed {
+		return true
+	}
+	for _, gp := range r.cfg.GroupPolicies {
+		if gp.RotateHTTPErrors > 0 {
+			return true
+		}
+	}
+	return false
+}
 
-	n := cur.HTTPErrors.Add(1)
-	if n >= r.cfg.RotateHTTPErrors {
-		r.rotateCh <- fmt.Sprintf("http-errors=%d destination=%s", n, domain)
+// totalErrorsReached reports the weighted conn+HTTP error total for px and
+// whether it has reached the combined RotateTotalErrors budget.
+func (r *Rotator) totalErrorsReached(px *pool.Proxy) (int64, bool) {
+	if r.cfg.RotateTotalErrors <= 0 {
+		return 0, false
 	}
+	_, connErrs, httpErrs := px.Session()
+	total := connErrs*r.cfg.ConnErrorWeight + httpErrs*r.cfg.HTTPErrorWeight
+	return total, total >= r.cfg.RotateTotalErrors
 }
 
 // Start launches background goroutines for interval rotation.
 // Call Stop to shut them down.
 func (r *Rotator) Start() {
-	if r.cfg.RotateInterval > 0 {
+	if r.cfg.RotateInterval > 0 || len(r.cfg.RotateSchedule) > 0 {
 		r.wg.Add(1)
 		go r.intervalLoop()
 	}
@@ -238,22 +767,56 @@ func (r *Rotator) Stop() {
 // Coalesces rapid back-to-back rotation requests.
 func (r *Rotator) rotationLoop() {
 	defer r.wg.Done()
+	var cooldownLogged time.Time // rotatedAt of the last suppression logged
+	var pauseLogged int64        // pauses count of the last pause logged
 	for {
 		select {
-		case reason := <-r.rotateCh:
+		case req := <-r.rotateCh:
 			// Drain any additional pending requests — if multiple triggers
 			// fired at once, we only need one rotation.
+			reason := req.reason
+			triggers := map[Trigger]bool{req.trigger: true}
 		drain:
 			for {
 				select {
 				case extra := <-r.rotateCh:
-					reason += "+" + extra
+					reason += "+" + extra.reason
+					triggers[extra.trigger] = true
 				default:
 					break drain
 				}
 			}
+			r.mu.RLock()
+			paused, pauses := r.paused, r.pauses
+			r.mu.RUnlock()
+			if paused {
+				// Dropped, not held: Resume makes a fresh selection anyway.
+				if pauses != pauseLogged {
+					log.Printf("[rotator] rotation (%s) dropped: paused while the current proxy drains (further triggers until resumed not logged)",
+						reason)
+					pauseLogged = pauses
+				}
+				continue
+			}
+			if left := r.cooldownLeft(triggers, time.Now()); left > 0 {
+				// Dropped, not deferred: triggers whose condition still
+				// holds fire again on the next request or error.
+				r.mu.RLock()
+				rotatedAt := r.rotatedAt
+				r.mu.RUnlock()
+				if rotatedAt != cooldownLogged {
+					log.Printf("[rotator] rotation (%s) suppressed: cooldown has %s left (further suppressions until the next rotation not logged)",
+						reason, left.Round(time.Millisecond))
+					cooldownLogged = rotatedAt
+				}
+				continue
+			}
+			gen, prev := r.Generation(), r.Current()
 			if err := r.pickNext(reason); err != nil {
 				log.Printf("[rotator] rotation failed (%s): %v", reason, err)
+			} else if r.Generation() != gen {
+				r.countTriggers(triggers)
+				r.quarantine(prev, triggers)
 			}
 		case <-r.stop:
 			return
@@ -263,53 +826,102 @@ func (r *Rotator) rotationLoop() {
 
 func (r *Rotator) intervalLoop() {
 	defer r.wg.Done()
-	ticker := time.NewTicker(r.cfg.RotateInterval)
-	defer ticker.Stop()
+	last := time.Now()
 	for {
+		now := time.Now()
+		rotate, wait := r.intervalStep(now, last)
+		if rotate {
+			r.requestRotation(TriggerInterval, string(TriggerInterval))
+			last = now
+		}
+		timer := time.NewTimer(wait)
 		select {
-		case <-ticker.C:
-			r.rotateCh <- "interval"
+		case <-timer.C:
 		case <-r.stop:
+			timer.Stop()
 			return
 		}
 	}
 }
 
+// intervalStep decides, at now, whether the interval trigger fires given
+// the previous firing (or start) at last, and how long to wait before
+// asking again. The interval in force is re-read from RotateSchedule every
+// time, and a wait never runs past the next schedule boundary, so entering
+// a shorter window takes effect straight away.
+func (r *Rotator) intervalStep(now, last time.Time) (rotate bool, wait time.Duration) {
+	interval := r.intervalAt(now)
+	if interval > 0 && now.Sub(last) >= interval {
+		rotate, last = true, now
+	}
+	wait = -1
+	if interval > 0 {
+		wait = last.Add(interval).Sub(now)
+	}
+	if len(r.cfg.RotateSchedule) > 0 {
+		if b := r.cfg.RotateSchedule.nextBoundary(now).Sub(now); wait < 0 || b < wait {
+			wait = b
+		}
+	}
+	return rotate, wait
+}
+
+// intervalAt returns the rotation interval in force at t; zero means none.
+func (r *Rotator) intervalAt(t time.Time) time.Duration {
+	if d, ok := r.cfg.RotateSchedule.IntervalAt(t); ok {
+		return d
+	}
+	return r.cfg.RotateInterval
+}
+
 // pickNext selects the next proxy from the alive pool (round-robin) and
 // updates the current proxy without killing in-flight connections.
 func (r *Rotator) pickNext(reason string) error {
-	alive := r.pool.Alive()
+	alive := r.usable()
 	if len(alive) == 0 {
-		return fmt.Errorf("no alive proxies")
+		if r.pool.AliveLen() == 0 && len(r.pool.Quarantined()) == 0 {
+			return fmt.Errorf("no alive proxies")
+		}
+		return fmt.Errorf("every alive proxy is reserved or has used up its max-requests")
 	}
+	tier := topTier(alive)
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// Move to next index (wrapping)
-	if r.current == nil {
-		r.poolIndex = 0
-	} else {
-		// Find current proxy in alive list to keep position meaningful
-		cur := r.current
-		found := -1
-		for i, px := range alive {
-			if px == cur {
-				found = i
-				break
-			}
-		}
-		if found >= 0 {
-			r.poolIndex = (found + 1) % len(alive)
-		} else {
-			// Current proxy not alive anymore — start from index 0
-			r.poolIndex = 0
+	if r.paused {
+		return ErrPaused
+	}
+	if len(tier) < len(alive) && len(tier) == 1 && tier[0] == r.current {
+		log.Printf("[rotator] rotation (%s) had no effect: %s is the only usable proxy with priority %d",
+			reason, r.current.String(), r.current.Priority)
+		return nil
+	}
+	alive = tier
+	if len(alive) == 1 && alive[0] == r.current {
+		switch r.cfg.NoAlternativeAction {
+		case NoAltKeep:
+			log.Printf("[rotator] rotation (%s) had no effect: %s is the only alive proxy", reason, r.current.String())
+			return nil
+		case NoAltFail:
+			r.current.MarkDead(DeadNoAlternative)
+			return fmt.Errorf("%s is the only alive proxy; marked it dead", r.current.String())
 		}
 	}
 
+	avoid, sameOnly := r.diversify(alive)
+	if sameOnly {
+		log.Printf("[rotator] rotation (%s): no alive proxy outside %s's %s %s, using any",
+			reason, r.current.String(), r.cfg.Diversify, r.networkKey(r.current))
+	}
+	r.poolIndex = r.nextIndex(alive, avoid)
+
 	prev := r.current
 	r.current = alive[r.poolIndex]
 	r.generation++
+	if r.cfg.Diversify != "" {
+		r.notePicked(alive)
+	}
 	// Only stamp the rotation time when we're actually switching away from a
 	// previous proxy. On the very first call (startup) prev is nil and no
 	// grace period should apply to incoming error reports.
@@ -317,15 +929,20 @@ func (r *Rotator) pickNext(reason string) error {
 		r.rotatedAt = time.Now()
 	}
 
-	// Reset error counters on the newly activated proxy
-	r.current.ResetErrorCounters()
+	// Reset error counters on the newly activated proxy, or with
+	// PreserveCounters just restart its session count.
+	if r.cfg.PreserveCounters {
+		r.current.StartSession()
+	} else {
+		r.current.ResetErrorCounters()
+	}
 
-	// Invalidate any domain pins that pointed to the old proxy
+	// Invalidate any pins that pointed to the old proxy
 	if prev != nil && prev != r.current {
 		r.pinsMu.Lock()
-		for domain, px := range r.pins {
+		for key, px := range r.pins {
 			if px == prev {
-				delete(r.pins, domain)
+				r.deletePin(key)
 			}
 		}
 		r.pinsMu.Unlock()
@@ -335,15 +952,23 @@ func (r *Rotator) pickNext(reason string) error {
 	if prev != nil {
 		prevStr = prev.String()
 	}
+	var oldConns int64
+	if prev != nil {
+		oldConns = prev.ActiveConns.Load()
+	}
 	log.Printf("[rotator] rotation #%d (%s): %s → %s (active_conns_old=%d)",
-		r.generation, reason, prevStr, r.current.String(),
-		func() int64 {
-			if prev != nil {
-				return prev.ActiveConns.Load()
-			}
-			return 0
-		}(),
-	)
+		r.generation, reason, prevStr, r.current.String(), oldConns)
+
+	if r.cfg.OnRotate != nil {
+		r.cfg.OnRotate(Rotation{
+			Time:           time.Now(),
+			Generation:     r.generation,
+			Reason:         reason,
+			From:           prev,
+			To:             r.current,
+			OldActiveConns: oldConns,
+		})
+	}
 	return nil
 }
 
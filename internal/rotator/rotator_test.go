@@ -2,6 +2,7 @@ package rotator
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -11,22 +12,18 @@ import (
 // makePool creates a pool from a slice of proxy URIs.
 func makePool(t *testing.T, uris []string) *pool.Pool {
 	t.Helper()
-	f, err := os.CreateTemp(t.TempDir(), "proxies*.txt")
-	if err != nil {
-		t.Fatal(err)
-	}
-	for _, u := range uris {
-		f.WriteString(u + "\n")
-	}
-	f.Close()
-
 	p := pool.New(false)
-	if err := p.LoadFile(f.Name()); err != nil {
+	if err := p.LoadProxies(uris); err != nil {
 		t.Fatal(err)
 	}
 	return p
 }
 
+// seedRand makes r's random choices the same on every run.
+func seedRand(r *Rotator, seed int64) {
+	r.rand = newLockedRand(seed)
+}
+
 func TestNew_PicksFirstProxy(t *testing.T) {
 	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
 	r, err := New(p, Config{})
@@ -73,6 +70,144 @@ func TestForceRotate(t *testing.T) {
 	t.Error("generation did not increment after ForceRotate")
 }
 
+func TestPickNext_NeverReselectsCurrent(t *testing.T) {
+	// Each rotation makes the current proxy the fastest, so it sorts to the
+	// front of the alive list, and the idlest, so least-conns would pick it
+	// again: only the exclusion of the current proxy keeps it from winning.
+	for _, strategy := range []string{StrategyRoundRobin, StrategyRandom, StrategyLeastConns} {
+		t.Run(strategy, func(t *testing.T) {
+			p := pool.New(true) // latency sort enabled
+			if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"}); err != nil {
+				t.Fatal(err)
+			}
+			r, err := New(p, Config{Strategy: strategy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			seedRand(r, 1)
+
+			for i := 0; i < 30; i++ {
+				cur := r.Current()
+				for _, px := range p.All() {
+					if px == cur {
+						px.SetLatency(time.Millisecond)
+						px.ActiveConns.Store(0)
+					} else {
+						px.SetLatency(time.Duration(100+i) * time.Millisecond)
+						px.ActiveConns.Store(5)
+					}
+				}
+				if err := r.pickNext("test"); err != nil {
+					t.Fatal(err)
+				}
+				if r.Current() == cur {
+					t.Fatalf("rotation %d reselected the same proxy %s", i, cur)
+				}
+			}
+		})
+	}
+}
+
+func TestOnRotate(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	var events []Rotation
+	r, err := New(p, Config{OnRotate: func(ev Rotation) { events = append(events, ev) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := r.Current()
+	first.ActiveConns.Add(2)
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("got %d rotation events, want 2 (startup + test)", len(events))
+	}
+	if ev := events[0]; ev.From != nil || ev.To != first || ev.Reason != "startup" {
+		t.Errorf("startup event = %+v", ev)
+	}
+	ev := events[1]
+	if ev.From != first || ev.To != r.Current() || ev.Reason != "test" || ev.Generation != 2 || ev.OldActiveConns != 2 {
+		t.Errorf("rotation event = %+v", ev)
+	}
+}
+
+func TestPickNext_SingleAliveProxy(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := r.Current()
+	for _, px := range p.All() {
+		if px != cur {
+			px.SetAlive(false)
+		}
+	}
+	if err := r.pickNext("test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != cur {
+		t.Error("expected the only alive proxy to be reselected")
+	}
+}
+
+func TestNoAlternativeAction(t *testing.T) {
+	// singleAlive returns a rotator whose current proxy is the only alive one
+	// and has some error counts.
+	singleAlive := func(t *testing.T, action string) *Rotator {
+		t.Helper()
+		p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+		r, err := New(p, Config{NoAlternativeAction: action})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.All()[1].SetAlive(false)
+		r.Current().ConnErrors.Store(3)
+		return r
+	}
+
+	t.Run("reselect", func(t *testing.T) {
+		r := singleAlive(t, NoAltReselect)
+		gen := r.Generation()
+		if err := r.pickNext("test"); err != nil {
+			t.Fatal(err)
+		}
+		if r.Generation() != gen+1 || r.Current().ConnErrors.Load() != 0 {
+			t.Error("reselect should start a new generation and reset counters")
+		}
+	})
+
+	t.Run("keep", func(t *testing.T) {
+		r := singleAlive(t, NoAltKeep)
+		gen := r.Generation()
+		if err := r.pickNext("test"); err != nil {
+			t.Fatal(err)
+		}
+		if r.Generation() != gen || r.Current().ConnErrors.Load() != 3 {
+			t.Error("keep should leave generation and counters untouched")
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		r := singleAlive(t, NoAltFail)
+		cur := r.Current()
+		if err := r.pickNext("test"); err == nil {
+			t.Fatal("expected an error")
+		}
+		if cur.IsAlive() || cur.DeadReason() != DeadNoAlternative {
+			t.Errorf("fail should mark the proxy dead, got alive=%v reason=%q", cur.IsAlive(), cur.DeadReason())
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := New(makePool(t, []string{"http://1.2.3.4:8080"}), Config{NoAlternativeAction: "bogus"}); err == nil {
+			t.Error("expected an error for an unknown action")
+		}
+	})
+}
+
 func TestRotateOnRequestCount(t *testing.T) {
 	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
 	r, err := New(p, Config{RotateRequests: 3})
@@ -85,9 +220,9 @@ func TestRotateOnRequestCount(t *testing.T) {
 	gen0 := r.Generation()
 
 	// Fire 3 requests
-	r.RecordRequest()
-	r.RecordRequest()
-	r.RecordRequest()
+	r.RecordRequest(r.Current(), "example.com:443")
+	r.RecordRequest(r.Current(), "example.com:443")
+	r.RecordRequest(r.Current(), "example.com:443")
 
 	deadline := time.Now().Add(500 * time.Millisecond)
 	for time.Now().Before(deadline) {
@@ -99,6 +234,148 @@ func TestRotateOnRequestCount(t *testing.T) {
 	t.Error("rotation did not fire after reaching request count threshold")
 }
 
+func TestRecordRequest_DestWeights(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{
+		RotateRequests: 10,
+		DestWeights:    map[string]int64{"heavy.com": 5, "img.heavy.com": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := r.Current()
+
+	for dest, want := range map[string]int64{
+		"cheap.com:443":       1,
+		"heavy.com:443":       5,
+		"api.heavy.com:443":   5,
+		"img.heavy.com:443":   2,
+		"notheavy.com:443":    1,
+		"a.img.heavy.com:443": 2,
+	} {
+		before := cur.ReqCount.Load()
+		r.RecordRequest(r.Current(), dest)
+		if got := cur.ReqCount.Load() - before; got != want {
+			t.Errorf("%s counted %d, want %d", dest, got, want)
+		}
+	}
+	// 16 weighted requests have passed the threshold of 10.
+	if req := <-r.rotateCh; req.trigger != TriggerRequests {
+		t.Errorf("trigger = %s, want %s", req.trigger, TriggerRequests)
+	}
+}
+
+func TestParseDestWeight(t *testing.T) {
+	domain, w, err := ParseDestWeight("Heavy.com=5")
+	if err != nil || domain != "heavy.com" || w != 5 {
+		t.Errorf("ParseDestWeight = %q, %d, %v; want heavy.com, 5", domain, w, err)
+	}
+	for _, bad := range []string{"heavy.com", "=5", "heavy.com=0", "heavy.com=x"} {
+		if _, _, err := ParseDestWeight(bad); err == nil {
+			t.Errorf("ParseDestWeight(%q): expected error", bad)
+		}
+	}
+}
+
+func TestRotateOnSuccessfulRequests(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{RotateSuccesses: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := r.Current()
+
+	// Three completions, the first of which the client reported as an HTTP
+	// error.
+	r.RecordCompletion(cur)
+	r.RecordHTTPError("example.com:443")
+	r.RecordCompletion(cur)
+	r.RecordCompletion(cur)
+	if n := len(r.rotateCh); n != 0 {
+		t.Fatalf("rotation queued after 2 successful requests (%d queued)", n)
+	}
+
+	// Completions on a proxy that is not current do not count.
+	for _, px := range p.All() {
+		if px != cur {
+			r.RecordCompletion(px)
+		}
+	}
+	if n := len(r.rotateCh); n != 0 {
+		t.Fatalf("completion on another proxy queued a rotation (%d queued)", n)
+	}
+
+	r.RecordCompletion(cur)
+	if req := <-r.rotateCh; req.trigger != TriggerSuccesses {
+		t.Errorf("trigger = %s, want %s", req.trigger, TriggerSuccesses)
+	}
+}
+
+func TestPreserveCounters(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{PreserveCounters: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := r.Current()
+	r.RecordRequest(r.Current(), "example.com:443")
+	r.RecordRequest(r.Current(), "example.com:443")
+	r.RecordConnError(r.Current())
+
+	// Rotate away and back again.
+	for i := 0; i < 2; i++ {
+		if err := r.RotateNow("test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Current() != first {
+		t.Fatalf("expected to be back on %s, got %s", first, r.Current())
+	}
+	if n := first.ReqCount.Load(); n != 2 {
+		t.Errorf("req_count = %d, want 2 kept across activations", n)
+	}
+	if n := first.ConnErrors.Load(); n != 1 {
+		t.Errorf("conn_errors = %d, want 1 kept across activations", n)
+	}
+
+	r.RecordRequest(r.Current(), "example.com:443")
+	if reqs, connErrs, _ := first.Session(); reqs != 1 || connErrs != 0 {
+		t.Errorf("session = %d reqs, %d conn errors; want 1, 0", reqs, connErrs)
+	}
+}
+
+func TestRotateOnResponseLatency(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{MaxResponseLatency: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	defer r.Stop()
+
+	cur := r.Current()
+	gen0 := r.Generation()
+
+	// Slow samples below the minimum count must not rotate yet.
+	for i := 0; i < minResponseLatencySamples-1; i++ {
+		r.RecordResponseLatency(cur, 2*time.Second)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if r.Generation() != gen0 {
+		t.Fatal("rotated before enough response latency samples")
+	}
+
+	r.RecordResponseLatency(cur, 2*time.Second)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if r.Generation() != gen0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("rotation did not fire after response latency exceeded the threshold")
+}
+
 func TestRotateOnConnErrors(t *testing.T) {
 	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
 	r, err := New(p, Config{RotateConnErrors: 2})
@@ -109,8 +386,8 @@ func TestRotateOnConnErrors(t *testing.T) {
 	defer r.Stop()
 
 	gen0 := r.Generation()
-	r.RecordConnError()
-	r.RecordConnError()
+	r.RecordConnError(r.Current())
+	r.RecordConnError(r.Current())
 
 	deadline := time.Now().Add(500 * time.Millisecond)
 	for time.Now().Before(deadline) {
@@ -122,6 +399,116 @@ func TestRotateOnConnErrors(t *testing.T) {
 	t.Error("rotation did not fire after reaching conn-error threshold")
 }
 
+func TestRotateOnTotalErrors(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{
+		RotateConnErrors:     3,
+		RotateHTTPErrors:     3,
+		RotateTotalErrors:    4,
+		HTTPErrorDedupWindow: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	defer r.Stop()
+
+	gen0 := r.Generation()
+
+	// 2 conn errors + 2 HTTP errors: neither per-type threshold (3) is hit,
+	// but the combined budget (4) is.
+	r.RecordConnError(r.Current())
+	r.RecordConnError(r.Current())
+	r.RecordHTTPError("site-a.com")
+	time.Sleep(20 * time.Millisecond)
+	if r.Generation() != gen0 {
+		t.Fatal("rotated before the combined budget was reached")
+	}
+	r.RecordHTTPError("site-b.com")
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if r.Generation() != gen0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("rotation did not fire after reaching combined error budget")
+}
+
+func TestTotalErrorsWeighted(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{RotateTotalErrors: 5, ConnErrorWeight: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := r.Current()
+	cur.ConnErrors.Store(2)
+	cur.HTTPErrors.Store(1)
+	if total, ok := r.totalErrorsReached(cur); !ok || total != 5 {
+		t.Errorf("totalErrorsReached = (%d, %v), want (5, true)", total, ok)
+	}
+}
+
+func TestGroupPolicy_OverridesThreshold(t *testing.T) {
+	p := makePool(t, []string{
+		"http://1.2.3.4:8080 group=residential",
+		"http://5.6.7.8:8080 group=datacenter",
+	})
+	r, err := New(p, Config{
+		RotateConnErrors: 5,
+		GroupPolicies: map[string]Policy{
+			"residential": {RotateConnErrors: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	defer r.Stop()
+
+	if r.Current().Group != "residential" {
+		t.Fatalf("expected residential proxy first, got %q", r.Current().Group)
+	}
+	gen0 := r.Generation()
+	r.RecordConnError(r.Current()) // residential: 1 error is enough
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for r.Generation() == gen0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.Generation() == gen0 {
+		t.Fatal("residential proxy did not rotate after its group threshold")
+	}
+
+	// datacenter falls back to the global threshold of 5
+	gen1 := r.Generation()
+	for i := 0; i < 4; i++ {
+		r.RecordConnError(r.Current())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if r.Generation() != gen1 {
+		t.Error("datacenter proxy rotated before the global threshold")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	group, pol, err := ParsePolicy("residential:http-errors=1,conn-errors=2,requests=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Policy{RotateRequests: 100, RotateConnErrors: 2, RotateHTTPErrors: 1}
+	if group != "residential" || pol != want {
+		t.Errorf("ParsePolicy = (%q, %+v), want (residential, %+v)", group, pol, want)
+	}
+
+	for _, bad := range []string{"residential", ":http-errors=1", "dc:http-errors", "dc:retries=3", "dc:requests=-1", "dc:http-errors=0"} {
+		if _, _, err := ParsePolicy(bad); err == nil {
+			t.Errorf("ParsePolicy(%q): expected error", bad)
+		}
+	}
+}
+
 func TestDomainPinning_StickyForSession(t *testing.T) {
 	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
 	r, err := New(p, Config{})
@@ -151,6 +538,134 @@ func TestDomainPinning_StickyForSession(t *testing.T) {
 	}
 }
 
+func TestProxyFor_OverflowsWhenFull(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080 max-conns=1", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := p.All()[0], p.All()[1]
+
+	if got := r.ProxyFor("example.com:443"); got != first {
+		t.Fatalf("expected current proxy %s, got %v", first, got)
+	}
+	if !first.AcquireConn() {
+		t.Fatal("AcquireConn on empty proxy failed")
+	}
+
+	// The pin is full: this connection overflows, but the pin is kept.
+	if got := r.ProxyFor("example.com:443"); got != second {
+		t.Errorf("expected overflow to %s, got %v", second, got)
+	}
+	first.ReleaseConn()
+	if got := r.ProxyFor("example.com:443"); got != first {
+		t.Errorf("expected pinned proxy once it has capacity, got %v", got)
+	}
+
+	// Nothing has capacity → nil.
+	first.AcquireConn()
+	second.MaxConns = 1
+	second.AcquireConn()
+	if got := r.ProxyFor("example.com:443"); got != nil {
+		t.Errorf("expected nil with every proxy full, got %s", got)
+	}
+}
+
+func TestRotate_PriorityTiers(t *testing.T) {
+	p := makePool(t, []string{
+		"http://1.2.3.4:8080",
+		"http://5.6.7.8:8080 priority=1 max-conns=1",
+		"http://9.10.11.12:8080 priority=1",
+	})
+	low, a, b := p.All()[0], p.All()[1], p.All()[2]
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != a {
+		t.Fatalf("startup picked %v, want the first priority-1 proxy", r.Current())
+	}
+
+	// Rotation cycles within the top tier.
+	for _, want := range []*pool.Proxy{b, a, b} {
+		if err := r.RotateNow("test"); err != nil {
+			t.Fatal(err)
+		}
+		if r.Current() != want {
+			t.Fatalf("rotated to %v, want %v", r.Current(), want)
+		}
+	}
+
+	// With b dead and a full, the lower tier is used.
+	b.MarkDead("test")
+	a.AcquireConn()
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != low {
+		t.Errorf("rotated to %v, want the priority-0 proxy", r.Current())
+	}
+
+	// Once a has room again, it is the only top-tier proxy and is kept.
+	a.ReleaseConn()
+	if err := r.RotateNow("test"); err != nil || r.Current() != a {
+		t.Fatalf("rotated to %v (%v), want %v", r.Current(), err, a)
+	}
+	if err := r.RotateNow("test"); err != nil || r.Current() != a {
+		t.Errorf("rotation left the top tier for %v (%v)", r.Current(), err)
+	}
+}
+
+func TestMaxPins_EvictsLeastRecentlyUsed(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{MaxPins: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.ProxyFor("a.com:443")
+	r.ProxyFor("b.com:443")
+	r.ProxyFor("a.com:443") // b.com is now the least recently used
+	r.ProxyFor("c.com:443")
+
+	if n, evicted := r.PinStats(); n != 2 || evicted != 1 {
+		t.Errorf("PinStats = %d, %d; want 2, 1", n, evicted)
+	}
+	if _, ok := r.pins["b.com"]; ok {
+		t.Error("b.com should have been evicted")
+	}
+	if _, ok := r.pins["a.com"]; !ok {
+		t.Error("a.com was used recently and should still be pinned")
+	}
+
+	// Pins dropped on rotation leave the LRU list too.
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.pinLRU.Len() != len(r.pins) {
+		t.Errorf("LRU list holds %d entries for %d pins", r.pinLRU.Len(), len(r.pins))
+	}
+}
+
+func TestNoPinning(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{NoPinning: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := r.ProxyFor("example.com:443")
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.ProxyFor("example.com:443"); got == first || got != r.Current() {
+		t.Errorf("expected the new current proxy after rotation, got %v (first was %v)", got, first)
+	}
+	if len(r.pins) != 0 {
+		t.Errorf("pin map has %d entries, want none", len(r.pins))
+	}
+}
+
 func TestDomainPinning_ClearedAfterRotation(t *testing.T) {
 	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
 	r, err := New(p, Config{})
@@ -252,3 +767,84 @@ func TestExtractDomain(t *testing.T) {
 		}
 	}
 }
+
+func TestReconcile_AfterReload(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "proxies.txt")
+	if err := os.WriteFile(list, []byte("http://1.2.3.4:8080\nhttp://5.6.7.8:8080\nhttp://9.10.11.12:8080\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := pool.New(false)
+	if err := p.LoadFile(list); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := r.Current()
+	if px := r.ProxyFor("example.com:443"); px != first {
+		t.Fatalf("expected example.com pinned to %s", first)
+	}
+
+	// Drop the current proxy from the list.
+	if err := os.WriteFile(list, []byte("http://5.6.7.8:8080\nhttp://9.10.11.12:8080\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+
+	cur := r.Current()
+	if cur == first {
+		t.Fatal("removed proxy should no longer be current")
+	}
+	if px := r.ProxyFor("example.com:443"); px != cur {
+		t.Errorf("pin to the removed proxy should be dropped, got %s", px)
+	}
+}
+
+func TestRotateOnMaxRequests(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080 max-requests=2", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{RotateRequests: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	capped := r.Current()
+	if capped.MaxRequests != 2 {
+		t.Fatalf("current proxy should be the capped one, got %s", capped)
+	}
+
+	for i := 0; i < 2; i++ {
+		if !capped.AcquireConn() {
+			t.Fatalf("AcquireConn %d failed within the budget", i)
+		}
+		r.RecordRequest(r.Current(), "example.com:443")
+	}
+	if req := <-r.rotateCh; req.trigger != TriggerMaxRequests {
+		t.Errorf("trigger = %s, want %s", req.trigger, TriggerMaxRequests)
+	}
+	if err := r.pickNext("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The exhausted proxy is never selected again until its budget is reset.
+	for i := 0; i < 3; i++ {
+		if r.Current() == capped {
+			t.Fatal("rotation selected a proxy with its budget used up")
+		}
+		if px := r.ProxyFor("other.com:443"); px == capped {
+			t.Fatal("ProxyFor returned a proxy with its budget used up")
+		}
+		_ = r.pickNext("test")
+	}
+	capped.ResetBudget()
+	if err := r.pickNext("test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != capped {
+		t.Error("a reset proxy should be selectable again")
+	}
+}
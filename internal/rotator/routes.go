@@ -0,0 +1,258 @@
+package rotator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// Static routes (Config.Routes) send every connection for a domain to one
+// fixed proxy, or to the proxies of one group or country, ahead of
+// canaries, pins and the current proxy. They are for the few targets that
+// must always leave through a proxy known to work there, or from a given
+// region. While no routed proxy is alive, the domain falls back to normal
+// selection, unless Config.RouteUnavailable says to fail or wait instead.
+
+// Policies for Config.RouteUnavailable: what a connection to a routed
+// domain does while none of its proxies is alive with a free slot.
+const (
+	// RouteFallback uses normal selection, as if the domain had no route.
+	RouteFallback = "fallback"
+
+	// RouteFail refuses the connection (see RouteError).
+	RouteFail = "fail"
+
+	// RouteQueue waits up to Config.RouteQueueTimeout for a routed proxy,
+	// then refuses the connection.
+	RouteQueue = "queue"
+)
+
+// RouteError reports a connection refused because its static route could
+// not be honoured.
+type RouteError struct {
+	Domain string
+	Target string // the routed proxy or constraint, as written in the routes file
+}
+
+func (e *RouteError) Error() string {
+	if kind, value, ok := routeConstraint(e.Target); ok {
+		return fmt.Sprintf("route %s -> %s: no alive proxy with %s %s has capacity", e.Domain, e.Target, kind, value)
+	}
+	return fmt.Sprintf("route %s -> %s: proxy is dead or at capacity", e.Domain, e.Target)
+}
+
+// CheckRoute applies Config.RouteUnavailable to a connection for
+// destination before ProxyFor selects its proxy. It returns nil when the
+// domain has no route, a routed proxy can take the connection, or the
+// policy is RouteFallback; otherwise, after waiting with RouteQueue, a
+// *RouteError. The wait wakes when the pool changes (see pool.Changed) and
+// ends with ctx's error once ctx is done, so a client that hangs up stops
+// waiting.
+func (r *Rotator) CheckRoute(ctx context.Context, destination string) error {
+	if len(r.cfg.Routes) == 0 || r.cfg.RouteUnavailable == RouteFallback {
+		return nil
+	}
+	domain := extractDomain(destination)
+	target, ok := r.cfg.Routes[domain]
+	if !ok {
+		return nil
+	}
+	var expired <-chan time.Time
+	if r.cfg.RouteUnavailable == RouteQueue {
+		timer := time.NewTimer(r.cfg.RouteQueueTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		changed := r.pool.Changed()
+		if px := r.routedProxy(domain); px != nil && px.HasCapacity() {
+			return nil
+		}
+		if expired == nil {
+			return &RouteError{Domain: domain, Target: target}
+		}
+		select {
+		case <-changed:
+		case <-expired:
+			return &RouteError{Domain: domain, Target: target}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RouteQueues reports whether CheckRoute may wait for destination: its
+// domain has a static route and the policy is RouteQueue.
+func (r *Rotator) RouteQueues(destination string) bool {
+	if r.cfg.RouteUnavailable != RouteQueue {
+		return false
+	}
+	_, ok := r.cfg.Routes[extractDomain(destination)]
+	return ok
+}
+
+// LoadRoutes reads a routes file: one "domain proxy" pair per line, where
+// proxy is a pool ID, the proxy's host:port, "group:<name>" for any proxy
+// of a group or "country:<CC>" for any proxy exiting in a country (see
+// pool.Proxy.Region). An arrow between the two
+// ("example.com -> 3") is allowed. Lines starting with '#' and empty lines
+// are ignored. Domains are matched exactly, case-insensitively.
+func LoadRoutes(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open routes file: %w", err)
+	}
+	defer f.Close()
+
+	routes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == "->" {
+			fields = []string{fields[0], fields[2]}
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("routes file line %d: want \"domain proxy\"", lineNo)
+		}
+		domain := strings.ToLower(fields[0])
+		if _, dup := routes[domain]; dup {
+			return nil, fmt.Errorf("routes file line %d: %s is already routed", lineNo, domain)
+		}
+		if kind, value, ok := routeConstraint(fields[1]); ok && value == "" {
+			return nil, fmt.Errorf("routes file line %d: %s: missing %s", lineNo, fields[1], kind)
+		}
+		routes[domain] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read routes file: %w", err)
+	}
+	return routes, nil
+}
+
+// checkRoutes verifies that every route names a proxy in the pool, or a
+// group or country at least one proxy in the pool belongs to.
+func (r *Rotator) checkRoutes() error {
+	for domain, target := range r.cfg.Routes {
+		kind, value, ok := routeConstraint(target)
+		if !ok {
+			if r.routeTarget(target) == nil {
+				return fmt.Errorf("route %s -> %s: no such proxy in the pool", domain, target)
+			}
+			continue
+		}
+		found := false
+		for _, px := range r.pool.All() {
+			if routeMatches(px, kind, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("route %s -> %s: no proxy in the pool has %s %s", domain, target, kind, value)
+		}
+	}
+	return nil
+}
+
+// routeConstraint splits a route target of the form "group:<name>" or
+// "country:<CC>" into its kind and value; ok is false for a target that
+// names one proxy.
+func routeConstraint(target string) (kind, value string, ok bool) {
+	kind, value, ok = strings.Cut(target, ":")
+	if !ok {
+		return "", "", false
+	}
+	switch kind = strings.ToLower(kind); kind {
+	case "group":
+		return kind, value, true
+	case "country":
+		return kind, strings.ToUpper(value), true
+	}
+	return "", "", false
+}
+
+// routeMatches reports whether px belongs to the group or country of a
+// route constraint.
+func routeMatches(px *pool.Proxy, kind, value string) bool {
+	if kind == "group" {
+		return px.Group == value
+	}
+	return px.Region() == value
+}
+
+// routeTarget returns the proxy a route names, by ID or host:port, or nil.
+func (r *Rotator) routeTarget(target string) *pool.Proxy {
+	if id, err := strconv.ParseInt(target, 10, 64); err == nil {
+		return r.pool.Get(id)
+	}
+	for _, px := range r.pool.All() {
+		if strings.EqualFold(px.URL.Host, target) {
+			return px
+		}
+	}
+	return nil
+}
+
+// routedProxy returns the proxy statically routed for domain, or nil if the
+// domain has no route or no routed proxy is usable. A group or country
+// route takes the first of its alive members in pool order (fastest first
+// with latency sorting) that has a free slot, else the first one. The
+// first fallback and the recovery are logged, not every connection in
+// between.
+func (r *Rotator) routedProxy(domain string) *pool.Proxy {
+	target, ok := r.cfg.Routes[domain]
+	if !ok {
+		return nil
+	}
+	var px *pool.Proxy
+	if kind, value, ok := routeConstraint(target); ok {
+		for _, c := range r.pool.Alive() {
+			if !routeMatches(c, kind, value) || c.ReservedFor() != "" {
+				continue
+			}
+			if c.HasCapacity() {
+				px = c
+				break
+			}
+			if px == nil {
+				px = c
+			}
+		}
+	} else {
+		px = r.routeTarget(target)
+	}
+	usable := px != nil && px.IsAlive() && px.ReservedFor() == ""
+
+	r.pinsMu.Lock()
+	defer r.pinsMu.Unlock()
+	if usable == r.routesDown[domain] {
+		if usable {
+			delete(r.routesDown, domain)
+			log.Printf("[rotator] route %s -> %s is back in use", domain, target)
+		} else {
+			r.routesDown[domain] = true
+			why := "proxy is dead, reserved or gone"
+			if kind, value, ok := routeConstraint(target); ok {
+				why = fmt.Sprintf("no alive proxy with %s %s", kind, value)
+			}
+			log.Printf("[rotator] route %s -> %s: %s, using normal selection", domain, target, why)
+		}
+	}
+	if !usable {
+		return nil
+	}
+	return px
+}
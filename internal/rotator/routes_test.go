@@ -0,0 +1,253 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+func TestLoadRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.txt")
+	content := "# critical targets\nShop.example.com 2\napi.example.com -> 5.6.7.8:8080\n\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes["shop.example.com"] != "2" || routes["api.example.com"] != "5.6.7.8:8080" {
+		t.Errorf("routes = %v", routes)
+	}
+
+	for _, bad := range []string{"only-a-domain\n", "a.com 1\na.com 2\n", "a.com => 1\n", "a.com group:\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRoutes(path); err == nil {
+			t.Errorf("LoadRoutes(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestProxyFor_StaticRoute(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	routed := p.All()[1]
+	r, err := New(p, Config{Routes: map[string]string{"api.example.com": "5.6.7.8:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() == routed {
+		t.Fatal("test needs the routed proxy not to be current")
+	}
+
+	if got := r.ProxyFor("api.example.com:443"); got != routed {
+		t.Errorf("routed domain got %v, want %v", got, routed)
+	}
+	if got := r.ProxyFor("other.example.com:443"); got != r.Current() {
+		t.Errorf("unrouted domain got %v, want the current proxy", got)
+	}
+
+	routed.MarkDead("test")
+	if got := r.ProxyFor("api.example.com:443"); got != r.Current() {
+		t.Errorf("with its proxy dead, routed domain got %v, want the current proxy", got)
+	}
+}
+
+func TestProxyFor_GroupAndCountryRoute(t *testing.T) {
+	p := makePool(t, []string{
+		"http://1.2.3.4:8080",
+		"http://5.6.7.8:8080 group=eu country=de",
+		"http://9.10.11.12:8080 group=eu country=fr",
+	})
+	all := p.All()
+	r, err := New(p, Config{
+		Routes: map[string]string{
+			"eu.example.com": "group:eu",
+			"de.example.com": "country:de",
+		},
+		RouteUnavailable: RouteFail,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.ProxyFor("eu.example.com:443"); got != all[1] {
+		t.Errorf("group route got %v, want the first eu proxy %v", got, all[1])
+	}
+	if got := r.ProxyFor("de.example.com:443"); got != all[1] {
+		t.Errorf("country route got %v, want the DE proxy %v", got, all[1])
+	}
+
+	all[1].MarkDead("test")
+	if got := r.ProxyFor("eu.example.com:443"); got != all[2] {
+		t.Errorf("with one member dead, group route got %v, want %v", got, all[2])
+	}
+	if err := r.CheckRoute(context.Background(), "eu.example.com:443"); err != nil {
+		t.Errorf("CheckRoute for a group with an alive member = %v, want nil", err)
+	}
+	err = r.CheckRoute(context.Background(), "de.example.com:443")
+	var re *RouteError
+	if !errors.As(err, &re) || re.Target != "country:de" {
+		t.Fatalf("CheckRoute with no DE proxy alive = %v, want a RouteError", err)
+	}
+	if want := "route de.example.com -> country:de: no alive proxy with country DE has capacity"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+
+	// The egress seen by the geo check wins over the declared country.
+	all[2].SetEgressCountry("DE")
+	if got := r.ProxyFor("de.example.com:443"); got != all[2] {
+		t.Errorf("country route got %v, want the proxy seen exiting in DE %v", got, all[2])
+	}
+}
+
+func TestCheckRoute_QueueWakesOnGroupMember(t *testing.T) {
+	p := makePool(t, []string{
+		"http://1.2.3.4:8080",
+		"http://5.6.7.8:8080 group=eu",
+		"http://9.10.11.12:8080 group=eu",
+	})
+	all := p.All()
+	all[1].MarkDead("test")
+	all[2].MarkDead("test")
+	r, err := New(p, Config{
+		Routes:            map[string]string{"eu.example.com": "group:eu"},
+		RouteUnavailable:  RouteQueue,
+		RouteQueueTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { all[2].SetAlive(true) })
+	start := time.Now()
+	if err := r.CheckRoute(context.Background(), "eu.example.com:443"); err != nil {
+		t.Fatalf("CheckRoute = %v, want nil once a member is back", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %s for a member revived after 50ms", d)
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	routed := p.All()[1]
+	routes := map[string]string{"api.example.com": "5.6.7.8:8080"}
+	routed.MarkDead("test")
+
+	fallback, err := New(p, Config{Routes: routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fallback.CheckRoute(context.Background(), "api.example.com:443"); err != nil {
+		t.Errorf("fallback: CheckRoute = %v, want nil", err)
+	}
+
+	fail, err := New(p, Config{Routes: routes, RouteUnavailable: RouteFail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var re *RouteError
+	if err := fail.CheckRoute(context.Background(), "api.example.com:443"); !errors.As(err, &re) || re.Target != "5.6.7.8:8080" {
+		t.Errorf("fail: CheckRoute = %v, want a RouteError for 5.6.7.8:8080", err)
+	}
+	if err := fail.CheckRoute(context.Background(), "other.example.com:443"); err != nil {
+		t.Errorf("fail: unrouted CheckRoute = %v, want nil", err)
+	}
+
+	queue, err := New(p, Config{Routes: routes, RouteUnavailable: RouteQueue, RouteQueueTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(150*time.Millisecond, func() { routed.SetAlive(true) })
+	if err := queue.CheckRoute(context.Background(), "api.example.com:443"); err != nil {
+		t.Errorf("queue: CheckRoute = %v, want nil once the proxy is back", err)
+	}
+}
+
+func TestCheckRoute_QueueWaitsForSlot(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080 max-conns=1"})
+	routed := p.All()[1]
+	r, err := New(p, Config{
+		Routes:            map[string]string{"api.example.com": "5.6.7.8:8080"},
+		RouteUnavailable:  RouteQueue,
+		RouteQueueTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.RouteQueues("api.example.com:443") || r.RouteQueues("other.example.com:443") {
+		t.Error("RouteQueues should hold for the routed domain only")
+	}
+	if !routed.AcquireConn() {
+		t.Fatal("could not take the routed proxy's only slot")
+	}
+
+	// A released slot wakes the waiter at once.
+	time.AfterFunc(50*time.Millisecond, routed.ReleaseConn)
+	start := time.Now()
+	if err := r.CheckRoute(context.Background(), "api.example.com:443"); err != nil {
+		t.Fatalf("CheckRoute = %v, want nil once the slot is free", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %s for a slot freed after 50ms", d)
+	}
+
+	// A caller that gives up stops waiting.
+	if !routed.AcquireConn() {
+		t.Fatal("could not take the routed proxy's only slot")
+	}
+	defer routed.ReleaseConn()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	if err := r.CheckRoute(ctx, "api.example.com:443"); !errors.Is(err, context.Canceled) {
+		t.Errorf("CheckRoute after cancel = %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %s after the caller gave up at 50ms", d)
+	}
+}
+
+func TestNew_RouteToUnknownProxy(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080"})
+	if _, err := New(p, Config{Routes: map[string]string{"a.example.com": "42"}}); err == nil {
+		t.Error("a route to a missing proxy should fail New")
+	}
+	if _, err := New(p, Config{Routes: map[string]string{"a.example.com": "group:eu"}}); err == nil {
+		t.Error("a route to a group with no proxies should fail New")
+	}
+}
+
+func TestRecordReportedLatency_Attribution(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	all := p.All()
+	r, err := New(p, Config{Routes: map[string]string{"api.example.com": "9.10.11.12:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := r.Current()
+	var pinned *pool.Proxy
+	for _, px := range all[:2] {
+		if px != cur {
+			pinned = px
+		}
+	}
+	r.pins["shop.example.com"] = pinned
+
+	for dest, want := range map[string]*pool.Proxy{
+		"api.example.com:443":   all[2],
+		"shop.example.com:443":  pinned,
+		"other.example.com:443": cur,
+	} {
+		if got := r.RecordReportedLatency(dest, time.Second); got != want {
+			t.Errorf("%s credited to %v, want %v", dest, got, want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package rotator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule varies the rotation interval by local time of day. Times outside
+// every window fall back to Config.RotateInterval.
+type Schedule []ScheduleWindow
+
+// ScheduleWindow is one HH:MM-HH:MM=interval entry of a Schedule. Start and
+// End are minutes since midnight; a window whose End is not after its Start
+// wraps past midnight.
+type ScheduleWindow struct {
+	Start, End int
+	Interval   time.Duration
+}
+
+const minutesPerDay = 24 * 60
+
+// ParseSchedule parses a --rotate-schedule value of the form
+//
+//	09:00-17:00=2m,17:00-09:00=10m
+//
+// Windows must not overlap. 24:00 may be used as an end time.
+func ParseSchedule(s string) (Schedule, error) {
+	var sched Schedule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		span, dur, ok := strings.Cut(entry, "=")
+		from, to, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("schedule entry %q: want HH:MM-HH:MM=interval", entry)
+		}
+		var w ScheduleWindow
+		var err error
+		if w.Start, err = parseClock(from, false); err != nil {
+			return nil, fmt.Errorf("schedule entry %q: %w", entry, err)
+		}
+		if w.End, err = parseClock(to, true); err != nil {
+			return nil, fmt.Errorf("schedule entry %q: %w", entry, err)
+		}
+		if w.Start == w.End {
+			return nil, fmt.Errorf("schedule entry %q: window is empty (use 00:00-24:00 for the whole day)", entry)
+		}
+		if w.Interval, err = time.ParseDuration(strings.TrimSpace(dur)); err != nil || w.Interval <= 0 {
+			return nil, fmt.Errorf("schedule entry %q: interval must be a positive duration", entry)
+		}
+		sched = append(sched, w)
+	}
+	for m := 0; m < minutesPerDay; m++ {
+		var hit []int
+		for i, w := range sched {
+			if w.contains(m) {
+				hit = append(hit, i)
+			}
+		}
+		if len(hit) > 1 {
+			return nil, fmt.Errorf("schedule windows %s and %s overlap", sched[hit[0]], sched[hit[1]])
+		}
+	}
+	return sched, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight. 24:00 is accepted
+// only when end is set.
+func parseClock(s string, end bool) (int, error) {
+	s = strings.TrimSpace(s)
+	hh, mm, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if !ok || err1 != nil || err2 != nil || len(mm) != 2 || h < 0 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	if h > 23 && !(end && h == 24 && m == 0) {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+func (w ScheduleWindow) contains(minute int) bool {
+	if w.Start < w.End {
+		return minute >= w.Start && minute < w.End
+	}
+	return minute >= w.Start || minute < w.End
+}
+
+func (w ScheduleWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d=%s", w.Start/60, w.Start%60, w.End/60, w.End%60, w.Interval)
+}
+
+// IntervalAt returns the interval of the window containing t, or false if
+// no window does.
+func (s Schedule) IntervalAt(t time.Time) (time.Duration, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s {
+		if w.contains(minute) {
+			return w.Interval, true
+		}
+	}
+	return 0, false
+}
+
+// nextBoundary returns the first window start or end strictly after t.
+func (s Schedule) nextBoundary(t time.Time) time.Time {
+	var next time.Time
+	for _, w := range s {
+		for _, m := range []int{w.Start, w.End} {
+			b := time.Date(t.Year(), t.Month(), t.Day(), m/60, m%60, 0, 0, t.Location())
+			if !b.After(t) {
+				b = time.Date(t.Year(), t.Month(), t.Day()+1, m/60, m%60, 0, 0, t.Location())
+			}
+			if next.IsZero() || b.Before(next) {
+				next = b
+			}
+		}
+	}
+	return next
+}
@@ -0,0 +1,82 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+)
+
+func at(hh, mm int) time.Time {
+	return time.Date(2024, 3, 1, hh, mm, 0, 0, time.Local)
+}
+
+func TestParseSchedule(t *testing.T) {
+	s, err := ParseSchedule("09:00-17:00=2m, 17:00-09:00=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		t    time.Time
+		want time.Duration
+	}{
+		{at(9, 0), 2 * time.Minute},
+		{at(16, 59), 2 * time.Minute},
+		{at(17, 0), 10 * time.Minute},
+		{at(3, 30), 10 * time.Minute},
+	} {
+		if got, ok := s.IntervalAt(tc.t); !ok || got != tc.want {
+			t.Errorf("IntervalAt(%s) = %s, %v; want %s", tc.t.Format("15:04"), got, ok, tc.want)
+		}
+	}
+
+	day, err := ParseSchedule("00:00-24:00=5m")
+	if err != nil {
+		t.Fatalf("whole-day window: %v", err)
+	}
+	for _, tm := range []time.Time{at(0, 0), at(12, 0), at(23, 59)} {
+		if got, ok := day.IntervalAt(tm); !ok || got != 5*time.Minute {
+			t.Errorf("whole day: IntervalAt(%s) = %s, %v; want 5m", tm.Format("15:04"), got, ok)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"09:00-17:00",
+		"9-17=2m",
+		"09:00-09:00=2m",
+		"00:00-00:00=2m",
+		"09:00-17:00=0s",
+		"24:00-06:00=2m",
+		"09:00-17:00=2m,16:00-18:00=5m",
+	} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestIntervalStep_Schedule(t *testing.T) {
+	s, err := ParseSchedule("09:00-17:00=2m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Rotator{cfg: Config{RotateInterval: 10 * time.Minute, RotateSchedule: s}}
+
+	// Outside the window the fallback interval applies, but the wait stops
+	// at the window's start.
+	rotate, wait := r.intervalStep(at(8, 55), at(8, 50))
+	if rotate || wait != 5*time.Minute {
+		t.Errorf("08:55 = %v, %s; want false, 5m", rotate, wait)
+	}
+	// At 09:00 the 2m interval has long passed since 08:50.
+	rotate, wait = r.intervalStep(at(9, 0), at(8, 50))
+	if !rotate || wait != 2*time.Minute {
+		t.Errorf("09:00 = %v, %s; want true, 2m", rotate, wait)
+	}
+
+	// Without a fallback, time outside the window only waits for it.
+	r.cfg.RotateInterval = 0
+	rotate, wait = r.intervalStep(at(18, 0), at(16, 59))
+	if rotate || wait != 15*time.Hour {
+		t.Errorf("18:00 = %v, %s; want false, 15h", rotate, wait)
+	}
+}
@@ -0,0 +1,112 @@
+package rotator
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// When a target, or the network in front of all proxies, goes down, every
+// status report is an error and rotating cannot help: it only burns through
+// the pool. ErrorSpikeRate watches the share of failed reports across all
+// destinations, and while it is exceeded ErrorSpikeMode decides what HTTP
+// errors do.
+
+// Modes for Config.ErrorSpikeMode.
+const (
+	// SpikeFailOpen stops HTTP errors from counting towards rotation while
+	// the error rate is spiking.
+	SpikeFailOpen = "fail-open"
+
+	// SpikeFailClosed rotates on every counted HTTP error while the error
+	// rate is spiking, whatever the thresholds say.
+	SpikeFailClosed = "fail-closed"
+)
+
+const (
+	// errorSpikeWindow is how far back the error rate is measured.
+	errorSpikeWindow = time.Minute
+
+	// errorSpikeBuckets is how many slices errorSpikeWindow is kept in; the
+	// oldest slice is dropped as a whole.
+	errorSpikeBuckets = 12
+
+	// errorSpikeMinReports is how many reports the window needs before a
+	// spike can be declared, so a handful of errors at startup is not one.
+	errorSpikeMinReports = 20
+)
+
+// statusWindow counts status reports, and how many of them failed, over
+// errorSpikeWindow. The zero value is ready to use.
+type statusWindow struct {
+	mu      sync.Mutex
+	buckets [errorSpikeBuckets]statusBucket
+	spiking bool
+}
+
+type statusBucket struct {
+	start   time.Time
+	reports int64
+	failed  int64
+}
+
+// add counts one report at now and returns the failed share and number of
+// reports in the window. Callers hold w.mu.
+func (w *statusWindow) add(now time.Time, failed bool) (rate float64, reports int64) {
+	width := errorSpikeWindow / errorSpikeBuckets
+	start := now.Truncate(width)
+	b := &w.buckets[(start.UnixNano()/int64(width))%errorSpikeBuckets]
+	if !b.start.Equal(start) {
+		*b = statusBucket{start: start}
+	}
+	b.reports++
+	if failed {
+		b.failed++
+	}
+
+	var errs int64
+	for _, b := range w.buckets {
+		if now.Sub(b.start) < errorSpikeWindow {
+			reports += b.reports
+			errs += b.failed
+		}
+	}
+	return float64(errs) / float64(reports), reports
+}
+
+// RecordStatus counts one status report towards ErrorSpikeRate. failed is
+// whether the status is an HTTP error. Reports of successes matter as much
+// as errors: without them every window looks like a spike.
+func (r *Rotator) RecordStatus(failed bool) {
+	if r.cfg.ErrorSpikeRate <= 0 {
+		return
+	}
+	w := &r.statuses
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rate, reports := w.add(time.Now(), failed)
+	spiking := reports >= errorSpikeMinReports && rate >= r.cfg.ErrorSpikeRate
+	if spiking == w.spiking {
+		return
+	}
+	w.spiking = spiking
+	if spiking {
+		effect := "HTTP errors no longer trigger rotations"
+		if r.cfg.ErrorSpikeMode == SpikeFailClosed {
+			effect = "rotating on every HTTP error"
+		}
+		log.Printf("[rotator] error spike: %.0f%% of %d status reports in the last %s failed; %s (%s)",
+			rate*100, reports, errorSpikeWindow, effect, r.cfg.ErrorSpikeMode)
+	} else {
+		log.Printf("[rotator] error spike over: %.0f%% of %d status reports in the last %s failed",
+			rate*100, reports, errorSpikeWindow)
+	}
+}
+
+// ErrorSpike reports whether the error rate of status reports is currently
+// at or above ErrorSpikeRate.
+func (r *Rotator) ErrorSpike() bool {
+	r.statuses.mu.Lock()
+	defer r.statuses.mu.Unlock()
+	return r.statuses.spiking
+}
@@ -0,0 +1,74 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatusWindow_AgesOut(t *testing.T) {
+	var w statusWindow
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		w.add(start, true)
+	}
+	if rate, n := w.add(start.Add(30*time.Second), false); n != 11 || rate < 0.9 {
+		t.Errorf("within the window: rate=%.2f reports=%d, want 10 of 11 failed", rate, n)
+	}
+	if rate, n := w.add(start.Add(2*errorSpikeWindow), false); n != 1 || rate != 0 {
+		t.Errorf("after the window: rate=%.2f reports=%d, want only the new success", rate, n)
+	}
+}
+
+func TestErrorSpike_Modes(t *testing.T) {
+	uris := []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"}
+	spike := func(r *Rotator) {
+		for i := 0; i < errorSpikeMinReports; i++ {
+			r.RecordStatus(i%4 != 0) // 75% failed
+		}
+		if !r.ErrorSpike() {
+			t.Fatal("75% failed reports should be a spike at rate 0.5")
+		}
+	}
+
+	open, err := New(makePool(t, uris), Config{RotateHTTPErrors: 3, HTTPErrorDedupWindow: time.Millisecond, ErrorSpikeRate: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spike(open)
+	for i := 0; i < 5; i++ {
+		open.RecordHTTPError("down.example:443")
+		time.Sleep(2 * time.Millisecond) // past the dedup window
+	}
+	if n := open.Current().HTTPErrors.Load(); n != 0 || len(open.rotateCh) != 0 {
+		t.Errorf("fail-open counted %d errors and queued %d rotations, want none", n, len(open.rotateCh))
+	}
+
+	closed, err := New(makePool(t, uris), Config{
+		RotateHTTPErrors:     3,
+		HTTPErrorDedupWindow: time.Millisecond,
+		ErrorSpikeRate:       0.5,
+		ErrorSpikeMode:       SpikeFailClosed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spike(closed)
+	closed.RecordHTTPError("down.example:443")
+	if got := (<-closed.rotateCh).reason; got != "http-errors=1 destination=down.example (error spike)" {
+		t.Errorf("fail-closed trigger = %q", got)
+	}
+
+	// Enough successes end the spike.
+	for i := 0; i < 3*errorSpikeMinReports; i++ {
+		closed.RecordStatus(false)
+	}
+	if closed.ErrorSpike() {
+		t.Error("spike should be over once most reports succeed")
+	}
+}
+
+func TestNew_BadErrorSpikeMode(t *testing.T) {
+	if _, err := New(makePool(t, []string{"http://1.2.3.4:8080"}), Config{ErrorSpikeMode: "panic"}); err == nil {
+		t.Error("expected an error for an unknown error spike mode")
+	}
+}
@@ -0,0 +1,136 @@
+package rotator
+
+import (
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// Strategies for Config.Strategy: how a rotation picks the next proxy from
+// the usable ones (alive, selectable, top priority tier).
+const (
+	// StrategyRoundRobin takes the proxy after the current one, in the
+	// pool's latency/streak order.
+	StrategyRoundRobin = "round-robin"
+
+	// StrategyRandom takes any proxy other than the current one, uniformly.
+	StrategyRandom = "random"
+
+	// StrategyLeastConns takes the proxy with the fewest active connections,
+	// the fastest on a tie, so proxies stuck holding long-lived tunnels are
+	// left alone until those drain.
+	StrategyLeastConns = "least-conns"
+)
+
+// nextIndex returns the index in alive of the proxy a rotation moves to.
+// Whatever the strategy, it is not the current proxy unless that is the
+// only one: a rotation must actually change the egress. Candidates on the
+// network avoid (see diversify) are skipped; the caller only passes a
+// non-empty avoid when some candidate is off that network.
+func (r *Rotator) nextIndex(alive []*pool.Proxy, avoid string) int {
+	cur := -1
+	for i, px := range alive {
+		if px == r.current {
+			cur = i
+			break
+		}
+	}
+	if len(alive) == 1 {
+		return 0
+	}
+	eligible := func(i int) bool {
+		return i != cur && (avoid == "" || r.networkKey(alive[i]) != avoid)
+	}
+
+	switch r.cfg.Strategy {
+	case StrategyRandom:
+		n := 0
+		for i := range alive {
+			if eligible(i) {
+				n++
+			}
+		}
+		k := r.rand.Intn(n)
+		for i := range alive {
+			if !eligible(i) {
+				continue
+			}
+			if k == 0 {
+				return i
+			}
+			k--
+		}
+		return cur // unreachable: k < n
+	case StrategyLeastConns:
+		// alive is in latency order, but the comparison still looks at
+		// latency so the tie-break holds with --no-latency-sort.
+		best := -1
+		for i, px := range alive {
+			if !eligible(i) {
+				continue
+			}
+			if best < 0 || fewerConns(px, alive[best]) {
+				best = i
+			}
+		}
+		return best
+	default:
+		// Round-robin over the whole tier from the proxy after the current
+		// one; a current proxy no longer usable restarts at 0. When avoiding
+		// a network, walking from the current proxy would always land on the
+		// same few candidates (with two networks, the pool collapses to a
+		// pair), so the eligible proxy picked longest ago wins instead, the
+		// walk order breaking ties.
+		best := -1
+		for step := 1; step <= len(alive); step++ {
+			i := (cur + step) % len(alive)
+			if !eligible(i) {
+				continue
+			}
+			if avoid == "" {
+				return i
+			}
+			if best < 0 || r.pickedAt[alive[i]] < r.pickedAt[alive[best]] {
+				best = i
+			}
+		}
+		return best
+	}
+}
+
+// fewerConns reports whether a should be preferred over b by least-conns:
+// fewer active connections, then lower latency, unprobed proxies last.
+func fewerConns(a, b *pool.Proxy) bool {
+	ca, cb := a.ActiveConns.Load(), b.ActiveConns.Load()
+	if ca != cb {
+		return ca < cb
+	}
+	la, lb := a.Latency(), b.Latency()
+	if la == 0 || lb == 0 {
+		return lb == 0 && la != 0
+	}
+	return la < lb
+}
+
+// PeekNext returns the proxy a rotation would move to right now, without
+// rotating. It is nil when there is no other usable proxy, while paused, and
+// with StrategyRandom, whose next pick cannot be known in advance.
+func (r *Rotator) PeekNext() *pool.Proxy {
+	if r.cfg.Strategy == StrategyRandom {
+		return nil
+	}
+	alive := r.usable()
+	if len(alive) == 0 {
+		return nil
+	}
+	alive = topTier(alive)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.paused {
+		return nil
+	}
+	avoid, _ := r.diversify(alive)
+	if next := alive[r.nextIndex(alive, avoid)]; next != r.current {
+		return next
+	}
+	return nil
+}
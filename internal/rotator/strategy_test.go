@@ -0,0 +1,102 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNew_UnknownStrategy(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080"})
+	if _, err := New(p, Config{Strategy: "fastest"}); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
+
+func TestStrategy_LeastConns(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	all := p.All()
+	all[0].ActiveConns.Store(3)
+	all[1].ActiveConns.Store(7)
+	all[2].ActiveConns.Store(1)
+	r, err := New(p, Config{Strategy: StrategyLeastConns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != all[2] {
+		t.Fatalf("startup picked %s, want the proxy with 1 connection", r.Current())
+	}
+
+	// The current proxy is skipped even when it has the fewest.
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != all[0] {
+		t.Errorf("rotated to %s, want the proxy with 3 connections", r.Current())
+	}
+
+	// Equal counts go to the faster proxy.
+	all[1].ActiveConns.Store(3)
+	all[1].SetLatency(50 * time.Millisecond)
+	all[2].ActiveConns.Store(3)
+	all[2].SetLatency(200 * time.Millisecond)
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != all[1] {
+		t.Errorf("rotated to %s, want the faster of two equally loaded proxies", r.Current())
+	}
+}
+
+func TestStrategy_Random(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	r, err := New(p, Config{Strategy: StrategyRandom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedRand(r, 7)
+
+	hits := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		prev, gen := r.Current(), r.Generation()
+		if err := r.RotateNow("test"); err != nil {
+			t.Fatal(err)
+		}
+		if r.Current() == prev {
+			t.Fatalf("rotation %d kept %s", i, prev)
+		}
+		if r.Generation() != gen+1 {
+			t.Fatalf("generation went from %d to %d", gen, r.Generation())
+		}
+		hits[r.Current().Host]++
+	}
+	for _, px := range p.All() {
+		if n := hits[px.Host]; n < 50 {
+			t.Errorf("%s picked %d times out of 300, want roughly 100", px.Host, n)
+		}
+	}
+}
+
+func TestPeekNext(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		next := r.PeekNext()
+		if next == nil || next == r.Current() {
+			t.Fatalf("PeekNext = %v with current %s", next, r.Current())
+		}
+		if err := r.RotateNow("test"); err != nil {
+			t.Fatal(err)
+		}
+		if r.Current() != next {
+			t.Fatalf("rotated to %s, PeekNext said %s", r.Current(), next)
+		}
+	}
+
+	r.DrainCurrent()
+	if next := r.PeekNext(); next != nil {
+		t.Errorf("PeekNext = %s while paused, want nil", next)
+	}
+}
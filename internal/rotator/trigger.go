@@ -0,0 +1,67 @@
+package rotator
+
+// Trigger identifies what asked for a rotation.
+type Trigger string
+
+// Rotation triggers, as counted by TriggerCounts.
+const (
+	TriggerInterval        Trigger = "interval"
+	TriggerRequests        Trigger = "request-count"
+	TriggerSuccesses       Trigger = "successful-requests"
+	TriggerMaxRequests     Trigger = "max-requests"
+	TriggerConnErrors      Trigger = "conn-errors"
+	TriggerHTTPErrors      Trigger = "http-errors"
+	TriggerTotalErrors     Trigger = "total-errors"
+	TriggerResponseLatency Trigger = "response-latency"
+	TriggerManual          Trigger = "manual"
+	TriggerSignal          Trigger = "signal"
+)
+
+// rotateRequest is one queued rotation: the trigger that fired and the
+// human-readable reason logged with it.
+type rotateRequest struct {
+	trigger Trigger
+	reason  string
+}
+
+// requestRotation queues a rotation for the rotation loop. It never blocks:
+// it runs on request-handling goroutines, and a full queue already holds
+// rotations that will pick a new proxy, so the request is dropped and
+// counted instead (see DroppedTriggers).
+func (r *Rotator) requestRotation(t Trigger, reason string) {
+	select {
+	case r.rotateCh <- rotateRequest{trigger: t, reason: reason}:
+	default:
+		r.droppedTriggers.Add(1)
+	}
+}
+
+// DroppedTriggers returns how many rotation requests were dropped because
+// the queue was full.
+func (r *Rotator) DroppedTriggers() int64 {
+	return r.droppedTriggers.Load()
+}
+
+// countTriggers credits one performed rotation to every trigger that
+// contributed to it. Coalesced triggers each get the credit.
+func (r *Rotator) countTriggers(triggers map[Trigger]bool) {
+	r.triggerCountsMu.Lock()
+	for t := range triggers {
+		r.triggerCounts[t]++
+	}
+	r.triggerCountsMu.Unlock()
+}
+
+// TriggerCounts returns how many rotations each trigger has caused since
+// startup. Rotations made directly with RotateNow or Reconcile (startup,
+// initial check, reload) are not counted, nor are requests that did not
+// change the generation.
+func (r *Rotator) TriggerCounts() map[Trigger]int64 {
+	r.triggerCountsMu.Lock()
+	defer r.triggerCountsMu.Unlock()
+	out := make(map[Trigger]int64, len(r.triggerCounts))
+	for t, n := range r.triggerCounts {
+		out[t] = n
+	}
+	return out
+}
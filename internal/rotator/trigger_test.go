@@ -0,0 +1,60 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTriggerCounts_CoalescedCreditsAll(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued before the loop starts, so they coalesce into one rotation.
+	r.requestRotation(TriggerManual, "manual")
+	r.requestRotation(TriggerConnErrors, "conn-errors=5")
+	gen := r.Generation()
+	r.Start()
+	defer r.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for r.Generation() == gen && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // counts are updated just after the rotation
+
+	got := r.TriggerCounts()
+	if r.Generation() != gen+1 {
+		t.Fatalf("expected exactly one rotation, generation went %d → %d", gen, r.Generation())
+	}
+	if got[TriggerManual] != 1 || got[TriggerConnErrors] != 1 || len(got) != 2 {
+		t.Errorf("counts = %v, want manual=1 conn-errors=1", got)
+	}
+}
+
+func TestRequestRotation_FullQueueDrops(t *testing.T) {
+	p := makePool(t, []string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"})
+	r, err := New(p, Config{RotateConnErrors: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotation loop is not running, so nothing drains the queue.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(r.rotateCh)+3; i++ {
+			r.RecordConnError(r.Current())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RecordConnError blocked on a full rotation queue")
+	}
+	if n := r.DroppedTriggers(); n != 3 {
+		t.Errorf("DroppedTriggers = %d, want 3", n)
+	}
+}
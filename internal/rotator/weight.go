@@ -0,0 +1,38 @@
+package rotator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseDestWeight parses a --dest-weight value of the form
+//
+//	heavy.com=5
+//
+// The weight is how many requests one request to that domain, or any of
+// its subdomains, counts as towards RotateRequests.
+func ParseDestWeight(s string) (domain string, weight int64, err error) {
+	domain, val, ok := strings.Cut(s, "=")
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if !ok || domain == "" {
+		return "", 0, fmt.Errorf("destination weight %q: want <domain>=N", s)
+	}
+	weight, err = strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil || weight < 1 {
+		return "", 0, fmt.Errorf("destination weight %q: weight must be a positive integer", s)
+	}
+	return domain, weight, nil
+}
+
+// destWeight returns the request weight of destination: that of the most
+// specific DestWeights entry matching its domain or a parent domain, else 1.
+func (r *Rotator) destWeight(destination string) int64 {
+	if len(r.cfg.DestWeights) == 0 {
+		return 1
+	}
+	if w, ok := lookupDomain(r.cfg.DestWeights, extractDomain(destination)); ok {
+		return w
+	}
+	return 1
+}
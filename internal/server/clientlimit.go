@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// clientConns counts the requests in flight from each client IP, so one
+// misbehaving consumer opening thousands of tunnels cannot take the whole
+// pool. The zero value is ready to use.
+type clientConns struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+// acquire counts one more request from ip, unless max is non-zero and ip
+// already has max in flight.
+func (c *clientConns) acquire(ip string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.n[ip] >= max {
+		return false
+	}
+	if c.n == nil {
+		c.n = make(map[string]int)
+	}
+	c.n[ip]++
+	return true
+}
+
+func (c *clientConns) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n[ip]--; c.n[ip] <= 0 {
+		delete(c.n, ip)
+	}
+}
+
+func (c *clientConns) snapshot() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]int, len(c.n))
+	for ip, n := range c.n {
+		out[ip] = n
+	}
+	return out
+}
+
+// ClientConns returns the number of requests in flight per client IP.
+func (s *Server) ClientConns() map[string]int {
+	return s.clients.snapshot()
+}
+
+// admitClient counts a request from client against MaxConnsPerClient. It
+// returns the func to call when the request is done, or false if the client
+// is at its limit.
+func (s *Server) admitClient(client net.Addr) (release func(), ok bool) {
+	ip := clientIP(client)
+	if !s.clients.acquire(ip, s.cfg.MaxConnsPerClient) {
+		ok, suppressed := s.clientLogs.allow(ip, time.Now(), dialLogWindow, func(n int) {
+			log.Printf("[server] client %s: %d more refusals not logged in the last %s", ip, n, dialLogWindow)
+		})
+		if ok {
+			repeats := ""
+			if suppressed > 0 {
+				repeats = fmt.Sprintf(" (%d refusals not logged)", suppressed)
+			}
+			log.Printf("[server] client %s has %d connections open, refusing more%s", ip, s.cfg.MaxConnsPerClient, repeats)
+		}
+		return nil, false
+	}
+	return func() { s.clients.release(ip) }, true
+}
+
+// clientIP is the address of client without its port.
+func clientIP(client net.Addr) string {
+	if host, _, err := net.SplitHostPort(client.String()); err == nil {
+		return host
+	}
+	return client.String()
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+	"github.com/drsoft-oss/proxyrotator/internal/upstream"
+)
+
+// A destination that does not resolve, or refuses every connection, fails
+// on any proxy. Counting those failures as connection errors rotates
+// through the pool for nothing, and each new request to the destination
+// waits out the upstream's own lookup again. With Config.DestFailureTTL
+// set, a dial the upstream blamed on the destination
+// (upstream.ErrDestination) is not held against the proxy, and requests to
+// that destination, CONNECT or plain HTTP, get a 502 straight away until
+// the TTL passes.
+//
+// A broken proxy can blame the destination for its own failure too: plenty
+// of gateways answer 502 when their exit is gone. So one proxy's word is
+// not enough. The first proxy to blame a destination is only noted as a
+// suspect and charged a connection error as usual; the destination counts
+// as unreachable once a second, different proxy blames it within the TTL.
+// Until then, further blames for the suspect are not charged: where nothing
+// retries on another proxy (plain HTTP, HTTP/2, a pinned domain,
+// --connect-retries 0 or a one-proxy pool) a second proxy may never be
+// asked, and each request to a dead destination would otherwise count
+// against the proxy and rotate the pool. A broken proxy is still charged
+// once for each destination it fails, and the monitor's probe catches it
+// regardless. A destination once confirmed stays a suspect for another TTL
+// after its cache entry ends, and any blame in that time re-confirms it.
+// A name our own resolver could not find needs no second opinion.
+
+// destFailurePrune is the size at which adding to destFailures first drops
+// the expired entries.
+const destFailurePrune = 1024
+
+// destFailures remembers destinations recently found unreachable, and the
+// suspects not yet confirmed or recently confirmed. The zero value is ready
+// to use.
+type destFailures struct {
+	mu       sync.Mutex
+	m        map[string]destFailure
+	suspects map[string]destSuspect
+}
+
+type destFailure struct {
+	until time.Time
+	err   string
+}
+
+type destSuspect struct {
+	until     time.Time
+	proxyID   int64 // the proxy that first blamed it
+	confirmed bool  // it was in m; any proxy's blame confirms it again
+}
+
+// blame is what a proxy's blaming a destination adds up to.
+type blame int
+
+const (
+	blameNew       blame = iota // first blame: charge the proxy
+	blameRepeated               // the same proxy again: let it go
+	blameConfirmed              // the destination is unreachable
+)
+
+// add records that destination failed with err, until now+ttl, and keeps it
+// a confirmed suspect for a TTL beyond that.
+func (d *destFailures) add(destination string, err error, now time.Time, ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.m == nil {
+		d.m = make(map[string]destFailure)
+	}
+	if len(d.m) >= destFailurePrune {
+		for dest, f := range d.m {
+			if !now.Before(f.until) {
+				delete(d.m, dest)
+			}
+		}
+	}
+	d.m[destination] = destFailure{until: now.Add(ttl), err: err.Error()}
+	d.note(destination, destSuspect{until: now.Add(2 * ttl), confirmed: true}, now)
+}
+
+// suspect records that proxyID blamed destination and returns what that
+// adds up to, given the blames within ttl before it.
+func (d *destFailures) suspect(destination string, proxyID int64, now time.Time, ttl time.Duration) blame {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.suspects[destination]; ok && now.Before(s.until) {
+		if s.confirmed || s.proxyID != proxyID {
+			return blameConfirmed
+		}
+		return blameRepeated
+	}
+	d.note(destination, destSuspect{until: now.Add(ttl), proxyID: proxyID}, now)
+	return blameNew
+}
+
+// note stores s for destination. Callers hold d.mu.
+func (d *destFailures) note(destination string, s destSuspect, now time.Time) {
+	if d.suspects == nil {
+		d.suspects = make(map[string]destSuspect)
+	}
+	if len(d.suspects) >= destFailurePrune {
+		for dest, old := range d.suspects {
+			if !now.Before(old.until) {
+				delete(d.suspects, dest)
+			}
+		}
+	}
+	d.suspects[destination] = s
+}
+
+// lookup returns the error destination last failed with, if that was
+// recent enough to still count.
+func (d *destFailures) lookup(destination string, now time.Time) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, ok := d.m[destination]
+	if !ok {
+		return "", false
+	}
+	if !now.Before(f.until) {
+		delete(d.m, destination)
+		return "", false
+	}
+	return f.err, true
+}
+
+// destinationFailed looks at err, from dialing destination through px.
+// unreachable reports that it shows the destination itself to be
+// unreachable, now remembered as such; charge that the failure is px's to
+// answer for with a connection error. Neither is set for a repeated blame
+// from the proxy that made destination a suspect.
+func (s *Server) destinationFailed(destination string, px *pool.Proxy, err error) (unreachable, charge bool) {
+	if s.cfg.DestFailureTTL <= 0 || !errors.Is(err, upstream.ErrDestination) {
+		return false, true
+	}
+	now := time.Now()
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		switch s.destFails.suspect(destination, px.ID, now, s.cfg.DestFailureTTL) {
+		case blameNew:
+			return false, true
+		case blameRepeated:
+			return false, false
+		}
+	}
+	s.destFails.add(destination, err, now, s.cfg.DestFailureTTL)
+	log.Printf("[server] destination %s unreachable (via %s): %v; failing requests to it for %s",
+		destination, px.String(), err, s.cfg.DestFailureTTL)
+	return true, false
+}
+
+// knownUnreachable reports whether destination failed within
+// DestFailureTTL, returning the message for the client's 502.
+func (s *Server) knownUnreachable(destination string) (string, bool) {
+	if s.cfg.DestFailureTTL <= 0 {
+		return "", false
+	}
+	msg, ok := s.destFails.lookup(destination, time.Now())
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("destination unreachable (cached): %s", msg), true
+}
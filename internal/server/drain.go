@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// A proxy retires when POST /api/drain-current pauses rotation on it or it
+// is removed from the pool. Its connections are left to finish, which one
+// long download, or a client holding an idle tunnel open, can drag out
+// indefinitely. With Config.DrainMaxBytes or Config.DrainIdleTimeout set,
+// tunnels count their bytes as they go and a loop closes the connections
+// of retiring proxies that are over either limit.
+
+// drainPoll is how often the connections of retiring proxies are checked
+// against the drain limits.
+const drainPoll = time.Second
+
+// DrainStatus is the progress of one retiring proxy's drain.
+type DrainStatus struct {
+	Proxy *pool.Proxy
+
+	// Conns is the number of connections still open on the proxy, and
+	// BytesUp and BytesDown what they have relayed so far (zero unless
+	// drain limits are configured).
+	Conns     int
+	BytesUp   int64
+	BytesDown int64
+
+	// Closed is how many connections the drain limits have closed.
+	Closed int64
+}
+
+// drainCloses counts the connections closed by the drain limits, per
+// retiring proxy. The zero value is ready to use.
+type drainCloses struct {
+	mu sync.Mutex
+	n  map[*pool.Proxy]int64
+}
+
+func (d *drainCloses) add(px *pool.Proxy, n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.n == nil {
+		d.n = make(map[*pool.Proxy]int64)
+	}
+	d.n[px] += n
+}
+
+func (d *drainCloses) get(px *pool.Proxy) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.n[px]
+}
+
+// forget drops the counts of proxies keep rejects.
+func (d *drainCloses) forget(keep func(*pool.Proxy) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for px := range d.n {
+		if !keep(px) {
+			delete(d.n, px)
+		}
+	}
+}
+
+// countsLive reports whether tunnels count their bytes as they go, which
+// the drain limits need.
+func (s *Server) countsLive() bool {
+	return s.cfg.DrainMaxBytes > 0 || s.cfg.DrainIdleTimeout > 0
+}
+
+// retiring reports whether px is draining for good: removed from the pool,
+// or the current proxy while rotation is paused.
+func (s *Server) retiring(px *pool.Proxy) bool {
+	if px.DeadReason() == pool.DeadRemoved {
+		return true
+	}
+	return s.rotator.Paused() && s.rotator.Current() == px
+}
+
+// enforceDrain closes the connections of retiring proxies that are over the
+// drain limits, until done is closed.
+func (s *Server) enforceDrain(done <-chan struct{}) {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.drainStep(now)
+		}
+	}
+}
+
+// drainStep is one pass of enforceDrain at now.
+func (s *Server) drainStep(now time.Time) {
+	type tally struct{ bytes, idle, open int }
+	tallies := make(map[*pool.Proxy]*tally)
+	for _, tc := range s.conns.tracked() {
+		px := tc.info.Proxy
+		if !s.retiring(px) {
+			continue
+		}
+		t := tallies[px]
+		if t == nil {
+			t = &tally{}
+			tallies[px] = t
+		}
+		c := tc.snapshot()
+		switch {
+		case s.cfg.DrainMaxBytes > 0 && c.BytesUp+c.BytesDown > s.cfg.DrainMaxBytes:
+			if tc.forceClose() {
+				t.bytes++
+				continue
+			}
+		case s.cfg.DrainIdleTimeout > 0 && now.Sub(c.LastActive) >= s.cfg.DrainIdleTimeout:
+			if tc.forceClose() {
+				t.idle++
+				continue
+			}
+		}
+		t.open++
+	}
+
+	for px, t := range tallies {
+		if t.bytes+t.idle == 0 {
+			continue
+		}
+		s.drainClosed.add(px, int64(t.bytes+t.idle))
+		var why []string
+		if t.bytes > 0 {
+			why = append(why, fmt.Sprintf("%d over %d bytes", t.bytes, s.cfg.DrainMaxBytes))
+		}
+		if t.idle > 0 {
+			why = append(why, fmt.Sprintf("%d idle for %s", t.idle, s.cfg.DrainIdleTimeout))
+		}
+		log.Printf("[server] drain of %s: closed connections (%s); %d still open", px.String(), strings.Join(why, ", "), t.open)
+	}
+	// Counts are kept while DrainProgress can still list the proxy.
+	s.drainClosed.forget(func(px *pool.Proxy) bool {
+		if t := tallies[px]; t != nil && t.open > 0 {
+			return true
+		}
+		return s.rotator.Paused() && s.rotator.Current() == px
+	})
+}
+
+// DrainProgress reports on every retiring proxy that still has connections
+// open, and on the paused current proxy whether it has any or not, ordered
+// by proxy ID.
+func (s *Server) DrainProgress() []DrainStatus {
+	byProxy := make(map[*pool.Proxy]*DrainStatus)
+	if s.rotator.Paused() {
+		if cur := s.rotator.Current(); cur != nil {
+			byProxy[cur] = &DrainStatus{Proxy: cur}
+		}
+	}
+	for _, c := range s.conns.Snapshot() {
+		if !s.retiring(c.Proxy) {
+			continue
+		}
+		st := byProxy[c.Proxy]
+		if st == nil {
+			st = &DrainStatus{Proxy: c.Proxy}
+			byProxy[c.Proxy] = st
+		}
+		st.Conns++
+		st.BytesUp += c.BytesUp
+		st.BytesDown += c.BytesDown
+	}
+
+	out := make([]DrainStatus, 0, len(byProxy))
+	for px, st := range byProxy {
+		st.Closed = s.drainClosed.get(px)
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Proxy.ID < out[j].Proxy.ID })
+	return out
+}
+
+// liveWriter counts the bytes written through it on a Tracked connection.
+type liveWriter struct {
+	w  io.Writer
+	tc *Tracked
+	up bool // client→upstream
+}
+
+func (lw *liveWriter) Write(p []byte) (int, error) {
+	n, err := lw.w.Write(p)
+	if n > 0 {
+		lw.tc.relayed(int64(n), lw.up)
+	}
+	return n, err
+}
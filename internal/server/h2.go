@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/drsoft-oss/proxyrotator/internal/accesslog"
+)
+
+// http2Preface is what an HTTP/2 client with prior knowledge sends before
+// its first frame (RFC 9113 §3.4).
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// isHTTP2 reports whether br starts with the HTTP/2 client preface. It only
+// waits for the whole preface once the first bytes match, so an HTTP/1
+// request shorter than the preface is not held up.
+func isHTTP2(br *bufio.Reader) bool {
+	if b, err := br.Peek(4); err != nil || string(b) != "PRI " {
+		return false
+	}
+	b, err := br.Peek(len(http2Preface))
+	return err == nil && string(b) == http2Preface
+}
+
+// serveHTTP2 speaks HTTP/2 on conn, whose preface is still unread in br.
+// Each stream is a request handled by handleHTTP2.
+func (s *Server) serveHTTP2(conn net.Conn, br *bufio.Reader) {
+	h2 := &http2.Server{}
+	h2.ServeConn(&bufferedConn{Conn: conn, r: br}, &http2.ServeConnOpts{
+		BaseConfig: &http.Server{MaxHeaderBytes: s.cfg.MaxHeaderBytes},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.handleHTTP2(conn.RemoteAddr(), w, req)
+		}),
+	})
+}
+
+// handleHTTP2 serves one HTTP/2 stream. Only CONNECT is supported: the
+// stream becomes a tunnel through the upstream proxy, exactly like an
+// HTTP/1 CONNECT.
+func (s *Server) handleHTTP2(client net.Addr, w http.ResponseWriter, req *http.Request) {
+	entry := &accesslog.Entry{
+		Time:       time.Now(),
+		ClientAddr: client.String(),
+		Method:     req.Method,
+	}
+	defer s.logAccess(entry)
+
+	if s.authRequired() && !s.checkAuth(req) {
+		entry.Result = "auth_required"
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxyrotator"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	release, ok := s.admitClient(client)
+	if !ok {
+		entry.Result = "client_limit"
+		writeH2Error(w, http.StatusTooManyRequests, "too many connections from this client")
+		return
+	}
+	defer release()
+	if req.Method != http.MethodConnect {
+		entry.Result = "bad_request"
+		writeH2Error(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s over HTTP/2 (only CONNECT is supported)", req.Method))
+		return
+	}
+	destination, ok := connectDestination(req)
+	if !ok {
+		entry.Result = "bad_request"
+		writeH2Error(w, http.StatusBadRequest, fmt.Sprintf("no usable CONNECT destination in %q", req.Host))
+		return
+	}
+	entry.Destination = destination
+	if s.isLoop(destination) {
+		entry.Result = "loop"
+		writeH2Error(w, http.StatusBadRequest, "connection loop")
+		return
+	}
+	if msg, ok := s.knownUnreachable(destination); ok {
+		entry.Result = "dest_unreachable"
+		writeH2Error(w, http.StatusBadGateway, msg)
+		return
+	}
+
+	px, err := s.selectProxy(req.Context(), clientLabel(req), clientIP(client), destination)
+	if err != nil {
+		entry.Result = unavailableResult(err)
+		writeH2Error(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if px == nil {
+		entry.Result = "no_proxy"
+		writeH2Error(w, http.StatusBadGateway, "no available upstream proxy")
+		return
+	}
+	defer px.ReleaseConn()
+	tc := s.conns.Track(client, destination, px)
+	defer tc.Done()
+	entry.ProxyID = px.ID
+
+	deadline := s.requestDeadline(entry.Time)
+	s.jitter()
+	ctx, cancel := s.dialContext(px, deadline)
+	defer cancel()
+
+	upstreamConn, err := s.dial(ctx, px, destination)
+	if err != nil {
+		unreachable, charge := s.destinationFailed(destination, px, err)
+		if unreachable {
+			entry.Result = "dest_unreachable"
+			writeH2Error(w, http.StatusBadGateway, fmt.Sprintf("destination unreachable: %v", err))
+			return
+		}
+		if charge {
+			s.recordConnError(px)
+		}
+		if expired(deadline) {
+			entry.Result = "timeout"
+			log.Printf("[server] request timeout after %s (proxy=%s dest=%s)", s.cfg.RequestTimeout, px.String(), destination)
+			writeH2Error(w, http.StatusGatewayTimeout, "request timeout")
+			return
+		}
+		entry.Result = "dial_error"
+		s.logDialFailure("h2 CONNECT", px, destination, err)
+		writeH2Error(w, http.StatusBadGateway, fmt.Sprintf("upstream dial: %v", err))
+		return
+	}
+	defer upstreamConn.Close()
+	// Closing the upstream ends the stream; the client's connection
+	// carries other streams and stays.
+	tc.setCloser(func() { upstreamConn.Close() })
+
+	for k, v := range s.connectHeaders(px) {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(http.StatusOK)
+	stream := &h2Stream{body: req.Body, w: w, f: w.(http.Flusher)}
+	stream.f.Flush()
+
+	s.recordRequest(px, entry.Destination, true)
+	entry.BytesUp, entry.BytesDown = s.tunnel(stream, upstreamConn, tc, time.Time{}, func(d time.Duration) {
+		s.rotator.RecordResponseLatency(px, d)
+	}, s.sniLogger(entry, px, destination))
+	s.recordSuccess(px, true)
+	entry.Result = "ok"
+}
+
+// writeH2Error is writeError for an HTTP/2 stream.
+func writeH2Error(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	log.Printf("[server] error %d: %s", code, msg)
+}
+
+// h2Stream is the client end of an HTTP/2 CONNECT tunnel: reads come from
+// the request body and writes go out as DATA frames straight away.
+type h2Stream struct {
+	body io.ReadCloser
+	w    io.Writer
+	f    http.Flusher
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err == nil {
+		s.f.Flush()
+	}
+	return n, err
+}
+
+// CloseWrite is called by tunnel when the upstream is done. The response
+// can only end when the handler returns, so this closes the request body,
+// which ends the client→upstream copy and with it the handler.
+func (s *h2Stream) CloseWrite() error {
+	return s.body.Close()
+}
+
+// bufferedConn is a net.Conn whose reads start with what is buffered in r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// A request held back before its upstream is chosen (a static route in
+// queue mode) should stop waiting once its client hangs up. The client
+// sends nothing while it waits for the answer, so a read that ends is the
+// hangup; a pending read is called off with a deadline in the past.
+
+// aLongTimeAgo is a read deadline that has already passed.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// readDeadliner is a connection that can tell the read deadline last set
+// on it. net.Conn cannot, so watchClient puts back the deadline of
+// connections that implement it and leaves others without one, which is
+// how the server hands them to the handlers.
+type readDeadliner interface {
+	ReadDeadline() time.Time
+}
+
+// watchClient returns a context that is cancelled when the client on conn
+// hangs up, for the wait in selectProxy. Only destinations whose route can
+// queue are watched; others get a background context. stop must be called
+// before br is read again; it restores the read deadline conn had (see
+// readDeadliner). The watch only peeks, so anything the client does send
+// stays buffered in br.
+func (s *Server) watchClient(conn net.Conn, br *bufio.Reader, destination string) (ctx context.Context, stop func()) {
+	if !s.rotator.RouteQueues(destination) {
+		return context.Background(), func() {}
+	}
+	var prev time.Time
+	if d, ok := conn.(readDeadliner); ok {
+		prev = d.ReadDeadline()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := br.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+	return ctx, func() {
+		_ = conn.SetReadDeadline(aLongTimeAgo)
+		<-done
+		_ = conn.SetReadDeadline(prev)
+		cancel()
+	}
+}
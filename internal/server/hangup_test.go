@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+	"github.com/drsoft-oss/proxyrotator/internal/rotator"
+)
+
+func TestRouteQueue_ClientHangupEndsWait(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	p.All()[1].MarkDead("test")
+	r, err := rotator.New(p, rotator.Config{
+		Routes:            map[string]string{"api.example.com": "5.6.7.8:8080"},
+		RouteUnavailable:  rotator.RouteQueue,
+		RouteQueueTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{}, r)
+
+	for _, raw := range []string{
+		"CONNECT api.example.com:443 HTTP/1.1\r\nHost: api.example.com:443\r\n\r\n",
+		"GET http://api.example.com/ HTTP/1.1\r\nHost: api.example.com\r\n\r\n",
+	} {
+		client, srv := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			s.handleConn(srv)
+			close(done)
+		}()
+		if _, err := client.Write([]byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond) // let it queue
+		client.Close()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q: still queued after the client hung up", strings.SplitN(raw, "\r\n", 2)[0])
+		}
+	}
+}
+
+// deadlineConn remembers its read deadline, as a readDeadliner.
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *deadlineConn) ReadDeadline() time.Time { return c.deadline }
+
+func TestWatchClient_RestoresReadDeadline(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{
+		Routes:           map[string]string{"api.example.com": "1.2.3.4:8080"},
+		RouteUnavailable: rotator.RouteQueue,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{}, r)
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	want := time.Now().Add(time.Hour)
+	conn := &deadlineConn{Conn: srv}
+	if err := conn.SetReadDeadline(want); err != nil {
+		t.Fatal(err)
+	}
+	_, stop := s.watchClient(conn, bufio.NewReader(conn), "api.example.com:443")
+	stop()
+	if !conn.deadline.Equal(want) {
+		t.Errorf("read deadline after the watch = %v, want %v", conn.deadline, want)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// An upstream that hangs mid-transfer leaves both copies of its tunnel
+// blocked for good, holding two goroutines and the proxy's connection slot.
+// With Config.TunnelIdleTimeout set, a tunnel on which no bytes have flowed
+// in either direction for that long is closed.
+
+// errTunnelIdle ends the upstream→client copy of an idle tunnel.
+var errTunnelIdle = errors.New("tunnel idle timeout")
+
+// tunnelIdle tracks when a tunnel last relayed anything.
+type tunnelIdle struct {
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano
+	expired atomic.Bool
+}
+
+func newTunnelIdle(timeout time.Duration) *tunnelIdle {
+	t := &tunnelIdle{timeout: timeout}
+	t.touch()
+	return t
+}
+
+func (t *tunnelIdle) touch() { t.last.Store(time.Now().UnixNano()) }
+
+// deadline is when the tunnel expires unless something is relayed first.
+func (t *tunnelIdle) deadline() time.Time {
+	return time.Unix(0, t.last.Load()).Add(t.timeout)
+}
+
+// activeReader marks the tunnel active whenever a read returns data.
+type activeReader struct {
+	r    io.Reader
+	idle *tunnelIdle
+}
+
+func (a *activeReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.idle.touch()
+	}
+	return n, err
+}
+
+// idleReader reads the upstream end of a tunnel under a read deadline that
+// follows the last activity in either direction, so a long download with a
+// quiet client is not mistaken for a hang. When the deadline passes with
+// nothing relayed, closeAll is called and the read fails with
+// errTunnelIdle.
+type idleReader struct {
+	conn     net.Conn
+	idle     *tunnelIdle
+	closeAll func()
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		_ = r.conn.SetReadDeadline(r.idle.deadline())
+		n, err := r.conn.Read(p)
+		if n > 0 {
+			r.idle.touch()
+			return n, err
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return n, err
+		}
+		if time.Now().Before(r.idle.deadline()) {
+			continue // the client→upstream direction was active
+		}
+		r.idle.expired.Store(true)
+		r.closeAll()
+		return 0, errTunnelIdle
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// dialLogWindow is how long a logged dial failure stands in for similar
+// ones (same upstream proxy, same class of error, see errClass): repeats
+// within it are only counted, and the count is logged when the window
+// closes.
+const dialLogWindow = 10 * time.Second
+
+// throttleForget is how many windows a key that has stopped recurring is
+// kept for, so its suppressed count can still be reported.
+const throttleForget = 6
+
+// logThrottle rate-limits log lines by key. The zero value is ready to use.
+type logThrottle struct {
+	mu      sync.Mutex
+	entries map[string]*throttled
+	pruned  time.Time
+}
+
+type throttled struct {
+	logged     time.Time // when the last line for the key was logged
+	suppressed int       // lines dropped since then
+}
+
+// allow reports whether a line for key should be logged at now, and if so
+// how many were suppressed since the previous one and not yet reported. At
+// most one line per key is allowed per window. When the first line of a
+// window is dropped, flush is scheduled for the end of the window with the
+// number dropped by then, so a burst that stops is still accounted for.
+func (t *logThrottle) allow(key string, now time.Time, window time.Duration, flush func(suppressed int)) (ok bool, suppressed int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]*throttled)
+	}
+	if now.Sub(t.pruned) >= window {
+		for k, e := range t.entries {
+			if age := now.Sub(e.logged); age >= window && (e.suppressed == 0 || age >= throttleForget*window) {
+				delete(t.entries, k)
+			}
+		}
+		t.pruned = now
+	}
+
+	e, seen := t.entries[key]
+	if seen && now.Sub(e.logged) < window {
+		e.suppressed++
+		if e.suppressed == 1 {
+			time.AfterFunc(e.logged.Add(window).Sub(now), func() { t.expire(key, e, flush) })
+		}
+		return false, 0
+	}
+	if !seen {
+		e = &throttled{}
+		t.entries[key] = e
+	}
+	suppressed = e.suppressed
+	e.logged, e.suppressed = now, 0
+	return true, suppressed
+}
+
+// expire reports the lines dropped for key in the window that just closed,
+// unless a later line already reported them.
+func (t *logThrottle) expire(key string, e *throttled, flush func(suppressed int)) {
+	t.mu.Lock()
+	n := 0
+	if t.entries[key] == e {
+		n, e.suppressed = e.suppressed, 0
+	}
+	t.mu.Unlock()
+	if n > 0 {
+		flush(n)
+	}
+}
+
+// errClass names the kind of err without the details that change from one
+// occurrence to the next, such as the local port in a *net.OpError: the
+// innermost error it wraps, e.g. "connection refused" or "i/o timeout".
+func errClass(err error) string {
+	for {
+		inner := errors.Unwrap(err)
+		if inner == nil {
+			return err.Error()
+		}
+		err = inner
+	}
+}
+
+// logDialFailure logs that dialling destination through px failed, unless
+// a similar failure was logged within dialLogWindow. what names the request
+// kind ("CONNECT", "h2 CONNECT", "HTTP").
+func (s *Server) logDialFailure(what string, px *pool.Proxy, destination string, err error) {
+	class := errClass(err)
+	ok, suppressed := s.dialLogs.allow(px.Host+" "+class, time.Now(), dialLogWindow, func(n int) {
+		log.Printf("[server] %d similar upstream dial failures not logged in the last %s (proxy=%s): %s", n, dialLogWindow, px.String(), class)
+	})
+	if !ok {
+		return
+	}
+	repeats := ""
+	if suppressed > 0 {
+		repeats = fmt.Sprintf(" (%d similar failures not logged)", suppressed)
+	}
+	log.Printf("[server] %s upstream dial failed (proxy=%s dest=%s): %v%s", what, px.String(), destination, err, repeats)
+}
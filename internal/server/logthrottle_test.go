@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func noFlush(int) {}
+
+func TestLogThrottle(t *testing.T) {
+	var lt logThrottle
+	t0 := time.Now()
+	window := 10 * time.Second
+
+	if ok, n := lt.allow("a", t0, window, noFlush); !ok || n != 0 {
+		t.Fatalf("first line: got (%v, %d), want (true, 0)", ok, n)
+	}
+	for i := 1; i <= 3; i++ {
+		if ok, _ := lt.allow("a", t0.Add(time.Duration(i)*time.Second), window, noFlush); ok {
+			t.Fatalf("repeat %d within the window was allowed", i)
+		}
+	}
+	if ok, _ := lt.allow("b", t0.Add(time.Second), window, noFlush); !ok {
+		t.Error("a different key must not be throttled")
+	}
+
+	// A prune in between must keep the pending count.
+	lt.allow("c", t0.Add(11*time.Second), window, noFlush)
+	if ok, n := lt.allow("a", t0.Add(12*time.Second), window, noFlush); !ok || n != 3 {
+		t.Errorf("after the window: got (%v, %d), want (true, 3)", ok, n)
+	}
+}
+
+func TestLogThrottle_FlushAtWindowEnd(t *testing.T) {
+	var lt logThrottle
+	window := 50 * time.Millisecond
+	flushed := make(chan int, 1)
+	flush := func(n int) { flushed <- n }
+
+	now := time.Now()
+	lt.allow("a", now, window, flush)
+	lt.allow("a", now, window, flush)
+	lt.allow("a", now, window, flush)
+	select {
+	case n := <-flushed:
+		if n != 2 {
+			t.Errorf("flushed %d suppressed lines, want 2", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the suppressed count was not flushed when the window closed")
+	}
+	if ok, n := lt.allow("a", time.Now(), window, flush); !ok || n != 0 {
+		t.Errorf("next line: got (%v, %d), want (true, 0) since the count was flushed", ok, n)
+	}
+}
+
+func TestErrClass(t *testing.T) {
+	reset := func(port int) error {
+		return fmt.Errorf("read CONNECT response: %w", &net.OpError{
+			Op:     "read",
+			Net:    "tcp",
+			Source: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+			Addr:   &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 8080},
+			Err:    os.NewSyscallError("read", syscall.ECONNRESET),
+		})
+	}
+	if a, b := errClass(reset(50001)), errClass(reset(50002)); a != b {
+		t.Errorf("errors differing only in the local port got classes %q and %q", a, b)
+	}
+	if got := errClass(reset(50001)); got != syscall.ECONNRESET.Error() {
+		t.Errorf("class = %q, want %q", got, syscall.ECONNRESET.Error())
+	}
+	if got := errClass(errors.New("upstream proxy CONNECT failed: 502 Bad Gateway")); got != "upstream proxy CONNECT failed: 502 Bad Gateway" {
+		t.Errorf("class of a plain error = %q", got)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// loopResolveTimeout bounds the DNS lookup isLoop does for a hostname
+// destination on one of the server's own ports.
+const loopResolveTimeout = 2 * time.Second
+
+// isLoop reports whether destination points back at this server: its own
+// listen address, or one of Config.SelfAddresses. Proxying it would only
+// feed the request back to us.
+//
+// Only destinations on a port we answer on are looked at further, so
+// ordinary traffic costs a string comparison. For those, a hostname is
+// resolved and its addresses compared: against every local address
+// (loopback included) when the listener is bound to all interfaces,
+// otherwise against the bound address.
+func (s *Server) isLoop(destination string) bool {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return false
+	}
+
+	var ips []net.IP
+	resolved := false
+	resolve := func() []net.IP {
+		if !resolved {
+			resolved = true
+			ips = lookupIPs(host)
+		}
+		return ips
+	}
+
+	for _, self := range s.selfAddresses() {
+		sh, sp, err := net.SplitHostPort(self)
+		if err != nil || sp != port {
+			continue
+		}
+		if strings.EqualFold(sh, host) {
+			return true
+		}
+		selfIP := net.ParseIP(sh)
+		switch {
+		case sh == "" || (selfIP != nil && selfIP.IsUnspecified()):
+			for _, ip := range resolve() {
+				if isLocalIP(ip) {
+					return true
+				}
+			}
+		case selfIP != nil:
+			for _, ip := range resolve() {
+				if ip.Equal(selfIP) || (ip.IsLoopback() && selfIP.IsLoopback()) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// selfAddresses returns the listen address (as bound, so an ephemeral port
+// is resolved) followed by Config.SelfAddresses.
+func (s *Server) selfAddresses() []string {
+	listen := s.cfg.ListenAddr
+	if s.ln != nil {
+		listen = s.ln.Addr().String()
+	}
+	return append([]string{listen}, s.cfg.SelfAddresses...)
+}
+
+// lookupIPs returns host's addresses: itself if it is an IP literal,
+// otherwise whatever the local resolver says (nil on failure).
+func lookupIPs(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), loopResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+// isLocalIP reports whether ip is a loopback or unspecified address or is
+// assigned to one of this host's interfaces.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
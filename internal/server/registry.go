@@ -0,0 +1,152 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// ConnInfo describes one in-flight proxied connection.
+type ConnInfo struct {
+	ID          uint64
+	ClientAddr  string
+	Destination string
+	Proxy       *pool.Proxy
+	Started     time.Time
+
+	// BytesUp and BytesDown count the bytes relayed so far, and LastActive
+	// is when the last of them went through. They are only kept while the
+	// server counts tunnel bytes live (see Config.DrainMaxBytes); otherwise
+	// they stay zero and LastActive is Started.
+	BytesUp    int64
+	BytesDown  int64
+	LastActive time.Time
+}
+
+// Tracked is one connection's entry in a Registry.
+type Tracked struct {
+	reg  *Registry
+	info ConnInfo
+
+	up, down atomic.Int64
+	active   atomic.Int64 // UnixNano of the last bytes relayed
+
+	mu     sync.Mutex
+	closer func() // set once the upstream connection is open
+	closed bool
+}
+
+// Registry tracks the connections currently being proxied. Connections
+// register once an upstream proxy has been chosen and deregister when their
+// handler returns.
+type Registry struct {
+	mu    sync.Mutex
+	next  uint64
+	conns map[uint64]*Tracked
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{conns: make(map[uint64]*Tracked)}
+}
+
+// Track registers a connection. Call Done on the result when its handler
+// returns.
+func (r *Registry) Track(client net.Addr, destination string, px *pool.Proxy) *Tracked {
+	now := time.Now()
+	r.mu.Lock()
+	r.next++
+	t := &Tracked{reg: r, info: ConnInfo{
+		ID:          r.next,
+		ClientAddr:  client.String(),
+		Destination: destination,
+		Proxy:       px,
+		Started:     now,
+	}}
+	t.active.Store(now.UnixNano())
+	r.conns[t.info.ID] = t
+	r.mu.Unlock()
+	return t
+}
+
+// Done deregisters the connection.
+func (t *Tracked) Done() {
+	t.reg.mu.Lock()
+	delete(t.reg.conns, t.info.ID)
+	t.reg.mu.Unlock()
+}
+
+// setCloser records how to force the connection closed.
+func (t *Tracked) setCloser(fn func()) {
+	t.mu.Lock()
+	t.closer = fn
+	t.mu.Unlock()
+}
+
+// forceClose closes the connection under its handler's feet, ending its
+// tunnel. It reports false if there was nothing to close yet, or it was
+// already closed.
+func (t *Tracked) forceClose() bool {
+	t.mu.Lock()
+	fn, done := t.closer, t.closed
+	t.closed = fn != nil
+	t.mu.Unlock()
+	if fn == nil || done {
+		return false
+	}
+	fn()
+	return true
+}
+
+// relayed counts n bytes relayed in the given direction.
+func (t *Tracked) relayed(n int64, up bool) {
+	if up {
+		t.up.Add(n)
+	} else {
+		t.down.Add(n)
+	}
+	t.active.Store(time.Now().UnixNano())
+}
+
+// snapshot returns the connection's ConnInfo with its current counts.
+func (t *Tracked) snapshot() ConnInfo {
+	c := t.info
+	c.BytesUp, c.BytesDown = t.up.Load(), t.down.Load()
+	c.LastActive = time.Unix(0, t.active.Load())
+	return c
+}
+
+// Snapshot returns the live connections, oldest first.
+func (r *Registry) Snapshot() []ConnInfo {
+	r.mu.Lock()
+	out := make([]ConnInfo, 0, len(r.conns))
+	for _, t := range r.conns {
+		out = append(out, t.snapshot())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// tracked returns the entries of the live connections, in no order.
+func (r *Registry) tracked() []*Tracked {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*Tracked, 0, len(r.conns))
+	for _, t := range r.conns {
+		out = append(out, t)
+	}
+	return out
+}
+
+// Len returns the number of live connections.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
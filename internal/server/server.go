@@ -1,7 +1,8 @@
 // Package server implements the local HTTP/HTTPS forward-proxy that clients
 // connect to. It speaks HTTP/1.1 and supports:
 //
-//   - CONNECT tunnelling (used by HTTPS and any TCP tunnel)
+//   - CONNECT tunnelling (used by HTTPS and any TCP tunnel), also over
+//     HTTP/2 for clients that open the connection with the h2 preface
 //   - Plain HTTP forwarding (GET/POST/… for http:// targets)
 //   - Optional Proxy-Authorization basic auth
 //   - Drain-on-rotate: existing connections finish on the proxy they started
@@ -10,16 +11,27 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/drsoft-oss/proxyrotator/internal/accesslog"
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
 	"github.com/drsoft-oss/proxyrotator/internal/rotator"
 	"github.com/drsoft-oss/proxyrotator/internal/upstream"
 )
@@ -36,13 +48,160 @@ type Config struct {
 
 	// DialTimeout is the maximum time to dial through the upstream proxy.
 	DialTimeout time.Duration
+
+	// AccessLog, when set, receives one entry per proxied request after its
+	// tunnel closes.
+	AccessLog *accesslog.Logger
+
+	// ConnectToIP resolves the destination locally and asks HTTP upstreams to
+	// CONNECT to ip:port, while keeping the original host:port in the Host
+	// header of the CONNECT request (for upstreams that route on it).
+	ConnectToIP bool
+
+	// Dialer carries upstream dial options. Nil uses upstream's defaults.
+	Dialer *upstream.Dialer
+
+	// ConnectReason is the reason phrase of the 200 response to CONNECT.
+	// Defaults to "Connection established".
+	ConnectReason string
+
+	// ConnectHeaders are added to the 200 response to CONNECT.
+	ConnectHeaders http.Header
+
+	// ConnectInfoHeaders adds X-Proxy-Id, X-Proxy-Region and X-Proxy-Group
+	// to the 200 response to CONNECT, naming the upstream proxy the tunnel
+	// goes through. Region is the egress country from the geo check, or the
+	// country= metadata; headers with no value are left out.
+	ConnectInfoHeaders bool
+
+	// MaxHeaderBytes caps the size of a client's request line plus headers.
+	// Larger requests are answered with 431. Defaults to 1 MiB
+	// (http.DefaultMaxHeaderBytes).
+	MaxHeaderBytes int
+
+	// TunnelBufferSize is the size of each copy buffer used by a tunnel (one
+	// per direction). Buffers are pooled and reused across connections.
+	// Defaults to 32 KiB.
+	TunnelBufferSize int
+
+	// JitterMin and JitterMax bound a random delay inserted before each
+	// upstream dial, so request timing looks less mechanical. Zero JitterMax
+	// disables it.
+	JitterMin time.Duration
+	JitterMax time.Duration
+
+	// RequestTimeout bounds a request from the moment it is read until the
+	// upstream dial completes (CONNECT) or the first response byte arrives
+	// (plain HTTP). On expiry the client gets a 504. Zero disables it.
+	RequestTimeout time.Duration
+
+	// LogSNI peeks at the first TLS record a client sends through a CONNECT
+	// tunnel and logs the server name of its ClientHello, noting when it
+	// differs from the CONNECT host. The access log gets it as %S.
+	LogSNI bool
+
+	// CountTraffic selects the requests that count towards the rotator's
+	// request-count and successful-requests triggers: CountBoth (the
+	// default), CountConnect or CountHTTP. Every request still counts in
+	// the proxy's own totals, and connection errors always count.
+	CountTraffic string
+
+	// SelfAddresses are extra host:port addresses that reach this server
+	// (a public name, a load balancer in front of it, …). A CONNECT or HTTP
+	// request for one of them, or for the listen address itself, is
+	// answered with 400 "connection loop" instead of being proxied.
+	SelfAddresses []string
+
+	// HotStandby keeps a connection open to the proxy the rotator will move
+	// to next, refreshed every 20 seconds, so tunnels right after a
+	// rotation skip connection setup. It has no effect with the random
+	// rotation strategy; see standby.go.
+	HotStandby bool
+
+	// MaxConnsPerClient caps the requests in flight from any one client IP
+	// (a CONNECT tunnel counts until it closes). Requests over it are
+	// answered with 429. Zero means no limit.
+	MaxConnsPerClient int
+
+	// ConnectRetries is how many other proxies a CONNECT whose dial failed
+	// is tried on before the client gets a 502. All attempts share the
+	// first proxy's dial timeout. Zero disables retries.
+	ConnectRetries int
+
+	// DestFailureTTL is how long a destination two different upstreams
+	// could not resolve or reach (upstream.ErrDestination) is remembered:
+	// requests to it get a 502 without a dial, and the confirming failure
+	// does not count as a connection error. Zero disables both; see
+	// destfail.go.
+	DestFailureTTL time.Duration
+
+	// TunnelIdleTimeout closes a tunnel once no bytes have flowed in either
+	// direction for this long, so an upstream that hangs mid-transfer does
+	// not hold its connection slot forever. Zero disables it; see idle.go.
+	TunnelIdleTimeout time.Duration
+
+	// DrainMaxBytes and DrainIdleTimeout keep a retiring proxy from
+	// draining forever: its connections are closed once they have relayed
+	// more than DrainMaxBytes, or nothing for DrainIdleTimeout. Zero
+	// disables either; see drain.go.
+	DrainMaxBytes    int64
+	DrainIdleTimeout time.Duration
 }
 
+// Values for Config.CountTraffic.
+const (
+	CountBoth    = "both"    // CONNECT tunnels and plain HTTP requests
+	CountConnect = "connect" // CONNECT tunnels (HTTP/1 and HTTP/2) only
+	CountHTTP    = "http"    // plain HTTP requests only
+)
+
+// defaultTunnelBufferSize matches io.Copy's internal buffer.
+const defaultTunnelBufferSize = 32 * 1024
+
 // Server is the local HTTP proxy server.
 type Server struct {
 	cfg     Config
 	rotator *rotator.Rotator
 	ln      net.Listener
+
+	// bufPool holds *[]byte copy buffers of cfg.TunnelBufferSize.
+	bufPool sync.Pool
+
+	conns *Registry
+
+	// dialLogs rate-limits the dial-failure log lines.
+	dialLogs logThrottle
+
+	// clients counts the requests in flight per client IP; clientLogs
+	// rate-limits the lines logged when one is refused.
+	clients    clientConns
+	clientLogs logThrottle
+
+	// drainClosed counts the connections the drain limits closed.
+	drainClosed drainCloses
+	destFails   destFailures
+
+	// Capacity diagnostics, see Stats.
+	handlers atomic.Int64 // handleConn calls in flight
+	tunnels  atomic.Int64 // tunnel calls in flight
+
+	// done is closed by Stop.
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// served counts the accepted connections not yet handled, for Wait.
+	// acceptMu orders its Adds against Stop: none happens once done is
+	// closed.
+	served   sync.WaitGroup
+	acceptMu sync.Mutex
+
+	// api serves management API requests arriving on the proxy listener;
+	// nil unless ServeAPI was called.
+	api http.Handler
+
+	// dial opens a connection through an upstream proxy. It is dialUpstream
+	// except in tests.
+	dial func(ctx context.Context, px *pool.Proxy, destination string) (net.Conn, error)
 }
 
 // New creates a Server. Call Start to begin accepting connections.
@@ -50,29 +209,139 @@ func New(cfg Config, r *rotator.Rotator) *Server {
 	if cfg.DialTimeout == 0 {
 		cfg.DialTimeout = 30 * time.Second
 	}
-	return &Server{cfg: cfg, rotator: r}
+	if cfg.Dialer == nil {
+		cfg.Dialer = &upstream.Dialer{}
+	}
+	if cfg.ConnectReason == "" {
+		cfg.ConnectReason = "Connection established"
+	}
+	if cfg.MaxHeaderBytes <= 0 {
+		cfg.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	if cfg.TunnelBufferSize <= 0 {
+		cfg.TunnelBufferSize = defaultTunnelBufferSize
+	}
+	if cfg.HotStandby {
+		// The standby is the server's own: health checks sharing the
+		// dialer must not use it up.
+		d := *cfg.Dialer
+		d.Standby = &upstream.Standby{}
+		cfg.Dialer = &d
+	}
+	s := &Server{cfg: cfg, rotator: r, conns: NewRegistry(), done: make(chan struct{})}
+	s.dial = s.dialUpstream
+	s.bufPool.New = func() any {
+		buf := make([]byte, s.cfg.TunnelBufferSize)
+		return &buf
+	}
+	return s
+}
+
+// Connections returns the registry of in-flight connections.
+func (s *Server) Connections() *Registry {
+	return s.conns
+}
+
+// Stats is a snapshot of the server's in-flight work.
+type Stats struct {
+	// Handlers is the number of accepted connections still being handled,
+	// including those waiting for a request or an upstream dial.
+	Handlers int64
+	// Tunnels is the number of connections currently relaying bytes.
+	Tunnels int64
+}
+
+// Stats returns the current in-flight handler and tunnel counts.
+func (s *Server) Stats() Stats {
+	return Stats{Handlers: s.handlers.Load(), Tunnels: s.tunnels.Load()}
+}
+
+// DialTest dials destination through px the way a client connection would,
+// within px's dial timeout and honouring ConnectToIP, then closes the
+// connection and returns how long the dial took. Unlike real traffic it
+// touches none of px's counters and none of the rotation triggers.
+func (s *Server) DialTest(ctx context.Context, px *pool.Proxy, destination string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.dialTimeout(px))
+	defer cancel()
+	start := time.Now()
+	conn, err := s.dial(ctx, px, destination)
+	elapsed := time.Since(start)
+	if err != nil {
+		return elapsed, err
+	}
+	conn.Close()
+	return elapsed, nil
 }
 
 // Start begins listening and serving. Blocks until the listener is closed.
 func (s *Server) Start() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen binds the listen address without accepting connections yet, so
+// callers can surface bind errors before serving in the background.
+func (s *Server) Listen() error {
 	ln, err := net.Listen("tcp", s.cfg.ListenAddr)
 	if err != nil {
 		return fmt.Errorf("listen %s: %w", s.cfg.ListenAddr, err)
 	}
 	s.ln = ln
 	log.Printf("[server] proxy listening on %s", s.cfg.ListenAddr)
+	return nil
+}
+
+// Serve accepts connections on the listener opened by Listen. Blocks until
+// the listener is closed; a close by Stop is a clean shutdown and returns
+// nil, anything else returns the accept error.
+func (s *Server) Serve() error {
+	if s.cfg.HotStandby {
+		go s.keepStandby(s.done)
+	}
+	if s.countsLive() {
+		go s.enforceDrain(s.done)
+	}
 	for {
-		conn, err := ln.Accept()
+		conn, err := s.ln.Accept()
 		if err != nil {
-			// Listener closed — normal shutdown
+			if errors.Is(err, net.ErrClosed) {
+				// Listener closed — normal shutdown
+				return nil
+			}
 			return err
 		}
-		go s.handleConn(conn)
+		s.acceptMu.Lock()
+		select {
+		case <-s.done:
+			// Stop raced the accept; the connection is not handled.
+			s.acceptMu.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		s.served.Add(1)
+		s.acceptMu.Unlock()
+		go func() {
+			defer s.served.Done()
+			s.handleConn(conn)
+		}()
 	}
 }
 
+// Wait blocks until Stop has been called and every connection accepted
+// before it has been handled, tunnels included.
+func (s *Server) Wait() {
+	<-s.done
+	s.acceptMu.Lock()
+	s.acceptMu.Unlock()
+	s.served.Wait()
+}
+
 // Stop closes the listener.
 func (s *Server) Stop() error {
+	s.stopOnce.Do(func() { close(s.done) })
 	if s.ln != nil {
 		return s.ln.Close()
 	}
@@ -84,19 +353,46 @@ func (s *Server) Stop() error {
 // -----------------------------------------------------------------------
 
 func (s *Server) handleConn(clientConn net.Conn) {
+	s.handlers.Add(1)
+	defer s.handlers.Add(-1)
 	defer clientConn.Close()
 
-	br := bufio.NewReader(clientConn)
+	// Only MaxHeaderBytes may be read while parsing the request head; the
+	// limit is lifted once it has been parsed so the body can follow.
+	lr := &io.LimitedReader{R: clientConn, N: int64(s.cfg.MaxHeaderBytes)}
+	br := bufio.NewReader(lr)
+	if isHTTP2(br) {
+		lr.N = math.MaxInt64
+		s.serveHTTP2(clientConn, br)
+		return
+	}
+	if s.api != nil && isAPIRequest(br) {
+		lr.N = math.MaxInt64
+		s.serveAPI(clientConn, br)
+		return
+	}
 	req, err := http.ReadRequest(br)
 	if err != nil {
-		if err != io.EOF {
+		if lr.N <= 0 {
+			log.Printf("[server] request headers from %s exceed %d bytes", clientConn.RemoteAddr(), s.cfg.MaxHeaderBytes)
+			writeError(clientConn, http.StatusRequestHeaderFieldsTooLarge, "request headers too large")
+		} else if err != io.EOF {
 			log.Printf("[server] read request: %v", err)
 		}
 		return
 	}
+	lr.N = math.MaxInt64
+
+	entry := &accesslog.Entry{
+		Time:       time.Now(),
+		ClientAddr: clientConn.RemoteAddr().String(),
+		Method:     req.Method,
+	}
+	defer s.logAccess(entry)
 
 	// Check auth before doing anything else
 	if s.authRequired() && !s.checkAuth(req) {
+		entry.Result = "auth_required"
 		resp := &http.Response{
 			StatusCode: http.StatusProxyAuthRequired,
 			ProtoMajor: 1,
@@ -109,56 +405,156 @@ func (s *Server) handleConn(clientConn net.Conn) {
 		return
 	}
 
+	release, ok := s.admitClient(clientConn.RemoteAddr())
+	if !ok {
+		entry.Result = "client_limit"
+		writeError(clientConn, http.StatusTooManyRequests, "too many connections from this client")
+		return
+	}
+	defer release()
+
 	if req.Method == http.MethodConnect {
-		s.handleCONNECT(clientConn, req)
+		s.handleCONNECT(clientConn, br, req, entry)
 	} else {
-		s.handleHTTP(clientConn, br, req)
+		s.handleHTTP(clientConn, br, req, entry)
 	}
 }
 
 // handleCONNECT tunnels a raw TCP connection through the upstream proxy.
 // This is used for HTTPS and anything that needs a transparent tunnel.
-func (s *Server) handleCONNECT(clientConn net.Conn, req *http.Request) {
-	destination := req.Host // "host:port"
-	if !hasPort(destination) {
-		destination += ":443"
+// Anything the client sent after the request head is waiting in br.
+func (s *Server) handleCONNECT(clientConn net.Conn, br *bufio.Reader, req *http.Request, entry *accesslog.Entry) {
+	destination, ok := connectDestination(req) // "host:port"
+	if !ok {
+		entry.Result = "bad_request"
+		writeError(clientConn, http.StatusBadRequest, fmt.Sprintf("no usable CONNECT destination in %q", req.RequestURI))
+		return
 	}
-
-	// Select proxy for this destination (honours domain pinning)
-	px := s.rotator.ProxyFor(destination)
-	if px == nil {
-		writeError(clientConn, http.StatusBadGateway, "no available upstream proxy")
+	entry.Destination = destination
+	if s.isLoop(destination) {
+		entry.Result = "loop"
+		writeError(clientConn, http.StatusBadRequest, "connection loop")
+		return
+	}
+	if msg, ok := s.knownUnreachable(destination); ok {
+		entry.Result = "dest_unreachable"
+		writeError(clientConn, http.StatusBadGateway, msg)
 		return
 	}
 
-	// Track active connection on this specific proxy instance.
+	// Select proxy for this destination (honours pinning) and claim
+	// a connection slot on it.
 	// Drain semantics: the rotator can switch "current" at any time; the
 	// existing connection continues on the proxy it grabbed here.
-	px.ActiveConns.Add(1)
-	defer px.ActiveConns.Add(-1)
-
-	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.DialTimeout)
-	defer cancel()
-
-	upstreamConn, err := upstream.Dial(ctx, px.URL, destination)
+	ctx, stop := s.watchClient(clientConn, br, destination)
+	px, err := s.selectProxy(ctx, clientLabel(req), clientIP(clientConn.RemoteAddr()), destination)
+	stop()
 	if err != nil {
-		s.rotator.RecordConnError()
-		log.Printf("[server] CONNECT upstream dial failed (proxy=%s dest=%s): %v", px.String(), destination, err)
-		writeError(clientConn, http.StatusBadGateway, fmt.Sprintf("upstream dial: %v", err))
+		entry.Result = unavailableResult(err)
+		writeError(clientConn, http.StatusServiceUnavailable, err.Error())
 		return
 	}
+	if px == nil {
+		entry.Result = "no_proxy"
+		writeError(clientConn, http.StatusBadGateway, "no available upstream proxy")
+		return
+	}
+	upstreamConn, px, tc := s.connectUpstream(clientConn, px, destination, entry)
+	if upstreamConn == nil {
+		return
+	}
+	defer px.ReleaseConn()
+	defer tc.Done()
 	defer upstreamConn.Close()
+	tc.setCloser(func() {
+		upstreamConn.Close()
+		clientConn.Close()
+	})
 
 	// Acknowledge tunnel establishment
-	_, _ = fmt.Fprintf(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	_, _ = io.WriteString(clientConn, s.connectEstablished(req, px))
+
+	// Bytes the client sent without waiting for the answer were read
+	// along with the request head; they go first.
+	var early int64
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		if _, err := upstreamConn.Write(b); err != nil {
+			entry.Result = "write_error"
+			return
+		}
+		early = int64(n)
+	}
 
-	s.rotator.RecordRequest()
-	s.tunnel(clientConn, upstreamConn)
+	s.recordRequest(px, entry.Destination, true)
+	entry.BytesUp, entry.BytesDown = s.tunnel(clientConn, upstreamConn, tc, time.Time{}, func(d time.Duration) {
+		s.rotator.RecordResponseLatency(px, d)
+	}, s.sniLogger(entry, px, destination))
+	entry.BytesUp += early
+	s.recordSuccess(px, true)
+	entry.Result = "ok"
+}
+
+// connectUpstream dials destination through px, on which the caller has
+// claimed a slot, for a CONNECT tunnel. A failed dial is retried on other
+// proxies up to ConnectRetries times, within the first proxy's dial timeout
+// overall: nothing has been written to the client yet, so it cannot tell.
+// On success it returns the connection, the proxy carrying it with its slot
+// still claimed, and the connection's registry entry. Otherwise it has
+// answered the client and released every slot, and the connection is nil.
+func (s *Server) connectUpstream(clientConn net.Conn, px *pool.Proxy, destination string, entry *accesslog.Entry) (net.Conn, *pool.Proxy, *Tracked) {
+	deadline := s.requestDeadline(entry.Time)
+	s.jitter()
+	budget := time.Now().Add(s.dialTimeout(px))
+	if deadline.IsZero() || budget.Before(deadline) {
+		deadline = budget
+	}
+	var failed []*pool.Proxy
+	for {
+		entry.ProxyID = px.ID
+		tc := s.conns.Track(clientConn.RemoteAddr(), destination, px)
+		ctx, cancel := s.dialContext(px, deadline)
+		upstreamConn, err := s.dial(ctx, px, destination)
+		cancel()
+		if err == nil {
+			return upstreamConn, px, tc
+		}
+		tc.Done()
+		px.ReleaseConn()
+		unreachable, charge := s.destinationFailed(destination, px, err)
+		if unreachable {
+			entry.Result = "dest_unreachable"
+			writeError(clientConn, http.StatusBadGateway, fmt.Sprintf("destination unreachable: %v", err))
+			return nil, nil, nil
+		}
+		if charge {
+			s.recordConnError(px)
+		}
+		if expired(s.requestDeadline(entry.Time)) {
+			s.requestTimedOut(clientConn, entry, px, destination)
+			return nil, nil, nil
+		}
+		s.logDialFailure("CONNECT", px, destination, err)
+
+		failed = append(failed, px)
+		var next *pool.Proxy
+		if len(failed) <= s.cfg.ConnectRetries && !expired(deadline) {
+			next = s.retryProxy(clientIP(clientConn.RemoteAddr()), destination, failed)
+		}
+		if next == nil {
+			entry.Result = "dial_error"
+			writeError(clientConn, http.StatusBadGateway, fmt.Sprintf("upstream dial: %v", err))
+			return nil, nil, nil
+		}
+		log.Printf("[server] retrying CONNECT %s via %s after dial failure on %s (retry %d of %d)",
+			destination, next.String(), px.String(), len(failed), s.cfg.ConnectRetries)
+		px = next
+	}
 }
 
 // handleHTTP forwards a plain HTTP request through the upstream proxy.
 // The upstream proxy handles all HTTP semantics; we just relay bytes.
-func (s *Server) handleHTTP(clientConn net.Conn, br *bufio.Reader, req *http.Request) {
+func (s *Server) handleHTTP(clientConn net.Conn, br *bufio.Reader, req *http.Request, entry *accesslog.Entry) {
 	destination := req.URL.Host
 	if destination == "" {
 		destination = req.Host
@@ -166,58 +562,573 @@ func (s *Server) handleHTTP(clientConn net.Conn, br *bufio.Reader, req *http.Req
 	if !hasPort(destination) {
 		destination += ":80"
 	}
+	entry.Destination = destination
+	if s.isLoop(destination) {
+		entry.Result = "loop"
+		writeError(clientConn, http.StatusBadRequest, "connection loop")
+		return
+	}
+	if msg, ok := s.knownUnreachable(destination); ok {
+		entry.Result = "dest_unreachable"
+		writeError(clientConn, http.StatusBadGateway, msg)
+		return
+	}
 
-	px := s.rotator.ProxyFor(destination)
+	// Remove proxy-specific headers before forwarding
+	client := clientLabel(req)
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del(clientHeader)
+
+	// A request that fails to write can be replayed through another proxy
+	// only if it is idempotent and its body is held in memory.
+	replayable := false
+	if isIdempotent(req.Method) {
+		var err error
+		replayable, err = bufferBody(req)
+		if err != nil {
+			entry.Result = "bad_request"
+			log.Printf("[server] read HTTP request body from client: %v", err)
+			return
+		}
+	}
+
+	ctx, stop := s.watchClient(clientConn, br, destination)
+	px, err := s.selectProxy(ctx, client, clientIP(clientConn.RemoteAddr()), destination)
+	stop()
+	if err != nil {
+		entry.Result = unavailableResult(err)
+		writeError(clientConn, http.StatusServiceUnavailable, err.Error())
+		return
+	}
 	if px == nil {
+		entry.Result = "no_proxy"
 		writeError(clientConn, http.StatusBadGateway, "no available upstream proxy")
 		return
 	}
+	for {
+		retry := s.forwardHTTP(clientConn, req, px, destination, entry, replayable)
+		px.ReleaseConn()
+		if !retry {
+			return
+		}
 
-	px.ActiveConns.Add(1)
-	defer px.ActiveConns.Add(-1)
+		// The write failed before the request reached the upstream intact;
+		// replay it once through a different proxy. A failed replay is
+		// charged to that proxy, so the current one counts this request's
+		// failure once at most.
+		failed := px
+		replayable = false
+		if px = s.acquireAlternative(failed); px == nil {
+			writeError(clientConn, http.StatusBadGateway, "upstream write failed and no other proxy is available")
+			return
+		}
+		req.Body, _ = req.GetBody()
+		log.Printf("[server] retrying %s %s via %s after write failure on %s", req.Method, destination, px.String(), failed.String())
+	}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.DialTimeout)
+// forwardHTTP writes req through px (already acquired) and then relays the
+// response. If writing the request fails and canRetry is set it returns true
+// without answering the client, so the caller can replay the request
+// elsewhere; otherwise every failure is answered with a 502.
+func (s *Server) forwardHTTP(clientConn net.Conn, req *http.Request, px *pool.Proxy, destination string, entry *accesslog.Entry, canRetry bool) (retry bool) {
+	tc := s.conns.Track(clientConn.RemoteAddr(), destination, px)
+	defer tc.Done()
+	entry.ProxyID = px.ID
+
+	deadline := s.requestDeadline(entry.Time)
+	s.jitter()
+	ctx, cancel := s.dialContext(px, deadline)
 	defer cancel()
 
-	upstreamConn, err := upstream.Dial(ctx, px.URL, destination)
+	upstreamConn, err := s.dial(ctx, px, destination)
 	if err != nil {
-		s.rotator.RecordConnError()
-		log.Printf("[server] HTTP upstream dial failed (proxy=%s dest=%s): %v", px.String(), destination, err)
+		unreachable, charge := s.destinationFailed(destination, px, err)
+		if unreachable {
+			entry.Result = "dest_unreachable"
+			writeError(clientConn, http.StatusBadGateway, fmt.Sprintf("destination unreachable: %v", err))
+			return false
+		}
+		if charge {
+			s.recordConnError(px)
+		}
+		if expired(deadline) {
+			s.requestTimedOut(clientConn, entry, px, destination)
+			return false
+		}
+		entry.Result = "dial_error"
+		s.logDialFailure("HTTP", px, destination, err)
 		writeError(clientConn, http.StatusBadGateway, fmt.Sprintf("upstream dial: %v", err))
-		return
+		return false
 	}
 	defer upstreamConn.Close()
+	tc.setCloser(func() {
+		upstreamConn.Close()
+		clientConn.Close()
+	})
+	if !deadline.IsZero() {
+		_ = upstreamConn.SetDeadline(deadline)
+	}
 
-	// Remove proxy-specific headers before forwarding
-	req.Header.Del("Proxy-Authorization")
-	req.Header.Del("Proxy-Connection")
+	// A failed write may have left a partial request on the upstream
+	// connection, so it is never tunnelled after one.
+	cw := &countingWriter{w: upstreamConn}
+	if err := req.Write(cw); err != nil {
+		s.recordConnError(px)
+		if expired(deadline) {
+			s.requestTimedOut(clientConn, entry, px, destination)
+			return false
+		}
+		entry.Result = "write_error"
+		log.Printf("[server] write HTTP request to upstream (proxy=%s dest=%s): %v", px.String(), destination, err)
+		if canRetry {
+			return true
+		}
+		writeError(clientConn, http.StatusBadGateway, fmt.Sprintf("upstream write: %v", err))
+		return false
+	}
+
+	sentAt := time.Now()
+	s.recordRequest(px, entry.Destination, false)
+	onResponse := func(d time.Duration) {
+		s.rotator.RecordResponseLatency(px, d)
+	}
+
+	// Under a request timeout, wait for the first response bytes here, while
+	// a 504 can still be sent, and only then hand over to the tunnel.
+	var head int64
+	if !deadline.IsZero() {
+		buf := s.bufPool.Get().(*[]byte)
+		n, err := upstreamConn.Read(*buf)
+		if err != nil {
+			s.bufPool.Put(buf)
+			if expired(deadline) {
+				s.requestTimedOut(clientConn, entry, px, destination)
+				return false
+			}
+			entry.Result = "read_error"
+			log.Printf("[server] read HTTP response from upstream (proxy=%s dest=%s): %v", px.String(), destination, err)
+			writeError(clientConn, http.StatusBadGateway, fmt.Sprintf("upstream read: %v", err))
+			return false
+		}
+		onResponse(time.Since(sentAt))
+		onResponse = nil
+		_ = upstreamConn.SetDeadline(time.Time{})
+		_, err = clientConn.Write((*buf)[:n])
+		s.bufPool.Put(buf)
+		if err != nil {
+			entry.Result = "write_error"
+			return false
+		}
+		head = int64(n)
+	}
+
+	up, down := s.tunnel(clientConn, upstreamConn, tc, sentAt, onResponse, nil)
+	entry.BytesUp, entry.BytesDown = cw.n+up, head+down
+	s.recordSuccess(px, false)
+	entry.Result = "ok"
+	return false
+}
+
+// selectProxy picks the proxy for a request from client to destination and
+// claims a connection slot on it: a proxy reserved for client if it has a
+// usable one, else the normal selection, which static routes can refuse
+// with a *rotator.RouteError. ip is the address the request came from, which
+// --pin-mode client-ip pins by. While the rotator is paused every request is
+// refused with rotator.ErrPaused. A route that queues waits until ctx is
+// done at most. A nil proxy means none has capacity. The caller must
+// ReleaseConn the returned proxy.
+func (s *Server) selectProxy(ctx context.Context, client, ip, destination string) (*pool.Proxy, error) {
+	if s.rotator.Paused() {
+		return nil, rotator.ErrPaused
+	}
+	if px := s.rotator.ReservedProxy(client); px != nil && px.AcquireConn() {
+		return px, nil
+	}
+	if err := s.rotator.CheckRoute(ctx, destination); err != nil {
+		return nil, err
+	}
+	return s.acquireProxy(ip, destination), nil
+}
+
+// unavailableResult is the access-log result for a request selectProxy
+// refused with err.
+func unavailableResult(err error) string {
+	if errors.Is(err, rotator.ErrPaused) {
+		return "paused"
+	}
+	return "route_unavailable"
+}
+
+// acquireAttempts bounds how often acquireProxy re-selects after losing the
+// race for a proxy's last connection slot.
+const acquireAttempts = 3
+
+// acquireProxy selects a proxy for a connection from ip to destination and
+// claims a connection slot on it. ProxyForClient's capacity check can be
+// outrun by a concurrent connection, so a failed claim re-selects rather
+// than exceeding the cap. The caller must ReleaseConn the returned proxy.
+func (s *Server) acquireProxy(ip, destination string) *pool.Proxy {
+	for i := 0; i < acquireAttempts; i++ {
+		px := s.rotator.ProxyForClient(ip, destination)
+		if px == nil {
+			return nil
+		}
+		if px.AcquireConn() {
+			return px
+		}
+	}
+	return nil
+}
+
+// connectEstablished renders the 200 response to a CONNECT request. The HTTP
+// version echoes the client's, since some clients stall on a mismatch.
+func (s *Server) connectEstablished(req *http.Request, px *pool.Proxy) string {
+	major, minor := req.ProtoMajor, req.ProtoMinor
+	if major != 1 {
+		major, minor = 1, 1
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/%d.%d 200 %s\r\n", major, minor, s.cfg.ConnectReason)
+	_ = s.connectHeaders(px).Write(&b)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// connectHeaders returns the headers of the 200 response to a CONNECT
+// tunnelled through px: ConnectHeaders, plus with ConnectInfoHeaders the
+// proxy's ID and, when known, its region and group.
+func (s *Server) connectHeaders(px *pool.Proxy) http.Header {
+	if !s.cfg.ConnectInfoHeaders || px == nil {
+		return s.cfg.ConnectHeaders
+	}
+	h := s.cfg.ConnectHeaders.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("X-Proxy-Id", strconv.FormatInt(px.ID, 10))
+	if region := px.Region(); region != "" {
+		h.Set("X-Proxy-Region", region)
+	}
+	if px.Group != "" {
+		h.Set("X-Proxy-Group", px.Group)
+	}
+	return h
+}
+
+// recordRequest counts a request for destination served through px. Canary
+// and reserved proxies only feed their own lifetime counters, and so does
+// any other proxy that is not current (a static route's, an overflow's or a
+// retry's): the rotator only counts traffic on the current proxy. A request CountTraffic
+// leaves out still used up part of the max-requests budget when its slot
+// was claimed, so the budget is checked either way.
+func (s *Server) recordRequest(px *pool.Proxy, destination string, connect bool) {
+	px.TotalReqs.Add(1)
+	px.RecordOutcome(false)
+	if !shared(px) {
+		return
+	}
+	if s.countsTraffic(connect) {
+		s.rotator.RecordRequest(px, destination)
+	} else {
+		s.rotator.CheckBudget(px)
+	}
+}
+
+// countsTraffic reports whether a CONNECT tunnel (connect) or a plain HTTP
+// request counts towards the request-count triggers under CountTraffic.
+func (s *Server) countsTraffic(connect bool) bool {
+	switch s.cfg.CountTraffic {
+	case CountConnect:
+		return connect
+	case CountHTTP:
+		return !connect
+	}
+	return true
+}
+
+// shared reports whether px serves general traffic, whose requests and
+// errors drive rotation: it is neither a canary nor reserved for a client.
+func shared(px *pool.Proxy) bool {
+	return px.Canary == 0 && px.ReservedFor() == ""
+}
+
+// recordSuccess records a request px carried to the end: it extends px's
+// success streak and counts towards successful-request rotation.
+func (s *Server) recordSuccess(px *pool.Proxy, connect bool) {
+	px.RecordSuccess()
+	if shared(px) && s.countsTraffic(connect) {
+		s.rotator.RecordCompletion(px)
+	}
+}
+
+// recordConnError is recordRequest for connection errors. It also breaks
+// px's success streak.
+func (s *Server) recordConnError(px *pool.Proxy) {
+	px.TotalConnErrors.Add(1)
+	px.RecordOutcome(true)
+	px.BreakStreak()
+	if shared(px) {
+		s.rotator.RecordConnError(px)
+	}
+}
+
+// acquireAlternative claims a connection slot on an alive proxy not in
+// failed, or returns nil if there is none.
+func (s *Server) acquireAlternative(failed ...*pool.Proxy) *pool.Proxy {
+	for i := 0; i < acquireAttempts; i++ {
+		px := s.rotator.AlternativeTo(failed...)
+		if px == nil {
+			return nil
+		}
+		if px.AcquireConn() {
+			return px
+		}
+	}
+	return nil
+}
+
+// retryProxy claims a connection slot for another attempt from ip at
+// destination after the proxies in failed could not reach it: on the proxy
+// ProxyForClient picks, unless that one has failed already, else on another
+// alive proxy. nil means none is left.
+func (s *Server) retryProxy(ip, destination string, failed []*pool.Proxy) *pool.Proxy {
+	if px := s.rotator.ProxyForClient(ip, destination); px != nil && !slices.Contains(failed, px) && px.AcquireConn() {
+		return px
+	}
+	return s.acquireAlternative(failed...)
+}
+
+// maxReplayBody is the largest request body held in memory so that an
+// idempotent request can be replayed. Larger bodies are streamed as before.
+const maxReplayBody = 1 << 20
+
+// isIdempotent reports whether method is idempotent (RFC 9110 §9.2.2), i.e.
+// safe to send again after a failed attempt.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads req's body into memory and sets GetBody so it can be
+// written more than once. It returns false, leaving the body untouched, if
+// the body's length is unknown or above maxReplayBody.
+func bufferBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return true, nil
+	}
+	if req.ContentLength < 0 || req.ContentLength > maxReplayBody {
+		return false, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return false, err
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+// dialTimeout returns px's own dial-timeout if it has one, else the global
+// DialTimeout.
+func (s *Server) dialTimeout(px *pool.Proxy) time.Duration {
+	if px.DialTimeout > 0 {
+		return px.DialTimeout
+	}
+	return s.cfg.DialTimeout
+}
+
+// requestDeadline returns when RequestTimeout expires for a request read at
+// start, or the zero time if there is no request timeout.
+func (s *Server) requestDeadline(start time.Time) time.Time {
+	if s.cfg.RequestTimeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(s.cfg.RequestTimeout)
+}
+
+// dialContext bounds a dial through px by its dial timeout and, if earlier,
+// the request deadline.
+func (s *Server) dialContext(px *pool.Proxy, deadline time.Time) (context.Context, context.CancelFunc) {
+	dl := time.Now().Add(s.dialTimeout(px))
+	if !deadline.IsZero() && deadline.Before(dl) {
+		dl = deadline
+	}
+	return context.WithDeadline(context.Background(), dl)
+}
 
-	if err := req.Write(upstreamConn); err != nil {
-		s.rotator.RecordConnError()
-		log.Printf("[server] write HTTP request to upstream: %v", err)
+// expired reports whether a request deadline is set and has passed.
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// requestTimedOut answers a request that ran out of RequestTimeout.
+func (s *Server) requestTimedOut(clientConn net.Conn, entry *accesslog.Entry, px *pool.Proxy, destination string) {
+	entry.Result = "timeout"
+	log.Printf("[server] request timeout after %s (proxy=%s dest=%s)", s.cfg.RequestTimeout, px.String(), destination)
+	writeError(clientConn, http.StatusGatewayTimeout, "request timeout")
+}
+
+// jitter sleeps for a random duration in [JitterMin, JitterMax], if
+// configured.
+func (s *Server) jitter() {
+	if s.cfg.JitterMax <= 0 {
 		return
 	}
+	d := s.cfg.JitterMin
+	if spread := s.cfg.JitterMax - s.cfg.JitterMin; spread > 0 {
+		d += time.Duration(rand.Int63n(int64(spread) + 1))
+	}
+	time.Sleep(d)
+}
 
-	s.rotator.RecordRequest()
-	s.tunnel(clientConn, upstreamConn)
+// dialUpstream opens a connection to destination through px, honouring
+// ConnectToIP except for socks5h upstreams, which are there to resolve
+// names remotely.
+func (s *Server) dialUpstream(ctx context.Context, px *pool.Proxy, destination string) (net.Conn, error) {
+	if !s.cfg.ConnectToIP || px.Scheme == "socks5h" {
+		return s.cfg.Dialer.Dial(ctx, px.URL, destination)
+	}
+	target, err := resolveTarget(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	return s.cfg.Dialer.DialHost(ctx, px.URL, target, destination)
 }
 
-// tunnel performs a bidirectional copy between two connections until
-// either side closes.
-func (s *Server) tunnel(a, b net.Conn) {
+// tunnel performs a bidirectional copy between the client and upstream
+// connections until either side closes. It returns the number of bytes
+// copied client→upstream and upstream→client.
+//
+// If onResponse is set it is called once with the response latency: the
+// time from the request being sent to the first upstream byte reaching the
+// client. sentAt is when the request was sent; if zero, the first
+// client→upstream chunk marks it (e.g. a TLS ClientHello in a CONNECT
+// tunnel).
+//
+// If onSNI is set, the client's first bytes are peeked at for a TLS
+// ClientHello and onSNI is called with its server name, if it has one.
+//
+// While drain limits are configured (see countsLive), bytes are also
+// counted on tc as they go, for the drain loop to judge the tunnel by.
+//
+// With TunnelIdleTimeout set, both ends are closed once nothing has been
+// relayed either way for that long (see idle.go).
+//
+// Copy buffers come from bufPool so thousands of concurrent tunnels do not
+// each allocate fresh ones. (When both ends are plain TCP, io.CopyBuffer
+// still prefers the kernel's zero-copy path and the buffer goes unused;
+// counting live or an idle timeout gives that path up.)
+func (s *Server) tunnel(client io.ReadWriter, upstream net.Conn, tc *Tracked, sentAt time.Time, onResponse func(time.Duration), onSNI func(string)) (up, down int64) {
+	s.tunnels.Add(1)
+	defer s.tunnels.Add(-1)
+
+	var upFirst, downFirst func()
+	if onResponse != nil {
+		var sent atomic.Int64 // UnixNano; 0 until the request is sent
+		if !sentAt.IsZero() {
+			sent.Store(sentAt.UnixNano())
+		}
+		upFirst = func() { sent.CompareAndSwap(0, time.Now().UnixNano()) }
+		downFirst = func() {
+			if t := sent.Load(); t != 0 {
+				onResponse(time.Since(time.Unix(0, t)))
+			}
+		}
+	}
+
+	var fromClient io.Reader = client
+	if onSNI != nil {
+		fromClient = &sniReader{r: client, done: onSNI}
+	}
+	var fromUpstream io.Reader = upstream
+	var idle *tunnelIdle
+	if s.cfg.TunnelIdleTimeout > 0 {
+		idle = newTunnelIdle(s.cfg.TunnelIdleTimeout)
+		fromClient = &activeReader{r: fromClient, idle: idle}
+		fromUpstream = &idleReader{conn: upstream, idle: idle, closeAll: func() {
+			_ = upstream.Close()
+			if c, ok := client.(io.Closer); ok {
+				_ = c.Close()
+			}
+		}}
+	}
+
 	done := make(chan struct{}, 2)
-	copy := func(dst, src net.Conn) {
-		_, _ = io.Copy(dst, src)
+	copy := func(dst io.ReadWriter, src io.Reader, n *int64, first func(), isUp bool) {
+		var w io.Writer = dst
+		if tc != nil && s.countsLive() {
+			w = &liveWriter{w: dst, tc: tc, up: isUp}
+		}
+		buf := s.bufPool.Get().(*[]byte)
+		*n, _ = copyFirst(w, src, *buf, first)
+		s.bufPool.Put(buf)
 		// Half-close to unblock the other goroutine
-		if tc, ok := dst.(*net.TCPConn); ok {
-			_ = tc.CloseWrite()
+		switch c := dst.(type) {
+		case *net.TCPConn:
+			_ = c.CloseWrite()
+		case *h2Stream:
+			_ = c.CloseWrite()
 		}
 		done <- struct{}{}
 	}
-	go copy(a, b)
-	go copy(b, a)
+	go copy(client, fromUpstream, &down, downFirst, false)
+	go copy(upstream, fromClient, &up, upFirst, true)
 	<-done
 	<-done
+	if idle != nil && idle.expired.Load() {
+		via := ""
+		if tc != nil {
+			via = fmt.Sprintf(" to %s via %s", tc.info.Destination, tc.info.Proxy.String())
+		}
+		log.Printf("[server] closed tunnel%s: nothing relayed for %s", via, s.cfg.TunnelIdleTimeout)
+	}
+	return up, down
+}
+
+// copyFirst is io.CopyBuffer that calls first (if non-nil) once the first
+// chunk has been written to dst. Only that chunk is copied by hand; the rest
+// goes through io.CopyBuffer so the zero-copy paths still apply.
+func copyFirst(dst io.Writer, src io.Reader, buf []byte, first func()) (int64, error) {
+	if first == nil {
+		return io.CopyBuffer(dst, src, buf)
+	}
+	var written int64
+	nr, err := src.Read(buf)
+	if nr > 0 {
+		nw, werr := dst.Write(buf[:nr])
+		written = int64(nw)
+		if werr != nil {
+			return written, werr
+		}
+		first()
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return written, err
+	}
+	n, err := io.CopyBuffer(dst, src, buf)
+	return written + n, err
+}
+
+// logAccess writes entry to the access log, if one is configured.
+func (s *Server) logAccess(entry *accesslog.Entry) {
+	if s.cfg.AccessLog == nil {
+		return
+	}
+	entry.Duration = time.Since(entry.Time)
+	s.cfg.AccessLog.Log(*entry)
 }
 
 // -----------------------------------------------------------------------
@@ -229,19 +1140,36 @@ func (s *Server) authRequired() bool {
 }
 
 func (s *Server) checkAuth(req *http.Request) bool {
+	user, pass, ok := proxyCredentials(req)
+	return ok && user == s.cfg.Username && pass == s.cfg.Password
+}
+
+// proxyCredentials returns the Basic credentials in req's
+// Proxy-Authorization header.
+func proxyCredentials(req *http.Request) (user, pass string, ok bool) {
 	auth := req.Header.Get("Proxy-Authorization")
 	if !strings.HasPrefix(auth, "Basic ") {
-		return false
+		return "", "", false
 	}
 	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
 	if err != nil {
-		return false
+		return "", "", false
 	}
-	parts := strings.SplitN(string(decoded), ":", 2)
-	if len(parts) != 2 {
-		return false
+	return strings.Cut(string(decoded), ":")
+}
+
+// clientHeader carries the client label used to find a proxy reserved for
+// the client (see rotator.Reserve). It is never forwarded upstream.
+const clientHeader = "X-Proxyrotator-Client"
+
+// clientLabel returns the label of the client sending req: its
+// X-Proxyrotator-Client header, else the username it authenticates with.
+func clientLabel(req *http.Request) string {
+	if label := req.Header.Get(clientHeader); label != "" {
+		return label
 	}
-	return parts[0] == s.cfg.Username && parts[1] == s.cfg.Password
+	user, _, _ := proxyCredentials(req)
+	return user
 }
 
 // -----------------------------------------------------------------------
@@ -255,6 +1183,82 @@ func writeError(conn net.Conn, code int, msg string) {
 	log.Printf("[server] error %d: %s", code, msg)
 }
 
+// connectDestination works out the "host:port" a CONNECT request asks for.
+// The usual authority-form target ("example.com:443") ends up in req.Host,
+// but some clients send an absolute URI ("https://example.com:443/") or a
+// scheme-relative one ("//example.com:443"), which net/http does not parse
+// into a usable host. Those are parsed from the raw request target; an
+// origin-form target ("/") falls back to the Host header. The port defaults
+// to 443 (80 for an explicit http:// target). ok is false if no valid
+// destination can be determined.
+func connectDestination(req *http.Request) (destination string, ok bool) {
+	host, port := "", "443"
+	if raw := req.RequestURI; strings.Contains(raw, "://") || strings.HasPrefix(raw, "//") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return "", false
+		}
+		host = u.Host
+		if strings.EqualFold(u.Scheme, "http") {
+			port = "80"
+		}
+	}
+	if host == "" {
+		host = req.URL.Host
+	}
+	if host == "" {
+		host = req.Host
+	}
+	if host == "" {
+		return "", false
+	}
+	if !hasPort(host) {
+		host += ":" + port
+	}
+	h, p, err := net.SplitHostPort(host)
+	if err != nil || h == "" || p == "" || strings.ContainsAny(h, "/?#") {
+		return "", false
+	}
+	return host, true
+}
+
+// resolveTarget turns a "host:port" destination into "ip:port" using the
+// local resolver. Destinations that already carry an IP are returned as-is.
+func resolveTarget(ctx context.Context, destination string) (string, error) {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return "", fmt.Errorf("split destination %q: %w", destination, err)
+	}
+	if net.ParseIP(host) != nil {
+		return destination, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		err = fmt.Errorf("resolve %s: %w", host, err)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			err = upstream.DestinationError(err)
+		}
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("resolve %s: no addresses", host)
+	}
+	return net.JoinHostPort(addrs[0].IP.String(), port), nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
 func hasPort(host string) bool {
 	_, _, err := net.SplitHostPort(host)
 	return err == nil
@@ -0,0 +1,1202 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+	"github.com/drsoft-oss/proxyrotator/internal/rotator"
+	"github.com/drsoft-oss/proxyrotator/internal/upstream"
+)
+
+// readRequest parses a raw HTTP request the same way handleConn does.
+func readRequest(t *testing.T, raw string) *http.Request {
+	t.Helper()
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("ReadRequest(%q): %v", raw, err)
+	}
+	return req
+}
+
+func TestConnectDestination(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want string
+		ok   bool
+	}{
+		{"authority form", "CONNECT example.com:443 HTTP/1.1\r\n\r\n", "example.com:443", true},
+		{"authority without port", "CONNECT example.com HTTP/1.1\r\n\r\n", "example.com:443", true},
+		{"ipv6 authority", "CONNECT [::1]:8443 HTTP/1.1\r\n\r\n", "[::1]:8443", true},
+		{"absolute https", "CONNECT https://example.com HTTP/1.1\r\n\r\n", "example.com:443", true},
+		{"absolute with port and path", "CONNECT http://example.com:8443/ HTTP/1.1\r\n\r\n", "example.com:8443", true},
+		{"absolute http default port", "CONNECT http://example.com/ HTTP/1.1\r\n\r\n", "example.com:80", true},
+		{"scheme relative", "CONNECT //example.com:443 HTTP/1.1\r\n\r\n", "example.com:443", true},
+		{"origin form with Host", "CONNECT / HTTP/1.1\r\nHost: example.com:443\r\n\r\n", "example.com:443", true},
+		{"origin form without Host", "CONNECT / HTTP/1.1\r\n\r\n", "", false},
+		{"absolute without host", "CONNECT https:/// HTTP/1.1\r\n\r\n", "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := connectDestination(readRequest(t, tc.raw))
+			if got != tc.want || ok != tc.ok {
+				t.Errorf("connectDestination = (%q, %v), want (%q, %v)", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestHandleConn_ConnectWithoutDestination(t *testing.T) {
+	s := New(Config{}, nil)
+	client, srv := net.Pipe()
+	defer client.Close()
+	go s.handleConn(srv)
+
+	if _, err := client.Write([]byte("CONNECT / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// runTunnels opens n concurrent tunnels over in-memory pipes, pushes payload
+// client→upstream and its first half back upstream→client through each one,
+// and waits for them all to finish.
+func runTunnels(tb testing.TB, n int, payload []byte, tunnel func(client, upstream net.Conn) (int64, int64)) {
+	reply := payload[:len(payload)/2]
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		clientApp, clientSide := net.Pipe()
+		upstreamSide, upstreamApp := net.Pipe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			up, down := tunnel(clientSide, upstreamSide)
+			if up != int64(len(payload)) {
+				tb.Errorf("tunnel copied %d bytes up, want %d", up, len(payload))
+			}
+			if down != int64(len(reply)) {
+				tb.Errorf("tunnel copied %d bytes down, want %d", down, len(reply))
+			}
+		}()
+		go func() {
+			clientApp.Write(payload)
+			got := make([]byte, len(reply))
+			if _, err := io.ReadFull(clientApp, got); err != nil || !bytes.Equal(got, reply) {
+				tb.Errorf("client read %q (%v), want the upstream's reply", got, err)
+			}
+			clientApp.Close()
+		}()
+		go func() {
+			io.ReadFull(upstreamApp, make([]byte, len(payload)))
+			upstreamApp.Write(reply)
+			upstreamApp.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTunnel_CopiesBothDirections(t *testing.T) {
+	s := New(Config{TunnelBufferSize: 512}, nil)
+	runTunnels(t, 20, bytes.Repeat([]byte("x"), 4096), s.plainTunnel)
+	if n := s.Stats().Tunnels; n != 0 {
+		t.Errorf("Stats().Tunnels = %d after all tunnels finished, want 0", n)
+	}
+}
+
+// BenchmarkTunnel compares pooled copy buffers against plain io.Copy, which
+// allocates a fresh 32 KiB buffer per direction per connection. Run with
+// -benchmem to see the allocation difference.
+func BenchmarkTunnel(b *testing.B) {
+	const conns = 1000
+	payload := bytes.Repeat([]byte("x"), 4096)
+
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			runTunnels(b, conns, payload, unpooledTunnel)
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		s := New(Config{}, nil)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			runTunnels(b, conns, payload, s.plainTunnel)
+		}
+	})
+}
+
+// plainTunnel is tunnel without response timing.
+func (s *Server) plainTunnel(client, upstream net.Conn) (int64, int64) {
+	return s.tunnel(client, upstream, nil, time.Time{}, nil, nil)
+}
+
+// unpooledTunnel is the io.Copy-based tunnel used as the benchmark baseline.
+func unpooledTunnel(client, upstream net.Conn) (up, down int64) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn, n *int64) {
+		*n, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(client, upstream, &down)
+	go cp(upstream, client, &up)
+	<-done
+	<-done
+	return up, down
+}
+
+// failingConn is an upstream connection whose writes always fail.
+type failingConn struct{ net.Conn }
+
+func (failingConn) Write([]byte) (int, error) { return 0, errors.New("connection reset by peer") }
+
+// newHTTPTestServer returns a server over a two-proxy pool whose first proxy
+// fails every write. Requests reaching the second proxy are passed to
+// handle, which must answer on conn.
+func newHTTPTestServer(t *testing.T, handle func(req *http.Request, conn net.Conn)) *Server {
+	t.Helper()
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := p.All()[0]
+
+	s := New(Config{}, r)
+	s.dial = func(_ context.Context, px *pool.Proxy, _ string) (net.Conn, error) {
+		local, remote := net.Pipe()
+		if px == bad {
+			remote.Close()
+			return failingConn{local}, nil
+		}
+		go func() {
+			defer remote.Close()
+			req, err := http.ReadRequest(bufio.NewReader(remote))
+			if err != nil {
+				t.Errorf("upstream read request: %v", err)
+				return
+			}
+			handle(req, remote)
+		}()
+		return local, nil
+	}
+	return s
+}
+
+// roundTrip sends raw through s and returns the response.
+func roundTrip(t *testing.T, s *Server, raw string) *http.Response {
+	t.Helper()
+	client, srv := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go s.handleConn(srv)
+
+	go client.Write([]byte(raw))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp
+}
+
+func TestHandleHTTP_ReplaysIdempotentRequest(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != "hello" {
+			t.Errorf("replayed body = %q, want hello", body)
+		}
+		io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+	})
+
+	resp := roundTrip(t, s, "PUT http://example.com/x HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want 204 from the second proxy", resp.StatusCode)
+	}
+}
+
+func TestHandleHTTP_FailedReplaySparesCurrent(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		t.Error("the replay proxy cannot be dialed")
+	})
+	cur := s.rotator.Current()
+	dial := s.dial
+	var replay *pool.Proxy
+	s.dial = func(ctx context.Context, px *pool.Proxy, destination string) (net.Conn, error) {
+		if px != cur {
+			replay = px
+			return nil, errors.New("connection refused")
+		}
+		return dial(ctx, px, destination)
+	}
+
+	resp := roundTrip(t, s, "PUT http://example.com/x HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if replay == nil {
+		t.Fatal("request was not replayed")
+	}
+	if _, n, _ := cur.Session(); n != 1 {
+		t.Errorf("current proxy charged %d conn errors, want 1: its failed write", n)
+	}
+	if n := replay.TotalConnErrors.Load(); n != 1 {
+		t.Errorf("replay proxy charged %d conn errors, want 1: its failed dial", n)
+	}
+}
+
+func TestHandleHTTP_WriteFailureNotReplayed(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		t.Errorf("non-idempotent %s must not be replayed", req.Method)
+	})
+
+	resp := roundTrip(t, s, "POST http://example.com/x HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestHandleConn_HeadersTooLarge(t *testing.T) {
+	s := New(Config{MaxHeaderBytes: 128}, nil)
+	raw := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Junk: " + strings.Repeat("a", 256) + "\r\n\r\n"
+
+	resp := roundTrip(t, s, raw)
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status = %d, want 431", resp.StatusCode)
+	}
+}
+
+func TestHandleConn_HeaderLimitDoesNotCapBody(t *testing.T) {
+	body := strings.Repeat("b", 512)
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		got, _ := io.ReadAll(req.Body)
+		if string(got) != body {
+			t.Errorf("upstream got %d body bytes, want %d", len(got), len(body))
+		}
+		io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+	})
+	s.cfg.MaxHeaderBytes = 128
+
+	// POST is not replayed, so make sure it goes straight to the good proxy.
+	if err := s.rotator.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := roundTrip(t, s, "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 512\r\n\r\n"+body)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", resp.StatusCode)
+	}
+}
+
+func TestTunnel_ReportsResponseLatency(t *testing.T) {
+	s := New(Config{}, nil)
+	clientApp, clientSide := net.Pipe()
+	upstreamSide, upstreamApp := net.Pipe()
+
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(upstreamApp, buf)
+		time.Sleep(50 * time.Millisecond)
+		upstreamApp.Write([]byte("pong"))
+		upstreamApp.Close()
+	}()
+	go func() {
+		clientApp.Write([]byte("ping"))
+		io.ReadFull(clientApp, make([]byte, 4))
+		clientApp.Close()
+	}()
+
+	var got []time.Duration
+	s.tunnel(clientSide, upstreamSide, nil, time.Time{}, func(d time.Duration) { got = append(got, d) }, nil)
+	if len(got) != 1 {
+		t.Fatalf("onResponse called %d times, want 1", len(got))
+	}
+	if got[0] < 50*time.Millisecond || got[0] > time.Second {
+		t.Errorf("response latency = %s, want ≈50ms", got[0])
+	}
+}
+
+func TestTunnel_IdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s := New(Config{TunnelIdleTimeout: timeout}, nil)
+	clientApp, clientSide := net.Pipe()
+	upstreamSide, upstreamApp := net.Pipe()
+	defer clientApp.Close()
+	defer upstreamApp.Close()
+
+	go io.Copy(io.Discard, clientApp)
+	go io.Copy(io.Discard, upstreamApp)
+	go func() {
+		// Trickle a few chunks, each inside the timeout, then hang without
+		// closing.
+		for i := 0; i < 3; i++ {
+			upstreamApp.Write([]byte("chunk"))
+			time.Sleep(timeout * 6 / 10)
+		}
+	}()
+
+	start := time.Now()
+	returned := make(chan struct{})
+	go func() {
+		s.tunnel(clientSide, upstreamSide, nil, time.Time{}, nil, nil)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel still open 2s after the upstream stalled")
+	}
+	if elapsed := time.Since(start); elapsed < 2*timeout {
+		t.Errorf("tunnel closed after %s, before the upstream went quiet", elapsed)
+	}
+	if _, err := clientApp.Write([]byte("x")); err == nil {
+		t.Error("client end should be closed")
+	}
+}
+
+func TestConnectEstablished(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+		raw  string
+		want string
+	}{
+		{"http/1.1", Config{}, "CONNECT example.com:443 HTTP/1.1\r\n\r\n",
+			"HTTP/1.1 200 Connection established\r\n\r\n"},
+		{"http/1.0 echoed", Config{}, "CONNECT example.com:443 HTTP/1.0\r\n\r\n",
+			"HTTP/1.0 200 Connection established\r\n\r\n"},
+		{"custom reason and headers", Config{
+			ConnectReason:  "OK",
+			ConnectHeaders: http.Header{"Proxy-Agent": {"proxyrotator"}},
+		}, "CONNECT example.com:443 HTTP/1.1\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nProxy-Agent: proxyrotator\r\n\r\n"},
+		{"info headers", Config{
+			ConnectInfoHeaders: true,
+			ConnectHeaders:     http.Header{"Proxy-Agent": {"proxyrotator"}},
+		}, "CONNECT example.com:443 HTTP/1.1\r\n\r\n",
+			"HTTP/1.1 200 Connection established\r\nProxy-Agent: proxyrotator\r\nX-Proxy-Group: residential\r\nX-Proxy-Id: 1\r\nX-Proxy-Region: DE\r\n\r\n"},
+	}
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080 group=residential country=de"}); err != nil {
+		t.Fatal(err)
+	}
+	px := p.All()[0]
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(tc.cfg, nil)
+			if got := s.connectEstablished(readRequest(t, tc.raw), px); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJitter_WithinRange(t *testing.T) {
+	s := New(Config{JitterMin: 20 * time.Millisecond, JitterMax: 40 * time.Millisecond}, nil)
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		s.jitter()
+		if d := time.Since(start); d < 20*time.Millisecond || d > time.Second {
+			t.Errorf("jitter slept %s, want 20ms–40ms", d)
+		}
+	}
+
+	start := time.Now()
+	New(Config{}, nil).jitter()
+	if d := time.Since(start); d > 10*time.Millisecond {
+		t.Errorf("disabled jitter slept %s", d)
+	}
+}
+
+func TestRequestTimeout_HTTPNoResponse(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		io.Copy(io.Discard, conn) // never answer
+	})
+	s.cfg.RequestTimeout = 50 * time.Millisecond
+	if err := s.rotator.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp := roundTrip(t, s, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", resp.StatusCode)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("timeout took %s", d)
+	}
+}
+
+func TestRequestTimeout_HTTPResponseRelayed(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+	})
+	s.cfg.RequestTimeout = time.Second
+	if err := s.rotator.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := roundTrip(t, s, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("got %d %q, want 200 hello", resp.StatusCode, body)
+	}
+}
+
+func TestRequestTimeout_ConnectDial(t *testing.T) {
+	s := newHTTPTestServer(t, nil)
+	s.cfg.RequestTimeout = 50 * time.Millisecond
+	s.dial = func(ctx context.Context, _ *pool.Proxy, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	resp := roundTrip(t, s, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", resp.StatusCode)
+	}
+}
+
+func TestHTTP2Connect(t *testing.T) {
+	s := newHTTPTestServer(t, nil)
+	s.dial = func(context.Context, *pool.Proxy, string) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(remote, buf); err == nil {
+				remote.Write(buf)
+			}
+		}()
+		return local, nil
+	}
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	go s.handleConn(srv)
+	cc, err := (&http2.Transport{}).NewClientConn(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp, err := cc.RoundTrip(get)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", resp.StatusCode)
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: "example.com:443"},
+		Host:   "example.com:443",
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	resp, err = cc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("CONNECT: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+	go pw.Write([]byte("ping"))
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read tunnel: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("tunnel echoed %q, want ping", got)
+	}
+}
+
+func TestServe_StopIsClean(t *testing.T) {
+	s := New(Config{ListenAddr: "127.0.0.1:0"}, nil)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve() }()
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve after Stop = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after Stop")
+	}
+}
+
+func TestWait_ForConnectionsAfterStop(t *testing.T) {
+	s := New(Config{ListenAddr: "127.0.0.1:0", MaxHeaderBytes: 1 << 20}, nil)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	client, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s.Stats().Handlers == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while a connection was still open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	client.Close()
+	select {
+	case <-waited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait did not return after the last connection closed")
+	}
+}
+
+func TestLoopRejected(t *testing.T) {
+	s := newHTTPTestServer(t, nil)
+	s.cfg.ListenAddr = "0.0.0.0:8080"
+	s.cfg.SelfAddresses = []string{"proxy.example.net:3128"}
+	s.dial = func(context.Context, *pool.Proxy, string) (net.Conn, error) {
+		t.Error("a loop must not be dialed")
+		return nil, errors.New("unexpected dial")
+	}
+
+	for _, raw := range []string{
+		"CONNECT 127.0.0.1:8080 HTTP/1.1\r\nHost: 127.0.0.1:8080\r\n\r\n",
+		"CONNECT localhost:8080 HTTP/1.1\r\nHost: localhost:8080\r\n\r\n",
+		"GET http://proxy.example.net:3128/ HTTP/1.1\r\nHost: proxy.example.net:3128\r\n\r\n",
+	} {
+		resp := roundTrip(t, s, raw)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want 400", strings.SplitN(raw, "\r\n", 2)[0], resp.StatusCode)
+		}
+	}
+
+	for _, dest := range []string{"127.0.0.1:8081", "203.0.113.9:8080", "proxy.example.net:443"} {
+		if s.isLoop(dest) {
+			t.Errorf("isLoop(%q) = true, want false", dest)
+		}
+	}
+}
+
+func TestServeAPI_UnifiedPort(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+	})
+	s.cfg.Username, s.cfg.Password = "user", "pass"
+	s.ServeAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "api "+r.URL.Path)
+	}))
+
+	resp := roundTrip(t, s, "GET /api/current HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("API without credentials: status = %d, want 401", resp.StatusCode)
+	}
+
+	resp = roundTrip(t, s, "GET /api/current HTTP/1.1\r\nHost: proxy\r\nAuthorization: Basic dXNlcjpwYXNz\r\n\r\n")
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if resp.StatusCode != http.StatusOK || string(body) != "api /api/current" {
+		t.Errorf("API request: status = %d body = %q, want 200 from the API", resp.StatusCode, body)
+	}
+
+	// An absolute-form request for a path under /api/ is still proxied.
+	resp = roundTrip(t, s, "GET http://example.com/api/current HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("proxy request: status = %d, want 204 from upstream", resp.StatusCode)
+	}
+}
+
+func TestServeAPI_LoopbackOnlyWithoutAuth(t *testing.T) {
+	s := newHTTPTestServer(t, nil)
+	s.ServeAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "api")
+	}))
+	for _, tc := range []struct {
+		remote string
+		want   int
+	}{
+		{"127.0.0.1:50000", http.StatusOK},
+		{"[::1]:50000", http.StatusOK},
+		{"203.0.113.7:50000", http.StatusForbidden},
+		{"pipe", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/rotate", nil)
+		req.RemoteAddr = tc.remote
+		rec := httptest.NewRecorder()
+		s.api.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("client %s: status = %d, want %d", tc.remote, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestReservedProxy_OnlyForItsClient(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		if v := req.Header.Get(clientHeader); v != "" {
+			t.Errorf("%s forwarded upstream: %q", clientHeader, v)
+		}
+		io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+	})
+	// The current proxy is the failing one; reserve the other.
+	good := s.rotator.AlternativeTo(s.rotator.Current())
+	if err := s.rotator.Reserve(good, "vip"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"
+	if resp := roundTrip(t, s, raw+clientHeader+": vip\r\n\r\n"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("reserved client: status = %d, want 204", resp.StatusCode)
+	}
+	// Anyone else stays off the reserved proxy, even to retry a failure.
+	if resp := roundTrip(t, s, raw+"\r\n"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("other client: status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestPausedRotator_RefusesNewConnections(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		t.Error("no request should reach an upstream while paused")
+	})
+	s.rotator.DrainCurrent()
+	for _, raw := range []string{
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		if resp := roundTrip(t, s, raw); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%q: status = %d, want 503", strings.SplitN(raw, "\r\n", 2)[0], resp.StatusCode)
+		}
+	}
+}
+
+func TestMaxConnsPerClient(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		t.Error("no request should reach an upstream over the client's limit")
+	})
+	s.cfg.MaxConnsPerClient = 1
+
+	// net.Pipe connections all share the address "pipe", so this holds the
+	// one slot the client has.
+	held, _ := net.Pipe()
+	defer held.Close()
+	release, ok := s.admitClient(held.RemoteAddr())
+	if !ok {
+		t.Fatal("first request should be admitted")
+	}
+	resp := roundTrip(t, s, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", resp.StatusCode)
+	}
+	if got := s.ClientConns()["pipe"]; got != 1 {
+		t.Errorf("ClientConns()[pipe] = %d, want 1", got)
+	}
+
+	release()
+	if got := s.ClientConns(); len(got) != 0 {
+		t.Errorf("ClientConns() = %v after release, want empty", got)
+	}
+}
+
+func TestCountTraffic(t *testing.T) {
+	for _, tc := range []struct {
+		count string
+		want  int64
+	}{
+		{CountBoth, 1},
+		{CountConnect, 0},
+		{CountHTTP, 1},
+	} {
+		t.Run(tc.count, func(t *testing.T) {
+			s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+			})
+			s.cfg.CountTraffic = tc.count
+			if err := s.rotator.RotateNow("test"); err != nil {
+				t.Fatal(err)
+			}
+			px := s.rotator.Current()
+
+			resp := roundTrip(t, s, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if n := px.ReqCount.Load(); n != tc.want {
+				t.Errorf("plain HTTP request counted %d times towards rotation, want %d", n, tc.want)
+			}
+			if n := px.TotalReqs.Load(); n != 1 {
+				t.Errorf("TotalReqs = %d, want 1 whatever counts towards rotation", n)
+			}
+		})
+	}
+}
+
+func TestCountTraffic_MaxRequestsStillRotates(t *testing.T) {
+	s := newHTTPTestServer(t, func(req *http.Request, conn net.Conn) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+	s.cfg.CountTraffic = CountConnect
+	if err := s.rotator.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	px := s.rotator.Current()
+	px.MaxRequests = 2
+	gen := s.rotator.Generation()
+	s.rotator.Start()
+	defer s.rotator.Stop()
+
+	for i := 0; i < 2; i++ {
+		resp := roundTrip(t, s, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+	if n := px.ReqCount.Load(); n != 0 {
+		t.Errorf("plain HTTP requests counted %d times towards --rotate-requests, want 0", n)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.rotator.Generation() == gen {
+		if time.Now().After(deadline) {
+			t.Fatal("no rotation after the proxy used up its max-requests budget on uncounted traffic")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.rotator.Current() == px {
+		t.Error("still on the exhausted proxy after rotating")
+	}
+}
+
+func TestDrainLimits(t *testing.T) {
+	s := newHTTPTestServer(t, nil)
+	s.cfg.DrainMaxBytes = 1000
+	s.cfg.DrainIdleTimeout = time.Minute
+	px := s.rotator.Current()
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 51234}
+
+	// A tunnel through the proxy counts its bytes as they go.
+	busy := s.conns.Track(client, "download.example:443", px)
+	clientSide, clientEnd := net.Pipe()
+	upstreamSide, upstreamEnd := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.tunnel(clientSide, upstreamSide, busy, time.Time{}, nil, nil)
+		close(done)
+	}()
+	go func() {
+		_, _ = upstreamEnd.Write(make([]byte, 2000))
+		upstreamEnd.Close()
+	}()
+	if _, err := io.ReadFull(clientEnd, make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	clientEnd.Close()
+	<-done
+	if got := busy.snapshot().BytesDown; got != 2000 {
+		t.Fatalf("BytesDown = %d, want 2000", got)
+	}
+
+	closed := map[string]bool{}
+	busy.setCloser(func() { closed["busy"] = true })
+	idle := s.conns.Track(client, "idle.example:443", px)
+	idle.setCloser(func() { closed["idle"] = true })
+
+	now := time.Now().Add(30 * time.Second)
+	s.drainStep(now)
+	if len(closed) != 0 {
+		t.Fatalf("closed %v while the proxy is not retiring", closed)
+	}
+
+	s.rotator.DrainCurrent()
+	s.drainStep(now)
+	if !closed["busy"] || closed["idle"] {
+		t.Fatalf("closed %v, want only the connection over the byte limit", closed)
+	}
+	busy.Done()
+	s.drainStep(now.Add(time.Minute))
+	if !closed["idle"] {
+		t.Fatal("idle connection not closed")
+	}
+
+	progress := s.DrainProgress()
+	if len(progress) != 1 || progress[0].Proxy != px || progress[0].Conns != 1 || progress[0].Closed != 2 {
+		t.Errorf("DrainProgress() = %+v, want the paused proxy with 1 conn and 2 closed", progress)
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	for _, tc := range []struct {
+		retries, failing int
+		want             int
+	}{
+		{retries: 2, failing: 2, want: http.StatusOK},
+		{retries: 1, failing: 2, want: http.StatusBadGateway},
+		{retries: 0, failing: 1, want: http.StatusBadGateway},
+	} {
+		p := pool.New(false)
+		if err := p.LoadProxies([]string{"http://1.1.1.1:8080", "http://2.2.2.2:8080", "http://3.3.3.3:8080"}); err != nil {
+			t.Fatal(err)
+		}
+		r, err := rotator.New(p, rotator.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := New(Config{ConnectRetries: tc.retries}, r)
+
+		var mu sync.Mutex
+		var tried []*pool.Proxy
+		s.dial = func(_ context.Context, px *pool.Proxy, _ string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			tried = append(tried, px)
+			if len(tried) <= tc.failing {
+				return nil, errors.New("connection refused")
+			}
+			local, remote := net.Pipe()
+			t.Cleanup(func() { remote.Close() })
+			return local, nil
+		}
+
+		resp := roundTrip(t, s, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		if resp.StatusCode != tc.want {
+			t.Errorf("retries=%d failing=%d: status = %d, want %d", tc.retries, tc.failing, resp.StatusCode, tc.want)
+		}
+		mu.Lock()
+		seen := map[*pool.Proxy]bool{}
+		for _, px := range tried {
+			if seen[px] {
+				t.Errorf("retries=%d failing=%d: %s tried twice", tc.retries, tc.failing, px.String())
+			}
+			seen[px] = true
+		}
+		if want := min(tc.retries, tc.failing) + 1; len(tried) != want {
+			t.Errorf("retries=%d failing=%d: %d attempts, want %d", tc.retries, tc.failing, len(tried), want)
+		}
+		mu.Unlock()
+		if tc.want != http.StatusOK {
+			for _, px := range p.All() {
+				if n := px.ActiveConns.Load(); n != 0 {
+					t.Errorf("retries=%d failing=%d: %s left with %d active conns", tc.retries, tc.failing, px.String(), n)
+				}
+			}
+		}
+	}
+}
+
+func TestConnectRetries_ErrorsOnAlternativesSpareCurrent(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.1.1.1:8080", "http://2.2.2.2:8080", "http://3.3.3.3:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{RotateConnErrors: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{ConnectRetries: 2}, r)
+	s.dial = func(context.Context, *pool.Proxy, string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	cur := r.Current()
+	resp := roundTrip(t, s, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	// Each proxy failed once; only the current proxy's own failure counts
+	// towards its rotation trigger.
+	for _, px := range p.All() {
+		if n := px.TotalConnErrors.Load(); n != 1 {
+			t.Errorf("%s: total_conn_errors = %d, want 1", px, n)
+		}
+	}
+	if _, n, _ := cur.Session(); n != 1 {
+		t.Errorf("current proxy charged %d conn errors, want 1: its own", n)
+	}
+}
+
+func TestStaticRoute_TrafficSparesCurrent(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.1.1.1:8080", "http://2.2.2.2:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{
+		RotateRequests:   2,
+		RotateConnErrors: 2,
+		Routes:           map[string]string{"api.example.com": "2.2.2.2:8080"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, routed := p.All()[0], p.All()[1]
+	if r.Current() != cur {
+		t.Fatalf("current = %s, want %s", r.Current(), cur)
+	}
+	s := New(Config{}, r)
+	var failing atomic.Bool
+	s.dial = func(context.Context, *pool.Proxy, string) (net.Conn, error) {
+		if failing.Load() {
+			return nil, errors.New("connection refused")
+		}
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		return local, nil
+	}
+
+	const n = 3
+	for _, fail := range []bool{false, true} {
+		failing.Store(fail)
+		for i := 0; i < n; i++ {
+			roundTrip(t, s, "CONNECT api.example.com:443 HTTP/1.1\r\nHost: api.example.com:443\r\n\r\n")
+		}
+	}
+	if reqs, errs := routed.TotalReqs.Load(), routed.TotalConnErrors.Load(); reqs != n || errs != n {
+		t.Errorf("routed proxy: %d requests, %d conn errors; want %d, %d", reqs, errs, n, n)
+	}
+	if reqs, errs, _ := cur.Session(); reqs != 0 || errs != 0 {
+		t.Errorf("current proxy charged %d requests and %d conn errors for routed traffic, want none", reqs, errs)
+	}
+	if r.Current() != cur {
+		t.Errorf("current proxy rotated to %s by routed traffic", r.Current())
+	}
+}
+
+func TestOverflow_TrafficSparesCurrent(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.1.1.1:8080 max-conns=1", "http://2.2.2.2:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{RotateRequests: 2, RotateConnErrors: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, overflow := p.All()[0], p.All()[1]
+	if r.Current() != cur {
+		t.Fatalf("current = %s, want %s", r.Current(), cur)
+	}
+	if !cur.AcquireConn() { // the current proxy is full
+		t.Fatal("AcquireConn on the current proxy failed")
+	}
+	s := New(Config{}, r)
+	var failing atomic.Bool
+	s.dial = func(_ context.Context, px *pool.Proxy, _ string) (net.Conn, error) {
+		if px != overflow {
+			t.Errorf("dialed %s, want the overflow proxy", px)
+		}
+		if failing.Load() {
+			return nil, errors.New("connection refused")
+		}
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		return local, nil
+	}
+
+	const n = 3
+	for _, fail := range []bool{false, true} {
+		failing.Store(fail)
+		for i := 0; i < n; i++ {
+			roundTrip(t, s, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		}
+	}
+	if reqs, errs := overflow.TotalReqs.Load(), overflow.TotalConnErrors.Load(); reqs != n || errs != n {
+		t.Errorf("overflow proxy: %d requests, %d conn errors; want %d, %d", reqs, errs, n, n)
+	}
+	if reqs, errs, _ := cur.Session(); reqs != 0 || errs != 0 {
+		t.Errorf("current proxy charged %d requests and %d conn errors for overflow traffic, want none", reqs, errs)
+	}
+}
+
+func TestDestFailureCache(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.1.1.1:8080", "http://2.2.2.2:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{DestFailureTTL: time.Minute, ConnectRetries: 1}, r)
+
+	var mu sync.Mutex
+	dials := map[string]int{}
+	s.dial = func(_ context.Context, _ *pool.Proxy, destination string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials[destination]++
+		if destination == "dead.example:443" {
+			return nil, upstream.DestinationError(errors.New("upstream proxy CONNECT failed: 502 Bad Gateway"))
+		}
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		return local, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := roundTrip(t, s, "CONNECT dead.example:443 HTTP/1.1\r\nHost: dead.example:443\r\n\r\n")
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("attempt %d: status = %d, want 502", i+1, resp.StatusCode)
+		}
+	}
+	mu.Lock()
+	if n := dials["dead.example:443"]; n != 2 {
+		t.Errorf("dead destination dialed %d times, want twice: once per proxy until confirmed, then cached", n)
+	}
+	mu.Unlock()
+	var connErrs int64
+	for _, px := range p.All() {
+		connErrs += px.TotalConnErrors.Load()
+		if n := px.ActiveConns.Load(); n != 0 {
+			t.Errorf("%s left with %d active conns", px.String(), n)
+		}
+	}
+	if connErrs != 1 {
+		t.Errorf("%d conn errors charged, want 1: the first proxy's, before a second one confirmed", connErrs)
+	}
+
+	if resp := roundTrip(t, s, "CONNECT ok.example:443 HTTP/1.1\r\nHost: ok.example:443\r\n\r\n"); resp.StatusCode != http.StatusOK {
+		t.Errorf("other destination: status = %d, want 200", resp.StatusCode)
+	}
+	if _, ok := s.destFails.lookup("dead.example:443", time.Now().Add(2*time.Minute)); ok {
+		t.Error("failure still cached after its TTL")
+	}
+}
+
+func TestDestFailureCache_BrokenProxy(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.1.1.1:8080", "http://2.2.2.2:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{DestFailureTTL: time.Minute, ConnectRetries: 1}, r)
+	broken := r.Current()
+	var healthy *pool.Proxy
+	for _, px := range p.All() {
+		if px != broken {
+			healthy = px
+		}
+	}
+
+	// The broken proxy answers 502 whatever the destination.
+	s.dial = func(_ context.Context, px *pool.Proxy, _ string) (net.Conn, error) {
+		if px == broken {
+			return nil, upstream.DestinationError(errors.New("upstream proxy CONNECT failed: 502 Bad Gateway"))
+		}
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		return local, nil
+	}
+
+	for i, host := range []string{"a.example", "b.example", "c.example", "a.example"} {
+		resp := roundTrip(t, s, "CONNECT "+host+":443 HTTP/1.1\r\nHost: "+host+":443\r\n\r\n")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200 via the healthy proxy", i+1, resp.StatusCode)
+		}
+	}
+	if n := broken.TotalConnErrors.Load(); n != 3 {
+		t.Errorf("broken proxy charged %d conn errors, want 3: once per destination it failed", n)
+	}
+	if n := healthy.TotalConnErrors.Load(); n != 0 {
+		t.Errorf("healthy proxy charged %d conn errors, want 0", n)
+	}
+	if msg, ok := s.knownUnreachable("a.example:443"); ok {
+		t.Errorf("healthy destination cached as unreachable: %s", msg)
+	}
+}
+
+// Without a second proxy to ask, a dead destination is charged to the proxy
+// once, not on every request.
+func TestDestFailureCache_NoRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name, raw string
+	}{
+		{"connect", "CONNECT dead.example:443 HTTP/1.1\r\nHost: dead.example:443\r\n\r\n"},
+		{"http", "GET http://dead.example:443/ HTTP/1.1\r\nHost: dead.example:443\r\n\r\n"},
+	} {
+		p := pool.New(false)
+		if err := p.LoadProxies([]string{"http://1.1.1.1:8080", "http://2.2.2.2:8080"}); err != nil {
+			t.Fatal(err)
+		}
+		r, err := rotator.New(p, rotator.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := New(Config{DestFailureTTL: time.Minute, ConnectRetries: 0}, r)
+		first := r.Current()
+		s.dial = func(context.Context, *pool.Proxy, string) (net.Conn, error) {
+			return nil, upstream.DestinationError(errors.New("upstream proxy CONNECT failed: 502 Bad Gateway"))
+		}
+
+		for i := 0; i < 5; i++ {
+			if resp := roundTrip(t, s, tc.raw); resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("%s: request %d: status = %d, want 502", tc.name, i+1, resp.StatusCode)
+			}
+		}
+		if n := first.TotalConnErrors.Load(); n != 1 {
+			t.Errorf("%s: proxy charged %d conn errors, want 1", tc.name, n)
+		}
+	}
+}
+
+func TestDestFailureCache_Reconfirm(t *testing.T) {
+	var d destFailures
+	now := time.Now()
+	if got := d.suspect("dead.example:443", 1, now, time.Minute); got != blameNew {
+		t.Fatalf("first blame = %v, want blameNew", got)
+	}
+	if got := d.suspect("dead.example:443", 2, now, time.Minute); got != blameConfirmed {
+		t.Fatalf("second proxy's blame = %v, want blameConfirmed", got)
+	}
+	d.add("dead.example:443", errors.New("502"), now, time.Minute)
+
+	// Past the cache entry, one blame is enough again, for a while.
+	later := now.Add(90 * time.Second)
+	if _, ok := d.lookup("dead.example:443", later); ok {
+		t.Fatal("failure still cached after its TTL")
+	}
+	if got := d.suspect("dead.example:443", 1, later, time.Minute); got != blameConfirmed {
+		t.Errorf("blame after the cache entry = %v, want blameConfirmed", got)
+	}
+	if got := d.suspect("dead.example:443", 1, now.Add(3*time.Minute), time.Minute); got != blameNew {
+		t.Errorf("blame long after = %v, want blameNew", got)
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/drsoft-oss/proxyrotator/internal/accesslog"
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// With Config.LogSNI set, the client→upstream side of a CONNECT tunnel is
+// read through an sniReader, which copies the first TLS record aside until
+// it is complete and then pulls the server name out of the ClientHello.
+// Nothing is terminated or altered: the bytes flow on unchanged.
+
+// maxRecordLen is the largest TLS record the peek waits for: a 5-byte
+// header plus a 2^14-byte plaintext fragment.
+const maxRecordLen = 5 + 1<<14
+
+// sniReader passes reads through and calls done with the SNI once the first
+// TLS record has been seen. done is not called for non-TLS streams or a
+// ClientHello without a server name.
+type sniReader struct {
+	r    io.Reader
+	buf  []byte
+	done func(sni string)
+}
+
+func (s *sniReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if s.done == nil {
+		return n, err
+	}
+	s.buf = append(s.buf, p[:n]...)
+	sni, more := parseClientHello(s.buf)
+	if more && err == nil {
+		return n, err
+	}
+	if sni != "" {
+		s.done(sni)
+	}
+	s.done, s.buf = nil, nil
+	return n, err
+}
+
+// parseClientHello returns the server_name in the TLS ClientHello record at
+// the start of b. more is true while b is a valid but incomplete prefix of
+// such a record.
+func parseClientHello(b []byte) (sni string, more bool) {
+	if len(b) < 5 {
+		return "", len(b) == 0 || b[0] == 0x16 // handshake record
+	}
+	if b[0] != 0x16 || b[1] != 3 {
+		return "", false
+	}
+	n := 5 + int(binary.BigEndian.Uint16(b[3:5]))
+	if n > maxRecordLen {
+		return "", false
+	}
+	if len(b) < n {
+		return "", true
+	}
+
+	// Handshake header: type (1 = ClientHello) and 24-bit length. A
+	// ClientHello longer than the record is cut short; its extensions may
+	// still hold the name.
+	msg := b[5:n]
+	if len(msg) < 4 || msg[0] != 1 {
+		return "", false
+	}
+	c := cursor(msg[4:])
+	c.skip(2 + 32) // legacy_version, random
+	c.skip(int(c.u8()))
+	c.skip(int(c.u16()))
+	c.skip(int(c.u8()))
+	exts := cursor(c.bytes(int(c.u16())))
+	for len(exts) >= 4 {
+		typ, data := exts.u16(), cursor(exts.bytes(int(exts.u16())))
+		if typ != 0 { // server_name
+			continue
+		}
+		list := cursor(data.bytes(int(data.u16())))
+		for len(list) >= 3 {
+			kind, name := list.u8(), list.bytes(int(list.u16()))
+			if kind == 0 { // host_name
+				return string(name), false
+			}
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// cursor reads big-endian fields off the front of a byte slice. Reading
+// past the end empties it instead of panicking, so a truncated message
+// simply yields zero values.
+type cursor []byte
+
+func (c *cursor) bytes(n int) []byte {
+	if n > len(*c) {
+		*c = nil
+		return nil
+	}
+	b := (*c)[:n]
+	*c = (*c)[n:]
+	return b
+}
+
+func (c *cursor) skip(n int) { c.bytes(n) }
+
+func (c *cursor) u8() uint8 {
+	b := c.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (c *cursor) u16() uint16 {
+	b := c.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// sniLogger returns the tunnel callback that records the SNI of a CONNECT
+// to destination, or nil if LogSNI is off.
+func (s *Server) sniLogger(entry *accesslog.Entry, px *pool.Proxy, destination string) func(string) {
+	if !s.cfg.LogSNI {
+		return nil
+	}
+	return func(sni string) {
+		entry.SNI = sni
+		host, _, _ := net.SplitHostPort(destination)
+		if net.ParseIP(host) == nil && !strings.EqualFold(sni, host) {
+			log.Printf("[server] SNI %q does not match CONNECT host (proxy=%s dest=%s)", sni, px.String(), destination)
+			return
+		}
+		log.Printf("[server] SNI %q (proxy=%s dest=%s)", sni, px.String(), destination)
+	}
+}
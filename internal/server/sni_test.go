@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+// clientHello returns the first bytes a TLS client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	defer client.Close()
+	defer server.Close()
+
+	buf := make([]byte, maxRecordLen)
+	var got []byte
+	for {
+		n, err := server.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, more := parseClientHello(got); !more {
+			return got
+		}
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	if sni, more := parseClientHello(hello); sni != "example.com" || more {
+		t.Errorf("full hello: got (%q, %v), want (example.com, false)", sni, more)
+	}
+	if _, more := parseClientHello(hello[:len(hello)-1]); !more {
+		t.Error("truncated hello: want more")
+	}
+	if sni, more := parseClientHello([]byte("GET / HTTP/1.1\r\n")); sni != "" || more {
+		t.Errorf("plain HTTP: got (%q, %v)", sni, more)
+	}
+	if sni, _ := parseClientHello(clientHello(t, "")); sni != "" {
+		t.Errorf("hello without SNI: got %q", sni)
+	}
+}
+
+func TestSNIReader_PassesBytesThrough(t *testing.T) {
+	hello := clientHello(t, "api.example.com")
+	stream := append(hello, "trailing application data"...)
+
+	var got []string
+	r := &sniReader{
+		r:    iotest.OneByteReader(bytes.NewReader(stream)),
+		done: func(sni string) { got = append(got, sni) },
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, stream) {
+		t.Error("bytes were altered")
+	}
+	if len(got) != 1 || got[0] != "api.example.com" {
+		t.Errorf("SNI callbacks = %q, want [api.example.com]", got)
+	}
+}
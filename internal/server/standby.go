@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+)
+
+// With Config.HotStandby the server keeps a connection open to the proxy
+// the next rotation will move to, so the first tunnel after the rotation
+// does not wait for TCP, TLS or the parent proxy. Only the connection to the
+// proxy is held; the CONNECT or SOCKS5 handshake still happens per tunnel,
+// since it names the destination.
+
+// standbyPoll is how often the standby is checked against the proxy that
+// is next up. Tests shorten it.
+var standbyPoll = time.Second
+
+// standbyRefresh is how long a standby connection is kept before it is
+// replaced, well inside the idle timeout proxies commonly apply to
+// connections that have not sent a request yet. A failed attempt is
+// retried after the same delay.
+const standbyRefresh = 20 * time.Second
+
+// keepStandby keeps the dialer's standby connection pointed at the
+// rotator's next proxy until done is closed.
+func (s *Server) keepStandby(done <-chan struct{}) {
+	standby := s.cfg.Dialer.Standby
+	defer standby.Close()
+
+	ticker := time.NewTicker(standbyPoll)
+	defer ticker.Stop()
+	var (
+		warmed   *pool.Proxy // proxy last warmed or tried
+		warmedAt time.Time
+		failed   bool
+	)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		next := s.rotator.PeekNext()
+		if next == nil {
+			continue
+		}
+		if next == warmed && time.Since(warmedAt) < standbyRefresh {
+			// Still fresh, or still backing off from a failure; a standby
+			// used up by a tunnel is replaced straight away.
+			if _, held := standby.Opened(next.URL); held || failed {
+				continue
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout(next))
+		err := s.cfg.Dialer.Warm(ctx, next.URL)
+		cancel()
+		switch {
+		case err != nil && (next != warmed || !failed):
+			log.Printf("[server] hot standby: cannot open a connection to %s: %v", next.String(), err)
+		case err == nil && next != warmed:
+			log.Printf("[server] hot standby: %s is ready for the next rotation", next.String())
+		}
+		warmed, warmedAt, failed = next, time.Now(), err != nil
+	}
+}
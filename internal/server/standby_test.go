@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+	"github.com/drsoft-oss/proxyrotator/internal/rotator"
+)
+
+// stubConnectProxy starts an HTTP proxy that accepts every CONNECT. With
+// dropFirst it closes the first connection it accepts without reading
+// from it, as a proxy does with an idle one. accepted counts connections.
+func stubConnectProxy(t *testing.T, dropFirst bool) (uri string, accepted *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted = new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if accepted.Add(1) == 1 && dropFirst {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(io.Discard, br)
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String(), accepted
+}
+
+// startStandby runs keepStandby on a fast poll for the rest of the test.
+func startStandby(t *testing.T, uris ...string) (*Server, *rotator.Rotator) {
+	t.Helper()
+	p := pool.New(false)
+	if err := p.LoadProxies(uris); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{HotStandby: true}, r)
+
+	poll := standbyPoll
+	standbyPoll = 10 * time.Millisecond
+	done := make(chan struct{})
+	go s.keepStandby(done)
+	t.Cleanup(func() {
+		close(done)
+		standbyPoll = poll
+	})
+	return s, r
+}
+
+// waitStandby waits until the standby holds a connection to px.
+func waitStandby(t *testing.T, s *Server, px *pool.Proxy) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := s.cfg.Dialer.Standby.Opened(px.URL); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no standby connection to %s", px.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepStandby_RefillsAfterRotation(t *testing.T) {
+	a, _ := stubConnectProxy(t, false)
+	b, _ := stubConnectProxy(t, false)
+	s, r := startStandby(t, a, b)
+
+	next := r.PeekNext()
+	waitStandby(t, s, next)
+
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+	after := r.PeekNext()
+	if after == nil || after == next {
+		t.Fatalf("next proxy after rotation = %v, want the one rotated away from", after)
+	}
+	waitStandby(t, s, after)
+}
+
+func TestKeepStandby_StaleConnFallsBack(t *testing.T) {
+	a, _ := stubConnectProxy(t, true)
+	b, _ := stubConnectProxy(t, true)
+	s, r := startStandby(t, a, b)
+
+	next := r.PeekNext()
+	waitStandby(t, s, next)
+
+	// The proxy has already closed the standby; the dial must notice and
+	// open a fresh connection instead of failing.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := s.dial(ctx, next, "example.com:443")
+	if err != nil {
+		t.Fatalf("dial over a stale standby: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiConnTimeout matches the read and write timeouts of the standalone API
+// server.
+const apiConnTimeout = 5 * time.Second
+
+// ServeAPI makes the proxy listener answer management API requests too, for
+// deployments with a single exposed port. A request is an API request if it
+// is origin-form (no scheme or host in the target, which proxy requests
+// always have) and its path is under /api/ or is /metrics; such connections
+// are served by h. When the proxy requires authentication, so do these,
+// through an ordinary Authorization header (curl -u). Without it, only
+// loopback clients may use the API, as with the standalone API listener:
+// the proxy port is usually reachable from elsewhere, and the API can
+// reload, drain and reserve. Call before Serve.
+func (s *Server) ServeAPI(h http.Handler) {
+	if s.authRequired() {
+		h = s.requireAPIAuth(h)
+	} else {
+		h = requireLoopback(h)
+	}
+	s.api = h
+}
+
+// isAPIRequest reports whether the request line waiting in br targets the
+// API. It only peeks, so br still holds the whole request afterwards.
+func isAPIRequest(br *bufio.Reader) bool {
+	for {
+		b, _ := br.Peek(br.Buffered())
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			method, rest, _ := strings.Cut(string(b[:i]), " ")
+			target, _, _ := strings.Cut(rest, " ")
+			path, _, _ := strings.Cut(target, "?")
+			return method != http.MethodConnect &&
+				(strings.HasPrefix(path, "/api/") || path == "/metrics")
+		}
+		if br.Buffered() == br.Size() {
+			return false // request line longer than any API path
+		}
+		if _, err := br.Peek(br.Buffered() + 1); err != nil {
+			return false
+		}
+	}
+}
+
+// serveAPI hands conn, whose first request is still buffered in br, to the
+// API handler for as long as the client keeps it open.
+func (s *Server) serveAPI(conn net.Conn, br *bufio.Reader) {
+	srv := &http.Server{
+		Handler:        s.api,
+		ReadTimeout:    apiConnTimeout,
+		WriteTimeout:   apiConnTimeout,
+		MaxHeaderBytes: s.cfg.MaxHeaderBytes,
+	}
+	_ = srv.Serve(newConnListener(&bufferedConn{Conn: conn, r: br}))
+}
+
+// requireAPIAuth wraps h so it answers 401 unless the request carries the
+// proxy's credentials as HTTP Basic authentication.
+func (s *Server) requireAPIAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != s.cfg.Username || pass != s.cfg.Password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="proxyrotator"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireLoopback wraps h so it answers 403 to clients not connecting from
+// a loopback address.
+func requireLoopback(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "the API on the proxy port is only open to loopback clients without --auth", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// connListener is a net.Listener that yields one connection and then blocks
+// until that connection is closed, so http.Server.Serve can serve it.
+type connListener struct {
+	conn   net.Conn
+	addr   net.Addr
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, addr: conn.LocalAddr(), closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return &listenedConn{Conn: c, l: l}, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return l.addr }
+
+// listenedConn closes its connListener along with itself.
+type listenedConn struct {
+	net.Conn
+	l *connListener
+}
+
+func (c *listenedConn) Close() error {
+	err := c.Conn.Close()
+	c.l.Close()
+	return err
+}
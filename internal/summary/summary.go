@@ -0,0 +1,92 @@
+// Package summary logs a periodic one-line heartbeat with pool health and
+// traffic totals, for deployments where logs are the only window in.
+package summary
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+	"github.com/drsoft-oss/proxyrotator/internal/rotator"
+)
+
+// Reporter logs a summary line every interval.
+type Reporter struct {
+	pool     *pool.Pool
+	rotator  *rotator.Rotator
+	interval time.Duration
+
+	// Values at the previous summary, for the deltas.
+	lastGen, lastReqs, lastErrs, lastHTTPErrs int64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates a Reporter. Call Start to begin logging.
+func New(p *pool.Pool, r *rotator.Rotator, interval time.Duration) *Reporter {
+	return &Reporter{
+		pool:     p,
+		rotator:  r,
+		interval: interval,
+		lastGen:  r.Generation(),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start launches the background logging loop. A zero interval disables it.
+func (s *Reporter) Start() {
+	if s.interval <= 0 {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Print(s.Line())
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the logging loop.
+func (s *Reporter) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Line builds the next summary line and advances the delta baselines.
+func (s *Reporter) Line() string {
+	var reqs, errs, httpErrs int64
+	all := s.pool.All()
+	for _, px := range all {
+		reqs += px.TotalReqs.Load()
+		errs += px.TotalConnErrors.Load()
+		httpErrs += px.TotalHTTPErrors.Load()
+	}
+	gen := s.rotator.Generation()
+
+	current := "none"
+	if cur := s.rotator.Current(); cur != nil {
+		current = fmt.Sprintf("#%d %s", cur.ID, cur.String())
+	}
+
+	alive, quarantined := s.pool.AliveLen(), len(s.pool.Quarantined())
+	health := fmt.Sprintf("alive=%d dead=%d", alive, len(all)-alive-quarantined)
+	if quarantined > 0 {
+		health += fmt.Sprintf(" quarantined=%d", quarantined)
+	}
+	line := fmt.Sprintf("[summary] %s current=%q rotations=%d requests=%d (+%d) conn_errors=%d (+%d) http_errors=%d (+%d)",
+		health, current,
+		gen-s.lastGen, reqs, reqs-s.lastReqs, errs, errs-s.lastErrs, httpErrs, httpErrs-s.lastHTTPErrs)
+	s.lastGen, s.lastReqs, s.lastErrs, s.lastHTTPErrs = gen, reqs, errs, httpErrs
+	return line
+}
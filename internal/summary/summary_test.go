@@ -0,0 +1,43 @@
+package summary
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+	"github.com/drsoft-oss/proxyrotator/internal/rotator"
+)
+
+func TestLine(t *testing.T) {
+	p := pool.New(false)
+	if err := p.LoadProxies([]string{"http://1.2.3.4:8080", "http://5.6.7.8:8080", "http://9.10.11.12:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rotator.New(p, rotator.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(p, r, time.Minute)
+
+	p.All()[2].SetAlive(false)
+	p.All()[0].TotalReqs.Add(10)
+	p.All()[1].TotalConnErrors.Add(2)
+	p.All()[1].TotalHTTPErrors.Add(3)
+	if err := r.RotateNow("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.Line()
+	want := `[summary] alive=2 dead=1 current="#2 http://5.6.7.8:8080" rotations=1 requests=10 (+10) conn_errors=2 (+2) http_errors=3 (+3)`
+	if got != want {
+		t.Errorf("first line:\n  got  %s\n  want %s", got, want)
+	}
+
+	p.All()[0].TotalReqs.Add(5)
+	p.All()[0].TotalHTTPErrors.Add(1)
+	got = s.Line()
+	if !strings.Contains(got, "rotations=0 requests=15 (+5) conn_errors=2 (+0) http_errors=4 (+1)") {
+		t.Errorf("second line should only count deltas since the first: %s", got)
+	}
+}
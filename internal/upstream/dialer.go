@@ -1,47 +1,260 @@
 // Package upstream handles dialing through HTTP and SOCKS5 upstream proxies.
+// SOCKS5 proxies fronted by TLS are reached with the socks5+tls scheme.
 package upstream
 
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
 
+// ErrProxyAuth is returned (wrapped) when an upstream proxy rejects our
+// credentials with 407 Proxy Authentication Required.
+var ErrProxyAuth = errors.New("upstream proxy authentication failed")
+
+// ErrParentProxy is returned (wrapped) when the Dialer's Parent could not
+// reach an upstream proxy. It never wraps ErrProxyAuth, so a parent that
+// rejects its credentials is not mistaken for an upstream that does.
+var ErrParentProxy = errors.New("parent proxy failed")
+
+// ErrDestination is matched (errors.Is) by dial errors where the upstream
+// proxy worked but could not resolve or reach the destination: an HTTP
+// CONNECT answered 502 or 504, or a SOCKS5 reply of host or network
+// unreachable, connection refused or TTL expired.
+var ErrDestination = errors.New("destination unreachable")
+
+// destinationError keeps err's message while also matching ErrDestination.
+type destinationError struct{ err error }
+
+func (e *destinationError) Error() string   { return e.err.Error() }
+func (e *destinationError) Unwrap() []error { return []error{e.err, ErrDestination} }
+
+// DestinationError marks err as the destination's fault, so that it matches
+// ErrDestination.
+func DestinationError(err error) error {
+	return &destinationError{err: err}
+}
+
+// socksDestinationReplies are the SOCKS5 reply codes, as x/net/proxy words
+// them, that blame the destination rather than the proxy.
+var socksDestinationReplies = []string{"network unreachable", "host unreachable", "connection refused", "TTL expired"}
+
+// socksDestinationFailed reports whether err carries one of
+// socksDestinationReplies. x/net/proxy reports a failed reply only as text
+// ("unknown error host unreachable"), hence the string match.
+func socksDestinationFailed(err error) bool {
+	msg := err.Error()
+	for _, r := range socksDestinationReplies {
+		if strings.Contains(msg, "unknown error "+r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dialer holds the options used when dialing through upstream proxies.
+// The zero value verifies TLS certificates and is what the package-level
+// Dial and DialHost use.
+type Dialer struct {
+	// InsecureSkipVerify disables certificate verification for upstreams
+	// reached over TLS (socks5+tls).
+	InsecureSkipVerify bool
+
+	// Parent, if set, is an HTTP proxy that every connection to an upstream
+	// proxy is CONNECTed through, for networks where upstreams are not
+	// directly reachable. It is fixed infrastructure, not part of the
+	// rotation. Credentials in the URL are sent as Proxy-Authorization.
+	Parent *url.URL
+
+	// Debug logs the full CONNECT exchange (request, response head and up
+	// to 4 KiB of body) whenever an HTTP upstream answers with anything but
+	// 200. Proxy-Authorization is redacted.
+	Debug bool
+
+	// ConnectHeaders are added to every CONNECT request sent to an HTTP
+	// upstream or to Parent, e.g. "Proxy-Connection: Keep-Alive" for proxies
+	// that drop tunnels opened without it. A User-Agent here replaces Go's
+	// default one. Host and Proxy-Authorization cannot be overridden.
+	ConnectHeaders http.Header
+
+	// Standby, if set, holds a connection opened ahead of time by Warm.
+	// DialHost uses it for the upstream it leads to instead of opening a
+	// new one.
+	Standby *Standby
+}
+
+var defaultDialer = &Dialer{}
+
 // Dial opens a TCP connection to destination through the upstream proxy.
 // destination must be in "host:port" format.
 // The returned conn is a raw TCP pipe ready for bidirectional tunneling.
 func Dial(ctx context.Context, upstream *url.URL, destination string) (net.Conn, error) {
+	return defaultDialer.DialHost(ctx, upstream, destination, destination)
+}
+
+// DialHost is like Dial but lets the CONNECT request target differ from the
+// Host header sent with it. target is what the upstream is asked to connect
+// to (e.g. "93.184.216.34:443"); host is placed in the Host header (e.g.
+// "example.com:443") so upstreams that route on it still see the domain.
+// SOCKS5 upstreams have no Host header and simply dial target.
+func DialHost(ctx context.Context, upstream *url.URL, target, host string) (net.Conn, error) {
+	return defaultDialer.DialHost(ctx, upstream, target, host)
+}
+
+// Dial is the package-level Dial using d's options.
+func (d *Dialer) Dial(ctx context.Context, upstream *url.URL, destination string) (net.Conn, error) {
+	return d.DialHost(ctx, upstream, destination, destination)
+}
+
+// DialHost is the package-level DialHost using d's options.
+func (d *Dialer) DialHost(ctx context.Context, upstream *url.URL, target, host string) (net.Conn, error) {
+	if conn := d.Standby.take(upstream); conn != nil {
+		hctx, cancel := standbyContext(ctx)
+		tunnel, err := d.handshake(hctx, conn, upstream, target, host)
+		stale := err != nil && standbyStale(ctx, hctx, err)
+		cancel()
+		if !stale {
+			return tunnel, err
+		}
+		// The proxy may have closed the idle connection since it was
+		// opened, or dropped it without a word; a fresh one settles it.
+	}
+	conn, err := d.openProxy(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+	return d.handshake(ctx, conn, upstream, target, host)
+}
+
+// standbyHandshakeTimeout bounds the handshake on a standby connection when
+// the caller's context has no deadline.
+const standbyHandshakeTimeout = 5 * time.Second
+
+// standbyContext bounds the handshake on a standby connection to half the
+// time ctx has left, so that a standby a NAT or the proxy dropped silently
+// leaves the fresh connection that replaces it a fair share of the budget.
+func standbyContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithTimeout(ctx, standbyHandshakeTimeout)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/2)
+}
+
+// standbyStale reports whether err, from a handshake on a standby connection
+// bounded by hctx, came before the proxy said anything: the connection was
+// closed or reset, or stayed silent until hctx ran out while ctx had time
+// left. Any answer the proxy did give — a refusal, a failed destination —
+// stands, so the request is not sent twice.
+func standbyStale(ctx, hctx context.Context, err error) bool {
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	return hctx.Err() != nil && ctx.Err() == nil
+}
+
+// openProxy opens a connection to the upstream proxy itself, ready for the
+// CONNECT or SOCKS5 handshake: TCP, through Parent if one is set, and TLS
+// for socks5+tls.
+func (d *Dialer) openProxy(ctx context.Context, upstream *url.URL) (net.Conn, error) {
 	switch upstream.Scheme {
-	case "http", "https":
-		return dialHTTP(ctx, upstream, destination)
-	case "socks5":
-		return dialSOCKS5(ctx, upstream, destination)
+	case "http", "https", "socks5", "socks5h", "socks5+tls":
 	default:
 		return nil, fmt.Errorf("unsupported upstream scheme: %s", upstream.Scheme)
 	}
+	conn, err := d.dialProxy(ctx, upstream.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial upstream proxy %s: %w", upstream.Host, err)
+	}
+	if upstream.Scheme != "socks5+tls" {
+		return conn, nil
+	}
+	tconn := tls.Client(conn, &tls.Config{
+		ServerName:         upstream.Hostname(),
+		InsecureSkipVerify: d.InsecureSkipVerify,
+	})
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s: %w", upstream.Host, err)
+	}
+	return tconn, nil
 }
 
-// dialHTTP sends an HTTP CONNECT request to the upstream proxy and returns
-// the connection after the tunnel is established.
-func dialHTTP(ctx context.Context, upstream *url.URL, destination string) (net.Conn, error) {
-	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", upstream.Host)
+// handshake asks the upstream proxy at the other end of conn, opened by
+// openProxy, for a tunnel to target. conn is closed on failure.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, upstream *url.URL, target, host string) (net.Conn, error) {
+	if upstream.Scheme == "http" || upstream.Scheme == "https" {
+		return d.httpConnect(ctx, conn, upstream, target, host)
+	}
+	tunnel, err := dialSOCKS5(ctx, upstream, target, connDialer{conn})
 	if err != nil {
-		return nil, fmt.Errorf("dial upstream proxy %s: %w", upstream.Host, err)
+		conn.Close() // not every early failure closes it
 	}
+	return tunnel, err
+}
 
+// dialProxy opens a TCP connection to the upstream proxy at addr, through
+// Parent if one is set.
+func (d *Dialer) dialProxy(ctx context.Context, addr string) (net.Conn, error) {
+	if d.Parent == nil {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", d.Parent.Host)
+	if err == nil {
+		conn, err = d.httpConnect(ctx, conn, d.Parent, addr, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrParentProxy, d.Parent.Host, err)
+	}
+	return conn, nil
+}
+
+// connDialer is a proxy.Dialer that "dials" by handing back a connection
+// already open to the SOCKS5 proxy, so the handshake runs over it.
+type connDialer struct{ conn net.Conn }
+
+func (c connDialer) Dial(_, _ string) (net.Conn, error) {
+	return c.conn, nil
+}
+
+func (c connDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	return c.conn, nil
+}
+
+// httpConnect sends an HTTP CONNECT request over conn, an open connection
+// to the HTTP proxy upstream, and returns the connection after the tunnel
+// is established. conn is closed on failure.
+func (d *Dialer) httpConnect(ctx context.Context, conn net.Conn, upstream *url.URL, target, host string) (net.Conn, error) {
 	// Build CONNECT request
-	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, "//"+destination, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, "//"+target, nil)
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("build CONNECT request: %w", err)
 	}
-	req.Host = destination
+	// The request line is taken from URL.Opaque for CONNECT, the Host header
+	// from req.Host — which is what lets the two differ.
+	req.URL.Opaque = target
+	req.Host = host
+	for k, v := range d.ConnectHeaders {
+		req.Header[k] = v
+	}
 
 	// Inject proxy auth header if credentials are present
 	if upstream.User != nil {
@@ -51,6 +264,20 @@ func dialHTTP(ctx context.Context, upstream *url.URL, destination string) (net.C
 		req.Header.Set("Proxy-Authorization", "Basic "+creds)
 	}
 
+	// A proxy that never answers would hold the exchange below forever;
+	// give up on it when ctx ends.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	tunnel, err := d.connectExchange(conn, upstream, req)
+	if !stop() && err == nil {
+		tunnel.Close()
+		return nil, fmt.Errorf("CONNECT: %w", ctx.Err())
+	}
+	return tunnel, err
+}
+
+// connectExchange writes the CONNECT request req over conn and reads the
+// proxy's answer, for httpConnect.
+func (d *Dialer) connectExchange(conn net.Conn, upstream *url.URL, req *http.Request) (net.Conn, error) {
 	if err := req.Write(conn); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("write CONNECT: %w", err)
@@ -63,11 +290,22 @@ func dialHTTP(ctx context.Context, upstream *url.URL, destination string) (net.C
 		conn.Close()
 		return nil, fmt.Errorf("read CONNECT response: %w", err)
 	}
+	if d.Debug && resp.StatusCode != http.StatusOK {
+		logConnect(upstream, req, resp)
+	}
 	resp.Body.Close()
 
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrProxyAuth, resp.Status)
+	}
 	if resp.StatusCode != http.StatusOK {
 		conn.Close()
-		return nil, fmt.Errorf("upstream proxy CONNECT failed: %s", resp.Status)
+		err := fmt.Errorf("upstream proxy CONNECT failed: %s", resp.Status)
+		if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout {
+			err = DestinationError(err)
+		}
+		return nil, err
 	}
 
 	// If the bufio reader consumed bytes beyond the response, wrap conn to
@@ -78,8 +316,31 @@ func dialHTTP(ctx context.Context, upstream *url.URL, destination string) (net.C
 	return conn, nil
 }
 
-// dialSOCKS5 dials through a SOCKS5 upstream proxy.
-func dialSOCKS5(ctx context.Context, upstream *url.URL, destination string) (net.Conn, error) {
+// maxDebugBody caps how much of a failed CONNECT response body Debug logs.
+const maxDebugBody = 4 << 10
+
+// logConnect logs a failed CONNECT exchange with upstream for Dialer.Debug.
+func logConnect(upstream *url.URL, req *http.Request, resp *http.Response) {
+	var b strings.Builder
+	sent := req.Clone(req.Context())
+	if sent.Header.Get("Proxy-Authorization") != "" {
+		sent.Header.Set("Proxy-Authorization", "[redacted]")
+	}
+	_ = sent.Write(&b)
+	head, _ := httputil.DumpResponse(resp, false)
+	b.Write(head)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxDebugBody))
+	b.Write(body)
+	log.Printf("[upstream] CONNECT via %s answered %s:\n%s", upstream.Redacted(), resp.Status, strings.TrimRight(b.String(), "\r\n"))
+}
+
+// dialSOCKS5 dials through a SOCKS5 upstream proxy (socks5, socks5h or
+// socks5+tls). forward opens the connection to the proxy itself; the
+// handshake runs over whatever it returns, which is closed if the handshake
+// fails. A destination given by name is sent as a name, for the proxy to
+// resolve; that is all socks5h promises, so it needs nothing of its own
+// here.
+func dialSOCKS5(ctx context.Context, upstream *url.URL, destination string, forward proxy.Dialer) (net.Conn, error) {
 	var auth *proxy.Auth
 	if upstream.User != nil {
 		user := upstream.User.Username()
@@ -87,7 +348,7 @@ func dialSOCKS5(ctx context.Context, upstream *url.URL, destination string) (net
 		auth = &proxy.Auth{User: user, Password: pass}
 	}
 
-	dialer, err := proxy.SOCKS5("tcp", upstream.Host, auth, proxy.Direct)
+	dialer, err := proxy.SOCKS5("tcp", upstream.Host, auth, forward)
 	if err != nil {
 		return nil, fmt.Errorf("create socks5 dialer: %w", err)
 	}
@@ -100,18 +361,27 @@ func dialSOCKS5(ctx context.Context, upstream *url.URL, destination string) (net
 	if cd, ok := dialer.(contextDialer); ok {
 		conn, err := cd.DialContext(ctx, "tcp", destination)
 		if err != nil {
-			return nil, fmt.Errorf("socks5 dial %s: %w", destination, err)
+			return nil, socksDialError(destination, err)
 		}
 		return conn, nil
 	}
 
 	conn, err := dialer.Dial("tcp", destination)
 	if err != nil {
-		return nil, fmt.Errorf("socks5 dial %s: %w", destination, err)
+		return nil, socksDialError(destination, err)
 	}
 	return conn, nil
 }
 
+// socksDialError wraps a failed SOCKS5 dial to destination, marking it
+// with ErrDestination when the reply blames the destination.
+func socksDialError(destination string, err error) error {
+	if socksDestinationFailed(err) {
+		err = DestinationError(err)
+	}
+	return fmt.Errorf("socks5 dial %s: %w", destination, err)
+}
+
 // bufferedConn wraps a net.Conn and prepends already-buffered bytes to the
 // read stream. Used when bufio.Reader consumed extra bytes from a CONNECT
 // response.
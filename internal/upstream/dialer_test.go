@@ -0,0 +1,591 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectRequest is the raw request line and headers seen by stubHTTPProxy.
+// http.ReadRequest is not used because it folds the Host header into the
+// request target for CONNECT.
+type connectRequest struct {
+	line   string
+	header textproto.MIMEHeader
+}
+
+// stubHTTPProxy accepts one CONNECT request, hands it to the returned
+// channel and replies 200.
+func stubHTTPProxy(t *testing.T) (*url.URL, <-chan connectRequest) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	reqs := make(chan connectRequest, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		reqs <- connectRequest{line: line, header: header}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}()
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}, reqs
+}
+
+func TestDialHost_SeparateTargetAndHost(t *testing.T) {
+	u, reqs := stubHTTPProxy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := DialHost(ctx, u, "93.184.216.34:443", "example.com:443")
+	if err != nil {
+		t.Fatalf("DialHost: %v", err)
+	}
+	conn.Close()
+
+	req := <-reqs
+	if want := "CONNECT 93.184.216.34:443 HTTP/1.1"; req.line != want {
+		t.Errorf("request line = %q, want %q", req.line, want)
+	}
+	if got := req.header.Get("Host"); got != "example.com:443" {
+		t.Errorf("Host = %q, want %q", got, "example.com:443")
+	}
+}
+
+func TestDial_TargetMatchesHost(t *testing.T) {
+	u, reqs := stubHTTPProxy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, u, "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+
+	req := <-reqs
+	if want := "CONNECT example.com:443 HTTP/1.1"; req.line != want {
+		t.Errorf("request line = %q, want %q", req.line, want)
+	}
+	if got := req.header.Get("Host"); got != "example.com:443" {
+		t.Errorf("Host = %q, want %q", got, "example.com:443")
+	}
+}
+
+// stubRawHTTPProxy accepts one CONNECT request, hands its exact bytes up to
+// and including the blank line to the returned channel and replies 200.
+func stubRawHTTPProxy(t *testing.T) (*url.URL, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	reqs := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		var raw strings.Builder
+		for !strings.HasSuffix(raw.String(), "\r\n\r\n") {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			raw.WriteString(line)
+		}
+		reqs <- raw.String()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}()
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}, reqs
+}
+
+func TestDial_ConnectHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers http.Header
+		user    *url.Userinfo
+		want    string
+	}{
+		{
+			name: "default",
+			want: "CONNECT example.com:443 HTTP/1.1\r\n" +
+				"Host: example.com:443\r\n" +
+				"User-Agent: Go-http-client/1.1\r\n\r\n",
+		},
+		{
+			name: "keep-alive",
+			headers: http.Header{
+				"Connection":       {"keep-alive"},
+				"Proxy-Connection": {"Keep-Alive"},
+			},
+			want: "CONNECT example.com:443 HTTP/1.1\r\n" +
+				"Host: example.com:443\r\n" +
+				"User-Agent: Go-http-client/1.1\r\n" +
+				"Connection: keep-alive\r\n" +
+				"Proxy-Connection: Keep-Alive\r\n\r\n",
+		},
+		{
+			name: "user-agent and credentials",
+			headers: http.Header{
+				"User-Agent":          {"crawler/2.0"},
+				"Proxy-Authorization": {"Basic bm9wZQ=="},
+			},
+			user: url.UserPassword("alice", "s3cret"),
+			want: "CONNECT example.com:443 HTTP/1.1\r\n" +
+				"Host: example.com:443\r\n" +
+				"User-Agent: crawler/2.0\r\n" +
+				"Proxy-Authorization: Basic YWxpY2U6czNjcmV0\r\n\r\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, reqs := stubRawHTTPProxy(t)
+			u.User = tc.user
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			d := &Dialer{ConnectHeaders: tc.headers}
+			conn, err := d.Dial(ctx, u, "example.com:443")
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			conn.Close()
+			if got := <-reqs; got != tc.want {
+				t.Errorf("CONNECT request =\n%q\nwant\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+// stubSOCKS5TLSProxy serves a no-auth SOCKS5 proxy behind TLS (using
+// httptest's self-signed certificate). It reports the requested destination
+// and then echoes whatever the client sends.
+func stubSOCKS5TLSProxy(t *testing.T) (*url.URL, <-chan string) {
+	t.Helper()
+	certSrv := httptest.NewTLSServer(nil)
+	t.Cleanup(certSrv.Close)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certSrv.TLS.Clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	dests := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dest, err := socks5Handshake(conn)
+				if err != nil {
+					return
+				}
+				dests <- dest
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "socks5+tls", Host: ln.Addr().String()}, dests
+}
+
+// socks5Handshake performs the server side of a no-auth SOCKS5 CONNECT and
+// returns the requested host:port.
+func socks5Handshake(conn net.Conn) (string, error) {
+	br := bufio.NewReader(conn)
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(br, make([]byte, hdr[1])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", io.ErrUnexpectedEOF
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func TestDial_SOCKS5h(t *testing.T) {
+	dests := make(chan string, 1)
+	addr := stubOnce(t, func(conn net.Conn) {
+		dest, err := socks5Handshake(conn)
+		if err != nil {
+			return
+		}
+		dests <- dest
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The name does not resolve here; only the proxy may look it up.
+	conn, err := Dial(ctx, &url.URL{Scheme: "socks5h", Host: addr}, "geo-routed.invalid:443")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+	if got := <-dests; got != "geo-routed.invalid:443" {
+		t.Errorf("destination = %q, want the hostname passed through", got)
+	}
+}
+
+func TestDial_SOCKS5OverTLS(t *testing.T) {
+	proxyURL, dests := stubSOCKS5TLSProxy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := &Dialer{InsecureSkipVerify: true}
+	conn, err := d.Dial(ctx, proxyURL, "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if got := <-dests; got != "example.com:443" {
+		t.Errorf("destination = %q, want example.com:443", got)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo = %q, want ping", buf)
+	}
+}
+
+func TestDial_SOCKS5OverTLS_VerifiesCertificate(t *testing.T) {
+	proxyURL, _ := stubSOCKS5TLSProxy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := Dial(ctx, proxyURL, "example.com:443")
+	if err == nil {
+		t.Fatal("expected a certificate error from a self-signed proxy")
+	}
+	if !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("error = %v, want a certificate verification failure", err)
+	}
+}
+
+func TestDial_ProxyAuthRequired(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		tp.ReadLine()
+		tp.ReadMIMEHeader()
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String(), User: url.UserPassword("old", "creds")}
+	_, err = Dial(ctx, proxyURL, "example.com:443")
+	if !errors.Is(err, ErrProxyAuth) {
+		t.Fatalf("err = %v, want ErrProxyAuth", err)
+	}
+}
+
+// stubOnce accepts one connection on a local listener and hands it to
+// serve.
+func stubOnce(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return ln.Addr().String()
+}
+
+func TestDial_SilentProxyHonoursContext(t *testing.T) {
+	addr := stubOnce(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn) // reads the CONNECT, never answers
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := Dial(ctx, &url.URL{Scheme: "http", Host: addr}, "example.com:443")
+	if err == nil {
+		t.Fatal("Dial through a silent proxy succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Dial gave up after %s, want about the context's 200ms", elapsed)
+	}
+}
+
+func TestDial_DestinationErrors(t *testing.T) {
+	httpReply := func(status string) func(net.Conn) {
+		return func(conn net.Conn) {
+			tp := textproto.NewReader(bufio.NewReader(conn))
+			tp.ReadLine()
+			tp.ReadMIMEHeader()
+			io.WriteString(conn, "HTTP/1.1 "+status+"\r\nContent-Length: 0\r\n\r\n")
+		}
+	}
+	socksReply := func(code byte) func(net.Conn) {
+		return func(conn net.Conn) {
+			br := bufio.NewReader(conn)
+			hdr := make([]byte, 2)
+			io.ReadFull(br, hdr)
+			io.ReadFull(br, make([]byte, hdr[1]))
+			conn.Write([]byte{5, 0})
+			req := make([]byte, 5) // through the length of the domain name
+			io.ReadFull(br, req)
+			io.ReadFull(br, make([]byte, int(req[4])+2))
+			conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+		}
+	}
+	cases := []struct {
+		name   string
+		scheme string
+		serve  func(net.Conn)
+		want   bool
+	}{
+		{"http 502", "http", httpReply("502 Bad Gateway"), true},
+		{"http 504", "http", httpReply("504 Gateway Timeout"), true},
+		{"http 503", "http", httpReply("503 Service Unavailable"), false},
+		{"socks host unreachable", "socks5", socksReply(4), true},
+		{"socks connection refused", "socks5", socksReply(5), true},
+		{"socks general failure", "socks5", socksReply(1), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			proxyURL := &url.URL{Scheme: tc.scheme, Host: stubOnce(t, tc.serve)}
+			_, err := Dial(ctx, proxyURL, "nxdomain.example:443")
+			if err == nil {
+				t.Fatal("dial succeeded")
+			}
+			if got := errors.Is(err, ErrDestination); got != tc.want {
+				t.Errorf("errors.Is(%v, ErrDestination) = %v, want %v", err, got, tc.want)
+			}
+		})
+	}
+
+	// The proxy itself refusing the connection is not the destination's
+	// fault.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err = Dial(context.Background(), &url.URL{Scheme: "socks5", Host: addr}, "example.com:443")
+	if err == nil || errors.Is(err, ErrDestination) {
+		t.Errorf("dial to a closed proxy port: %v, want a proxy error", err)
+	}
+}
+
+// stubParentProxy accepts CONNECT requests, reports each one and relays the
+// connection to the requested address. With reject set it answers 407
+// instead.
+func stubParentProxy(t *testing.T, reject bool) (*url.URL, <-chan connectRequest) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	reqs := make(chan connectRequest, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		tp := textproto.NewReader(br)
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		reqs <- connectRequest{line: line, header: header}
+		if reject {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		target, err := net.Dial("tcp", strings.Fields(line)[1])
+		if err != nil {
+			return
+		}
+		defer target.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(target, br)
+		io.Copy(conn, target)
+	}()
+	return &url.URL{Scheme: "http", Host: ln.Addr().String(), User: url.UserPassword("corp", "secret")}, reqs
+}
+
+func TestDial_ThroughParent(t *testing.T) {
+	parent, parentReqs := stubParentProxy(t, false)
+	u, reqs := stubHTTPProxy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	d := &Dialer{Parent: parent}
+	conn, err := d.Dial(ctx, u, "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+
+	preq := <-parentReqs
+	if want := "CONNECT " + u.Host + " HTTP/1.1"; preq.line != want {
+		t.Errorf("parent request line = %q, want %q", preq.line, want)
+	}
+	if got := preq.header.Get("Proxy-Authorization"); got == "" {
+		t.Error("parent credentials were not sent")
+	}
+	if req := <-reqs; req.line != "CONNECT example.com:443 HTTP/1.1" {
+		t.Errorf("upstream request line = %q", req.line)
+	}
+}
+
+func TestDial_ParentAuthIsNotUpstreamAuth(t *testing.T) {
+	parent, _ := stubParentProxy(t, true)
+	u, _ := stubHTTPProxy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err := (&Dialer{Parent: parent}).Dial(ctx, u, "example.com:443")
+	if !errors.Is(err, ErrParentProxy) {
+		t.Fatalf("err = %v, want ErrParentProxy", err)
+	}
+	if errors.Is(err, ErrProxyAuth) {
+		t.Error("a parent 407 must not read as an upstream auth failure")
+	}
+}
+
+func TestDial_DebugLogsRefusedConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		tp.ReadLine()
+		tp.ReadMIMEHeader()
+		io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nX-Reason: blocked-port\r\nContent-Length: 21\r\n\r\nport 25 not permitted")
+	}()
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String(), User: url.UserPassword("alice", "s3cret")}
+	if _, err := (&Dialer{Debug: true}).Dial(ctx, proxyURL, "example.com:25"); err == nil {
+		t.Fatal("expected the CONNECT to fail")
+	}
+
+	out := logs.String()
+	for _, want := range []string{"CONNECT example.com:25 HTTP/1.1", "Proxy-Authorization: [redacted]", "X-Reason: blocked-port", "port 25 not permitted"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("debug log lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "s3cret") || strings.Contains(out, "YWxpY2U6czNjcmV0") {
+		t.Errorf("debug log leaks the password:\n%s", out)
+	}
+}
@@ -0,0 +1,83 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Standby holds one connection opened ahead of time to an upstream proxy,
+// so the first tunnel through that proxy skips the TCP (and TLS, and
+// parent proxy) setup. The zero value holds nothing and is ready to use.
+type Standby struct {
+	mu     sync.Mutex
+	key    string // standbyKey of the upstream conn leads to
+	conn   net.Conn
+	opened time.Time
+}
+
+func standbyKey(upstream *url.URL) string {
+	return upstream.Scheme + "://" + upstream.Host
+}
+
+// Warm opens a connection to upstream and leaves it in d.Standby, closing
+// the one held before, if any.
+func (d *Dialer) Warm(ctx context.Context, upstream *url.URL) error {
+	if d.Standby == nil {
+		return errors.New("dialer has no standby")
+	}
+	conn, err := d.openProxy(ctx, upstream)
+	if err != nil {
+		return err
+	}
+	s := d.Standby
+	s.mu.Lock()
+	old := s.conn
+	s.key, s.conn, s.opened = standbyKey(upstream), conn, time.Now()
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Opened returns when the connection held for upstream was opened, or
+// false if none is held for it.
+func (s *Standby) Opened(upstream *url.URL) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil || s.key != standbyKey(upstream) {
+		return time.Time{}, false
+	}
+	return s.opened, true
+}
+
+// take hands over the connection held for upstream, if any. A nil
+// *Standby holds nothing.
+func (s *Standby) take(upstream *url.URL) net.Conn {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil || s.key != standbyKey(upstream) {
+		return nil
+	}
+	conn := s.conn
+	s.conn = nil
+	return conn
+}
+
+// Close closes the connection held, if any.
+func (s *Standby) Close() {
+	s.mu.Lock()
+	conn := s.conn
+	s.conn = nil
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
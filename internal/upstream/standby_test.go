@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDial_UsesStandby(t *testing.T) {
+	u, reqs := stubHTTPProxy(t) // accepts a single connection
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	d := &Dialer{Standby: &Standby{}}
+	if err := d.Warm(ctx, u); err != nil {
+		t.Fatalf("Warm: %v", err)
+	}
+	if _, ok := d.Standby.Opened(u); !ok {
+		t.Fatal("Opened reports no connection after Warm")
+	}
+	other := &url.URL{Scheme: "socks5", Host: u.Host}
+	if _, ok := d.Standby.Opened(other); ok {
+		t.Error("the standby of an http upstream must not serve socks5 on the same address")
+	}
+
+	conn, err := d.Dial(ctx, u, "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+	if req := <-reqs; req.line != "CONNECT example.com:443 HTTP/1.1" {
+		t.Errorf("request line = %q", req.line)
+	}
+	if _, ok := d.Standby.Opened(u); ok {
+		t.Error("the standby connection should be used up by the dial")
+	}
+}
+
+func TestDial_StaleStandbyFallsBack(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if accepted.Add(1) == 1 {
+				conn.Close() // the proxy drops the idle standby
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewReader(bufio.NewReader(conn))
+				tp.ReadLine()
+				tp.ReadMIMEHeader()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			}()
+		}
+	}()
+	u := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	d := &Dialer{Standby: &Standby{}}
+	if err := d.Warm(ctx, u); err != nil {
+		t.Fatalf("Warm: %v", err)
+	}
+	conn, err := d.Dial(ctx, u, "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial with a stale standby: %v", err)
+	}
+	conn.Close()
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("proxy accepted %d connections, want 2", n)
+	}
+}
+
+func TestDial_HalfOpenStandbyFallsBack(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if accepted.Add(1) == 1 {
+				// The standby: dropped without a word, as by a NAT.
+				t.Cleanup(func() { conn.Close() })
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewReader(bufio.NewReader(conn))
+				tp.ReadLine()
+				tp.ReadMIMEHeader()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			}()
+		}
+	}()
+	u := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	d := &Dialer{Standby: &Standby{}}
+	if err := d.Warm(ctx, u); err != nil {
+		t.Fatalf("Warm: %v", err)
+	}
+	conn, err := d.Dial(ctx, u, "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial with a half-open standby: %v", err)
+	}
+	conn.Close()
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("proxy accepted %d connections, want 2", n)
+	}
+}
+
+func TestDial_StandbyAnswerIsNotRetried(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewReader(bufio.NewReader(conn))
+				tp.ReadLine()
+				tp.ReadMIMEHeader()
+				io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+			}()
+		}
+	}()
+	u := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	d := &Dialer{Standby: &Standby{}}
+	if err := d.Warm(ctx, u); err != nil {
+		t.Fatalf("Warm: %v", err)
+	}
+	if _, err := d.Dial(ctx, u, "example.com:443"); err == nil {
+		t.Fatal("Dial succeeded through a proxy that refuses CONNECT")
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("proxy accepted %d connections, want 1: its answer on the standby must stand", n)
+	}
+}
@@ -0,0 +1,892 @@
+// Package service assembles the proxy pool, health monitor, rotator,
+// management API and proxy server into a single unit with a Start/Stop
+// lifecycle. The CLI is a thin wrapper around it; embedders can use it to run
+// proxyrotator inside their own process.
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drsoft-oss/proxyrotator/internal/accesslog"
+	"github.com/drsoft-oss/proxyrotator/internal/api"
+	"github.com/drsoft-oss/proxyrotator/internal/monitor"
+	"github.com/drsoft-oss/proxyrotator/internal/pool"
+	"github.com/drsoft-oss/proxyrotator/internal/rotationlog"
+	"github.com/drsoft-oss/proxyrotator/internal/rotator"
+	"github.com/drsoft-oss/proxyrotator/internal/server"
+	"github.com/drsoft-oss/proxyrotator/internal/summary"
+	"github.com/drsoft-oss/proxyrotator/internal/upstream"
+)
+
+const (
+	defaultListenAddr      = "0.0.0.0:8080"
+	defaultAPIAddr         = "127.0.0.1:9090"
+	defaultMonitorInterval = 30 * time.Second
+
+	defaultMinHealthyTimeout = 2 * time.Minute
+)
+
+// healthyRecheck is the pause between health-check passes while Start
+// waits for MinHealthyFraction of the pool to be alive. Tests shorten it.
+var healthyRecheck = 5 * time.Second
+
+// Config describes a complete proxyrotator instance. Zero values disable the
+// corresponding rotation trigger or fall back to the CLI defaults.
+type Config struct {
+	// ProxyFile is the path to a proxy list file (one URI per line).
+	// Ignored when Proxies is non-empty.
+	ProxyFile string
+
+	// Proxies is an in-memory proxy list, one URI per entry.
+	Proxies []string
+
+	// AuthFile optionally maps proxy host:port to credentials for proxies
+	// listed without inline credentials.
+	AuthFile string
+
+	// RoutesFile optionally pins domains to fixed proxies, ahead of
+	// rotation; see rotator.LoadRoutes.
+	RoutesFile string
+
+	// RouteUnavailable and RouteQueueTimeout decide what a connection to a
+	// routed domain does while no routed proxy is usable; see rotator.CheckRoute.
+	RouteUnavailable  string
+	RouteQueueTimeout time.Duration
+
+	// PreferScheme keeps only the entry with this scheme for a host:port
+	// listed under several schemes. Empty keeps them all (with a warning).
+	PreferScheme string
+
+	// AllowedSchemes, if set, is the list of upstream schemes the proxy
+	// list may use; an entry with any other scheme fails the load.
+	AllowedSchemes []string
+
+	// ListenAddr is the proxy listen address. Defaults to "0.0.0.0:8080".
+	ListenAddr string
+
+	// APIAddr is the management API listen address. Defaults to
+	// "127.0.0.1:9090".
+	APIAddr string
+
+	// UnifiedPort serves the API on the proxy listener instead of APIAddr;
+	// see server.Server.ServeAPI.
+	UnifiedPort bool
+
+	// Username and Password enable Proxy-Authorization when both are set.
+	Username string
+	Password string
+
+	// Monitor enables liveness updates from the background health checker.
+	Monitor bool
+
+	// MonitorInterval is the time between health-check passes.
+	// Defaults to 30s.
+	MonitorInterval time.Duration
+
+	// MonitorURL is the URL probed through each proxy.
+	MonitorURL string
+
+	// MonitorHealthyCodes are the MonitorURL status codes that count as
+	// alive; see monitor.Config.HealthyStatuses.
+	MonitorHealthyCodes []int
+
+	// MonitorPassTimeout caps a whole health-check pass. Defaults to
+	// MonitorInterval.
+	MonitorPassTimeout time.Duration
+
+	// MonitorConcurrency limits how many proxies are checked in parallel
+	// (default 10); MonitorMaxRPS caps how many checks start per second
+	// (zero = no cap).
+	MonitorConcurrency int
+	MonitorMaxRPS      float64
+
+	// InitialConcurrency replaces MonitorConcurrency for the first
+	// pass; zero keeps MonitorConcurrency.
+	InitialConcurrency int
+
+	// MonitorRetries is how many probe attempts a check makes before a
+	// proxy counts as failed. Defaults to 1.
+	MonitorRetries int
+
+	// GeoCheckURL, if set, is fetched through each proxy with a country=
+	// declaration to find where it actually exits (see monitor.Config.GeoURL).
+	GeoCheckURL string
+
+	// GeoMismatchDead marks proxies exiting outside their declared country
+	// dead. Requires Monitor.
+	GeoMismatchDead bool
+
+	// WaitInitialCheck makes Start run the first health-check pass before
+	// accepting connections instead of in the background.
+	WaitInitialCheck bool
+
+	// RequireAllAlive makes Start fail, listing the dead proxies, if any
+	// proxy is dead after the initial check. Requires WaitInitialCheck and
+	// Monitor.
+	RequireAllAlive bool
+
+	// MinHealthyFraction makes Start hold off accepting connections until
+	// at least this fraction of the pool is alive, re-running health-check
+	// passes, and fail if MinHealthyTimeout (default 2m) passes first. Zero
+	// disables it. Requires WaitInitialCheck and Monitor.
+	MinHealthyFraction float64
+	MinHealthyTimeout  time.Duration
+
+	// LatencyInterval is how often latencies are re-measured.
+	LatencyInterval time.Duration
+
+	// NoLatencySort keeps the original list order instead of preferring the
+	// fastest proxies.
+	NoLatencySort bool
+
+	// LatencyMinSamples is how many successful probes a proxy needs before
+	// the latency sort trusts its latency.
+	LatencyMinSamples int64
+
+	// LatencyErrorPenalty inflates each proxy's sort latency by its lifetime
+	// connection error rate; see pool.Pool.SetLatencyErrorPenalty.
+	LatencyErrorPenalty float64
+
+	// HealthDecay is the half-life of the proxies' error rate and latency
+	// averages; zero keeps lifetime rates. See pool.Pool.SetHealthDecay.
+	HealthDecay time.Duration
+
+	// PreferStreak selects proxies with the longest run of requests since
+	// their last connection error first; see pool.Pool.SetPreferStreak.
+	PreferStreak bool
+
+	// RotateCooldown is the least time between two automatic rotations;
+	// see rotator.Config.MinRotateInterval.
+	RotateCooldown time.Duration
+
+	// Quarantine keeps a proxy rotated away from for errors out of
+	// selection for this long; see rotator.Config.QuarantineDuration.
+	Quarantine time.Duration
+
+	// CountTraffic selects the requests counted by the request-count
+	// triggers; see server.Config.
+	CountTraffic string
+
+	// Rotation triggers; see rotator.Config.
+	RotateInterval   time.Duration
+	RotateRequests   int64
+	RotateConnErrors int64
+	RotateHTTPErrors int64
+	DedupWindow      time.Duration
+
+	// RotateSuccesses rotates after this many requests complete without a
+	// connection or reported HTTP error.
+	RotateSuccesses int64
+
+	// AdaptiveRequests is the base of a request threshold scaled by each
+	// proxy's connection error rate; see rotator.Config.AdaptiveRequests.
+	AdaptiveRequests int64
+
+	// RotateSchedule varies RotateInterval by local time of day, as
+	// HH:MM-HH:MM=interval windows separated by commas, e.g.
+	// "09:00-17:00=2m,17:00-09:00=10m". Empty disables it.
+	RotateSchedule string
+
+	// GroupPolicies overrides rotation thresholds per proxy group (the
+	// group= metadata on a proxy line).
+	GroupPolicies map[string]GroupPolicy
+
+	// DestWeights weighs requests per destination domain towards
+	// RotateRequests; see rotator.Config.DestWeights.
+	DestWeights map[string]int64
+
+	// DestGrace overrides the post-rotation grace period per destination
+	// domain; see rotator.Config.DestGrace.
+	DestGrace map[string]time.Duration
+
+	// RotateTotalErrors is the combined, weighted conn+HTTP error budget.
+	RotateTotalErrors int64
+	ConnErrorWeight   int64
+	HTTPErrorWeight   int64
+
+	// NoPinning sends every connection to the current proxy instead of
+	// pinning domains.
+	NoPinning bool
+
+	// PinMode is what connections are pinned by; see rotator.Config.PinMode.
+	PinMode string
+
+	// MaxPins caps the pin map, evicting the least recently used pin.
+	MaxPins int
+
+	// NoAlternativeAction is what a rotation does when the current proxy is
+	// the only alive one; see rotator.Config.
+	NoAlternativeAction string
+
+	// RotateStrategy is how a rotation picks the next proxy; see
+	// rotator.Config.Strategy.
+	RotateStrategy string
+
+	// RotateDiversify makes rotations prefer another subnet or ASN; see
+	// rotator.Config.Diversify. With DiversifySubnet the monitor resolves
+	// proxy host names.
+	RotateDiversify string
+
+	// ASNCheckURL, if set, is fetched through each proxy to find the ASN it
+	// exits from (see monitor.Config.ASNURL).
+	ASNCheckURL string
+
+	// HotStandby keeps a connection open to the next proxy up; see
+	// server.Config.
+	HotStandby bool
+
+	// PreserveCounters keeps per-proxy request and error counters across
+	// activations; see rotator.Config.
+	PreserveCounters bool
+
+	// MaxResponseLatency rotates away from a proxy whose average response
+	// latency exceeds it.
+	MaxResponseLatency time.Duration
+
+	// DestBlockProxies and DestBlockWindow stop rotations for a destination
+	// that many distinct proxies have failed; see rotator.Config.
+	DestBlockProxies int
+	DestBlockWindow  time.Duration
+
+	// ErrorSpikeRate and ErrorSpikeMode decide what HTTP errors do while
+	// most status reports fail; see rotator.Config.
+	ErrorSpikeRate float64
+	ErrorSpikeMode string
+
+	// DialTimeout bounds dialling through an upstream proxy.
+	DialTimeout time.Duration
+
+	// ConnectRetries is how many other proxies a failed CONNECT dial is
+	// retried on; see server.Config.
+	ConnectRetries int
+
+	// RequestTimeout bounds dial plus first response, answering 504 on
+	// expiry; see server.Config.
+	RequestTimeout time.Duration
+
+	// ConnectReason and ConnectHeaders customise the 200 response to CONNECT;
+	// see server.Config.
+	ConnectReason  string
+	ConnectHeaders http.Header
+
+	// ConnectInfoHeaders names the upstream proxy in the 200 response to
+	// CONNECT; see server.Config.
+	ConnectInfoHeaders bool
+
+	// SelfAddresses lists extra host:port addresses that reach the proxy;
+	// requests for them (or the listen address) are refused as loops.
+	SelfAddresses []string
+
+	// MaxHeaderBytes caps a client request's line plus headers. Defaults to
+	// 1 MiB.
+	MaxHeaderBytes int
+
+	// TunnelBufferSize is the per-direction tunnel copy buffer size.
+	// Defaults to 32 KiB.
+	TunnelBufferSize int
+
+	// RequestJitterMin and RequestJitterMax bound a random delay before each
+	// upstream dial. Zero RequestJitterMax disables it.
+	RequestJitterMin time.Duration
+	RequestJitterMax time.Duration
+
+	// ConnectToIP sends CONNECT to the resolved ip:port; see server.Config.
+	ConnectToIP bool
+
+	// LogSNI logs the TLS server name of each CONNECT tunnel; see
+	// server.Config.
+	LogSNI bool
+
+	// MaxConnsPerClient caps the requests in flight from one client IP;
+	// see server.Config. Zero means no limit.
+	MaxConnsPerClient int
+
+	// DrainMaxBytes and DrainIdleTimeout close the connections of a
+	// retiring proxy that would keep it draining; see server.Config.
+	DrainMaxBytes    int64
+	DrainIdleTimeout time.Duration
+
+	// TunnelIdleTimeout closes tunnels on which nothing has flowed for this
+	// long; see server.Config.
+	TunnelIdleTimeout time.Duration
+
+	// DestFailureTTL is how long unreachable destinations are failed fast;
+	// see server.Config.
+	DestFailureTTL time.Duration
+
+	// UpstreamInsecure skips certificate verification for TLS upstreams
+	// (socks5+tls).
+	UpstreamInsecure bool
+
+	// ParentProxy is an optional http:// proxy URL that every connection to
+	// an upstream proxy goes through; see upstream.Dialer.Parent.
+	ParentProxy string
+
+	// UpstreamDebug logs the full CONNECT exchange whenever an HTTP upstream
+	// refuses a tunnel; see upstream.Dialer.Debug.
+	UpstreamDebug bool
+
+	// UpstreamHeaders are added to CONNECT requests sent to HTTP
+	// upstreams; see upstream.Dialer.ConnectHeaders.
+	UpstreamHeaders http.Header
+
+	// AccessLog is the path of the per-request access log ("-" for stdout).
+	// Empty disables access logging.
+	AccessLog string
+
+	// AccessLogFormat is the access log line format; see package accesslog.
+	AccessLogFormat string
+
+	// RotationLog is the path of a JSONL file receiving one record per
+	// rotation. Empty disables it.
+	RotationLog string
+
+	// SummaryInterval is how often a one-line pool health summary is
+	// logged. Zero disables it.
+	SummaryInterval time.Duration
+
+	// StateFile persists per-proxy lifetime counters and latencies across
+	// restarts: it is loaded by New, saved every StateInterval and saved a
+	// final time by Stop. Empty disables it.
+	StateFile string
+
+	// StateInterval is how often StateFile is saved while running. Zero
+	// saves only on Stop.
+	StateInterval time.Duration
+}
+
+// GroupPolicy overrides the rotation thresholds for the proxies of one
+// group. Zero fields keep the global thresholds.
+type GroupPolicy struct {
+	RotateRequests   int64
+	RotateConnErrors int64
+	RotateHTTPErrors int64
+}
+
+// Service is a running (or ready to run) proxyrotator instance.
+type Service struct {
+	cfg Config
+
+	pool    *pool.Pool
+	monitor *monitor.Monitor
+	rotator *rotator.Rotator
+	api     *api.Server
+	proxy   *server.Server
+	summary *summary.Reporter
+
+	accessLog   *accesslog.Logger
+	rotationLog *rotationlog.Logger
+
+	stateWG sync.WaitGroup
+
+	srvErr   chan error
+	stopped  chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// ParseParentProxy parses a Config.ParentProxy URL, which must be
+// http://[user:pass@]host:port.
+func ParseParentProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("%q: want http://[user:pass@]host:port", raw)
+	}
+	return u, nil
+}
+
+// New loads the proxy list and builds every component. Nothing listens or
+// runs in the background until Start is called.
+func New(cfg Config) (*Service, error) {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = defaultListenAddr
+	}
+	if cfg.APIAddr == "" {
+		cfg.APIAddr = defaultAPIAddr
+	}
+	if cfg.MonitorInterval == 0 {
+		cfg.MonitorInterval = defaultMonitorInterval
+	}
+	if cfg.RequireAllAlive && (!cfg.WaitInitialCheck || !cfg.Monitor) {
+		return nil, fmt.Errorf("RequireAllAlive needs WaitInitialCheck and Monitor")
+	}
+	if cfg.MinHealthyFraction < 0 || cfg.MinHealthyFraction > 1 {
+		return nil, fmt.Errorf("MinHealthyFraction must be between 0 and 1")
+	}
+	if cfg.MinHealthyFraction > 0 && (!cfg.WaitInitialCheck || !cfg.Monitor) {
+		return nil, fmt.Errorf("MinHealthyFraction needs WaitInitialCheck and Monitor")
+	}
+	if cfg.MinHealthyTimeout == 0 {
+		cfg.MinHealthyTimeout = defaultMinHealthyTimeout
+	}
+	if cfg.GeoMismatchDead && (cfg.GeoCheckURL == "" || !cfg.Monitor) {
+		return nil, fmt.Errorf("GeoMismatchDead needs GeoCheckURL and Monitor")
+	}
+	var groupPolicies map[string]rotator.Policy
+	for group, gp := range cfg.GroupPolicies {
+		if groupPolicies == nil {
+			groupPolicies = make(map[string]rotator.Policy, len(cfg.GroupPolicies))
+		}
+		groupPolicies[group] = rotator.Policy(gp)
+	}
+	var schedule rotator.Schedule
+	if cfg.RotateSchedule != "" {
+		var err error
+		if schedule, err = rotator.ParseSchedule(cfg.RotateSchedule); err != nil {
+			return nil, fmt.Errorf("rotate schedule: %w", err)
+		}
+	}
+	var parent *url.URL
+	if cfg.ParentProxy != "" {
+		var err error
+		if parent, err = ParseParentProxy(cfg.ParentProxy); err != nil {
+			return nil, fmt.Errorf("parent proxy: %w", err)
+		}
+	}
+
+	// ---- Build pool -----------------------------------------------------
+	p := pool.New(!cfg.NoLatencySort)
+	p.SetPreferredScheme(cfg.PreferScheme)
+	p.SetAllowedSchemes(cfg.AllowedSchemes)
+	p.SetLatencyMinSamples(cfg.LatencyMinSamples)
+	p.SetLatencyErrorPenalty(cfg.LatencyErrorPenalty)
+	p.SetErrorWeights(cfg.ConnErrorWeight, cfg.HTTPErrorWeight)
+	p.SetHealthDecay(cfg.HealthDecay)
+	p.SetPreferStreak(cfg.PreferStreak)
+	if cfg.AuthFile != "" {
+		if err := p.LoadAuthFile(cfg.AuthFile); err != nil {
+			return nil, err
+		}
+	}
+	var routes map[string]string
+	if cfg.RoutesFile != "" {
+		var err error
+		if routes, err = rotator.LoadRoutes(cfg.RoutesFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Proxies) > 0 {
+		if err := p.LoadProxies(cfg.Proxies); err != nil {
+			return nil, fmt.Errorf("load proxies: %w", err)
+		}
+	} else {
+		log.Printf("[init] loading proxy list from %s", cfg.ProxyFile)
+		if err := p.LoadFile(cfg.ProxyFile); err != nil {
+			return nil, fmt.Errorf("load proxy file: %w", err)
+		}
+	}
+	log.Printf("[init] loaded %d proxies", p.Len())
+	warnSchemeCollisions(p)
+	if cfg.StateFile != "" {
+		n, err := p.LoadState(cfg.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[init] restored state of %d proxies from %s", n, cfg.StateFile)
+	}
+
+	dialer := &upstream.Dialer{
+		InsecureSkipVerify: cfg.UpstreamInsecure,
+		Parent:             parent,
+		Debug:              cfg.UpstreamDebug,
+		ConnectHeaders:     cfg.UpstreamHeaders,
+	}
+
+	// ---- Health monitor -------------------------------------------------
+	mon := monitor.New(p, monitor.Config{
+		Interval:           cfg.MonitorInterval,
+		LatencyInterval:    cfg.LatencyInterval,
+		CheckURL:           cfg.MonitorURL,
+		HealthyStatuses:    cfg.MonitorHealthyCodes,
+		Timeout:            10 * time.Second,
+		Concurrency:        cfg.MonitorConcurrency,
+		InitialConcurrency: cfg.InitialConcurrency,
+		MaxRPS:             cfg.MonitorMaxRPS,
+		ProbeAttempts:      cfg.MonitorRetries,
+		PassTimeout:        cfg.MonitorPassTimeout,
+		UpdateLiveness:     cfg.Monitor,
+		Dialer:             dialer,
+		GeoURL:             cfg.GeoCheckURL,
+		ASNURL:             cfg.ASNCheckURL,
+		ResolveHosts:       cfg.RotateDiversify == rotator.DiversifySubnet,
+		GeoMismatchDead:    cfg.GeoMismatchDead,
+	})
+
+	// Logs opened below are closed again if New fails after opening them;
+	// on success the Service owns them and Stop closes them.
+	var opened []io.Closer
+	defer func() {
+		for _, c := range opened {
+			c.Close()
+		}
+	}()
+
+	// ---- Rotation log ---------------------------------------------------
+	var rotationLog *rotationlog.Logger
+	var onRotate func(rotator.Rotation)
+	if cfg.RotationLog != "" {
+		var err error
+		rotationLog, err = rotationlog.Open(cfg.RotationLog)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, rotationLog)
+		onRotate = func(ev rotator.Rotation) {
+			rec := rotationlog.Record{
+				Time:           ev.Time,
+				Generation:     ev.Generation,
+				Reason:         ev.Reason,
+				ToID:           ev.To.ID,
+				OldActiveConns: ev.OldActiveConns,
+			}
+			if ev.From != nil {
+				rec.FromID = ev.From.ID
+			}
+			rotationLog.Log(rec)
+		}
+	}
+
+	// ---- Rotator --------------------------------------------------------
+	rot, err := rotator.New(p, rotator.Config{
+		RotateInterval:       cfg.RotateInterval,
+		MinRotateInterval:    cfg.RotateCooldown,
+		QuarantineDuration:   cfg.Quarantine,
+		RotateSchedule:       schedule,
+		RotateRequests:       cfg.RotateRequests,
+		RotateSuccesses:      cfg.RotateSuccesses,
+		AdaptiveRequests:     cfg.AdaptiveRequests,
+		RotateConnErrors:     cfg.RotateConnErrors,
+		RotateHTTPErrors:     cfg.RotateHTTPErrors,
+		HTTPErrorDedupWindow: cfg.DedupWindow,
+		GroupPolicies:        groupPolicies,
+		DestWeights:          cfg.DestWeights,
+		DestGrace:            cfg.DestGrace,
+		RotateTotalErrors:    cfg.RotateTotalErrors,
+		ConnErrorWeight:      cfg.ConnErrorWeight,
+		HTTPErrorWeight:      cfg.HTTPErrorWeight,
+		MaxResponseLatency:   cfg.MaxResponseLatency,
+		DestBlockProxies:     cfg.DestBlockProxies,
+		DestBlockWindow:      cfg.DestBlockWindow,
+		ErrorSpikeRate:       cfg.ErrorSpikeRate,
+		ErrorSpikeMode:       cfg.ErrorSpikeMode,
+		NoPinning:            cfg.NoPinning,
+		PinMode:              cfg.PinMode,
+		MaxPins:              cfg.MaxPins,
+		NoAlternativeAction:  cfg.NoAlternativeAction,
+		Strategy:             cfg.RotateStrategy,
+		Diversify:            cfg.RotateDiversify,
+		PreserveCounters:     cfg.PreserveCounters,
+		Routes:               routes,
+		RouteUnavailable:     cfg.RouteUnavailable,
+		RouteQueueTimeout:    cfg.RouteQueueTimeout,
+		OnRotate:             onRotate,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("init rotator: %w", err)
+	}
+
+	// ---- Access log -----------------------------------------------------
+	var accessLog *accesslog.Logger
+	if cfg.AccessLog != "" {
+		accessLog, err = accesslog.Open(cfg.AccessLog, cfg.AccessLogFormat)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, accessLog)
+	}
+
+	// ---- Proxy and API servers ------------------------------------------
+	proxySrv := server.New(server.Config{
+		ListenAddr:         cfg.ListenAddr,
+		Username:           cfg.Username,
+		Password:           cfg.Password,
+		DialTimeout:        cfg.DialTimeout,
+		ConnectRetries:     cfg.ConnectRetries,
+		RequestTimeout:     cfg.RequestTimeout,
+		TunnelBufferSize:   cfg.TunnelBufferSize,
+		JitterMin:          cfg.RequestJitterMin,
+		JitterMax:          cfg.RequestJitterMax,
+		MaxHeaderBytes:     cfg.MaxHeaderBytes,
+		ConnectReason:      cfg.ConnectReason,
+		ConnectHeaders:     cfg.ConnectHeaders,
+		ConnectInfoHeaders: cfg.ConnectInfoHeaders,
+		ConnectToIP:        cfg.ConnectToIP,
+		LogSNI:             cfg.LogSNI,
+		SelfAddresses:      cfg.SelfAddresses,
+		CountTraffic:       cfg.CountTraffic,
+		MaxConnsPerClient:  cfg.MaxConnsPerClient,
+		DrainMaxBytes:      cfg.DrainMaxBytes,
+		DrainIdleTimeout:   cfg.DrainIdleTimeout,
+		TunnelIdleTimeout:  cfg.TunnelIdleTimeout,
+		DestFailureTTL:     cfg.DestFailureTTL,
+		HotStandby:         cfg.HotStandby,
+		AccessLog:          accessLog,
+		Dialer:             dialer,
+	}, rot)
+	apiSrv := api.New(cfg.APIAddr, p, rot, mon, proxySrv)
+	if cfg.UnifiedPort {
+		proxySrv.ServeAPI(apiSrv.Handler())
+	}
+
+	svc := &Service{
+		cfg:         cfg,
+		pool:        p,
+		monitor:     mon,
+		rotator:     rot,
+		api:         apiSrv,
+		proxy:       proxySrv,
+		summary:     summary.New(p, rot, cfg.SummaryInterval),
+		accessLog:   accessLog,
+		rotationLog: rotationLog,
+		srvErr:      make(chan error, 1),
+		stopped:     make(chan struct{}),
+	}
+	apiSrv.SetReload(svc.reload)
+	opened = nil
+	return svc, nil
+}
+
+// Start binds the proxy listener and launches all background components.
+// It returns once the service is accepting connections. The service stops
+// itself when ctx is cancelled; Stop may also be called directly.
+func (s *Service) Start(ctx context.Context) error {
+	if s.cfg.WaitInitialCheck {
+		if err := s.initialCheck(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.proxy.Listen(); err != nil {
+		return err
+	}
+
+	// Unless asked to wait, run the initial health check in the background so
+	// startup is instant. The rotator begins with all proxies assumed alive;
+	// the monitor will update liveness and latency asynchronously within the
+	// first check pass.
+	if !s.cfg.WaitInitialCheck {
+		go func() {
+			log.Printf("[init] running initial health check (background)…")
+			s.monitor.RunOnce()
+		}()
+	}
+
+	s.rotator.Start()
+
+	if s.cfg.UnifiedPort {
+		if s.cfg.Username == "" || s.cfg.Password == "" {
+			log.Printf("[init] API served on the proxy port (http://%s/api/), loopback clients only without proxy auth", s.cfg.ListenAddr)
+		} else {
+			log.Printf("[init] API served on the proxy port (http://%s/api/)", s.cfg.ListenAddr)
+		}
+	} else {
+		go func() {
+			log.Printf("[init] API server listening on http://%s", s.cfg.APIAddr)
+			if err := s.api.Start(); err != nil {
+				log.Printf("[api] server stopped: %v", err)
+			}
+		}()
+	}
+
+	s.monitor.Start()
+	s.summary.Start()
+	if s.cfg.StateFile != "" && s.cfg.StateInterval > 0 {
+		s.stateWG.Add(1)
+		go s.saveStateLoop()
+	}
+
+	go func() { s.srvErr <- s.proxy.Serve() }()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Stop()
+		case <-s.stopped:
+		}
+	}()
+	return nil
+}
+
+// initialCheck runs the first health-check pass synchronously, enforces
+// RequireAllAlive and MinHealthyFraction and moves the rotator off a proxy
+// found dead.
+func (s *Service) initialCheck() error {
+	log.Printf("[init] running initial health check…")
+	s.monitor.RunOnce()
+
+	var dead []string
+	for _, px := range s.pool.All() {
+		if !px.IsAlive() {
+			dead = append(dead, px.String())
+		}
+	}
+	log.Printf("[init] initial health check: %d/%d alive", s.pool.Len()-len(dead), s.pool.Len())
+	if s.cfg.RequireAllAlive && len(dead) > 0 {
+		return fmt.Errorf("%d of %d proxies dead after initial check: %s",
+			len(dead), s.pool.Len(), strings.Join(dead, ", "))
+	}
+	if s.cfg.MinHealthyFraction > 0 {
+		if err := s.waitHealthy(); err != nil {
+			return err
+		}
+	}
+
+	if cur := s.rotator.Current(); cur != nil && !cur.IsAlive() {
+		if err := s.rotator.RotateNow("initial-check"); err != nil {
+			return fmt.Errorf("initial health check: %w", err)
+		}
+	}
+	return nil
+}
+
+// waitHealthy re-runs health-check passes until MinHealthyFraction of the
+// pool is alive. It fails once MinHealthyTimeout has passed without that.
+func (s *Service) waitHealthy() error {
+	want := s.cfg.MinHealthyFraction
+	deadline := time.Now().Add(s.cfg.MinHealthyTimeout)
+	for waited := false; ; waited = true {
+		alive, total := s.pool.AliveLen(), s.pool.Len()
+		frac := 0.0
+		if total > 0 {
+			frac = float64(alive) / float64(total)
+		}
+		if frac >= want {
+			if waited {
+				log.Printf("[init] %d/%d proxies alive (%.0f%%), at least %.0f%% required", alive, total, frac*100, want*100)
+			}
+			return nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("only %d of %d proxies alive (%.0f%%) after %s, at least %.0f%% required",
+				alive, total, frac*100, s.cfg.MinHealthyTimeout, want*100)
+		}
+		log.Printf("[init] waiting for %.0f%% of proxies to be alive: %d/%d (%.0f%%), re-checking (%s left)",
+			want*100, alive, total, frac*100, left.Round(time.Second))
+		time.Sleep(min(healthyRecheck, left))
+		s.monitor.RunOnce()
+	}
+}
+
+// ReloadResult summarises the changes a Reload applied to the proxy list.
+type ReloadResult struct {
+	Added     int
+	Removed   int
+	Updated   int
+	Unchanged int
+}
+
+// Reload re-reads the proxy file and auth file, applies the changes to the
+// pool and moves the rotator off any proxy that was removed. Open tunnels are
+// not interrupted. It fails if the service was configured with Proxies
+// rather than ProxyFile. POST /api/reload runs it too.
+func (s *Service) Reload() (ReloadResult, error) {
+	res, err := s.reload()
+	return ReloadResult(res), err
+}
+
+func (s *Service) reload() (pool.ReloadResult, error) {
+	res, err := s.pool.Reload()
+	if err != nil {
+		return res, fmt.Errorf("reload proxy list: %w", err)
+	}
+	log.Printf("[init] proxy list reloaded: added=%d removed=%d updated=%d unchanged=%d",
+		res.Added, res.Removed, res.Updated, res.Unchanged)
+	warnSchemeCollisions(s.pool)
+	if err := s.rotator.Reconcile(); err != nil {
+		return res, fmt.Errorf("reload proxy list: %w", err)
+	}
+	return res, nil
+}
+
+// saveStateLoop saves the state file every StateInterval until Stop.
+func (s *Service) saveStateLoop() {
+	defer s.stateWG.Done()
+	ticker := time.NewTicker(s.cfg.StateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveState()
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+func (s *Service) saveState() {
+	if err := s.pool.SaveState(s.cfg.StateFile); err != nil {
+		log.Printf("[init] save state: %v", err)
+	}
+}
+
+// warnSchemeCollisions logs every host:port listed under more than one
+// scheme: the entries share an egress IP, so rotating between them gains
+// nothing.
+func warnSchemeCollisions(p *pool.Pool) {
+	for _, group := range p.SchemeCollisions() {
+		entries := make([]string, len(group))
+		for i, px := range group {
+			entries[i] = px.String()
+		}
+		log.Printf("[init] warning: %s is listed under several schemes and likely shares one egress IP: %s (see --prefer-scheme)",
+			group[0].Host, strings.Join(entries, ", "))
+	}
+}
+
+// Done returns a channel that receives the proxy server's exit error once
+// it stops serving: the failure, or nil if Stop was called.
+func (s *Service) Done() <-chan error {
+	return s.srvErr
+}
+
+// Stop closes the proxy listener and shuts down the monitor, API server and
+// rotator, then writes the final state file (if configured) so a restart
+// resumes from the freshest counters. In-flight tunnels are not interrupted;
+// the access log stays open for their entries until the last has closed.
+// Safe to call more than once.
+func (s *Service) Stop() error {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+		s.stopErr = s.proxy.Stop()
+		s.monitor.Stop()
+		s.summary.Stop()
+		s.api.Stop()
+		s.rotator.Stop()
+		s.stateWG.Wait()
+		if s.cfg.StateFile != "" {
+			s.saveState()
+		}
+		if s.accessLog != nil {
+			go func() {
+				s.proxy.Wait()
+				s.accessLog.Close()
+			}()
+		}
+		if s.rotationLog != nil {
+			s.rotationLog.Close()
+		}
+	})
+	return s.stopErr
+}
+
+// Pool returns the upstream proxy pool.
+func (s *Service) Pool() *pool.Pool {
+	return s.pool
+}
+
+// Rotator returns the rotator selecting the active upstream.
+func (s *Service) Rotator() *rotator.Rotator {
+	return s.rotator
+}
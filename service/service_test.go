@@ -0,0 +1,171 @@
+package service
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubProxy starts an HTTP proxy that accepts any CONNECT and answers the
+// health check sent through the tunnel with 204 while healthy returns true,
+// else 503. It returns the proxy's URI.
+func stubProxy(t *testing.T, healthy func() bool) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				if healthy() {
+					io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+				} else {
+					io.WriteString(conn, "HTTP/1.1 503 Service Unavailable\r\n\r\n")
+				}
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func up() bool   { return true }
+func down() bool { return false }
+
+// newTestService builds a Service over the given proxies that waits for
+// the initial health check. Nothing is started.
+func newTestService(t *testing.T, cfg Config, uris ...string) *Service {
+	t.Helper()
+	cfg.ProxyFile = filepath.Join(t.TempDir(), "proxies.txt")
+	if err := os.WriteFile(cfg.ProxyFile, []byte(strings.Join(uris, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Monitor = true
+	cfg.WaitInitialCheck = true
+	cfg.NoLatencySort = true
+	cfg.MonitorURL = "http://check.example/generate_204"
+	cfg.ListenAddr = "127.0.0.1:0"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestInitialCheck_RequireAllAlive(t *testing.T) {
+	dead := stubProxy(t, down)
+	s := newTestService(t, Config{RequireAllAlive: true}, dead, stubProxy(t, up))
+	before, gen := s.rotator.Current(), s.rotator.Generation()
+
+	err := s.initialCheck()
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 proxies dead") || !strings.Contains(err.Error(), strings.TrimPrefix(dead, "http://")) {
+		t.Fatalf("initialCheck = %v, want an error naming the dead proxy", err)
+	}
+	// The check fails before the rotator is moved off the dead proxy.
+	if s.rotator.Current() != before || s.rotator.Generation() != gen {
+		t.Error("the rotator rotated although the initial check failed")
+	}
+}
+
+func TestInitialCheck_RotatesOffDeadCurrent(t *testing.T) {
+	s := newTestService(t, Config{}, stubProxy(t, down), stubProxy(t, up))
+	all := s.pool.All()
+	if s.rotator.Current() != all[0] {
+		t.Fatal("test needs the first proxy to start as current")
+	}
+
+	if err := s.initialCheck(); err != nil {
+		t.Fatalf("initialCheck: %v", err)
+	}
+	if all[0].IsAlive() {
+		t.Error("the failing proxy is still alive after the check")
+	}
+	if s.rotator.Current() != all[1] {
+		t.Errorf("current = %s, want the healthy proxy %s", s.rotator.Current(), all[1])
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	defer func(d time.Duration) { healthyRecheck = d }(healthyRecheck)
+	healthyRecheck = 10 * time.Millisecond
+
+	t.Run("recovers on a re-check", func(t *testing.T) {
+		var checks atomic.Int32
+		late := stubProxy(t, func() bool { return checks.Add(1) > 1 }) // fails the first pass only
+		s := newTestService(t, Config{MinHealthyFraction: 1, MinHealthyTimeout: 5 * time.Second}, stubProxy(t, up), late)
+
+		if err := s.initialCheck(); err != nil {
+			t.Fatalf("initialCheck: %v", err)
+		}
+		if n := checks.Load(); n < 2 {
+			t.Errorf("the late proxy was checked %d times, want a re-check", n)
+		}
+		if alive := s.pool.AliveLen(); alive != 2 {
+			t.Errorf("%d proxies alive, want 2", alive)
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		s := newTestService(t, Config{MinHealthyFraction: 1, MinHealthyTimeout: 100 * time.Millisecond}, stubProxy(t, up), stubProxy(t, down))
+
+		start := time.Now()
+		err := s.initialCheck()
+		if err == nil || !strings.Contains(err.Error(), "only 1 of 2 proxies alive") {
+			t.Fatalf("initialCheck = %v, want a timeout error", err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("gave up after %s, want about the 100ms timeout", d)
+		}
+	})
+}
+
+func TestNew_FailureClosesLogs(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("needs /proc/self/fd to list open files")
+	}
+	dir := t.TempDir()
+	proxies := filepath.Join(dir, "proxies.txt")
+	if err := os.WriteFile(proxies, []byte("http://1.2.3.4:8080\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rotations := filepath.Join(dir, "rotations.log")
+	_, err := New(Config{
+		ProxyFile:   proxies,
+		RotationLog: rotations,
+		AccessLog:   filepath.Join(dir, "missing", "access.log"),
+	})
+	if err == nil {
+		t.Fatal("New should fail when the access log cannot be opened")
+	}
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range fds {
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); target == rotations {
+			t.Fatalf("the rotation log is still open after New failed")
+		}
+	}
+}